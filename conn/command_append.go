@@ -1,67 +1,107 @@
 package conn
 
 import (
-	"strconv"
+	"bufio"
+	"fmt"
 
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
 )
 
-const (
-	appendArgMailbox int = 0
-	appendArgFlags   int = 1
-	appendArgDate    int = 2
-	appendArgLength  int = 3
-)
+const appendArgMailbox int = 0
 
 // Add a new message to a mailbox
-func cmdAppend(args commandArgs, c *Conn) {
-	if !c.assertAuthenticated(args.ID()) {
+func cmdAppend(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
 		return
 	}
 
-	mailboxName := args.Arg(appendArgMailbox)
-	mailbox, err := c.User.MailboxByName(mailboxName)
-	if err != nil {
-		c.writeResponse(args.ID(), "NO could not get mailbox")
+	if err := args.ExpectCount(2, 4); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
 
-	length, err := strconv.ParseUint(args.Arg(appendArgLength), 10, 64)
-	if err != nil || length == 0 {
-		c.writeResponse(args.ID(), "BAD invalid length for message literal")
+	mailboxName, err := args.Mailbox(appendArgMailbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
 
-	flagString := args.Arg(appendArgFlags)
-	flags := types.Flags(0)
-	if flagString != "" {
-		flags = types.FlagsFromString(flagString)
+	// The flag list and date are optional, so work out which arguments were
+	// given. The message literal is always last.
+	var flags types.FlagSet
+	argIndex := appendArgMailbox + 1
+	if args.Args[argIndex].Kind == parser.KindList {
+		flagList, err := args.Atoms(argIndex)
+		if err == nil {
+			flags, err = types.ParseFlagSet(flagList)
+		}
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		argIndex++
+	}
+	if argIndex < len(args.Args)-1 {
+		// Date/time argument is accepted but not yet used
+		if _, err = args.String(argIndex); err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		argIndex++
+	}
+	if argIndex != len(args.Args)-1 {
+		c.writeResponse(args.Tag, "BAD Unexpected arguments")
+		return
 	}
 
-	// Tell client to send the mail message
-	c.writeResponse("+", "go ahead, feed me your message")
-
-	// Read in the whole message
-	messageData, err := c.ReadFixedLength(int(length))
+	// The message is streamed from the client into the mailbox, so
+	// everything else is checked before the client is told to send it
+	messageData, err := args.Literal(argIndex)
 	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	if messageData.Size == 0 {
+		c.writeResponse(args.Tag, "BAD invalid length for message literal")
+		return
+	}
+	if c.AppendLimit != 0 && messageData.Size > int64(c.AppendLimit) {
+		c.writeResponse(args.Tag, "NO [TOOBIG] Message is too large")
 		return
 	}
 
-	msg := mailbox.NewMessage()
-	rawMsg, err := types.MessageFromBytes(messageData)
+	mailbox, err := mailstore.MailboxByNameContext(c.Context(), c.User, mailboxName)
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "NO [TRYCREATE] could not get mailbox")
 		return
 	}
-	msg = msg.SetHeaders(rawMsg.Headers)
-	msg = msg.SetBody(rawMsg.Body)
-	msg = msg.OverwriteFlags(flags)
 
-	msg, err = msg.Save()
+	var saved mailstore.Message
+	c.stopWatching()
+	message := bufio.NewReader(messageData)
+	header, _, err := util.ReadHeader(message)
+	if err == nil {
+		msg := mailbox.NewMessage()
+		msg = msg.SetHeaders(util.ParseHeader(header))
+		msg = msg.SetBody(message)
+		msg = msg.OverwriteFlags(flags.Flags)
+		msg = msg.AddKeywords(flags.Keywords...)
+		saved, err = mailstore.SaveContext(c.Context(), msg)
+	}
+
+	// The rest of the command must be read before it's answered
+	if closeErr := messageData.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "NO "+err.Error())
 		return
 	}
 
-	c.writeResponse(args.ID(), "OK APPEND completed")
+	// Tell the client the UID of the new message (RFC 4315)
+	c.writeResponse(args.Tag, fmt.Sprintf("OK [APPENDUID %d %d] APPEND completed",
+		mailbox.UIDValidity(), saved.UID()))
 }
@@ -2,6 +2,7 @@ package conn_test
 
 import (
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -23,7 +24,9 @@ var _ = Describe("APPEND Command", func() {
 			SendLine("Hello! This is the body.")
 			SendLine("From me")
 			SendLine("")
-			ExpectResponse("abcd.123 OK APPEND completed")
+			// End of the APPEND command line following the literal
+			SendLine("")
+			ExpectResponse("abcd.123 OK [APPENDUID 250 13] APPEND completed")
 
 			// Ensure that the email was indeed appended
 			mbox := tConn.User.Mailboxes()[0]
@@ -45,5 +48,29 @@ var _ = Describe("APPEND Command", func() {
 			msg = mbox.MessageBySequenceNumber(4)
 			Expect(msg.Header().Get("Subject")).To(Equal("This is a newly appended email"))
 		})
+
+		It("should append a message with keywords", func() {
+			SendLine("abcd.123 append \"INBOX\" (\\Seen $Forwarded) {22}")
+			ExpectResponse("+ go ahead, feed me your message")
+			SendLine("Subject: Forwarded")
+			SendLine("")
+			SendLine("")
+			ExpectResponse("abcd.123 OK [APPENDUID 250 13] APPEND completed")
+
+			msg := tConn.User.Mailboxes()[0].MessageByUID(13)
+			Expect(msg.Flags()).To(Equal(types.FlagSeen))
+			Expect(msg.Keywords()).To(Equal([]string{"$Forwarded"}))
+		})
+
+		It("should reject an invalid keyword before reading the message", func() {
+			SendLine("abcd.123 append \"INBOX\" (\\Seen $Bad]) {20}")
+			ExpectResponsePattern(`^abcd\.123 BAD `)
+		})
+
+		It("should refuse a message over the append limit before reading it", func() {
+			tConn.AppendLimit = 100
+			SendLine("abcd.123 APPEND \"INBOX\" {101}")
+			ExpectResponse("abcd.123 NO [TOOBIG] Message is too large")
+		})
 	})
 })
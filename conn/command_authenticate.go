@@ -3,10 +3,28 @@ package conn
 import (
 	"encoding/base64"
 	"regexp"
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 )
 
 // Handles PLAIN text AUTHENTICATE command
-func cmdAuthPlain(args commandArgs, c *Conn) {
+func cmdAuthPlain(args *parser.Command, c *Conn) {
+	mechanism, err := args.Atom(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	if !strings.EqualFold(mechanism, "PLAIN") {
+		c.writeResponse(args.Tag, "NO Unsupported authentication mechanism")
+		return
+	}
+	if c.loginDisabled() {
+		c.writeResponse(args.Tag, "NO Plain text authentication is disabled until TLS is active, use STARTTLS")
+		return
+	}
+
 	// Compile login regex
 	loginRE := regexp.MustCompile("(?:[A-z0-9]+)?\x00([A-z0-9]+)\x00([A-z0-9]+)")
 
@@ -14,11 +32,10 @@ func cmdAuthPlain(args commandArgs, c *Conn) {
 	c.writeResponse("+", "")
 
 	// Wait for client to send auth details
-	ok := c.RwcScanner.Scan()
+	authDetails, ok := c.ReadLine()
 	if !ok {
 		return
 	}
-	authDetails := c.RwcScanner.Text()
 
 	data, err := base64.StdEncoding.DecodeString(authDetails)
 	if err != nil {
@@ -27,14 +44,14 @@ func cmdAuthPlain(args commandArgs, c *Conn) {
 	}
 	match := loginRE.FindSubmatch(data)
 	if len(match) != 3 {
-		c.writeResponse(args.ID(), "NO Incorrect username/password")
+		c.writeResponse(args.Tag, "NO Incorrect username/password")
 		return
 	}
-	c.User, err = c.Mailstore.Authenticate(string(match[1]), string(match[2]))
+	c.User, err = mailstore.AuthenticateContext(c.Context(), c.Mailstore, string(match[1]), string(match[2]))
 	if err != nil {
-		c.writeResponse(args.ID(), "NO Incorrect username/password")
+		c.writeResponse(args.Tag, "NO Incorrect username/password")
 		return
 	}
 	c.SetState(StateAuthenticated)
-	c.writeResponse(args.ID(), "OK Authenticated")
+	c.writeResponse(args.Tag, "OK Authenticated")
 }
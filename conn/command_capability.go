@@ -1,7 +1,59 @@
 package conn
 
+import (
+	"fmt"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
 // Handles a CAPABILITY command
-func cmdCapability(args commandArgs, c *Conn) {
-	c.writeResponse("", "CAPABILITY IMAP4rev1 AUTH=PLAIN")
-	c.writeResponse(args.ID(), "OK CAPABILITY completed")
+func cmdCapability(args *parser.Command, c *Conn) {
+	c.writeResponse("", "CAPABILITY "+c.capabilities())
+	c.writeResponse(args.Tag, "OK CAPABILITY completed")
+}
+
+// capabilities returns the list of capabilities to advertise, which depends
+// on whether the connection is encrypted, on the commands registered and on
+// which extensions the mailstore supports.
+func (c *Conn) capabilities() string {
+	r := c.registry()
+	capabilities := "IMAP4rev1"
+	if c.TLSConfig != nil && !c.IsTLS() && r.hasCommand("STARTTLS") {
+		capabilities += " STARTTLS"
+	}
+	if c.loginDisabled() {
+		capabilities += " LOGINDISABLED"
+	} else if r.hasCommand("AUTHENTICATE") {
+		capabilities += " AUTH=PLAIN"
+	}
+	if r.hasCommand("IDLE") {
+		capabilities += " IDLE"
+	}
+	if r.hasCommand("UID EXPUNGE") && mailstore.SupportsUIDExpunge(c.Mailstore) {
+		capabilities += " UIDPLUS"
+	}
+	if r.hasCommand("MOVE") {
+		capabilities += " MOVE"
+	}
+	modSeq := mailstore.SupportsModSeq(c.Mailstore)
+	if modSeq {
+		capabilities += " CONDSTORE"
+	}
+	if r.hasCommand("ENABLE") {
+		capabilities += " ENABLE"
+		if modSeq {
+			capabilities += " QRESYNC"
+		}
+	}
+	if r.hasCommand("STATUS") {
+		capabilities += " STATUS=SIZE"
+	}
+	if c.AppendLimit != 0 {
+		capabilities += fmt.Sprintf(" APPENDLIMIT=%d", c.AppendLimit)
+	}
+	for _, capability := range r.capabilities {
+		capabilities += " " + capability
+	}
+	return capabilities
 }
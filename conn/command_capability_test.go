@@ -2,6 +2,7 @@ package conn_test
 
 import (
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
 	. "github.com/onsi/ginkgo"
 )
 
@@ -13,7 +14,27 @@ var _ = Describe("CAPABILITY Command", func() {
 
 		It("should return server capabilities", func() {
 			SendLine("abcd.123 CAPABILITY")
-			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN")
+			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE")
+			ExpectResponse("abcd.123 OK CAPABILITY completed")
+		})
+
+		It("should advertise the append limit if there is one", func() {
+			tConn.AppendLimit = 1000
+			SendLine("abcd.123 CAPABILITY")
+			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE APPENDLIMIT=1000")
+			ExpectResponse("abcd.123 OK CAPABILITY completed")
+		})
+	})
+
+	Context("When the mailstore doesn't say which extensions it supports", func() {
+		BeforeEach(func() {
+			tConn.Mailstore = struct{ mailstore.Mailstore }{mStore}
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should not advertise UIDPLUS, CONDSTORE or QRESYNC", func() {
+			SendLine("abcd.123 CAPABILITY")
+			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE MOVE ENABLE STATUS=SIZE")
 			ExpectResponse("abcd.123 OK CAPABILITY completed")
 		})
 	})
@@ -1,7 +1,9 @@
 package conn
 
-func cmdClose(args commandArgs, c *Conn) {
+import "github.com/jordwest/imap-server/parser"
+
+func cmdClose(args *parser.Command, c *Conn) {
 	c.SetState(StateAuthenticated)
-	c.SelectedMailbox = nil
-	c.writeResponse(args.ID(), "OK CLOSE Completed")
+	c.deselectMailbox()
+	c.writeResponse(args.Tag, "OK CLOSE Completed")
 }
@@ -1,75 +1,88 @@
 package conn
 
 import (
-	"strings"
+	"fmt"
 
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 	"github.com/jordwest/imap-server/types"
 )
 
 const (
-	copyArgUID     int = 0
-	copyArgRange   int = 1
-	copyArgMailbox int = 2
+	copyArgRange   int = 0
+	copyArgMailbox int = 1
 )
 
-func cmdCopy(args commandArgs, c *Conn) {
-	if !c.assertSelected(args.ID(), readWrite) {
+func cmdCopy(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readWrite) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	seqSet, err := args.SequenceSet(copyArgRange)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	targetMailbox, err := args.Mailbox(copyArgMailbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
 
 	// Check if the target mailbox exists.
-	targetMailbox := args.Arg(copyArgMailbox)
-	mbox, err := c.User.MailboxByName(targetMailbox)
+	mbox, err := mailstore.MailboxByNameContext(c.Context(), c.User, targetMailbox)
 	if err != nil {
-		c.writeResponse(args.ID(), "NO [TRYCREATE] "+err.Error())
+		c.writeResponse(args.Tag, "NO [TRYCREATE] "+err.Error())
 		return
 	}
 
 	// Check if connection is writable.
 	if c.mailboxWritable != readWrite {
-		c.writeResponse(args.ID(), "NO read-only connection")
+		c.writeResponse(args.Tag, "NO read-only connection")
 		return
 	}
 
 	// Fetch the messages.
-	seqSet, err := types.InterpretSequenceSet(args.Arg(copyArgRange))
+	searchByUID := args.UID
+
+	msgs, err := c.messageSet(seqSet, searchByUID)
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "NO "+err.Error())
 		return
 	}
 
-	searchByUID := strings.ToUpper(args.Arg(copyArgUID)) == "UID "
-
-	var msgs []mailstore.Message
-	if searchByUID {
-		msgs = c.SelectedMailbox.MessageSetByUID(seqSet)
-	} else {
-		msgs = c.SelectedMailbox.MessageSetBySequenceNumber(seqSet)
-	}
-
 	if len(msgs) == 0 {
-		c.writeResponse(args.ID(), "NO no messages found")
+		// A UID set matching nothing isn't an error (RFC 3501 6.4.8)
+		if searchByUID {
+			c.writeResponse(args.Tag, "OK UID COPY Completed")
+		} else {
+			c.writeResponse(args.Tag, "NO no messages found")
+		}
 		return
 	}
 
+	var srcUIDs, dstUIDs []uint32
 	for _, msg := range msgs {
-		_, err := mbox.NewMessage().
-			SetBody(msg.Body()).
-			SetHeaders(msg.Header()).
-			AddFlags(msg.Flags() & types.FlagRecent).
-			Save()
-
+		copied, err := mailstore.CopyMessageContext(c.Context(), msg, mbox)
 		if err != nil {
 			// TODO Reverse all previous operations if it failed.
-			c.writeResponse(args.ID(), "NO "+err.Error())
+			c.writeResponse(args.Tag, "NO "+err.Error())
 			return
 		}
+		srcUIDs = append(srcUIDs, msg.UID())
+		dstUIDs = append(dstUIDs, copied.UID())
 	}
 
+	// Tell the client the UIDs of the copies (RFC 4315)
+	copyUID := fmt.Sprintf("[COPYUID %d %s %s]", mbox.UIDValidity(),
+		types.NewSequenceSet(srcUIDs), types.NewSequenceSet(dstUIDs))
 	if searchByUID {
-		c.writeResponse(args.ID(), "OK UID COPY Completed")
+		c.writeResponse(args.Tag, "OK "+copyUID+" UID COPY Completed")
 	} else {
-		c.writeResponse(args.ID(), "OK COPY Completed")
+		c.writeResponse(args.Tag, "OK "+copyUID+" COPY Completed")
 	}
 }
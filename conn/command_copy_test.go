@@ -3,6 +3,7 @@ package conn_test
 import (
 	"github.com/jordwest/imap-server/conn"
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -17,14 +18,14 @@ var _ = Describe("COPY Command", func() {
 		})
 
 		checkMsgEqual := func(actualMsg, expectMsg mailstore.Message) {
-			Expect(expectMsg.Body()).To(Equal(actualMsg.Body()))
+			Expect(MessageContent(expectMsg)).To(Equal(MessageContent(actualMsg)))
 			Expect(expectMsg.Header()).To(Equal(actualMsg.Header()))
 			Expect(expectMsg.Flags()).To(Equal(actualMsg.Flags()))
 		}
 
 		It("should copy a message by sequence number", func() {
 			SendLine(`abcd.123 COPY 1:2 "Trash"`)
-			ExpectResponse("abcd.123 OK COPY Completed")
+			ExpectResponse("abcd.123 OK [COPYUID 251 10:11 10:11] COPY Completed")
 
 			// Verify that everything matches.
 			trash, _ := tConn.User.MailboxByName("Trash")
@@ -36,7 +37,7 @@ var _ = Describe("COPY Command", func() {
 
 		It("should copy a message by UID", func() {
 			SendLine(`abcd.123 uid COPY 11:12 "Trash"`)
-			ExpectResponse("abcd.123 OK UID COPY Completed")
+			ExpectResponse("abcd.123 OK [COPYUID 251 11:12 10:11] UID COPY Completed")
 
 			// Verify that everything matches.
 			trash, _ := tConn.User.MailboxByName("Trash")
@@ -46,14 +47,38 @@ var _ = Describe("COPY Command", func() {
 				tConn.SelectedMailbox.MessageByUID(12))
 		})
 
+		It("should keep the flags and keywords of copied messages", func() {
+			_, err := tConn.SelectedMailbox.MessageByUID(10).
+				AddFlags(types.FlagSeen | types.FlagFlagged).AddKeywords("$Label1").Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine(`abcd.123 COPY 1 "Trash"`)
+			ExpectResponse("abcd.123 OK [COPYUID 251 10 10] COPY Completed")
+
+			trash, _ := tConn.User.MailboxByName("Trash")
+			copied := trash.MessageByUID(10)
+			Expect(copied.Flags().HasFlags(types.FlagSeen | types.FlagFlagged)).To(BeTrue())
+			Expect(copied.Keywords()).To(Equal([]string{"$Label1"}))
+		})
+
+		It("should copy nothing for UIDs matching no messages", func() {
+			SendLine("abcd.125 uid COPY 50:60 Trash")
+			ExpectResponse("abcd.125 OK UID COPY Completed")
+		})
+
+		It("should still want the target mailbox for UIDs matching no messages", func() {
+			SendLine("abcd.125 uid COPY 50:60 Nowhere")
+			ExpectResponsePattern(`^abcd\.125 NO \[TRYCREATE\]`)
+		})
+
 		It("shouldn't copy nonexistant message by sequence number", func() {
-			SendLine("abcd.125 uid COPY 50:* Trash")
+			SendLine("abcd.125 COPY 5 Trash")
 			ExpectResponse("abcd.125 NO no messages found")
 		})
 
-		It("shouldn't copy nonexistant message by UID", func() {
+		It("should copy the last message for a range starting past the end", func() {
 			SendLine("abcd.125 COPY 5:* Trash")
-			ExpectResponse("abcd.125 NO no messages found")
+			ExpectResponse("abcd.125 OK [COPYUID 251 12 10] COPY Completed")
 		})
 	})
 
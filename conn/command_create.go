@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdCreate(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(1, 1); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	if strings.ContainsAny(mailboxName, "*%") {
+		c.writeResponse(args.Tag, "NO Mailbox names may not contain wildcards")
+		return
+	}
+
+	manager, ok := c.User.(mailstore.MailboxManager)
+	if !ok {
+		c.writeResponse(args.Tag, "NO CREATE not supported")
+		return
+	}
+
+	_, err = manager.CreateMailbox(mailboxName)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK CREATE completed")
+}
@@ -0,0 +1,61 @@
+package conn_test
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CREATE Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should create a mailbox and its superiors", func() {
+			SendLine("abcd.123 CREATE \"Archive/2024/Sent Items\"")
+			ExpectResponse("abcd.123 OK CREATE completed")
+
+			for _, name := range []string{"Archive", "Archive/2024", "Archive/2024/Sent Items"} {
+				_, err := tConn.User.MailboxByName(name)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("should allow COPY to a newly created mailbox", func() {
+			SendLine("abcd.123 CREATE Saved")
+			ExpectResponse("abcd.123 OK CREATE completed")
+			SendLine("abcd.124 SELECT INBOX")
+			for {
+				line, err := reader.ReadLine()
+				Expect(err).ToNot(HaveOccurred())
+				if strings.HasPrefix(line, "abcd.124 ") {
+					break
+				}
+			}
+			SendLine("abcd.125 COPY 1 Saved")
+			ExpectResponse("abcd.125 OK [COPYUID 252 10 10] COPY Completed")
+		})
+
+		It("should not create an existing mailbox", func() {
+			SendLine("abcd.123 CREATE Trash")
+			ExpectResponse("abcd.123 NO Mailbox already exists")
+			SendLine("abcd.124 CREATE inbox")
+			ExpectResponse("abcd.124 NO Mailbox already exists")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 CREATE Archive")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdDelete(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(1, 1); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	manager, ok := c.User.(mailstore.MailboxManager)
+	if !ok {
+		c.writeResponse(args.Tag, "NO DELETE not supported")
+		return
+	}
+
+	err = manager.DeleteMailbox(mailboxName)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK DELETE completed")
+}
@@ -0,0 +1,45 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DELETE Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should delete a mailbox", func() {
+			SendLine("abcd.123 DELETE Trash")
+			ExpectResponse("abcd.123 OK DELETE completed")
+
+			_, err := tConn.User.MailboxByName("Trash")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should not delete INBOX", func() {
+			SendLine("abcd.123 DELETE INBOX")
+			ExpectResponse("abcd.123 NO Cannot delete INBOX")
+		})
+
+		It("should not delete a mailbox that doesn't exist", func() {
+			SendLine("abcd.123 DELETE Nothing")
+			ExpectResponse("abcd.123 NO Invalid mailbox")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 DELETE Trash")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
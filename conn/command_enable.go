@@ -0,0 +1,53 @@
+package conn
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+// enableExtensions are the extensions a client may turn on with ENABLE
+// (RFC 5161). Both need the mailstore to keep mod-sequences.
+var enableExtensions = map[string]func(c *Conn){
+	"CONDSTORE": (*Conn).enableCondstore,
+	"QRESYNC":   (*Conn).enableQresync,
+}
+
+// Handles an ENABLE command (RFC 5161), which turns on extensions that
+// change how the server responds
+func cmdEnable(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+	if err := args.ExpectMin(1); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	// Unknown and unsupported extensions are ignored, and only those enabled
+	// are listed
+	supported := mailstore.SupportsModSeq(c.Mailstore)
+	var enabled []string
+	seen := make(map[string]bool)
+	for i := range args.Args {
+		name, err := args.Atom(i)
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		name = strings.ToUpper(name)
+		if enable, ok := enableExtensions[name]; ok && supported && !seen[name] {
+			seen[name] = true
+			enable(c)
+			enabled = append(enabled, name)
+		}
+	}
+
+	response := "ENABLED"
+	if len(enabled) > 0 {
+		response += " " + strings.Join(enabled, " ")
+	}
+	c.writeResponse("", response)
+	c.writeResponse(args.Tag, "OK ENABLE completed")
+}
@@ -0,0 +1,62 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("ENABLE Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should enable QRESYNC", func() {
+			SendLine("abcd.123 ENABLE QRESYNC")
+			ExpectResponse("* ENABLED QRESYNC")
+			ExpectResponse("abcd.123 OK ENABLE completed")
+		})
+
+		It("should ignore unknown extensions", func() {
+			SendLine("abcd.123 ENABLE X-BOGUS condstore")
+			ExpectResponse("* ENABLED CONDSTORE")
+			ExpectResponse("abcd.123 OK ENABLE completed")
+
+			SendLine("abcd.124 ENABLE X-BOGUS")
+			ExpectResponse("* ENABLED")
+			ExpectResponse("abcd.124 OK ENABLE completed")
+		})
+
+		It("should need at least one extension", func() {
+			SendLine("abcd.123 ENABLE")
+			ExpectResponsePattern(`^abcd\.123 BAD `)
+		})
+	})
+
+	Context("When the mailstore doesn't keep mod-sequences", func() {
+		BeforeEach(func() {
+			tConn.Mailstore = struct{ mailstore.Mailstore }{mStore}
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should ignore CONDSTORE and QRESYNC", func() {
+			SendLine("abcd.123 ENABLE CONDSTORE QRESYNC")
+			ExpectResponse("* ENABLED")
+			ExpectResponse("abcd.123 OK ENABLE completed")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 ENABLE QRESYNC")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
@@ -1,14 +1,37 @@
 package conn
 
-import "fmt"
+import (
+	"fmt"
 
-func cmdExamine(args commandArgs, c *Conn) {
-	m, err := c.User.MailboxByName(args.Arg(0))
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdExamine(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	opts, err := parseSelectParams(args, c)
 	if err != nil {
-		fmt.Fprintf(c, "%s NO %s\r\n", args.ID(), err)
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
 
-	writeMailboxInfo(c, m)
-	c.writeResponse(args.ID(), "OK [READ-ONLY] EXAMINE completed")
+	m, err := mailstore.MailboxByNameContext(c.Context(), c.User, mailboxName)
+	if err != nil {
+		fmt.Fprintf(c, "%s NO %s\r\n", args.Tag, err)
+		return
+	}
+
+	if err := c.openMailbox(m, opts, readOnly); err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK [READ-ONLY] EXAMINE completed")
 }
@@ -12,7 +12,17 @@ var _ = Describe("EXAMINE Command", func() {
 			tConn.User = mStore.User
 		})
 
-		PIt("should (implement test)", func() {
+		It("should open the mailbox read-only", func() {
+			SendLine("abcd.123 EXAMINE INBOX")
+			ExpectResponse("* 3 EXISTS")
+			ExpectResponse("* 3 RECENT")
+			ExpectResponse("* OK [UNSEEN 3]")
+			ExpectResponse("* OK [UIDNEXT 13]")
+			ExpectResponse("* OK [UIDVALIDITY 250]")
+			ExpectResponse("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)")
+			ExpectResponse("* OK [PERMANENTFLAGS ()]")
+			ExpectResponse("* OK [HIGHESTMODSEQ 4]")
+			ExpectResponse("abcd.123 OK [READ-ONLY] EXAMINE completed")
 		})
 	})
 
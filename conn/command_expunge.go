@@ -1,26 +1,59 @@
 package conn
 
 import (
-	"fmt"
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/types"
 )
 
-func cmdExpunge(args commandArgs, c *Conn) {
-	if !c.assertSelected(args.ID(), readWrite) {
+const uidExpungeArgRange int = 0
+
+func cmdExpunge(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readWrite) {
 		return
 	}
 
+	// UID EXPUNGE only deletes flagged messages in a set of UIDs (RFC 4315)
+	var uidSet types.SequenceSet
+	if args.UID {
+		if err := args.ExpectCount(1, 1); err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		var err error
+		if uidSet, err = args.SequenceSet(uidExpungeArgRange); err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+	}
+
+	// Report changes made by others first, so that sequence numbers agree
+	c.writeUpdates()
+
 	// Delete flagged messages.
-	msgs, err := c.SelectedMailbox.DeleteFlaggedMessages()
+	var msgs []mailstore.Message
+	var err error
+	if args.UID {
+		msgs, err = mailstore.DeleteFlaggedMessagesByUIDContext(c.Context(), c.SelectedMailbox, uidSet)
+	} else {
+		msgs, err = mailstore.DeleteFlaggedMessagesContext(c.Context(), c.SelectedMailbox)
+	}
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "NO "+err.Error())
 		return
 	}
 
-	// Write sequence numbers of deleted messages.
-	for _, msg := range msgs {
-		c.writeResponse("", fmt.Sprintf("%d EXPUNGE", msg.SequenceNumber()))
+	// Tell the client which messages were deleted
+	uids := make([]uint32, len(msgs))
+	for i, msg := range msgs {
+		uids[i] = msg.UID()
 	}
+	c.writeExpunged(uids)
 
 	// And we're done.
-	c.writeResponse(args.ID(), "OK EXPUNGE completed")
+	if args.UID {
+		c.writeResponse(args.Tag, "OK UID EXPUNGE completed")
+	} else {
+		c.writeResponse(args.Tag, "OK EXPUNGE completed")
+	}
 }
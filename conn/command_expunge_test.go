@@ -2,6 +2,7 @@ package conn_test
 
 import (
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
 	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -50,8 +51,9 @@ var _ = Describe("EXPUNGE Command", func() {
 
 			// Expunge the e-mail.
 			SendLine("abc.234 EXPUNGE")
+			// The third message becomes the second once the first is gone
 			ExpectResponse("* 1 EXPUNGE")
-			ExpectResponse("* 3 EXPUNGE")
+			ExpectResponse("* 2 EXPUNGE")
 			ExpectResponse("abc.234 OK EXPUNGE completed")
 
 			// Make sure that the two messages were deleted from the mailbox.
@@ -64,6 +66,54 @@ var _ = Describe("EXPUNGE Command", func() {
 			}
 		})
 
+		It("should only delete messages in the UID set with UID EXPUNGE", func() {
+			for _, seqNo := range []uint32{1, 3} {
+				_, err := tConn.SelectedMailbox.MessageBySequenceNumber(seqNo).
+					AddFlags(types.FlagDeleted).Save()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			SendLine("abc.345 UID EXPUNGE 11:*")
+			ExpectResponse("* 3 EXPUNGE")
+			ExpectResponse("abc.345 OK UID EXPUNGE completed")
+
+			// The first message is still flagged, but wasn't in the set
+			Expect(tConn.SelectedMailbox.Messages()).To(Equal(uint32(2)))
+			msg := tConn.SelectedMailbox.MessageByUID(10)
+			Expect(msg.Flags().HasFlags(types.FlagDeleted)).To(BeTrue())
+		})
+
+		It("should refuse UID EXPUNGE for mailboxes which can't do it", func() {
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(1).
+				AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			tConn.SelectedMailbox = struct{ mailstore.Mailbox }{tConn.SelectedMailbox}
+
+			SendLine("abc.345 UID EXPUNGE 10")
+			ExpectResponse("abc.345 NO UID EXPUNGE not supported")
+			Expect(tConn.SelectedMailbox.Messages()).To(Equal(uint32(3)))
+		})
+
+		It("should report expunged UIDs once QRESYNC is enabled", func() {
+			for _, seqNo := range []uint32{1, 3} {
+				_, err := tConn.SelectedMailbox.MessageBySequenceNumber(seqNo).
+					AddFlags(types.FlagDeleted).Save()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			SendLine("abc.345 ENABLE QRESYNC")
+			ExpectResponse("* ENABLED QRESYNC")
+			ExpectResponse("abc.345 OK ENABLE completed")
+
+			SendLine("abc.346 EXPUNGE")
+			ExpectResponse("* VANISHED 10,12")
+			ExpectResponse("abc.346 OK EXPUNGE completed")
+		})
+
+		It("should require a UID set with UID EXPUNGE", func() {
+			SendLine("abc.456 UID EXPUNGE")
+			ExpectResponse("abc.456 BAD Not enough arguments (argument 1 missing)")
+		})
 	})
 
 	Context("When logged in but no mailbox is selected", func() {
@@ -1,24 +1,40 @@
 package conn
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"net/textproto"
+	"io"
 	"regexp"
 	"strings"
 
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 	"github.com/jordwest/imap-server/types"
 	"github.com/jordwest/imap-server/util"
 )
 
 const (
-	fetchArgUID    int = 0
-	fetchArgRange  int = 1
-	fetchArgParams int = 2
+	fetchArgRange     int = 0
+	fetchArgParams    int = 1
+	fetchArgModifiers int = 2
 )
 
-var registeredFetchParams []fetchParamDefinition
+// fetchModifiers are the modifiers which may follow the FETCH items, and
+// whether each takes a value
+var fetchModifiers = map[string]bool{
+	"CHANGEDSINCE": true,
+	"VANISHED":     false,
+}
+
+// fetchMacros are shorthand names for common sets of FETCH parameters
+var fetchMacros = map[string]string{
+	"ALL":  "FLAGS INTERNALDATE RFC822.SIZE ENVELOPE",
+	"FAST": "FLAGS INTERNALDATE RFC822.SIZE",
+	"FULL": "FLAGS INTERNALDATE RFC822.SIZE ENVELOPE BODY",
+}
+
 var peekRE *regexp.Regexp
 
 // ErrUnrecognisedParameter indicates that the parameter requested in a FETCH
@@ -26,124 +42,281 @@ var peekRE *regexp.Regexp
 var ErrUnrecognisedParameter = errors.New("Unrecognised Parameter")
 
 type fetchParamDefinition struct {
+	name    string // The name used to replace or disable the item
 	re      *regexp.Regexp
-	handler func([]string, *Conn, mailstore.Message, bool) string
+	handler fetchHandler
+}
+
+// fetchHandler writes a single FETCH data item for a message. Handlers which
+// write literals stream the message content rather than holding it in memory.
+type fetchHandler func(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error
+
+// fetchItem is a requested FETCH parameter matched with its handler
+type fetchItem struct {
+	def  fetchParamDefinition
+	args []string
+	peek bool
 }
 
 // Register all supported fetch parameters
 func init() {
-	peekRE = regexp.MustCompile("\\.PEEK")
-	registeredFetchParams = make([]fetchParamDefinition, 0)
-	registerFetchParam("UID", fetchUID)
-	registerFetchParam("FLAGS", fetchFlags)
-	registerFetchParam("RFC822\\.SIZE", fetchRfcSize)
-	registerFetchParam("INTERNALDATE", fetchInternalDate)
-	registerFetchParam("BODY(?:\\.PEEK)?\\[HEADER\\]", fetchHeaders)
-	registerFetchParam("BODY(?:\\.PEEK)?"+
-		"\\[HEADER\\.FIELDS \\(([A-z\\s-]+)\\)\\]", fetchHeaderSpecificFields)
-	registerFetchParam("BODY(?:\\.PEEK)?\\[TEXT\\]", fetchBody)
-	registerFetchParam("BODY(?:\\.PEEK)?\\[\\]", fetchFullText)
-}
-
-func cmdFetch(args commandArgs, c *Conn) {
-	if !c.assertSelected(args.ID(), readOnly) {
+	peekRE = regexp.MustCompile("(?i)\\.PEEK")
+	registerFetchParam("UID", "UID", fetchUID)
+	registerFetchParam("FLAGS", "FLAGS", fetchFlags)
+	registerFetchParam("RFC822.SIZE", "RFC822\\.SIZE", fetchRfcSize)
+	registerFetchParam("INTERNALDATE", "INTERNALDATE", fetchInternalDate)
+	registerFetchParam("ENVELOPE", "ENVELOPE$", fetchEnvelope)
+	registerFetchHandler("BODYSTRUCTURE", "BODYSTRUCTURE$", fetchBodyStructure)
+	registerFetchHandler("BODY", "BODY$", fetchBodyNonExtensible)
+	registerFetchHandler("BODY[]", sectionRE, fetchSection)
+}
+
+func cmdFetch(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readOnly) {
 		return
 	}
 
-	// Fetch the messages
-	seqSet, err := types.InterpretSequenceSet(args.Arg(fetchArgRange))
+	if err := args.ExpectCount(2, 3); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	seqSet, err := args.SequenceSet(fetchArgRange)
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	paramList, err := args.Atoms(fetchArgParams)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
 
-	searchByUID := strings.ToUpper(args.Arg(fetchArgUID)) == "UID "
+	// CHANGEDSINCE (RFC 7162) only fetches messages whose flags have
+	// changed since the given mod-sequence. With QRESYNC, VANISHED also
+	// lists the messages expunged since then.
+	changedSince := uint64(0)
+	hasChangedSince := false
+	hasVanished := false
+	if args.Has(fetchArgModifiers) {
+		list, err := args.List(fetchArgModifiers)
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		modifiers, err := parseModifiers(list, fetchModifiers)
+		if err == nil {
+			if value, ok := modifiers["CHANGEDSINCE"]; ok {
+				hasChangedSince = true
+				changedSince, err = parseModSeq(value.Value)
+			}
+			_, hasVanished = modifiers["VANISHED"]
+		}
+		if err == nil && hasVanished && (!args.UID || !hasChangedSince || !c.qresync) {
+			err = errors.New("VANISHED requires UID FETCH, CHANGEDSINCE and QRESYNC")
+		}
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+	}
 
-	var msgs []mailstore.Message
-	if searchByUID {
-		msgs = c.SelectedMailbox.MessageSetByUID(seqSet)
-	} else {
-		msgs = c.SelectedMailbox.MessageSetBySequenceNumber(seqSet)
+	// Expand macros and check whether the UID and MODSEQ were requested
+	hasUID := false
+	hasModSeq := false
+	for i, param := range paramList {
+		if expanded, ok := fetchMacros[strings.ToUpper(param)]; ok && len(paramList) == 1 {
+			paramList[i] = expanded
+		}
+		if strings.EqualFold(param, "UID") {
+			hasUID = true
+		}
+		if strings.EqualFold(param, "MODSEQ") {
+			hasModSeq = true
+		}
+	}
+	if hasModSeq || hasChangedSince {
+		if !c.hasModSeq() {
+			c.writeResponse(args.Tag, "BAD "+errNoModSeq)
+			return
+		}
+		c.enableCondstore()
 	}
 
-	fetchParamString := args.Arg(fetchArgParams)
-	if searchByUID && !strings.Contains(fetchParamString, "UID") {
+	// Fetch the messages
+	searchByUID := args.UID
+
+	fetchParamString := strings.Join(paramList, " ")
+	if searchByUID && !hasUID {
 		fetchParamString += " UID"
 	}
+	if hasChangedSince && !hasModSeq {
+		fetchParamString += " MODSEQ"
+	}
+
+	// Every parameter is checked before anything is sent, as the response
+	// can't be taken back once it has started
+	items, err := c.registry().parseFetchParams(fetchParamString)
+	if err != nil {
+		if err == ErrUnrecognisedParameter {
+			c.writeResponse(args.Tag, "BAD Unrecognised Parameter")
+			return
+		}
+
+		c.writeResponse(args.Tag, "BAD")
+		return
+	}
+
+	// Fetching a body section without PEEK sets the \Seen flag, and the
+	// client is sent the new flags if it didn't ask for them (RFC 3501 6.4.5)
+	setsSeen := false
+	hasFlags := false
+	for _, item := range items {
+		setsSeen = setsSeen || (item.def.name == "BODY[]" && !item.peek)
+		hasFlags = hasFlags || item.def.name == "FLAGS"
+	}
+	setsSeen = setsSeen && c.mailboxWritable == readWrite
+	seenItems := items
+	if setsSeen && !hasFlags {
+		flagsItem, err := c.registry().fetchParam("FLAGS")
+		if err == nil {
+			seenItems = append(items[:len(items):len(items)], flagsItem)
+		}
+	}
+
+	msgs, err := c.messageSet(seqSet, searchByUID)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	if hasVanished {
+		if err := c.writeVanishedEarlier(changedSince, seqSet); err != nil {
+			c.writeResponse(args.Tag, "NO "+err.Error())
+			return
+		}
+	}
 
+	w := bufio.NewWriter(c)
 	for _, msg := range msgs {
-		fetchParams, err := fetch(fetchParamString, c, msg)
-		if err != nil {
-			if err == ErrUnrecognisedParameter {
-				c.writeResponse(args.ID(), "BAD Unrecognised Parameter")
-				return
-			}
+		if hasChangedSince && mailstore.ModSeq(msg) <= changedSince {
+			continue
+		}
+		// The flag is saved along with \Recent being removed below
+		msgItems := items
+		if setsSeen && !msg.Flags().HasFlags(types.FlagSeen) {
+			msg, msgItems = msg.AddFlags(types.FlagSeen), seenItems
+		}
 
-			c.writeResponse(args.ID(), "BAD")
+		fmt.Fprintf(w, "* %d FETCH (", c.sequenceNumber(msg))
+		err := writeFetch(w, msgItems, c, msg)
+		if err == nil {
+			_, err = w.WriteString(")\r\n")
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			// Part of the response may already have been sent, possibly
+			// in the middle of a literal, so the client can't be told about
+			// the error. Drop the connection instead.
+			fmt.Fprintf(c.Transcript, "Error fetching message %d: %s\n", msg.UID(), err)
+			c.Close()
+			c.state = StateLoggedOut
 			return
 		}
 
 		if c.mailboxWritable == readWrite {
 			msg = msg.RemoveFlags(types.FlagRecent)
-			msg, err = msg.Save()
+			msg, err = mailstore.SaveContext(c.Context(), msg)
 			if err != nil {
 				// TODO: this error is not fatal, but should still be logged
+			} else if c.view != nil {
+				c.view.setFlags(msg.UID(), types.FlagSet{Flags: msg.Flags(), Keywords: msg.Keywords()})
 			}
 		}
-
-		fullReply := fmt.Sprintf("%d FETCH (%s)",
-			msg.SequenceNumber(),
-			fetchParams)
-
-		c.writeResponse("", fullReply)
 	}
 
 	if searchByUID {
-		c.writeResponse(args.ID(), "OK UID FETCH Completed")
+		c.writeResponse(args.Tag, "OK UID FETCH Completed")
 	} else {
-		c.writeResponse(args.ID(), "OK FETCH Completed")
+		c.writeResponse(args.Tag, "OK FETCH Completed")
 	}
 }
 
 // Fetch requested params from a given message
 // eg fetch("UID BODY[TEXT] RFC822.SIZE", c, message)
 func fetch(params string, c *Conn, m mailstore.Message) (string, error) {
-	paramList := util.SplitParams(params)
+	items, err := c.registry().parseFetchParams(params)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := writeFetch(&buf, items, c, m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
 
-	// Prepare the list of responses
-	responseParams := make([]string, 0, len(paramList))
+// parseFetchParams matches each of a list of fetch parameters to its handler
+func (r *Registry) parseFetchParams(params string) ([]fetchItem, error) {
+	paramList := util.SplitParams(params)
+	items := make([]fetchItem, 0, len(paramList))
 
 	for _, param := range paramList {
-		paramResponse, err := fetchParam(param, c, m)
+		item, err := r.fetchParam(param)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		responseParams = append(responseParams, paramResponse)
+		items = append(items, item)
 	}
-	return strings.Join(responseParams, " "), nil
+	return items, nil
 }
 
-// Match a single fetch parameter and return the data
-func fetchParam(param string, c *Conn, m mailstore.Message) (string, error) {
+// Match a single fetch parameter to its handler
+func (r *Registry) fetchParam(param string) (fetchItem, error) {
 	peek := false
 	if peekRE.MatchString(param) {
 		peek = true
 	}
 	// Search through the parameter list until a parameter handler is found
-	for _, element := range registeredFetchParams {
+	for _, element := range r.fetchParams {
 		if element.re.MatchString(param) {
-			return element.handler(element.re.FindStringSubmatch(param), c, m, peek), nil
+			return fetchItem{element, element.re.FindStringSubmatch(param), peek}, nil
+		}
+	}
+	return fetchItem{}, ErrUnrecognisedParameter
+}
+
+// writeFetch writes the requested data items of a message, separated by
+// spaces
+func writeFetch(w io.Writer, items []fetchItem, c *Conn, m mailstore.Message) error {
+	for i, item := range items {
+		if i > 0 {
+			if _, err := io.WriteString(w, " "); err != nil {
+				return err
+			}
+		}
+		if err := item.def.handler(item.args, c, m, item.peek, w); err != nil {
+			return err
 		}
 	}
-	return "", ErrUnrecognisedParameter
+	return nil
+}
+
+func registerFetchParam(name string, regex string, handler func([]string, *Conn, mailstore.Message, bool) string) {
+	registerFetchHandler(name, regex, func(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+		_, err := io.WriteString(w, handler(args, c, m, peekOnly))
+		return err
+	})
 }
 
-func registerFetchParam(regex string, handler func([]string, *Conn, mailstore.Message, bool) string) {
+func registerFetchHandler(name string, regex string, handler fetchHandler) {
 	newParam := fetchParamDefinition{
-		re:      regexp.MustCompile(regex),
+		name:    name,
+		re:      regexp.MustCompile("(?i)^" + regex),
 		handler: handler,
 	}
-	registeredFetchParams = append(registeredFetchParams, newParam)
+	defaultRegistry.fetchParams = append(defaultRegistry.fetchParams, newParam)
 }
 
 // Fetch the UID of the mail message
@@ -165,57 +338,3 @@ func fetchInternalDate(args []string, c *Conn, m mailstore.Message, peekOnly boo
 	dateStr := m.InternalDate().Format(util.InternalDate)
 	return fmt.Sprintf("INTERNALDATE \"%s\"", dateStr)
 }
-
-func fetchHeaders(args []string, c *Conn, m mailstore.Message, peekOnly bool) string {
-	hdr := fmt.Sprintf("%s\r\n", util.MIMEHeaderToString(m.Header()))
-	hdrLen := len(hdr)
-
-	peekStr := ""
-	if peekOnly {
-		peekStr = ".PEEK"
-	}
-
-	return fmt.Sprintf("BODY%s[HEADER] {%d}\r\n%s", peekStr, hdrLen, hdr)
-}
-
-func fetchHeaderSpecificFields(args []string, c *Conn, m mailstore.Message, peekOnly bool) string {
-	if !peekOnly {
-		fmt.Printf("TODO: Peek not requested, mark all as non-recent\n")
-	}
-	fields := strings.Split(args[1], " ")
-	hdrs := m.Header()
-	requestedHeaders := make(textproto.MIMEHeader)
-	replyFieldList := make([]string, len(fields))
-	for i, key := range fields {
-		replyFieldList[i] = "\"" + key + "\""
-		// If the key exists in the headers, copy it over
-		v := hdrs.Get(key)
-		if v != "" {
-			requestedHeaders.Add(key, v)
-		}
-	}
-	hdr := util.MIMEHeaderToString(requestedHeaders)
-	hdrLen := len(hdr)
-
-	return fmt.Sprintf("BODY[HEADER.FIELDS (%s)] {%d}\r\n%s",
-		strings.Join(replyFieldList, " "),
-		hdrLen,
-		hdr)
-
-}
-
-func fetchBody(args []string, c *Conn, m mailstore.Message, peekOnly bool) string {
-	body := fmt.Sprintf("%s\r\n", m.Body())
-	bodyLen := len(body)
-
-	return fmt.Sprintf("BODY[TEXT] {%d}\r\n%s",
-		bodyLen, body)
-}
-
-func fetchFullText(args []string, c *Conn, m mailstore.Message, peekOnly bool) string {
-	mail := fmt.Sprintf("%s\r\n%s\r\n", util.MIMEHeaderToString(m.Header()), m.Body())
-	mailLen := len(mail)
-
-	return fmt.Sprintf("BODY[] {%d}\r\n%s",
-		mailLen, mail)
-}
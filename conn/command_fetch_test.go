@@ -1,10 +1,17 @@
 package conn_test
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
-
-	//. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("FETCH Command", func() {
@@ -22,6 +29,69 @@ var _ = Describe("FETCH Command", func() {
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
+		It("should fetch ranges whose ends are in either order", func() {
+			SendLine("abcd.123 FETCH 4:* (UID)")
+			ExpectResponse("* 3 FETCH (UID 12)")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+
+			SendLine("abcd.124 FETCH *:2 (UID)")
+			ExpectResponse("* 2 FETCH (UID 11)")
+			ExpectResponse("* 3 FETCH (UID 12)")
+			ExpectResponse("abcd.124 OK FETCH Completed")
+		})
+
+		It("should fetch the mod-sequence of a message", func() {
+			SendLine("abcd.123 FETCH 1:2 (MODSEQ)")
+			ExpectResponse("* 1 FETCH (MODSEQ (2))")
+			ExpectResponse("* 2 FETCH (MODSEQ (3))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+		})
+
+		It("should only fetch messages changed since a mod-sequence", func() {
+			_, err := tConn.SelectedMailbox.MessageByUID(11).AddFlags(types.FlagSeen).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 UID FETCH 1:* (FLAGS) (CHANGEDSINCE 4)")
+			ExpectResponse("* 2 FETCH (FLAGS (\\Seen \\Recent) UID 11 MODSEQ (5))")
+			ExpectResponse("abcd.123 OK UID FETCH Completed")
+		})
+
+		It("should list messages expunged since a mod-sequence", func() {
+			SendLine("abcd.123 UID FETCH 1:* (FLAGS) (CHANGEDSINCE 4 VANISHED)")
+			ExpectResponse("abcd.123 BAD VANISHED requires UID FETCH, CHANGEDSINCE and QRESYNC")
+
+			SendLine("abcd.124 ENABLE QRESYNC")
+			ExpectResponse("* ENABLED QRESYNC")
+			ExpectResponse("abcd.124 OK ENABLE completed")
+
+			SendLine("abcd.125 UID FETCH 1:* (FLAGS) (VANISHED)")
+			ExpectResponse("abcd.125 BAD VANISHED requires UID FETCH, CHANGEDSINCE and QRESYNC")
+
+			SendLine("abcd.126 STORE 1 +FLAGS.SILENT (\\Deleted)")
+			ExpectResponse("* 1 FETCH (UID 10 MODSEQ (5))")
+			ExpectResponse("abcd.126 OK STORE Completed")
+			SendLine("abcd.127 EXPUNGE")
+			ExpectResponse("* VANISHED 10")
+			ExpectResponse("abcd.127 OK EXPUNGE completed")
+
+			SendLine("abcd.128 UID FETCH 1:* (FLAGS) (CHANGEDSINCE 4 VANISHED)")
+			ExpectResponse("* VANISHED (EARLIER) 10")
+			ExpectResponse("abcd.128 OK UID FETCH Completed")
+		})
+
+		It("should reject unknown modifiers", func() {
+			SendLine("abcd.123 FETCH 1 (FLAGS) (BOGUS 1)")
+			ExpectResponse("abcd.123 BAD Unrecognised modifier BOGUS")
+		})
+
+		It("should refuse mod-sequences for a mailbox without them", func() {
+			// Hiding the mailbox's methods leaves it without mod-sequences
+			tConn.SelectedMailbox = struct{ mailstore.Mailbox }{tConn.SelectedMailbox}
+
+			SendLine("abcd.123 FETCH 1 (FLAGS) (CHANGEDSINCE 1)")
+			ExpectResponse("abcd.123 BAD Mailbox does not support mod-sequences")
+		})
+
 		It("should be case insensitive", func() {
 			SendLine("abcd.123 fetch 1 (FLAGS UID)")
 			ExpectResponse("* 1 FETCH (FLAGS (\\Recent) UID 10)")
@@ -37,28 +107,50 @@ var _ = Describe("FETCH Command", func() {
 			ExpectResponsePattern("^((?i)(subject)|(message-id)|(to)|(from)|(date)): [<>A-z0-9\\s@\\.,\\:\\+]+$")
 			ExpectResponsePattern("^((?i)(subject)|(message-id)|(to)|(from)|(date)): [<>A-z0-9\\s@\\.,\\:\\+]+$")
 			ExpectResponse("")
-			ExpectResponse(")")
+			ExpectResponse(" FLAGS (\\Seen \\Recent))")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
 		It("should fetch specific headers of a message", func() {
 			SendLine("abcd.123 FETCH 1 (BODY[HEADER.FIELDS (From Subject)])")
-			ExpectResponse("* 1 FETCH (BODY[HEADER.FIELDS (\"From\" \"Subject\")] {40}")
+			ExpectResponse("* 1 FETCH (BODY[HEADER.FIELDS (\"From\" \"Subject\")] {42}")
 			ExpectResponsePattern("^((?i)(subject)|(from)): [<>A-z0-9\\s@\\.,\\:\\+]+$")
 			ExpectResponsePattern("^((?i)(subject)|(from)): [<>A-z0-9\\s@\\.,\\:\\+]+$")
-			ExpectResponse(")")
+			ExpectResponse("")
+			ExpectResponse(" FLAGS (\\Seen \\Recent))")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
 		It("should PEEK specific headers of a message without changing the Recent flag", func() {
 			SendLine("abcd.123 FETCH 1 (BODY.PEEK[HEADER.FIELDS (from Subject x-priority)])")
-			ExpectResponse("* 1 FETCH (BODY[HEADER.FIELDS (\"from\" \"Subject\" \"x-priority\")] {40}")
+			ExpectResponse("* 1 FETCH (BODY[HEADER.FIELDS (\"from\" \"Subject\" \"x-priority\")] {42}")
 			ExpectResponsePattern("^((?i)(subject)|(from)): [A-z0-9\\s@\\.]+$")
 			ExpectResponsePattern("^((?i)(subject)|(from)): [A-z0-9\\s@\\.]+$")
+			ExpectResponse("")
 			ExpectResponse(")")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
+		It("should mark a message as seen when fetching its body", func() {
+			SendLine("abcd.123 FETCH 3 (BODY[TEXT]<0.4>)")
+			ExpectResponse("* 3 FETCH (BODY[TEXT]<0> {4}")
+			ExpectResponse("Hell FLAGS (\\Seen \\Recent))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+
+			flags := tConn.SelectedMailbox.MessageBySequenceNumber(3).Flags()
+			Expect(flags.HasFlags(types.FlagSeen)).To(BeTrue())
+		})
+
+		It("shouldn't mark a message as seen when peeking at its body", func() {
+			SendLine("abcd.123 FETCH 3 (BODY.PEEK[TEXT]<0.4>)")
+			ExpectResponse("* 3 FETCH (BODY[TEXT]<0> {4}")
+			ExpectResponse("Hell)")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+
+			flags := tConn.SelectedMailbox.MessageBySequenceNumber(3).Flags()
+			Expect(flags.HasFlags(types.FlagSeen)).To(BeFalse())
+		})
+
 		It("should fetch the internal date of a message", func() {
 			SendLine("abcd.123 FETCH 1 (INTERNALDATE)")
 			ExpectResponse("* 1 FETCH (INTERNALDATE \"28-Oct-2014 00:09:00 +0700\")")
@@ -67,7 +159,7 @@ var _ = Describe("FETCH Command", func() {
 
 		It("should fetch the RFC822 size of a message", func() {
 			SendLine("abcd.123 FETCH 1 (RFC822.SIZE)")
-			ExpectResponse("* 1 FETCH (RFC822.SIZE 154)")
+			ExpectResponse("* 1 FETCH (RFC822.SIZE 152)")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
@@ -77,7 +169,16 @@ var _ = Describe("FETCH Command", func() {
 			ExpectResponse("Test email")
 			ExpectResponse("Regards,")
 			ExpectResponse("Me")
-			ExpectResponse(")")
+			ExpectResponse(" FLAGS (\\Seen \\Recent))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+		})
+
+		It("should fetch part of the body of a message", func() {
+			SendLine("abcd.123 FETCH 1 (BODY[TEXT]<5.5> BODY[]<150.10>)")
+			ExpectResponse("* 1 FETCH (BODY[TEXT]<5> {5}")
+			ExpectResponse("email BODY[]<150> {2}")
+			ExpectResponse("")
+			ExpectResponse(" FLAGS (\\Seen \\Recent))")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
@@ -93,7 +194,7 @@ var _ = Describe("FETCH Command", func() {
 			ExpectResponse("Test email")
 			ExpectResponse("Regards,")
 			ExpectResponse("Me")
-			ExpectResponse(")")
+			ExpectResponse(" FLAGS (\\Seen \\Recent))")
 			ExpectResponse("abcd.123 OK FETCH Completed")
 		})
 
@@ -107,10 +208,205 @@ var _ = Describe("FETCH Command", func() {
 			ExpectResponsePattern("^((?i)(subject)|(message-id)|(to)|(from)|(date)): [<>A-z0-9\\s@\\.,\\:\\+]+$")
 			ExpectResponse("")
 			ExpectResponse("Another test email")
-			ExpectResponse(" UID 11)")
+			ExpectResponse(" UID 11 FLAGS (\\Seen \\Recent))")
 			ExpectResponse("abcd.123 OK UID FETCH Completed")
 		})
 
+
+		It("should fetch the envelope of a message", func() {
+			SendLine("abcd.123 FETCH 3 (ENVELOPE)")
+			ExpectResponse("* 3 FETCH (ENVELOPE (\"Tue, 28 Oct 2014 00:09:00 +0700\" \"Last email\" " +
+				"((NIL NIL \"me\" \"test.com\")) ((NIL NIL \"me\" \"test.com\")) " +
+				"((NIL NIL \"me\" \"test.com\")) ((NIL NIL \"you\" \"test.com\")) " +
+				"NIL NIL NIL \"<12@test.com>\"))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+		})
+
+		It("should fetch the body structure of a plain text message", func() {
+			SendLine("abcd.123 FETCH 3 (BODYSTRUCTURE BODY)")
+			ExpectResponse("* 3 FETCH (" +
+				"BODYSTRUCTURE (\"TEXT\" \"PLAIN\" (\"CHARSET\" \"us-ascii\") NIL NIL \"7BIT\" 7 1 NIL NIL NIL NIL) " +
+				"BODY (\"TEXT\" \"PLAIN\" (\"CHARSET\" \"us-ascii\") NIL NIL \"7BIT\" 7 1))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+		})
+
+		Context("with folded and repeated header fields", func() {
+			received := "Received: from a.example.com\r\n" +
+				"\tby b.example.com; Mon, 1 Jan 2024 00:00:01 +0000\r\n"
+			subject := "Subject: Folded\r\n"
+			receivedAgain := "received: from c.example.com\r\n" +
+				"  by a.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n"
+			spam := "X-Spam: no\r\n"
+
+			BeforeEach(func() {
+				tConn.SelectedMailbox = rawMailbox{
+					Mailbox: tConn.SelectedMailbox,
+					content: received + subject + receivedAgain + spam + "\r\nHello\r\n",
+				}
+			})
+
+			It("should fetch the fields as they appear in the message", func() {
+				SendLine("abcd.123 FETCH 1 (BODY.PEEK[HEADER.FIELDS (RECEIVED)])")
+				ExpectResponse(fmt.Sprintf("* 1 FETCH (BODY[HEADER.FIELDS (\"RECEIVED\")] {%d}",
+					len(received+receivedAgain)+2))
+				ExpectResponse("Received: from a.example.com")
+				ExpectResponse("\tby b.example.com; Mon, 1 Jan 2024 00:00:01 +0000")
+				ExpectResponse("received: from c.example.com")
+				ExpectResponse("  by a.example.com; Mon, 1 Jan 2024 00:00:00 +0000")
+				ExpectResponse("")
+				ExpectResponse(")")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should leave out the fields given in their order", func() {
+				SendLine("abcd.123 FETCH 1 (BODY.PEEK[HEADER.FIELDS.NOT (Subject)])")
+				ExpectResponse(fmt.Sprintf("* 1 FETCH (BODY[HEADER.FIELDS.NOT (\"Subject\")] {%d}",
+					len(received+receivedAgain+spam)+2))
+				ExpectResponse("Received: from a.example.com")
+				ExpectResponse("\tby b.example.com; Mon, 1 Jan 2024 00:00:01 +0000")
+				ExpectResponse("received: from c.example.com")
+				ExpectResponse("  by a.example.com; Mon, 1 Jan 2024 00:00:00 +0000")
+				ExpectResponse("X-Spam: no")
+				ExpectResponse("")
+				ExpectResponse(")")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+		})
+
+		Context("with a MIME message", func() {
+			BeforeEach(func() {
+				hdr := make(textproto.MIMEHeader)
+				hdr.Set("From", "\"Jane \\\"JD\\\" Doe\" <jane@example.com>")
+				hdr.Set("Reply-To", "replies@example.com")
+				hdr.Set("To", "a@example.com, Bob <b@example.com>")
+				hdr.Set("Subject", "Multipart")
+				hdr.Set("Content-Type", "multipart/alternative; boundary=b")
+				_, err := tConn.User.Mailboxes()[0].NewMessage().
+					SetHeaders(hdr).
+					SetBody(strings.NewReader("--b\r\n" +
+						"Content-Type: text/plain\r\n" +
+						"\r\n" +
+						"Hello\r\n" +
+						"--b\r\n" +
+						"Content-Type: text/html; charset=utf-8\r\n" +
+						"Content-Disposition: inline\r\n" +
+						"Content-Language: en, fr\r\n" +
+						"\r\n" +
+						"<p>Hello</p>\r\n" +
+						"--b--\r\n")).
+					Save()
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should fetch the envelope with display names", func() {
+				SendLine("abcd.123 FETCH 4 (ENVELOPE)")
+				ExpectResponse("* 4 FETCH (ENVELOPE (NIL \"Multipart\" " +
+					"((\"Jane \\\"JD\\\" Doe\" NIL \"jane\" \"example.com\")) " +
+					"((\"Jane \\\"JD\\\" Doe\" NIL \"jane\" \"example.com\")) " +
+					"((NIL NIL \"replies\" \"example.com\")) " +
+					"((NIL NIL \"a\" \"example.com\")(\"Bob\" NIL \"b\" \"example.com\")) " +
+					"NIL NIL NIL NIL))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should fetch the body structure of each part", func() {
+				SendLine("abcd.123 FETCH 4 (BODYSTRUCTURE)")
+				ExpectResponse("* 4 FETCH (BODYSTRUCTURE (" +
+					"(\"TEXT\" \"PLAIN\" NIL NIL NIL \"7BIT\" 5 1 NIL NIL NIL NIL)" +
+					"(\"TEXT\" \"HTML\" (\"CHARSET\" \"utf-8\") NIL NIL \"7BIT\" 12 1 " +
+					"NIL (\"INLINE\" NIL) (\"en\" \"fr\") NIL) " +
+					"\"ALTERNATIVE\" (\"BOUNDARY\" \"b\") NIL NIL NIL))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should fetch a single part", func() {
+				SendLine("abcd.123 FETCH 4 (BODY[1])")
+				ExpectResponse("* 4 FETCH (BODY[1] {5}")
+				ExpectResponse("Hello FLAGS (\\Seen))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should fetch the MIME header of a part", func() {
+				SendLine("abcd.123 FETCH 4 (BODY.PEEK[2.MIME])")
+				ExpectResponse("* 4 FETCH (BODY[2.MIME] {97}")
+				ExpectResponse("Content-Type: text/html; charset=utf-8")
+				ExpectResponse("Content-Disposition: inline")
+				ExpectResponse("Content-Language: en, fr")
+				ExpectResponse("")
+				ExpectResponse(")")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should fetch part of a part", func() {
+				SendLine("abcd.123 FETCH 4 (BODY[2]<3.5> BODY[2]<10.100> BODY[2]<50.10>)")
+				ExpectResponse("* 4 FETCH (BODY[2]<3> {5}")
+				ExpectResponse("Hello BODY[2]<10> {2}")
+				ExpectResponse("p> BODY[2]<50> {0}")
+				ExpectResponse(" FLAGS (\\Seen))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should fetch all header fields except those given", func() {
+				SendLine("abcd.123 FETCH 4 (BODY.PEEK[HEADER.FIELDS.NOT (Content-Type From reply-to To)])")
+				ExpectResponse("* 4 FETCH (BODY[HEADER.FIELDS.NOT " +
+					"(\"Content-Type\" \"From\" \"reply-to\" \"To\")] {22}")
+				ExpectResponse("Subject: Multipart")
+				ExpectResponse("")
+				ExpectResponse(")")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should return NIL for parts which don't exist", func() {
+				SendLine("abcd.123 FETCH 4 (BODY[3] BODY[1.HEADER])")
+				ExpectResponse("* 4 FETCH (BODY[3] NIL BODY[1.HEADER] NIL FLAGS (\\Seen))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should reject an invalid section", func() {
+				SendLine("abcd.123 FETCH 4 (BODY[1.BOGUS])")
+				ExpectResponse("abcd.123 BAD Unrecognised Parameter")
+			})
+
+			It("should leave out extension data for BODY", func() {
+				SendLine("abcd.123 FETCH 4 (BODY)")
+				ExpectResponse("* 4 FETCH (BODY (" +
+					"(\"TEXT\" \"PLAIN\" NIL NIL NIL \"7BIT\" 5 1)" +
+					"(\"TEXT\" \"HTML\" (\"CHARSET\" \"utf-8\") NIL NIL \"7BIT\" 12 1) " +
+					"\"ALTERNATIVE\"))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+		})
+		Context("with an attached message", func() {
+			BeforeEach(func() {
+				hdr := make(textproto.MIMEHeader)
+				hdr.Set("Subject", "Forwarded")
+				hdr.Set("Content-Type", "message/rfc822")
+				_, err := tConn.User.Mailboxes()[0].NewMessage().
+					SetHeaders(hdr).
+					SetBody(strings.NewReader("Subject: Inner\r\n\r\nInner body\r\n")).
+					Save()
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should fetch the header and text of the attached message", func() {
+				SendLine("abcd.123 FETCH 4 (BODY[1.HEADER] BODY[1.TEXT])")
+				ExpectResponse("* 4 FETCH (BODY[1.HEADER] {18}")
+				ExpectResponse("Subject: Inner")
+				ExpectResponse("")
+				ExpectResponse(" BODY[1.TEXT] {12}")
+				ExpectResponse("Inner body")
+				ExpectResponse(" FLAGS (\\Seen))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+
+			It("should describe the attached message in the body structure", func() {
+				SendLine("abcd.123 FETCH 4 (BODY)")
+				ExpectResponse("* 4 FETCH (BODY (\"MESSAGE\" \"RFC822\" NIL NIL NIL \"7BIT\" 30 " +
+					"(NIL \"Inner\" NIL NIL NIL NIL NIL NIL NIL NIL) " +
+					"(\"TEXT\" \"PLAIN\" (\"CHARSET\" \"us-ascii\") NIL NIL \"7BIT\" 12 1) 3))")
+				ExpectResponse("abcd.123 OK FETCH Completed")
+			})
+		})
 	})
 
 	Context("When logged in but no mailbox is selected", func() {
@@ -136,3 +432,27 @@ var _ = Describe("FETCH Command", func() {
 		})
 	})
 })
+
+// rawMailbox gives the messages of a mailbox the same raw content, so that
+// it can have a header which the dummy mailstore wouldn't keep as it is.
+type rawMailbox struct {
+	mailstore.Mailbox
+	content string
+}
+
+func (m rawMailbox) MessageByUID(uid uint32) mailstore.Message {
+	msg := m.Mailbox.MessageByUID(uid)
+	if msg == nil {
+		return nil
+	}
+	return rawMessage{Message: msg, content: m.content}
+}
+
+type rawMessage struct {
+	mailstore.Message
+	content string
+}
+
+func (m rawMessage) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(m.content)), nil
+}
@@ -0,0 +1,70 @@
+package conn
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jordwest/imap-server/parser"
+)
+
+// idleLine is a line sent by the client while idling
+type idleLine struct {
+	text string
+	ok   bool
+}
+
+// Handles an IDLE command (RFC 2177). Changes to the selected mailbox are
+// sent to the client as they happen until the client sends DONE.
+func cmdIdle(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	c.writeResponse("+", "idling")
+
+	// Wait for the client to end the command in the background, so that
+	// updates can be sent in the meantime
+	lines := make(chan idleLine, 1)
+	c.stopWatching()
+	c.readTimeout = c.AutologoutTimeout
+	go func() {
+		text, ok := c.ReadLine()
+		lines <- idleLine{text, ok}
+	}()
+
+	var ready <-chan struct{}
+	if c.view != nil {
+		ready = c.view.ready()
+	}
+
+	c.writeUpdates()
+	for {
+		select {
+		case <-ready:
+			c.writeUpdates()
+		case <-c.shutdown:
+			// The server is shutting down, so the client won't get to
+			// send DONE
+			c.writeResponse("", "BYE Server shutting down")
+			c.SetState(StateLoggedOut)
+			return
+		case line := <-lines:
+			if !line.ok {
+				// The client has closed the connection, or has been
+				// silent for too long
+				if c.timedOut {
+					c.autologout()
+				}
+				c.SetState(StateLoggedOut)
+				return
+			}
+			fmt.Fprintf(c.Transcript, "C: %s\n", line.text)
+			if !strings.EqualFold(strings.TrimSpace(line.text), "DONE") {
+				c.writeResponse(args.Tag, "BAD Expected DONE to end IDLE")
+				return
+			}
+			c.writeResponse(args.Tag, "OK IDLE terminated")
+			return
+		}
+	}
+}
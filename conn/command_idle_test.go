@@ -0,0 +1,104 @@
+package conn_test
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IDLE Command", func() {
+	Context("When a mailbox is selected", func() {
+		var inbox mailstore.Mailbox
+
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+
+			var err error
+			inbox, err = mStore.User.MailboxByName("INBOX")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			SendLine("abcd.122 SELECT INBOX")
+			for {
+				line, err := reader.ReadLine()
+				Expect(err).ToNot(HaveOccurred())
+				if strings.HasPrefix(line, "abcd.122 ") {
+					break
+				}
+			}
+		})
+
+		It("should end when the client sends DONE", func() {
+			SendLine("abcd.123 IDLE")
+			ExpectResponse("+ idling")
+			SendLine("DONE")
+			ExpectResponse("abcd.123 OK IDLE terminated")
+		})
+
+		It("should send new messages while idling", func() {
+			SendLine("abcd.123 IDLE")
+			ExpectResponse("+ idling")
+
+			_, err := inbox.NewMessage().SetBody(strings.NewReader("Hello\r\n")).Save()
+			Expect(err).ToNot(HaveOccurred())
+			ExpectResponse("* 4 EXISTS")
+
+			SendLine("DONE")
+			ExpectResponse("abcd.123 OK IDLE terminated")
+		})
+
+		It("should send flag changes and expunges while idling", func() {
+			SendLine("abcd.123 IDLE")
+			ExpectResponse("+ idling")
+
+			msg := inbox.MessageBySequenceNumber(2)
+			_, err := msg.AddFlags(types.FlagSeen).Save()
+			Expect(err).ToNot(HaveOccurred())
+			ExpectResponse("* 2 FETCH (FLAGS (\\Seen \\Recent))")
+
+			msg = inbox.MessageBySequenceNumber(1)
+			_, err = msg.AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			ExpectResponse("* 1 FETCH (FLAGS (\\Recent \\Deleted))")
+			_, err = inbox.DeleteFlaggedMessages()
+			Expect(err).ToNot(HaveOccurred())
+			ExpectResponse("* 1 EXPUNGE")
+
+			SendLine("DONE")
+			ExpectResponse("abcd.123 OK IDLE terminated")
+		})
+
+		It("should send changes made before IDLE in response to NOOP", func() {
+			_, err := inbox.NewMessage().SetBody(strings.NewReader("Hello\r\n")).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 NOOP")
+			ExpectResponse("* 4 EXISTS")
+			ExpectResponse("abcd.123 OK NOOP Completed")
+		})
+
+		It("should reject anything other than DONE", func() {
+			SendLine("abcd.123 IDLE")
+			ExpectResponse("+ idling")
+			SendLine("abcd.124 NOOP")
+			ExpectResponse("abcd.123 BAD Expected DONE to end IDLE")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 IDLE")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
@@ -1,20 +1,191 @@
 package conn
 
-const listArgSelector int = 1
+import (
+	"fmt"
+	"strings"
 
-func cmdList(args commandArgs, c *Conn) {
-	if !c.assertAuthenticated(args.ID()) {
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/util"
+)
+
+const (
+	listArgReference int = 0
+	listArgSelector  int = 1
+)
+
+// listEntry is a name in the mailbox hierarchy and its LIST attributes
+type listEntry struct {
+	name       string
+	attributes []string
+}
+
+func cmdList(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	reference, err := args.AString(listArgReference)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
+	selector, err := args.AString(listArgSelector)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	delimiter := mailstore.Delimiter(c.User)
+
+	if selector == "" {
+		// Blank selector requests the delimiter and the reference's root
+		c.writeResponse("", fmt.Sprintf("LIST (\\Noselect) %s %s",
+			formatDelimiter(delimiter), util.FormatString(listRoot(reference, delimiter))))
+		c.writeResponse(args.Tag, "OK LIST completed")
+		return
+	}
+
+	mailboxes, err := mailstore.MailboxesContext(c.Context(), c.User)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	pattern := listPattern(reference, selector, delimiter)
+	for _, entry := range listEntries(mailboxes, delimiter) {
+		if listMatch(pattern, entry.name, delimiter) {
+			c.writeResponse("", fmt.Sprintf("LIST (%s) %s %s", strings.Join(entry.attributes, " "),
+				formatDelimiter(delimiter), util.FormatString(entry.name)))
+		}
+	}
+	c.writeResponse(args.Tag, "OK LIST completed")
+}
+
+// listEntries returns every name in the mailbox hierarchy with its
+// attributes. Superiors which don't exist as mailboxes are included, marked
+// \Noselect, just before their first inferior.
+func listEntries(mailboxes []mailstore.Mailbox, delimiter string) []listEntry {
+	exists := make(map[string]bool, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		exists[mailbox.Name()] = true
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	hasChildren := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, mailbox := range mailboxes {
+		name := mailbox.Name()
+		if delimiter != "" {
+			levels := strings.Split(name, delimiter)
+			for i := 1; i < len(levels); i++ {
+				superior := strings.Join(levels[:i], delimiter)
+				hasChildren[superior] = true
+				add(superior)
+			}
+		}
+		add(name)
+	}
 
-	if args.Arg(listArgSelector) == "" {
-		// Blank selector means request directory separator
-		c.writeResponse("", "LIST (\\Noselect) \"/\" \"\"")
-	} else if args.Arg(listArgSelector) == "*" {
-		// List all mailboxes requested
-		for _, mailbox := range c.User.Mailboxes() {
-			c.writeResponse("", "LIST () \"/\" \""+mailbox.Name()+"\"")
+	entries := make([]listEntry, len(names))
+	for i, name := range names {
+		var attributes []string
+		if !exists[name] {
+			attributes = append(attributes, "\\Noselect")
+		}
+		switch {
+		case delimiter == "":
+			attributes = append(attributes, "\\Noinferiors")
+		case hasChildren[name]:
+			attributes = append(attributes, "\\HasChildren")
+		default:
+			attributes = append(attributes, "\\HasNoChildren")
 		}
+		entries[i] = listEntry{name: name, attributes: attributes}
+	}
+	return entries
+}
+
+// listPattern joins a reference name and a mailbox pattern, as given to LIST
+// and LSUB, into one pattern. INBOX is matched in any case.
+func listPattern(reference, pattern, delimiter string) string {
+	if delimiter != "" && strings.HasSuffix(reference, delimiter) &&
+		strings.HasPrefix(pattern, delimiter) {
+		pattern = pattern[len(delimiter):]
+	}
+	pattern = reference + pattern
+	if len(pattern) >= 5 && strings.EqualFold(pattern[:5], "INBOX") &&
+		(len(pattern) == 5 || (delimiter != "" && strings.HasPrefix(pattern[5:], delimiter))) {
+		pattern = "INBOX" + pattern[5:]
+	}
+	return pattern
+}
+
+// listMatch returns true if a mailbox name matches a LIST pattern, in which
+// "*" matches anything and "%" matches anything but the delimiter. It takes
+// time proportional to the length of the pattern times that of the name, as
+// clients choose the patterns.
+func listMatch(pattern, name, delimiter string) bool {
+	// inDelimiter marks the bytes of the name which belong to a delimiter
+	inDelimiter := make([]bool, len(name))
+	if delimiter != "" {
+		for i := 0; i+len(delimiter) <= len(name); i++ {
+			if strings.HasPrefix(name[i:], delimiter) {
+				for j := i; j < i+len(delimiter); j++ {
+					inDelimiter[j] = true
+				}
+			}
+		}
+	}
+
+	// matched[j] is true if the pattern so far matches the first j bytes of
+	// the name
+	matched := make([]bool, len(name)+1)
+	next := make([]bool, len(name)+1)
+	matched[0] = true
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '%':
+			next[0] = matched[0]
+			for j := 1; j <= len(name); j++ {
+				next[j] = matched[j] || (next[j-1] && (c == '*' || !inDelimiter[j-1]))
+			}
+		default:
+			next[0] = false
+			for j := 1; j <= len(name); j++ {
+				next[j] = matched[j-1] && name[j-1] == c
+			}
+		}
+		matched, next = next, matched
+	}
+	return matched[len(name)]
+}
+
+// listRoot returns the root of a reference name's hierarchy, which is sent
+// in answer to LIST with an empty pattern.
+func listRoot(reference, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	if i := strings.Index(reference, delimiter); i >= 0 {
+		return reference[:i+len(delimiter)]
+	}
+	return ""
+}
+
+// formatDelimiter formats a hierarchy delimiter for LIST and LSUB, which is
+// NIL if mailbox names are flat.
+func formatDelimiter(delimiter string) string {
+	if delimiter == "" {
+		return "NIL"
 	}
-	c.writeResponse(args.ID(), "OK LIST completed")
+	return util.FormatString(delimiter)
 }
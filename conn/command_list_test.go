@@ -1,10 +1,21 @@
 package conn_test
 
 import (
+	"strings"
+	"time"
+
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
+// dottedUser presents the dummy store's mailboxes with "." separating the
+// levels of the hierarchy
+type dottedUser struct{ mailstore.User }
+
+func (dottedUser) Delimiter() string { return "." }
+
 var _ = Describe("LIST Command", func() {
 	Context("When logged in", func() {
 		BeforeEach(func() {
@@ -16,14 +27,97 @@ var _ = Describe("LIST Command", func() {
 			SendLine("abcd.123 LIST \"\" \"\"")
 			ExpectResponse("* LIST (\\Noselect) \"/\" \"\"")
 			ExpectResponse("abcd.123 OK LIST completed")
+
+			SendLine("abcd.124 LIST \"Archive/2020\" \"\"")
+			ExpectResponse("* LIST (\\Noselect) \"/\" \"Archive/\"")
+			ExpectResponse("abcd.124 OK LIST completed")
 		})
 
 		It("should return the list of mailboxes", func() {
 			SendLine("abcd.123 LIST \"\" \"*\"")
-			ExpectResponse("* LIST () \"/\" \"INBOX\"")
-			ExpectResponse("* LIST () \"/\" \"Trash\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"INBOX\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"Trash\"")
 			ExpectResponse("abcd.123 OK LIST completed")
 		})
+
+		It("should match one level of the hierarchy with %", func() {
+			_, err := mStore.User.CreateMailbox("Archive/2020/Q1")
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 LIST \"\" %")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"INBOX\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"Trash\"")
+			ExpectResponse("* LIST (\\HasChildren) \"/\" \"Archive\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+
+			SendLine("abcd.124 LIST \"\" Archive/%")
+			ExpectResponse("* LIST (\\HasChildren) \"/\" \"Archive/2020\"")
+			ExpectResponse("abcd.124 OK LIST completed")
+		})
+
+		It("should join the reference name and the pattern", func() {
+			_, err := mStore.User.CreateMailbox("Archive/2020/Q1")
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 LIST \"Archive/\" *")
+			ExpectResponse("* LIST (\\HasChildren) \"/\" \"Archive/2020\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"Archive/2020/Q1\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+
+			SendLine("abcd.124 LIST \"Archive\" \"/2020/%\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"Archive/2020/Q1\"")
+			ExpectResponse("abcd.124 OK LIST completed")
+		})
+
+		It("should mark superiors which aren't mailboxes", func() {
+			_, err := mStore.User.CreateMailbox("Archive/2020")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mStore.User.DeleteMailbox("Archive")).To(Succeed())
+
+			SendLine("abcd.123 LIST \"\" Arch%")
+			ExpectResponse("* LIST (\\Noselect \\HasChildren) \"/\" \"Archive\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+		})
+
+		It("should match pathological patterns quickly", func() {
+			start := time.Now()
+			name := strings.Repeat("a", 40)
+			_, err := mStore.User.CreateMailbox(name)
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 LIST \"\" \"*a*a*a*a*a*a*a*a*a*a*b\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+
+			SendLine("abcd.124 LIST \"\" \"*a*a*a*a*a*a*a*a*a*a*\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"" + name + "\"")
+			ExpectResponse("abcd.124 OK LIST completed")
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+
+		It("should match INBOX in any case", func() {
+			SendLine("abcd.123 LIST \"\" inbox")
+			ExpectResponse("* LIST (\\HasNoChildren) \"/\" \"INBOX\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+		})
+
+		It("should use the store's hierarchy delimiter", func() {
+			_, err := mStore.User.CreateMailbox("INBOX.Sent")
+			Expect(err).ToNot(HaveOccurred())
+			tConn.User = dottedUser{mStore.User}
+
+			SendLine("abcd.123 LIST \"\" \"\"")
+			ExpectResponse("* LIST (\\Noselect) \".\" \"\"")
+			ExpectResponse("abcd.123 OK LIST completed")
+
+			SendLine("abcd.124 LIST \"\" \"INBOX.%\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \".\" \"INBOX.Sent\"")
+			ExpectResponse("abcd.124 OK LIST completed")
+
+			SendLine("abcd.125 LIST \"\" %")
+			ExpectResponse("* LIST (\\HasChildren) \".\" \"INBOX\"")
+			ExpectResponse("* LIST (\\HasNoChildren) \".\" \"Trash\"")
+			ExpectResponse("abcd.125 OK LIST completed")
+		})
 	})
 
 	Context("When not logged in", func() {
@@ -1,13 +1,42 @@
 package conn
 
+import (
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+const (
+	loginArgUsername int = 0
+	loginArgPassword int = 1
+)
+
 // Handles PLAIN text LOGIN command
-func cmdLogin(args commandArgs, c *Conn) {
-	user, err := c.Mailstore.Authenticate(args.Arg(0), args.Arg(1))
+func cmdLogin(args *parser.Command, c *Conn) {
+	if c.loginDisabled() {
+		c.writeResponse(args.Tag, "NO LOGIN is disabled until TLS is active, use STARTTLS")
+		return
+	}
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	username, err := args.AString(loginArgUsername)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	password, err := args.AString(loginArgPassword)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	user, err := mailstore.AuthenticateContext(c.Context(), c.Mailstore, username, password)
 	c.User = user
 	if err != nil {
-		c.writeResponse(args.ID(), "NO Incorrect username/password")
+		c.writeResponse(args.Tag, "NO Incorrect username/password")
 		return
 	}
 	c.SetState(StateAuthenticated)
-	c.writeResponse(args.ID(), "OK Authenticated")
+	c.writeResponse(args.Tag, "OK Authenticated")
 }
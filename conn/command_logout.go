@@ -1,8 +1,10 @@
 package conn
 
-func cmdLogout(args commandArgs, c *Conn) {
+import "github.com/jordwest/imap-server/parser"
+
+func cmdLogout(args *parser.Command, c *Conn) {
 	c.writeResponse("", "BYE IMAP4rev1 server logging out")
 	c.SetState(StateLoggedOut)
-	c.writeResponse(args.ID(), "OK LOGOUT completed")
+	c.writeResponse(args.Tag, "OK LOGOUT completed")
 	c.Close()
 }
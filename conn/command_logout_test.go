@@ -3,6 +3,7 @@ package conn_test
 import (
 	"github.com/jordwest/imap-server/conn"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("LOGOUT Command", func() {
@@ -17,6 +18,14 @@ var _ = Describe("LOGOUT Command", func() {
 			ExpectResponse("* BYE IMAP4rev1 server logging out")
 			ExpectResponse("abcd.123 OK LOGOUT completed")
 		})
+
+		It("should cancel the connection's context", func() {
+			ctx := tConn.Context()
+			SendLine("abcd.123 LOGOUT")
+			ExpectResponse("* BYE IMAP4rev1 server logging out")
+			ExpectResponse("abcd.123 OK LOGOUT completed")
+			Eventually(ctx.Done()).Should(BeClosed())
+		})
 	})
 
 	Context("When not logged in", func() {
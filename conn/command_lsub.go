@@ -1,8 +1,60 @@
 package conn
 
-func cmdLSub(args commandArgs, c *Conn) {
-	for _, mailbox := range c.User.Mailboxes() {
-		c.writeResponse("", "LSUB () \"/\" \""+mailbox.Name()+"\"")
+import (
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/util"
+)
+
+func cmdLSub(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	reference, err := args.AString(listArgReference)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	selector, err := args.AString(listArgSelector)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	delimiter := mailstore.Delimiter(c.User)
+	pattern := listPattern(reference, selector, delimiter)
+
+	manager, ok := c.User.(mailstore.SubscriptionManager)
+	if !ok {
+		// Without a subscription list, every mailbox is subscribed
+		mailboxes, err := mailstore.MailboxesContext(c.Context(), c.User)
+		if err != nil {
+			c.writeResponse(args.Tag, "NO "+err.Error())
+			return
+		}
+		for _, mailbox := range mailboxes {
+			if listMatch(pattern, mailbox.Name(), delimiter) {
+				c.writeResponse("", "LSUB () "+formatDelimiter(delimiter)+" "+util.FormatString(mailbox.Name()))
+			}
+		}
+		c.writeResponse(args.Tag, "OK LSUB Completed")
+		return
+	}
+
+	for _, name := range manager.Subscriptions() {
+		if !listMatch(pattern, name, delimiter) {
+			continue
+		}
+		// Subscribed mailboxes which no longer exist can't be selected
+		attributes := "()"
+		if _, err := mailstore.MailboxByNameContext(c.Context(), c.User, name); err != nil {
+			attributes = "(\\Noselect)"
+		}
+		c.writeResponse("", "LSUB "+attributes+" "+formatDelimiter(delimiter)+" "+util.FormatString(name))
 	}
-	c.writeResponse(args.ID(), "OK LSUB Completed")
+	c.writeResponse(args.Tag, "OK LSUB Completed")
 }
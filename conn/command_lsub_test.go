@@ -5,14 +5,27 @@ import (
 	. "github.com/onsi/ginkgo"
 )
 
-var _ = Describe("LOGIN Command", func() {
+var _ = Describe("LSUB Command", func() {
 	Context("When logged in", func() {
 		BeforeEach(func() {
 			tConn.SetState(conn.StateAuthenticated)
 			tConn.User = mStore.User
 		})
 
-		PIt("should (implement test)", func() {
+		It("should list subscribed mailboxes", func() {
+			SendLine("abcd.123 LSUB \"\" \"*\"")
+			ExpectResponse("* LSUB () \"/\" \"INBOX\"")
+			ExpectResponse("* LSUB () \"/\" \"Trash\"")
+			ExpectResponse("abcd.123 OK LSUB Completed")
+		})
+
+		It("should mark subscribed mailboxes that no longer exist", func() {
+			SendLine("abcd.123 DELETE Trash")
+			ExpectResponse("abcd.123 OK DELETE completed")
+			SendLine("abcd.124 LSUB \"\" \"*\"")
+			ExpectResponse("* LSUB () \"/\" \"INBOX\"")
+			ExpectResponse("* LSUB (\\Noselect) \"/\" \"Trash\"")
+			ExpectResponse("abcd.124 OK LSUB Completed")
 		})
 	})
 
@@ -21,7 +34,9 @@ var _ = Describe("LOGIN Command", func() {
 			tConn.SetState(conn.StateNotAuthenticated)
 		})
 
-		PIt("should give an error", func() {
+		It("should give an error", func() {
+			SendLine("abcd.123 LSUB \"\" \"*\"")
+			ExpectResponse("abcd.123 BAD not authenticated")
 		})
 	})
 })
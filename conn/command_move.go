@@ -0,0 +1,86 @@
+package conn
+
+import (
+	"fmt"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/types"
+)
+
+const (
+	moveArgRange   int = 0
+	moveArgMailbox int = 1
+)
+
+// Handles MOVE and UID MOVE (RFC 6851), which copy messages to another
+// mailbox and expunge them from the selected one
+func cmdMove(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readWrite) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	seqSet, err := args.SequenceSet(moveArgRange)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	targetMailbox, err := args.Mailbox(moveArgMailbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	mbox, err := mailstore.MailboxByNameContext(c.Context(), c.User, targetMailbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO [TRYCREATE] "+err.Error())
+		return
+	}
+
+	// Report changes made by others first, so that sequence numbers agree
+	c.writeUpdates()
+
+	msgs, err := c.messageSet(seqSet, args.UID)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	if len(msgs) == 0 {
+		// A UID set matching nothing isn't an error (RFC 3501 6.4.8)
+		if args.UID {
+			c.writeResponse(args.Tag, "OK UID MOVE completed")
+		} else {
+			c.writeResponse(args.Tag, "NO no messages found")
+		}
+		return
+	}
+
+	moved, err := mailstore.MoveMessagesContext(c.Context(), c.SelectedMailbox, msgs, mbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	srcUIDs := make([]uint32, len(msgs))
+	dstUIDs := make([]uint32, len(moved))
+	for i := range msgs {
+		srcUIDs[i] = msgs[i].UID()
+	}
+	for i := range moved {
+		dstUIDs[i] = moved[i].UID()
+	}
+	c.writeResponse("", fmt.Sprintf("OK [COPYUID %d %s %s]", mbox.UIDValidity(),
+		types.NewSequenceSet(srcUIDs), types.NewSequenceSet(dstUIDs)))
+
+	c.writeExpunged(srcUIDs)
+
+	if args.UID {
+		c.writeResponse(args.Tag, "OK UID MOVE completed")
+	} else {
+		c.writeResponse(args.Tag, "OK MOVE completed")
+	}
+}
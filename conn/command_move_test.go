@@ -0,0 +1,104 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MOVE Command", func() {
+	Context("When a mailbox is selected", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateSelected)
+			tConn.SetReadWrite()
+			tConn.User = mStore.User
+			tConn.SelectedMailbox = tConn.User.Mailboxes()[0]
+		})
+
+		It("should move messages by sequence number", func() {
+			subject := tConn.SelectedMailbox.MessageBySequenceNumber(2).Header().Get("Subject")
+
+			SendLine(`abcd.123 MOVE 2:3 "Trash"`)
+			ExpectResponse("* OK [COPYUID 251 11:12 10:11]")
+			ExpectResponse("* 2 EXPUNGE")
+			ExpectResponse("* 2 EXPUNGE")
+			ExpectResponse("abcd.123 OK MOVE completed")
+
+			Expect(tConn.SelectedMailbox.Messages()).To(Equal(uint32(1)))
+			trash, _ := tConn.User.MailboxByName("Trash")
+			Expect(trash.Messages()).To(Equal(uint32(2)))
+			Expect(trash.MessageByUID(10).Header().Get("Subject")).To(Equal(subject))
+		})
+
+		It("should move messages by UID and keep their flags", func() {
+			_, err := tConn.SelectedMailbox.MessageByUID(10).
+				AddFlags(types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine(`abcd.123 UID MOVE 10 "Trash"`)
+			ExpectResponse("* OK [COPYUID 251 10 10]")
+			ExpectResponse("* 1 EXPUNGE")
+			ExpectResponse("abcd.123 OK UID MOVE completed")
+
+			trash, _ := tConn.User.MailboxByName("Trash")
+			Expect(trash.MessageByUID(10).Flags().HasFlags(types.FlagFlagged)).To(BeTrue())
+			Expect(tConn.SelectedMailbox.MessageByUID(10)).To(BeNil())
+		})
+
+		It("should not expunge other deleted messages", func() {
+			_, err := tConn.SelectedMailbox.MessageByUID(12).
+				AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine(`abcd.123 UID MOVE 10 "Trash"`)
+			ExpectResponse("* OK [COPYUID 251 10 10]")
+			ExpectResponse("* 1 EXPUNGE")
+			ExpectResponse("abcd.123 OK UID MOVE completed")
+
+			Expect(tConn.SelectedMailbox.MessageByUID(12)).ToNot(BeNil())
+		})
+
+		It("should ask the client to create a missing mailbox", func() {
+			SendLine(`abcd.123 MOVE 1 "Missing"`)
+			ExpectResponsePattern(`^abcd\.123 NO \[TRYCREATE\]`)
+		})
+
+		It("should move nothing for UIDs matching no messages", func() {
+			SendLine(`abcd.123 UID MOVE 50:60 "Trash"`)
+			ExpectResponse("abcd.123 OK UID MOVE completed")
+
+			Expect(tConn.SelectedMailbox.Messages()).To(Equal(uint32(3)))
+		})
+
+		It("shouldn't move nonexistent messages by sequence number", func() {
+			SendLine(`abcd.123 MOVE 5 "Trash"`)
+			ExpectResponse("abcd.123 NO no messages found")
+		})
+	})
+
+	Context("When the mailbox is read-only", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateSelected)
+			tConn.SetReadOnly()
+			tConn.User = mStore.User
+			tConn.SelectedMailbox = tConn.User.Mailboxes()[0]
+		})
+
+		It("should return an error", func() {
+			SendLine(`abcd.123 MOVE 1 "Trash"`)
+			ExpectResponse("abcd.123 NO Selected mailbox is READONLY")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should return an error", func() {
+			SendLine("abcd.123 MOVE 1 INBOX")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
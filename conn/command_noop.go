@@ -1,5 +1,7 @@
 package conn
 
-func cmdNoop(args commandArgs, c *Conn) {
-	c.writeResponse(args.ID(), "OK NOOP Completed")
+import "github.com/jordwest/imap-server/parser"
+
+func cmdNoop(args *parser.Command, c *Conn) {
+	c.writeResponse(args.Tag, "OK NOOP Completed")
 }
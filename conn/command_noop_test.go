@@ -1,8 +1,12 @@
 package conn_test
 
 import (
+	"strings"
+
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("NOOP Command", func() {
@@ -12,16 +16,115 @@ var _ = Describe("NOOP Command", func() {
 			tConn.User = mStore.User
 		})
 
-		PIt("should (implement test)", func() {
+		It("should complete", func() {
+			SendLine("abcd.123 NOOP")
+			ExpectResponse("abcd.123 OK NOOP Completed")
 		})
 	})
 
-	Context("When not logged in", func() {
+	Context("When another session changes the selected mailbox", func() {
 		BeforeEach(func() {
-			tConn.SetState(conn.StateNotAuthenticated)
+			tConn.SetState(conn.StateSelected)
+			tConn.SetReadWrite()
+			tConn.User = mStore.User
+			tConn.SelectedMailbox = tConn.User.Mailboxes()[0]
+		})
+
+		JustBeforeEach(func() {
+			// Make sure the connection has taken its view of the mailbox
+			SendLine("abcd.122 NOOP")
+			ExpectResponse("abcd.122 OK NOOP Completed")
+		})
+
+		It("should report new messages", func() {
+			_, err := tConn.SelectedMailbox.NewMessage().SetBody(strings.NewReader("Hello\r\n")).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 NOOP")
+			ExpectResponse("* 4 EXISTS")
+			ExpectResponse("abcd.123 OK NOOP Completed")
+
+			SendLine("abcd.124 FETCH 4 (UID)")
+			ExpectResponse("* 4 FETCH (UID 13)")
+			ExpectResponse("abcd.124 OK FETCH Completed")
+		})
+
+		It("should report flag changes", func() {
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(3).
+				AddFlags(types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 NOOP")
+			ExpectResponse("* 3 FETCH (FLAGS (\\Recent \\Flagged))")
+			ExpectResponse("abcd.123 OK NOOP Completed")
+
+			// The change has been reported, so it isn't reported again
+			SendLine("abcd.124 NOOP")
+			ExpectResponse("abcd.124 OK NOOP Completed")
+		})
+
+		It("should report the UID and mod-sequence once CONDSTORE is used", func() {
+			SendLine("abcd.123 FETCH 1 (MODSEQ)")
+			ExpectResponse("* 1 FETCH (MODSEQ (2))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(3).
+				AddFlags(types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.124 NOOP")
+			ExpectResponse("* 3 FETCH (UID 12 MODSEQ (5) FLAGS (\\Recent \\Flagged))")
+			ExpectResponse("abcd.124 OK NOOP Completed")
 		})
 
-		PIt("should give an error", func() {
+		It("should not report its own flag changes twice", func() {
+			SendLine("abcd.123 STORE 1 +FLAGS (\\Seen)")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Seen \\Recent))")
+			ExpectResponse("abcd.123 OK STORE Completed")
+
+			SendLine("abcd.124 NOOP")
+			ExpectResponse("abcd.124 OK NOOP Completed")
+		})
+
+		It("should hold back expunges until sequence numbers may change", func() {
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(1).
+				AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.SelectedMailbox.DeleteFlaggedMessages()
+			Expect(err).ToNot(HaveOccurred())
+
+			// The client still numbers the messages as before
+			SendLine("abcd.123 FETCH 2 (UID)")
+			ExpectResponse("* 2 FETCH (UID 11)")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Recent \\Deleted))")
+			ExpectResponse("abcd.123 OK FETCH Completed")
+
+			SendLine("abcd.124 SEARCH ALL")
+			ExpectResponse("* SEARCH 2 3")
+			ExpectResponse("abcd.124 OK SEARCH Completed")
+
+			SendLine("abcd.125 NOOP")
+			ExpectResponse("* 1 EXPUNGE")
+			ExpectResponse("abcd.125 OK NOOP Completed")
+
+			SendLine("abcd.126 FETCH 1 (UID)")
+			ExpectResponse("* 1 FETCH (UID 11)")
+			ExpectResponse("abcd.126 OK FETCH Completed")
+		})
+
+		It("should announce new messages before expunging them", func() {
+			msg, err := tConn.SelectedMailbox.NewMessage().SetBody(strings.NewReader("Hello\r\n")).Save()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = msg.AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.SelectedMailbox.DeleteFlaggedMessages()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 NOOP")
+			ExpectResponse("* 4 EXISTS")
+			ExpectResponse("* 4 FETCH (FLAGS (\\Deleted))")
+			ExpectResponse("* 4 EXPUNGE")
+			ExpectResponse("abcd.123 OK NOOP Completed")
 		})
 	})
 })
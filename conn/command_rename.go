@@ -0,0 +1,51 @@
+package conn
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+const (
+	renameArgOldName int = 0
+	renameArgNewName int = 1
+)
+
+func cmdRename(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	oldName, err := args.Mailbox(renameArgOldName)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	newName, err := args.Mailbox(renameArgNewName)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	if strings.ContainsAny(newName, "*%") {
+		c.writeResponse(args.Tag, "NO Mailbox names may not contain wildcards")
+		return
+	}
+
+	manager, ok := c.User.(mailstore.MailboxManager)
+	if !ok {
+		c.writeResponse(args.Tag, "NO RENAME not supported")
+		return
+	}
+
+	err = manager.RenameMailbox(oldName, newName)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK RENAME completed")
+}
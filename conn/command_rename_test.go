@@ -0,0 +1,59 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RENAME Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should rename a mailbox and its inferiors", func() {
+			SendLine("abcd.123 CREATE Work/Projects")
+			ExpectResponse("abcd.123 OK CREATE completed")
+			SendLine("abcd.124 RENAME Work \"Old Work\"")
+			ExpectResponse("abcd.124 OK RENAME completed")
+
+			_, err := tConn.User.MailboxByName("Old Work")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.User.MailboxByName("Old Work/Projects")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.User.MailboxByName("Work")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should move the messages in INBOX when renaming INBOX", func() {
+			SendLine("abcd.123 RENAME INBOX Old/Inbox")
+			ExpectResponse("abcd.123 OK RENAME completed")
+
+			inbox, err := tConn.User.MailboxByName("INBOX")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inbox.Messages()).To(Equal(uint32(0)))
+
+			old, err := tConn.User.MailboxByName("Old/Inbox")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(old.Messages()).To(Equal(uint32(3)))
+		})
+
+		It("should not rename to an existing mailbox", func() {
+			SendLine("abcd.123 RENAME Trash INBOX")
+			ExpectResponse("abcd.123 NO Mailbox already exists")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 RENAME Trash Bin")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
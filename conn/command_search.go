@@ -0,0 +1,381 @@
+package conn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/types"
+)
+
+// searchDate is the date format used by search keys such as SINCE
+const searchDate = "2-Jan-2006"
+
+// Search keys which simply check for a flag being set or not set
+var searchFlagKeys = map[string]types.Flags{
+	"ANSWERED": types.FlagAnswered,
+	"DELETED":  types.FlagDeleted,
+	"DRAFT":    types.FlagDraft,
+	"FLAGGED":  types.FlagFlagged,
+	"RECENT":   types.FlagRecent,
+	"SEEN":     types.FlagSeen,
+}
+
+// Search keys which take a string to search for in a header field
+var searchHeaderKeys = map[string]string{
+	"BCC":     "Bcc",
+	"CC":      "Cc",
+	"FROM":    "From",
+	"SUBJECT": "Subject",
+	"TO":      "To",
+}
+
+// Search keys which take a date
+var searchDateKeys = map[string]types.SearchKey{
+	"BEFORE":     types.SearchBefore,
+	"ON":         types.SearchOn,
+	"SINCE":      types.SearchSince,
+	"SENTBEFORE": types.SearchSentBefore,
+	"SENTON":     types.SearchSentOn,
+	"SENTSINCE":  types.SearchSentSince,
+}
+
+func cmdSearch(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readOnly) {
+		return
+	}
+
+	searchArgs := args.Args
+	if len(searchArgs) >= 2 && strings.EqualFold(searchArgs[0].Value, "CHARSET") &&
+		searchArgs[0].Kind == parser.KindAtom {
+		charset, err := args.AString(1)
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		charset = strings.ToUpper(charset)
+		if charset != "US-ASCII" && charset != "UTF-8" {
+			c.writeResponse(args.Tag, "NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+			return
+		}
+		searchArgs = searchArgs[2:]
+	}
+
+	criteria, err := parseSearchCriteria(searchArgs)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	byModSeq := searchUsesModSeq(criteria)
+	if byModSeq {
+		if !c.hasModSeq() {
+			c.writeResponse(args.Tag, "BAD "+errNoModSeq)
+			return
+		}
+		c.enableCondstore()
+	}
+
+	if err = c.resolveSearchSets(criteria); err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	msgs, err := mailstore.SearchContext(c.Context(), c.SelectedMailbox, criteria)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	response := "SEARCH"
+	found := 0
+	highestModSeq := uint64(0)
+	for _, msg := range msgs {
+		// Leave out messages the client hasn't been told about yet
+		seqNo := c.sequenceNumber(msg)
+		if seqNo == 0 {
+			continue
+		}
+		if args.UID {
+			response += fmt.Sprintf(" %d", msg.UID())
+		} else {
+			response += fmt.Sprintf(" %d", seqNo)
+		}
+		if modSeq := mailstore.ModSeq(msg); modSeq > highestModSeq {
+			highestModSeq = modSeq
+		}
+		found++
+	}
+	// A search by mod-sequence also gives the highest one found (RFC 7162)
+	if byModSeq && found > 0 {
+		response += fmt.Sprintf(" (MODSEQ %d)", highestModSeq)
+	}
+	c.writeResponse("", response)
+
+	if args.UID {
+		c.writeResponse(args.Tag, "OK UID SEARCH Completed")
+	} else {
+		c.writeResponse(args.Tag, "OK SEARCH Completed")
+	}
+}
+
+// parseSearchCriteria converts the arguments of a SEARCH command into search
+// criteria. Multiple keys are combined with AND.
+func parseSearchCriteria(args []parser.Arg) (*types.SearchCriteria, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Missing search criteria")
+	}
+
+	p := &searchParser{args: args}
+	children := make([]*types.SearchCriteria, 0, len(args))
+	for p.pos < len(p.args) {
+		child, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &types.SearchCriteria{Key: types.SearchAnd, Children: children}, nil
+}
+
+type searchParser struct {
+	args []parser.Arg
+	pos  int
+}
+
+// next returns the next argument, or an error if there are none left.
+func (p *searchParser) next(key string) (parser.Arg, error) {
+	if p.pos >= len(p.args) {
+		return parser.Arg{}, fmt.Errorf("Missing argument for search key %s", key)
+	}
+	arg := p.args[p.pos]
+	p.pos++
+	return arg, nil
+}
+
+// nextString returns the next argument as an astring.
+func (p *searchParser) nextString(key string) (string, error) {
+	arg, err := p.next(key)
+	if err != nil {
+		return "", err
+	}
+	if arg.Kind == parser.KindList {
+		return "", fmt.Errorf("Expected string for search key %s, got %s", key, arg)
+	}
+	return arg.Value, nil
+}
+
+// parseKey parses a single search key and any arguments it takes.
+func (p *searchParser) parseKey() (*types.SearchCriteria, error) {
+	arg, err := p.next("")
+	if err != nil {
+		return nil, err
+	}
+
+	if arg.Kind == parser.KindList {
+		// A parenthesised list of keys, all of which must match
+		return parseSearchCriteria(arg.List)
+	}
+	if arg.Kind != parser.KindAtom {
+		return nil, fmt.Errorf("Unrecognised search key %s", arg)
+	}
+
+	// A bare sequence set
+	if len(arg.Value) > 0 && (arg.Value[0] == '*' || (arg.Value[0] >= '0' && arg.Value[0] <= '9')) {
+		set, err := types.InterpretSequenceSet(arg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sequence set %s", arg)
+		}
+		return &types.SearchCriteria{Key: types.SearchSequenceSet, Set: set}, nil
+	}
+
+	key := strings.ToUpper(arg.Value)
+
+	if flag, ok := searchFlagKeys[key]; ok {
+		return &types.SearchCriteria{Key: types.SearchFlags, Flags: flag}, nil
+	}
+	if strings.HasPrefix(key, "UN") {
+		if flag, ok := searchFlagKeys[key[2:]]; ok && key != "UNRECENT" {
+			return searchNot(&types.SearchCriteria{Key: types.SearchFlags, Flags: flag}), nil
+		}
+	}
+	if field, ok := searchHeaderKeys[key]; ok {
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		return &types.SearchCriteria{Key: types.SearchHeader, Field: field, Value: value}, nil
+	}
+	if dateKey, ok := searchDateKeys[key]; ok {
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		date, err := time.Parse(searchDate, value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date %q for search key %s", value, key)
+		}
+		return &types.SearchCriteria{Key: dateKey, Date: date}, nil
+	}
+
+	switch key {
+	case "ALL":
+		return &types.SearchCriteria{Key: types.SearchAll}, nil
+	case "NEW":
+		return &types.SearchCriteria{Key: types.SearchAnd, Children: []*types.SearchCriteria{
+			{Key: types.SearchFlags, Flags: types.FlagRecent},
+			searchNot(&types.SearchCriteria{Key: types.SearchFlags, Flags: types.FlagSeen}),
+		}}, nil
+	case "OLD":
+		return searchNot(&types.SearchCriteria{Key: types.SearchFlags, Flags: types.FlagRecent}), nil
+	case "KEYWORD", "UNKEYWORD":
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		criteria := &types.SearchCriteria{Key: types.SearchKeyword, Value: value}
+		if key == "UNKEYWORD" {
+			return searchNot(criteria), nil
+		}
+		return criteria, nil
+	case "HEADER":
+		field, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		return &types.SearchCriteria{Key: types.SearchHeader, Field: field, Value: value}, nil
+	case "BODY", "TEXT":
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		if key == "BODY" {
+			return &types.SearchCriteria{Key: types.SearchBody, Value: value}, nil
+		}
+		return &types.SearchCriteria{Key: types.SearchText, Value: value}, nil
+	case "LARGER", "SMALLER":
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size %q for search key %s", value, key)
+		}
+		if key == "LARGER" {
+			return &types.SearchCriteria{Key: types.SearchLarger, Size: uint32(size)}, nil
+		}
+		return &types.SearchCriteria{Key: types.SearchSmaller, Size: uint32(size)}, nil
+	case "MODSEQ":
+		// An entry name and type may come first. They are ignored, as all
+		// of a message's flags share its mod-sequence.
+		arg, err := p.next(key)
+		if err == nil && arg.IsString() {
+			if _, err = p.nextString(key); err == nil {
+				arg, err = p.next(key)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if arg.Kind != parser.KindAtom {
+			return nil, fmt.Errorf("Expected mod-sequence for search key %s, got %s", key, arg)
+		}
+		modSeq, err := parseModSeq(arg.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &types.SearchCriteria{Key: types.SearchModSeq, ModSeq: modSeq}, nil
+	case "UID":
+		value, err := p.nextString(key)
+		if err != nil {
+			return nil, err
+		}
+		set, err := types.InterpretSequenceSet(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid UID set %q", value)
+		}
+		return &types.SearchCriteria{Key: types.SearchUID, Set: set}, nil
+	case "NOT":
+		child, err := p.parseKeyArg(key)
+		if err != nil {
+			return nil, err
+		}
+		return searchNot(child), nil
+	case "OR":
+		first, err := p.parseKeyArg(key)
+		if err != nil {
+			return nil, err
+		}
+		second, err := p.parseKeyArg(key)
+		if err != nil {
+			return nil, err
+		}
+		return &types.SearchCriteria{Key: types.SearchOr,
+			Children: []*types.SearchCriteria{first, second}}, nil
+	}
+
+	return nil, fmt.Errorf("Unrecognised search key %s", arg)
+}
+
+// parseKeyArg parses a search key which is the argument of NOT or OR.
+func (p *searchParser) parseKeyArg(key string) (*types.SearchCriteria, error) {
+	if p.pos >= len(p.args) {
+		return nil, fmt.Errorf("Missing argument for search key %s", key)
+	}
+	return p.parseKey()
+}
+
+// resolveSearchSets replaces the sequence sets in search criteria with the
+// UIDs of the messages they refer to, as the client's sequence numbers may
+// differ from the mailbox's own while expunges are waiting to be reported.
+func (c *Conn) resolveSearchSets(criteria *types.SearchCriteria) error {
+	if criteria.Key == types.SearchSequenceSet && c.view != nil {
+		msgs, err := c.messageSet(criteria.Set, false)
+		if err != nil {
+			return err
+		}
+		uids := make([]uint32, len(msgs))
+		for i, msg := range msgs {
+			uids[i] = msg.UID()
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		criteria.Key = types.SearchUID
+		criteria.Set = types.NewSequenceSet(uids)
+	}
+	for _, child := range criteria.Children {
+		if err := c.resolveSearchSets(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchUsesModSeq returns true if the criteria include a MODSEQ key.
+func searchUsesModSeq(criteria *types.SearchCriteria) bool {
+	if criteria.Key == types.SearchModSeq {
+		return true
+	}
+	for _, child := range criteria.Children {
+		if searchUsesModSeq(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func searchNot(criteria *types.SearchCriteria) *types.SearchCriteria {
+	return &types.SearchCriteria{Key: types.SearchNot,
+		Children: []*types.SearchCriteria{criteria}}
+}
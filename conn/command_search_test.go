@@ -0,0 +1,142 @@
+package conn_test
+
+import (
+	"strings"
+
+	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SEARCH Command", func() {
+	Context("When a mailbox is selected", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateSelected)
+			tConn.SetReadWrite()
+			tConn.User = mStore.User
+			tConn.SelectedMailbox = tConn.User.Mailboxes()[0]
+		})
+
+		It("should find all messages", func() {
+			SendLine("abcd.123 SEARCH ALL")
+			ExpectResponse("* SEARCH 1 2 3")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+		})
+
+		It("should search by subject without regard to case", func() {
+			SendLine("abcd.123 search subject \"TEST EMAIL\"")
+			ExpectResponse("* SEARCH 1 2")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+		})
+
+		It("should return UIDs for UID SEARCH", func() {
+			SendLine("abcd.123 UID SEARCH CHARSET UTF-8 BODY hello")
+			ExpectResponse("* SEARCH 12")
+			ExpectResponse("abcd.123 OK UID SEARCH Completed")
+		})
+
+		It("should search by flags", func() {
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(2).
+				AddFlags(types.FlagSeen | types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 SEARCH UNSEEN")
+			ExpectResponse("* SEARCH 1 3")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+			SendLine("abcd.124 SEARCH FLAGGED SEEN")
+			ExpectResponse("* SEARCH 2")
+			ExpectResponse("abcd.124 OK SEARCH Completed")
+		})
+
+		It("should search by keyword", func() {
+			SendLine("abcd.123 STORE 1:2 +FLAGS.SILENT ($Junk)")
+			ExpectResponse("abcd.123 OK STORE Completed")
+
+			SendLine("abcd.124 SEARCH KEYWORD $junk")
+			ExpectResponse("* SEARCH 1 2")
+			ExpectResponse("abcd.124 OK SEARCH Completed")
+			SendLine("abcd.125 SEARCH UNKEYWORD $Junk")
+			ExpectResponse("* SEARCH 3")
+			ExpectResponse("abcd.125 OK SEARCH Completed")
+		})
+
+		It("should search by mod-sequence", func() {
+			SendLine("abcd.123 SEARCH MODSEQ 3")
+			ExpectResponse("* SEARCH 2 3 (MODSEQ 4)")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+			SendLine(`abcd.124 UID SEARCH MODSEQ "/flags/\\draft" all 4`)
+			ExpectResponse("* SEARCH 12 (MODSEQ 4)")
+			ExpectResponse("abcd.124 OK UID SEARCH Completed")
+			SendLine("abcd.125 SEARCH MODSEQ 5")
+			ExpectResponse("* SEARCH")
+			ExpectResponse("abcd.125 OK SEARCH Completed")
+		})
+
+		It("should combine NOT, OR and parenthesised keys", func() {
+			SendLine("abcd.123 SEARCH OR (2 UID 11) NOT (OR SUBJECT last TEXT another)")
+			ExpectResponse("* SEARCH 1 2")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+		})
+
+		It("should search by date and size", func() {
+			SendLine("abcd.123 SEARCH ON 28-Oct-2014 SENTBEFORE 1-Nov-2014 SMALLER 152")
+			ExpectResponse("* SEARCH 3")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+			SendLine("abcd.124 SEARCH SINCE 29-Oct-2014")
+			ExpectResponse("* SEARCH")
+			ExpectResponse("abcd.124 OK SEARCH Completed")
+		})
+
+		It("should use the client's sequence numbers while expunges are held back", func() {
+			SendLine("abcd.122 NOOP")
+			ExpectResponse("abcd.122 OK NOOP Completed")
+
+			_, err := tConn.SelectedMailbox.MessageBySequenceNumber(1).
+				AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.SelectedMailbox.DeleteFlaggedMessages()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tConn.SelectedMailbox.NewMessage().
+				SetBody(strings.NewReader("Hello\r\n")).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 SEARCH 1:2")
+			ExpectResponse("* SEARCH 2")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Recent \\Deleted))")
+			ExpectResponse("abcd.123 OK SEARCH Completed")
+
+			SendLine("abcd.124 SEARCH *")
+			ExpectResponse("* SEARCH 3")
+			ExpectResponse("abcd.124 OK SEARCH Completed")
+
+			// The new message hasn't been reported yet
+			SendLine("abcd.125 UID SEARCH ALL")
+			ExpectResponse("* SEARCH 11 12")
+			ExpectResponse("* 1 EXPUNGE")
+			ExpectResponse("* 3 EXISTS")
+			ExpectResponse("abcd.125 OK UID SEARCH Completed")
+		})
+
+		It("should reject unknown search keys", func() {
+			SendLine("abcd.123 SEARCH FROM me@test.com BOGUS")
+			ExpectResponse("abcd.123 BAD Unrecognised search key BOGUS")
+		})
+
+		It("should reject unsupported charsets", func() {
+			SendLine("abcd.123 SEARCH CHARSET KOI8-R ALL")
+			ExpectResponse("abcd.123 NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should return an error", func() {
+			SendLine("abcd.123 SEARCH ALL")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
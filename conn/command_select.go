@@ -1,21 +1,103 @@
 package conn
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
 
-func cmdSelect(args commandArgs, c *Conn) {
-	if !c.assertAuthenticated(args.ID()) {
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+const selectArgParams int = 1
+
+// selectParams are the parameters which may follow the mailbox name in
+// SELECT and EXAMINE, and whether each takes a value
+var selectParams = map[string]bool{
+	"CONDSTORE": false,
+	"QRESYNC":   true,
+}
+
+// selectOptions are the parameters given with SELECT or EXAMINE
+type selectOptions struct {
+	condstore bool
+	qresync   *qresyncParams // The client's cached state, if QRESYNC was given
+}
+
+// parseSelectParams reads the optional parameters of SELECT and EXAMINE.
+// QRESYNC may only be given once the client has enabled it.
+func parseSelectParams(args *parser.Command, c *Conn) (*selectOptions, error) {
+	if err := args.ExpectCount(1, 2); err != nil {
+		return nil, err
+	}
+	opts := &selectOptions{}
+	if !args.Has(selectArgParams) {
+		return opts, nil
+	}
+	list, err := args.List(selectArgParams)
+	if err != nil {
+		return nil, err
+	}
+	params, err := parseModifiers(list, selectParams)
+	if err != nil {
+		return nil, err
+	}
+	_, opts.condstore = params["CONDSTORE"]
+	if value, ok := params["QRESYNC"]; ok {
+		if !c.qresync {
+			return nil, errors.New("QRESYNC has not been enabled")
+		}
+		if opts.qresync, err = parseQresync(value); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// openMailbox selects a mailbox for SELECT or EXAMINE, and sends the client
+// its details along with any changes it asked to be resynchronised. Once
+// QRESYNC is enabled the client is told when the previous mailbox is closed,
+// so that it knows where the responses for each mailbox begin.
+func (c *Conn) openMailbox(m mailstore.Mailbox, opts *selectOptions, mode writeMode) error {
+	if c.qresync && c.SelectedMailbox != nil {
+		c.writeResponse("", "OK [CLOSED] Previous mailbox closed")
+	}
+	c.selectMailbox(m)
+	if opts.condstore {
+		c.enableCondstore()
+	}
+	c.mailboxWritable = mode
+
+	writeMailboxInfo(c, m)
+	if opts.qresync != nil {
+		return c.resync(opts.qresync)
+	}
+	return nil
+}
+
+func cmdSelect(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
 		return
 	}
 
-	var err error
-	c.SelectedMailbox, err = c.User.MailboxByName(args.Arg(0))
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	opts, err := parseSelectParams(args, c)
 	if err != nil {
-		fmt.Fprintf(c, "%s NO %s\r\n", args.ID(), err)
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
-	c.SetState(StateSelected)
-	c.SetReadWrite()
 
-	writeMailboxInfo(c, c.SelectedMailbox)
-	c.writeResponse(args.ID(), "OK [READ-WRITE] SELECT completed")
+	m, err := mailstore.MailboxByNameContext(c.Context(), c.User, mailboxName)
+	if err != nil {
+		fmt.Fprintf(c, "%s NO %s\r\n", args.Tag, err)
+		return
+	}
+	if err := c.openMailbox(m, opts, readWrite); err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK [READ-WRITE] SELECT completed")
 }
@@ -2,7 +2,9 @@ package conn_test
 
 import (
 	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/types"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("SELECT Command", func() {
@@ -20,6 +22,93 @@ var _ = Describe("SELECT Command", func() {
 			ExpectResponse("* OK [UIDNEXT 13]")
 			ExpectResponse("* OK [UIDVALIDITY 250]")
 			ExpectResponse("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)")
+			ExpectResponse("* OK [PERMANENTFLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft \\*)]")
+			ExpectResponse("* OK [HIGHESTMODSEQ 4]")
+		})
+
+		It("should give a recreated mailbox a new UIDVALIDITY", func() {
+			Expect(mStore.User.DeleteMailbox("Trash")).To(Succeed())
+			_, err := mStore.User.CreateMailbox("Trash")
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 SELECT Trash")
+			ExpectResponse("* 0 EXISTS")
+			ExpectResponse("* 0 RECENT")
+			ExpectResponse("* OK [UNSEEN 0]")
+			ExpectResponse("* OK [UIDNEXT 10]")
+			ExpectResponse("* OK [UIDVALIDITY 252]")
+		})
+
+		It("should accept the CONDSTORE parameter", func() {
+			SendLine("abcd.123 SELECT INBOX (CONDSTORE)")
+			for i := 0; i < 7; i++ {
+				ExpectResponsePattern(`^\* `)
+			}
+			ExpectResponse("* OK [HIGHESTMODSEQ 4]")
+			ExpectResponse("abcd.123 OK [READ-WRITE] SELECT completed")
+
+			SendLine("abcd.124 SELECT INBOX (BOGUS)")
+			ExpectResponse("abcd.124 BAD Unrecognised modifier BOGUS")
+		})
+
+		It("should resynchronise a mailbox with QRESYNC", func() {
+			SendLine("abcd.123 SELECT INBOX (QRESYNC (250 4))")
+			ExpectResponse("abcd.123 BAD QRESYNC has not been enabled")
+
+			inbox, err := mStore.User.MailboxByName("INBOX")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = inbox.MessageByUID(10).AddFlags(types.FlagDeleted).Save()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = inbox.DeleteFlaggedMessages()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = inbox.MessageByUID(12).AddFlags(types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.124 ENABLE QRESYNC")
+			ExpectResponse("* ENABLED QRESYNC")
+			ExpectResponse("abcd.124 OK ENABLE completed")
+
+			SendLine("abcd.125 SELECT INBOX (QRESYNC (250 4))")
+			for i := 0; i < 7; i++ {
+				ExpectResponsePattern(`^\* `)
+			}
+			ExpectResponse("* OK [HIGHESTMODSEQ 7]")
+			ExpectResponse("* VANISHED (EARLIER) 10")
+			ExpectResponse("* 2 FETCH (UID 12 MODSEQ (7) FLAGS (\\Recent \\Flagged))")
+			ExpectResponse("abcd.125 OK [READ-WRITE] SELECT completed")
+
+			// Only the known UIDs are resynchronised, and nothing is sent if
+			// UIDVALIDITY has changed
+			SendLine("abcd.126 EXAMINE INBOX (QRESYNC (250 4 11))")
+			ExpectResponse("* OK [CLOSED] Previous mailbox closed")
+			for i := 0; i < 7; i++ {
+				ExpectResponsePattern(`^\* `)
+			}
+			ExpectResponse("* OK [HIGHESTMODSEQ 7]")
+			ExpectResponse("abcd.126 OK [READ-ONLY] EXAMINE completed")
+
+			SendLine("abcd.127 SELECT INBOX (QRESYNC (1 4))")
+			ExpectResponse("* OK [CLOSED] Previous mailbox closed")
+			for i := 0; i < 7; i++ {
+				ExpectResponsePattern(`^\* `)
+			}
+			ExpectResponse("* OK [HIGHESTMODSEQ 7]")
+			ExpectResponse("abcd.127 OK [READ-WRITE] SELECT completed")
+
+			SendLine("abcd.128 SELECT INBOX (QRESYNC (250))")
+			ExpectResponse("abcd.128 BAD Invalid QRESYNC parameter (250)")
+		})
+
+		It("should accept a quoted mailbox name in any case", func() {
+			SendLine("abcd.123 SELECT \"inbox\"")
+			ExpectResponse("* 3 EXISTS")
+		})
+
+		It("should point out a malformed mailbox name", func() {
+			SendLine("abcd.123 SELECT \"INBOX")
+			ExpectResponse("abcd.123 BAD Syntax error at column 23 near \"\\\"INBOX\": unterminated quoted string")
+			SendLine("abcd.124 SELECT (INBOX)")
+			ExpectResponse("abcd.124 BAD Expected mailbox name (argument 1: (INBOX))")
 		})
 	})
 
@@ -0,0 +1,32 @@
+package conn
+
+import (
+	"fmt"
+
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdStartTLS(args *parser.Command, c *Conn) {
+	if c.TLSConfig == nil {
+		c.writeResponse(args.Tag, "BAD STARTTLS not supported")
+		return
+	}
+	if c.IsTLS() {
+		c.writeResponse(args.Tag, "BAD TLS is already active")
+		return
+	}
+	if c.state != StateNotAuthenticated {
+		c.writeResponse(args.Tag, "BAD STARTTLS is only allowed before authenticating")
+		return
+	}
+
+	// The handshake must not be read ahead into the command reader
+	c.stopWatching()
+	c.writeResponse(args.Tag, "OK Begin TLS negotiation now")
+	if err := c.startTLS(); err != nil {
+		// The connection is in an unknown state, so give up on it
+		fmt.Fprintf(c.Transcript, "TLS handshake failed: %s\n", err)
+		c.SetState(StateLoggedOut)
+		c.Close()
+	}
+}
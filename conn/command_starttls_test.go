@@ -0,0 +1,84 @@
+package conn_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/textproto"
+	"time"
+
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testTLSConfig creates a server TLS configuration with a self-signed
+// certificate.
+func testTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+}
+
+var _ = Describe("STARTTLS Command", func() {
+	Context("When TLS is configured", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+			tConn.TLSConfig = testTLSConfig()
+		})
+
+		It("should advertise STARTTLS and disable plain text login", func() {
+			SendLine("abcd.123 CAPABILITY")
+			ExpectResponse("* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE")
+			ExpectResponse("abcd.123 OK CAPABILITY completed")
+			SendLine("abcd.124 LOGIN username password")
+			ExpectResponse("abcd.124 NO LOGIN is disabled until TLS is active, use STARTTLS")
+		})
+
+		It("should upgrade the connection to TLS", func() {
+			SendLine("abcd.123 STARTTLS")
+			ExpectResponse("abcd.123 OK Begin TLS negotiation now")
+
+			tlsClient := tls.Client(mockConn.Client, &tls.Config{InsecureSkipVerify: true})
+			Expect(tlsClient.Handshake()).To(Succeed())
+			reader = textproto.NewReader(bufio.NewReader(tlsClient))
+
+			fmt.Fprintf(tlsClient, "abcd.124 CAPABILITY\r\n")
+			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE")
+			ExpectResponse("abcd.124 OK CAPABILITY completed")
+			fmt.Fprintf(tlsClient, "abcd.125 LOGIN username password\r\n")
+			ExpectResponse("abcd.125 OK Authenticated")
+			Expect(tConn.IsTLS()).To(BeTrue())
+		})
+	})
+
+	Context("When TLS is not configured", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 STARTTLS")
+			ExpectResponse("abcd.123 BAD STARTTLS not supported")
+		})
+	})
+})
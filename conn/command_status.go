@@ -1,19 +1,122 @@
 package conn
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
 
-func cmdStatus(args commandArgs, c *Conn) {
-	if !c.assertAuthenticated(args.ID()) {
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+const (
+	statusArgMailbox int = 0
+	statusArgItems   int = 1
+)
+
+// statusItem returns the value of a STATUS data item for a mailbox
+type statusItem func(c *Conn, m mailstore.Mailbox) (string, error)
+
+// statusItems are the data items which STATUS can report
+var statusItems = map[string]statusItem{
+	"MESSAGES": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		return fmt.Sprint(m.Messages()), nil
+	},
+	"RECENT": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		return fmt.Sprint(m.Recent()), nil
+	},
+	"UIDNEXT": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		return fmt.Sprint(m.NextUID()), nil
+	},
+	"UIDVALIDITY": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		return fmt.Sprint(m.UIDValidity()), nil
+	},
+	"UNSEEN": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		return fmt.Sprint(m.Unseen()), nil
+	},
+	"SIZE":          statusSize,
+	"HIGHESTMODSEQ": statusHighestModSeq,
+	"APPENDLIMIT": func(c *Conn, m mailstore.Mailbox) (string, error) {
+		if c.AppendLimit == 0 {
+			return "NIL", nil
+		}
+		return fmt.Sprint(c.AppendLimit), nil
+	},
+}
+
+// statusSize adds up the sizes of the messages in a mailbox (RFC 8438)
+func statusSize(c *Conn, m mailstore.Mailbox) (string, error) {
+	all, _ := types.InterpretSequenceSet("1:*")
+	msgs, err := mailstore.MessageSetByUIDContext(c.Context(), m, all)
+	if err != nil {
+		return "", err
+	}
+	var size uint64
+	for _, msg := range msgs {
+		size += uint64(msg.Size())
+	}
+	return fmt.Sprint(size), nil
+}
+
+// statusHighestModSeq reports the highest mod-sequence of a mailbox, which
+// is 0 for mailboxes without mod-sequences (RFC 7162)
+func statusHighestModSeq(c *Conn, m mailstore.Mailbox) (string, error) {
+	highestModSeq, _ := mailstore.HighestModSeq(m)
+	c.enableCondstore()
+	return fmt.Sprint(highestModSeq), nil
+}
+
+func cmdStatus(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(2, 2); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	mailboxName, err := args.Mailbox(statusArgMailbox)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	items, err := args.Atoms(statusArgItems)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	if len(items) == 0 {
+		c.writeResponse(args.Tag, "BAD No status items requested")
 		return
 	}
 
-	mailbox, err := c.User.MailboxByName(args.Arg(0))
+	// Every item is checked before the mailbox is looked at
+	for i, item := range items {
+		items[i] = strings.ToUpper(item)
+		if _, ok := statusItems[items[i]]; !ok {
+			c.writeResponse(args.Tag, "BAD Unknown status item "+item)
+			return
+		}
+	}
+
+	mailbox, err := mailstore.MailboxByNameContext(c.Context(), c.User, mailboxName)
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "NO "+err.Error())
 		return
 	}
 
-	c.writeResponse("", fmt.Sprintf("STATUS %s (UIDNEXT %d UNSEEN %d)",
-		mailbox.Name(), mailbox.NextUID(), mailbox.Unseen()))
-	c.writeResponse(args.ID(), "OK STATUS Completed")
+	// The items are answered in the order they were asked for
+	status := make([]string, len(items))
+	for i, item := range items {
+		value, err := statusItems[item](c, mailbox)
+		if err != nil {
+			c.writeResponse(args.Tag, "NO "+err.Error())
+			return
+		}
+		status[i] = item + " " + value
+	}
+	c.writeResponse("", fmt.Sprintf("STATUS %s (%s)",
+		util.FormatString(mailbox.Name()), strings.Join(status, " ")))
+	c.writeResponse(args.Tag, "OK STATUS Completed")
 }
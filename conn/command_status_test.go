@@ -1,8 +1,11 @@
 package conn_test
 
 import (
+	"fmt"
+
 	"github.com/jordwest/imap-server/conn"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("STATUS Command", func() {
@@ -14,8 +17,62 @@ var _ = Describe("STATUS Command", func() {
 
 		It("should respond with the status of INBOX", func() {
 			SendLine("abcd.123 STATUS INBOX (UIDNEXT UNSEEN)")
-			ExpectResponse("* STATUS INBOX (UIDNEXT 13 UNSEEN 3)")
+			ExpectResponse("* STATUS \"INBOX\" (UIDNEXT 13 UNSEEN 3)")
+			ExpectResponse("abcd.123 OK STATUS Completed")
+		})
+
+		It("should only answer the items requested, in order", func() {
+			SendLine("abcd.123 STATUS INBOX (unseen MESSAGES RECENT UIDNEXT)")
+			ExpectResponse("* STATUS \"INBOX\" (UNSEEN 3 MESSAGES 3 RECENT 3 UIDNEXT 13)")
+			ExpectResponse("abcd.123 OK STATUS Completed")
+
+			SendLine("abcd.124 STATUS Trash (UIDVALIDITY)")
+			ExpectResponse("* STATUS \"Trash\" (UIDVALIDITY 251)")
+			ExpectResponse("abcd.124 OK STATUS Completed")
+		})
+
+		It("should include HIGHESTMODSEQ if requested", func() {
+			SendLine("abcd.123 STATUS INBOX (UIDNEXT UNSEEN HIGHESTMODSEQ)")
+			ExpectResponse("* STATUS \"INBOX\" (UIDNEXT 13 UNSEEN 3 HIGHESTMODSEQ 4)")
+			ExpectResponse("abcd.123 OK STATUS Completed")
+		})
+
+		It("should report the total size of the messages", func() {
+			inbox, err := mStore.User.MailboxByName("INBOX")
+			Expect(err).ToNot(HaveOccurred())
+			size := uint32(0)
+			for uid := uint32(10); uid <= 12; uid++ {
+				size += inbox.MessageByUID(uid).Size()
+			}
+
+			SendLine("abcd.123 STATUS INBOX (SIZE)")
+			ExpectResponse(fmt.Sprintf("* STATUS \"INBOX\" (SIZE %d)", size))
+			ExpectResponse("abcd.123 OK STATUS Completed")
+		})
+
+		It("should report the append limit", func() {
+			SendLine("abcd.123 STATUS INBOX (APPENDLIMIT)")
+			ExpectResponse("* STATUS \"INBOX\" (APPENDLIMIT NIL)")
 			ExpectResponse("abcd.123 OK STATUS Completed")
+
+			tConn.AppendLimit = 1000
+			SendLine("abcd.124 STATUS INBOX (APPENDLIMIT)")
+			ExpectResponse("* STATUS \"INBOX\" (APPENDLIMIT 1000)")
+			ExpectResponse("abcd.124 OK STATUS Completed")
+		})
+
+		It("should quote the mailbox name", func() {
+			_, err := mStore.User.CreateMailbox("My \"Mail\"")
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 STATUS \"My \\\"Mail\\\"\" (MESSAGES)")
+			ExpectResponse("* STATUS \"My \\\"Mail\\\"\" (MESSAGES 0)")
+			ExpectResponse("abcd.123 OK STATUS Completed")
+		})
+
+		It("should reject unknown items", func() {
+			SendLine("abcd.123 STATUS INBOX (MESSAGES BOGUS)")
+			ExpectResponse("abcd.123 BAD Unknown status item BOGUS")
 		})
 	})
 
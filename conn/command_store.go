@@ -5,69 +5,172 @@ import (
 	"strings"
 
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 	"github.com/jordwest/imap-server/types"
 )
 
-const storeArgUID int = 0
-const storeArgRange int = 1
-const storeArgOperation int = 2
-const storeArgSilent int = 3
-const storeArgFlags int = 4
+const storeArgRange int = 0
+const storeArgItem int = 1
+const storeArgFlags int = 2
 
-func cmdStoreFlags(args commandArgs, c *Conn) {
-	if !c.assertSelected(args.ID(), readWrite) {
+// storeModifiers are the modifiers which may follow the STORE sequence set,
+// and whether each takes a value
+var storeModifiers = map[string]bool{
+	"UNCHANGEDSINCE": true,
+}
+
+func cmdStoreFlags(args *parser.Command, c *Conn) {
+	if !c.assertSelected(args.Tag, readWrite) {
 		return
 	}
 
-	operation := args.Arg(storeArgOperation)
-	flags := args.Arg(storeArgFlags)
-	uid := strings.ToUpper(args.Arg(storeArgUID)) == "UID "
-	seqSetStr := args.Arg(storeArgRange)
+	if err := args.ExpectMin(3); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	seqSet, err := args.SequenceSet(storeArgRange)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
 
+	// UNCHANGEDSINCE (RFC 7162) leaves alone messages whose flags have
+	// changed since the given mod-sequence. The modifiers come before the
+	// item, so the later arguments are shifted along.
+	itemArg, flagsArg := storeArgItem, storeArgFlags
+	unchangedSince := uint64(0)
+	hasUnchangedSince := false
+	if args.Args[storeArgItem].Kind == parser.KindList {
+		itemArg, flagsArg = itemArg+1, flagsArg+1
+		err = args.ExpectMin(flagsArg + 1)
+		var modifiers map[string]parser.Arg
+		if err == nil {
+			modifiers, err = parseModifiers(args.Args[storeArgItem].List, storeModifiers)
+		}
+		if err == nil {
+			if value, ok := modifiers["UNCHANGEDSINCE"]; ok {
+				hasUnchangedSince = true
+				unchangedSince, err = parseModSeq(value.Value)
+			}
+		}
+		if err != nil {
+			c.writeResponse(args.Tag, "BAD "+err.Error())
+			return
+		}
+		if hasUnchangedSince {
+			if !c.hasModSeq() {
+				c.writeResponse(args.Tag, "BAD "+errNoModSeq)
+				return
+			}
+			c.enableCondstore()
+		}
+	}
+
+	item, err := args.Atom(itemArg)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	// The item is one of FLAGS, +FLAGS or -FLAGS, optionally with .SILENT
+	item = strings.ToUpper(item)
+	operation := ""
+	if strings.HasPrefix(item, "+") || strings.HasPrefix(item, "-") {
+		operation = item[:1]
+		item = item[1:]
+	}
 	silent := false
-	if args.Arg(storeArgSilent) == ".SILENT" {
+	if strings.HasSuffix(item, ".SILENT") {
 		silent = true
+		item = strings.TrimSuffix(item, ".SILENT")
+	}
+	if item != "FLAGS" {
+		c.writeResponse(args.Tag, "BAD Unrecognised STORE item "+args.Args[itemArg].String())
+		return
 	}
 
-	var msgs []mailstore.Message
-	seqSet, err := types.InterpretSequenceSet(seqSetStr)
+	// Flags are given either as a parenthesised list or as separate atoms
+	var flagList []string
+	if args.Args[flagsArg].Kind == parser.KindList {
+		if err = args.ExpectCount(flagsArg+1, flagsArg+1); err == nil {
+			flagList, err = args.Atoms(flagsArg)
+		}
+	} else {
+		for i := flagsArg; i < len(args.Args) && err == nil; i++ {
+			var flag string
+			flag, err = args.Atom(i)
+			flagList = append(flagList, flag)
+		}
+	}
 	if err != nil {
-		c.writeResponse(args.ID(), "NO "+err.Error())
+		c.writeResponse(args.Tag, "BAD "+err.Error())
 		return
 	}
-	if uid {
-		msgs = c.SelectedMailbox.MessageSetByUID(seqSet)
-	} else {
-		msgs = c.SelectedMailbox.MessageSetBySequenceNumber(seqSet)
+	flagSet, err := types.ParseFlagSet(flagList)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	msgs, err := c.messageSet(seqSet, args.UID)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	// With CONDSTORE, responses carry the UID and mod-sequence, and are sent
+	// even when the client asked for silence
+	var fetchItems string
+	switch {
+	case c.condstore && silent:
+		fetchItems = "UID MODSEQ"
+	case c.condstore:
+		fetchItems = "UID MODSEQ FLAGS"
+	case !silent:
+		fetchItems = "FLAGS"
 	}
 
-	flagField := types.FlagsFromString(flags)
+	var modified []uint32
 	for _, msg := range msgs {
+		if hasUnchangedSince && mailstore.ModSeq(msg) > unchangedSince {
+			if args.UID {
+				modified = append(modified, msg.UID())
+			} else {
+				modified = append(modified, c.sequenceNumber(msg))
+			}
+			continue
+		}
 
 		if operation == "+" {
-			msg = msg.AddFlags(flagField)
+			msg = msg.AddFlags(flagSet.Flags).AddKeywords(flagSet.Keywords...)
 		} else if operation == "-" {
-			msg = msg.RemoveFlags(flagField)
+			msg = msg.RemoveFlags(flagSet.Flags).RemoveKeywords(flagSet.Keywords...)
 		} else {
-			msg = msg.OverwriteFlags(flagField)
+			msg = msg.OverwriteFlags(flagSet.Flags).
+				RemoveKeywords(msg.Keywords()...).
+				AddKeywords(flagSet.Keywords...)
 		}
-		msg.Save()
-
+		msg, err = mailstore.SaveContext(c.Context(), msg)
 		if err != nil {
-			c.writeResponse(args.ID(), "NO "+err.Error())
+			c.writeResponse(args.Tag, "NO "+err.Error())
 			return
 		}
 
+		// The client is told about its own changes below, or asked not to be
+		if c.view != nil {
+			c.view.setFlags(msg.UID(), types.FlagSet{Flags: msg.Flags(), Keywords: msg.Keywords()})
+		}
+
 		// Auto-fetch for the client
-		if !silent {
-			newFlags, err := fetch("FLAGS", c, msg)
+		if fetchItems != "" {
+			newFlags, err := fetch(fetchItems, c, msg)
 			if err != nil {
-				c.writeResponse(args.ID(), "NO "+err.Error())
+				c.writeResponse(args.Tag, "NO "+err.Error())
 				return
 			}
 
 			fetchResponse := fmt.Sprintf("%d FETCH (%s)",
-				msg.SequenceNumber(),
+				c.sequenceNumber(msg),
 				newFlags,
 			)
 
@@ -75,5 +178,10 @@ func cmdStoreFlags(args commandArgs, c *Conn) {
 		}
 	}
 
-	c.writeResponse(args.ID(), "OK STORE Completed")
+	if len(modified) > 0 {
+		c.writeResponse(args.Tag, fmt.Sprintf("OK [MODIFIED %s] Conditional STORE failed",
+			types.NewSequenceSet(modified)))
+		return
+	}
+	c.writeResponse(args.Tag, "OK STORE Completed")
 }
@@ -36,6 +36,45 @@ var _ = Describe("STORE Command", func() {
 			ExpectResponse("* 3 FETCH (FLAGS (\\Seen \\Deleted))")
 			ExpectResponse("abcd.125 OK STORE Completed")
 		})
+
+		It("should only change messages unchanged since a mod-sequence", func() {
+			_, err := tConn.SelectedMailbox.MessageByUID(12).AddFlags(types.FlagFlagged).Save()
+			Expect(err).ToNot(HaveOccurred())
+
+			SendLine("abcd.123 STORE 1:3 (UNCHANGEDSINCE 4) +FLAGS.SILENT (\\Deleted)")
+			ExpectResponse("* 1 FETCH (UID 10 MODSEQ (6))")
+			ExpectResponse("* 2 FETCH (UID 11 MODSEQ (7))")
+			ExpectResponse("abcd.123 OK [MODIFIED 3] Conditional STORE failed")
+
+			Expect(tConn.SelectedMailbox.MessageByUID(12).Flags().HasFlags(types.FlagDeleted)).
+				To(BeFalse())
+
+			SendLine("abcd.124 UID STORE 10 (UNCHANGEDSINCE 6) -FLAGS (\\Deleted)")
+			ExpectResponse("* 1 FETCH (UID 10 MODSEQ (8) FLAGS (\\Recent))")
+			ExpectResponse("abcd.124 OK STORE Completed")
+		})
+
+		It("should add, remove and replace keywords", func() {
+			SendLine("abcd.123 STORE 1 +FLAGS (\\Flagged $Junk $Label1)")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Recent \\Flagged $Junk $Label1))")
+			ExpectResponse("abcd.123 OK STORE Completed")
+
+			SendLine("abcd.124 STORE 1 -FLAGS ($junk)")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Recent \\Flagged $Label1))")
+			ExpectResponse("abcd.124 OK STORE Completed")
+
+			SendLine("abcd.125 STORE 1 FLAGS (\\Seen $Forwarded)")
+			ExpectResponse("* 1 FETCH (FLAGS (\\Seen $Forwarded))")
+			ExpectResponse("abcd.125 OK STORE Completed")
+
+			msg := tConn.SelectedMailbox.MessageBySequenceNumber(1)
+			Expect(msg.Keywords()).To(Equal([]string{"$Forwarded"}))
+		})
+
+		It("should reject unknown system flags", func() {
+			SendLine("abcd.123 STORE 1 +FLAGS (\\Bogus)")
+			ExpectResponse("abcd.123 BAD Unknown flag \\Bogus")
+		})
 	})
 
 	Context("When logged in but no mailbox is selected", func() {
@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdSubscribe(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(1, 1); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	manager, ok := c.User.(mailstore.SubscriptionManager)
+	if !ok {
+		c.writeResponse(args.Tag, "NO SUBSCRIBE not supported")
+		return
+	}
+
+	// Only allow subscribing to mailboxes that currently exist
+	if _, err = mailstore.MailboxByNameContext(c.Context(), c.User, mailboxName); err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+
+	err = manager.Subscribe(mailboxName)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK SUBSCRIBE completed")
+}
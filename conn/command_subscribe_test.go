@@ -0,0 +1,43 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("SUBSCRIBE Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should add a mailbox to the subscription list", func() {
+			SendLine("abcd.123 CREATE Lists")
+			ExpectResponse("abcd.123 OK CREATE completed")
+			SendLine("abcd.124 SUBSCRIBE Lists")
+			ExpectResponse("abcd.124 OK SUBSCRIBE completed")
+			SendLine("abcd.125 LSUB \"\" *")
+			ExpectResponse("* LSUB () \"/\" \"INBOX\"")
+			ExpectResponse("* LSUB () \"/\" \"Trash\"")
+			ExpectResponse("* LSUB () \"/\" \"Lists\"")
+			ExpectResponse("abcd.125 OK LSUB Completed")
+		})
+
+		It("should not subscribe to a mailbox that doesn't exist", func() {
+			SendLine("abcd.123 SUBSCRIBE Nothing")
+			ExpectResponse("abcd.123 NO Invalid mailbox")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 SUBSCRIBE INBOX")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+)
+
+func cmdUnsubscribe(args *parser.Command, c *Conn) {
+	if !c.assertAuthenticated(args.Tag) {
+		return
+	}
+
+	if err := args.ExpectCount(1, 1); err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+	mailboxName, err := args.Mailbox(0)
+	if err != nil {
+		c.writeResponse(args.Tag, "BAD "+err.Error())
+		return
+	}
+
+	manager, ok := c.User.(mailstore.SubscriptionManager)
+	if !ok {
+		c.writeResponse(args.Tag, "NO UNSUBSCRIBE not supported")
+		return
+	}
+
+	err = manager.Unsubscribe(mailboxName)
+	if err != nil {
+		c.writeResponse(args.Tag, "NO "+err.Error())
+		return
+	}
+	c.writeResponse(args.Tag, "OK UNSUBSCRIBE completed")
+}
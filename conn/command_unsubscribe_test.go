@@ -0,0 +1,39 @@
+package conn_test
+
+import (
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("UNSUBSCRIBE Command", func() {
+	Context("When logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateAuthenticated)
+			tConn.User = mStore.User
+		})
+
+		It("should remove a mailbox from the subscription list", func() {
+			SendLine("abcd.123 UNSUBSCRIBE INBOX")
+			ExpectResponse("abcd.123 OK UNSUBSCRIBE completed")
+			SendLine("abcd.124 LSUB \"\" *")
+			ExpectResponse("* LSUB () \"/\" \"Trash\"")
+			ExpectResponse("abcd.124 OK LSUB Completed")
+		})
+
+		It("should give an error when not subscribed", func() {
+			SendLine("abcd.123 UNSUBSCRIBE Nothing")
+			ExpectResponse("abcd.123 NO Not subscribed to mailbox")
+		})
+	})
+
+	Context("When not logged in", func() {
+		BeforeEach(func() {
+			tConn.SetState(conn.StateNotAuthenticated)
+		})
+
+		It("should give an error", func() {
+			SendLine("abcd.123 UNSUBSCRIBE INBOX")
+			ExpectResponse("abcd.123 BAD not authenticated")
+		})
+	})
+})
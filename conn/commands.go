@@ -2,91 +2,216 @@ package conn
 
 import (
 	"fmt"
+	"io"
 	"regexp"
+	"strings"
 
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 )
 
 type command struct {
-	match   *regexp.Regexp
-	handler func(commandArgs, *Conn)
+	handler func(*parser.Command, *Conn)
 }
 
-type commandArgs []string
+// Handler handles a command registered with a Registry. It must finish by
+// sending a tagged response, eg with Session.WriteResponse.
+type Handler interface {
+	ServeIMAP(s *Session, cmd *parser.Command)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(s *Session, cmd *parser.Command)
 
-func (a commandArgs) FullCommand() string {
-	return a[0]
+// ServeIMAP calls f(s, cmd).
+func (f HandlerFunc) ServeIMAP(s *Session, cmd *parser.Command) {
+	f(s, cmd)
 }
 
-func (a commandArgs) ID() string {
-	return a[1]
+// FetchHandler writes a FETCH data item registered with a Registry, as the
+// item name followed by a space and its value, eg `X-GUID "abc"`.
+type FetchHandler func(s *Session, m mailstore.Message, w io.Writer) error
+
+// Registry holds the commands and FETCH items understood by a connection,
+// so that applications can add their own, override the built in ones or
+// disable them. A Registry must not be changed while it is in use.
+type Registry struct {
+	// commands maps upper case command names to their handlers. Commands
+	// which may be prefixed with UID are registered a second time as
+	// "UID <name>".
+	commands map[string]command
+
+	// fetchParams holds the FETCH items, which are matched in order
+	fetchParams []fetchParamDefinition
+
+	// capabilities holds extra capabilities to advertise
+	capabilities []string
+}
+
+// defaultRegistry holds the built in commands and FETCH items. It is used by
+// connections which don't have their own Registry.
+var defaultRegistry = &Registry{commands: make(map[string]command)}
+
+// NewRegistry returns a new Registry containing the built in commands and
+// FETCH items.
+func NewRegistry() *Registry {
+	r := &Registry{
+		commands:     make(map[string]command, len(defaultRegistry.commands)),
+		fetchParams:  append([]fetchParamDefinition(nil), defaultRegistry.fetchParams...),
+		capabilities: append([]string(nil), defaultRegistry.capabilities...),
+	}
+	for name, cmd := range defaultRegistry.commands {
+		r.commands[name] = cmd
+	}
+	return r
 }
 
-func (a commandArgs) Arg(i int) string {
-	return a[i+2]
+// Handle registers the handler for a command, replacing any existing
+// handler. The UID form of a command is registered separately with the name
+// "UID <name>", eg "UID FETCH"; the handler can tell which form was used from
+// the command's UID field.
+func (r *Registry) Handle(name string, h Handler) {
+	r.commands[strings.ToUpper(name)] = command{handler: func(args *parser.Command, c *Conn) {
+		h.ServeIMAP(&Session{c}, args)
+	}}
+}
+
+// HandleFunc registers a function to handle a command, as Handle does.
+func (r *Registry) HandleFunc(name string, f func(s *Session, cmd *parser.Command)) {
+	r.Handle(name, HandlerFunc(f))
+}
+
+// Disable removes a command, so that clients are told it isn't understood.
+// Capabilities provided by built in commands, such as IDLE and STARTTLS,
+// are no longer advertised once the command is disabled.
+func (r *Registry) Disable(name string) {
+	delete(r.commands, strings.ToUpper(name))
+}
+
+// HandleFetch registers the handler for a FETCH item which takes no
+// arguments, replacing any existing handler for it. Items are matched case
+// insensitively.
+func (r *Registry) HandleFetch(name string, h FetchHandler) {
+	def := fetchParamDefinition{
+		name: strings.ToUpper(name),
+		re:   regexp.MustCompile("(?i)^" + regexp.QuoteMeta(name) + "$"),
+		handler: func(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+			return h(&Session{c}, m, w)
+		},
+	}
+	for i, existing := range r.fetchParams {
+		if existing.name == def.name {
+			r.fetchParams[i] = def
+			return
+		}
+	}
+	// New items are matched before the built in ones, which may match
+	// longer names starting with the same letters
+	r.fetchParams = append([]fetchParamDefinition{def}, r.fetchParams...)
 }
 
-func (a commandArgs) DebugPrint(prompt string) {
-	fmt.Printf("%s\n", prompt)
-	fmt.Printf("\tFull Command: %s\n", a.FullCommand())
-	fmt.Printf("\t.ID(): %s\n", a.ID())
-	for index, arg := range a {
-		if index < 2 {
-			continue
+// DisableFetch removes a FETCH item, so that requesting it is an error. The
+// built in items are UID, FLAGS, RFC822.SIZE, INTERNALDATE, ENVELOPE,
+// BODYSTRUCTURE, BODY, BODY[], which covers every section of the message,
+// and MODSEQ.
+func (r *Registry) DisableFetch(name string) {
+	name = strings.ToUpper(name)
+	for i, existing := range r.fetchParams {
+		if existing.name == name {
+			r.fetchParams = append(r.fetchParams[:i:i], r.fetchParams[i+1:]...)
+			return
 		}
-		fmt.Printf("\t.Arg(%d): \"%s\"\n", index-2, arg)
 	}
 }
 
-var commands []command
+// AddCapability adds a capability to those listed by the CAPABILITY
+// command, eg for a command registered with Handle.
+func (r *Registry) AddCapability(name string) {
+	r.capabilities = append(r.capabilities, name)
+}
+
+// hasCommand returns true if a command is registered
+func (r *Registry) hasCommand(name string) bool {
+	_, ok := r.commands[name]
+	return ok
+}
 
 // Register all supported client command handlers
-// with the server. This function is run on server startup and
-// panics if a command regex is invalid.
+// with the server. This function is run on server startup.
 func init() {
-	commands = make([]command, 0)
-
-	// A sequence set consists only of digits, colons, stars and commas.
-	// eg: 5,9,10:15,256:*,566
-	sequenceSet := "[\\d\\:\\*\\,]+"
-
-	registerCommand("(?i:CAPABILITY)", cmdCapability)
-	registerCommand("(?i:LOGIN) \"([A-z0-9]+)\" \"([A-z0-9]+)\"", cmdLogin)
-	registerCommand("(?i:AUTHENTICATE PLAIN)", cmdAuthPlain)
-	registerCommand("(?i:LIST) \"?([A-z0-9]+)?\"? \"?([A-z0-9*]+)?\"?", cmdList)
-	registerCommand("(?i:LSUB)", cmdLSub)
-	registerCommand("(?i:LOGOUT)", cmdLogout)
-	registerCommand("(?i:NOOP)", cmdNoop)
-	registerCommand("(?i:CLOSE)", cmdClose)
-	registerCommand("(?i:EXPUNGE)", cmdExpunge)
-	registerCommand("(?i:SELECT) \"?([A-z0-9]+)?\"?", cmdSelect)
-	registerCommand("(?i:EXAMINE) \"?([A-z0-9]+)\"?", cmdExamine)
-	registerCommand("(?i:STATUS) \"?([A-z0-9/]+)\"? \\(([A-z\\s]+)\\)", cmdStatus)
-	registerCommand("((?i)UID )?(?i:FETCH) ("+sequenceSet+") \\(([A-z0-9\\s\\(\\)\\[\\]\\.-]+)\\)", cmdFetch)
+	registerCommand("CAPABILITY", cmdCapability)
+	registerCommand("STARTTLS", cmdStartTLS)
+	registerCommand("LOGIN", cmdLogin)
+	registerCommand("AUTHENTICATE", cmdAuthPlain)
+	registerCommand("LIST", cmdList)
+	registerCommand("LSUB", cmdLSub)
+	registerCommand("LOGOUT", cmdLogout)
+	registerCommand("NOOP", cmdNoop)
+	registerCommand("IDLE", cmdIdle)
+	registerCommand("ENABLE", cmdEnable)
+	registerCommand("CLOSE", cmdClose)
+	registerCommand("EXPUNGE", cmdExpunge)
+	registerUIDCommand("EXPUNGE", cmdExpunge)
+	registerCommand("SELECT", cmdSelect)
+	registerCommand("EXAMINE", cmdExamine)
+	registerCommand("STATUS", cmdStatus)
+	registerCommand("CREATE", cmdCreate)
+	registerCommand("DELETE", cmdDelete)
+	registerCommand("RENAME", cmdRename)
+	registerCommand("SUBSCRIBE", cmdSubscribe)
+	registerCommand("UNSUBSCRIBE", cmdUnsubscribe)
 
 	// APPEND "INBOX" (\Seen) {310}
 	// APPEND "INBOX" (\Seen) "21-Jun-2015 01:00:25 +0900" {310}
 	// APPEND "INBOX" {310}
-	registerCommand("(?i:APPEND) \"?([A-z0-9/]+)\"?(?: \\(([\\\\A-z\\s]+)\\))?(?: \"([A-Za-z0-9\\-\\:\\+ ]+)\")? {([0-9]+)}", cmdAppend)
+	registerCommand("APPEND", cmdAppend)
+
+	registerCommand("FETCH", cmdFetch)
+	registerUIDCommand("FETCH", cmdFetch)
 
 	// STORE 2:4 +FLAGS (\Deleted)       Mark messages as deleted
 	// STORE 2:4 -FLAGS (\Seen)          Mark messages as unseen
 	// STORE 2:4 FLAGS (\Seen \Deleted)  Replace flags
-	registerCommand("((?i)UID )?(?i:STORE) ("+sequenceSet+") ([\\+\\-])?(?i:FLAGS(\\.SILENT)?) \\(?([\\\\A-z0-9\\s]+)\\)?", cmdStoreFlags)
+	registerCommand("STORE", cmdStoreFlags)
+	registerUIDCommand("STORE", cmdStoreFlags)
 
-	registerCommand("((?i)UID )?(?i:COPY) ("+sequenceSet+") \"?([A-z0-9]+)?\"?", cmdCopy)
+	registerCommand("COPY", cmdCopy)
+	registerUIDCommand("COPY", cmdCopy)
 
-	registerCommand("", cmdNA)
+	registerCommand("MOVE", cmdMove)
+	registerUIDCommand("MOVE", cmdMove)
+
+	registerCommand("SEARCH", cmdSearch)
+	registerUIDCommand("SEARCH", cmdSearch)
 }
 
-func registerCommand(matchExpr string, handleFunc func(commandArgs, *Conn)) error {
-	// Add command identifier to beginning of command
-	matchExpr = "([A-z0-9\\.]+) " + matchExpr
+func registerCommand(name string, handleFunc func(*parser.Command, *Conn)) {
+	defaultRegistry.commands[name] = command{handler: handleFunc}
+}
 
-	newRE := regexp.MustCompile(matchExpr)
-	c := command{match: newRE, handler: handleFunc}
-	commands = append(commands, c)
-	return nil
+// registerUIDCommand registers a handler for the UID form of a command. The
+// handler can tell which form was used by checking the command's UID field.
+func registerUIDCommand(name string, handleFunc func(*parser.Command, *Conn)) {
+	defaultRegistry.commands["UID "+name] = command{handler: handleFunc}
+}
+
+// registry returns the commands and FETCH items understood by the
+// connection.
+func (c *Conn) registry() *Registry {
+	if c.Registry != nil {
+		return c.Registry
+	}
+	return defaultRegistry
+}
+
+// lookupCommand finds the handler for a parsed command.
+func (c *Conn) lookupCommand(args *parser.Command) (command, bool) {
+	name := args.Name
+	if args.UID {
+		name = "UID " + name
+	}
+	cmd, ok := c.registry().commands[name]
+	return cmd, ok
 }
 
 // Write out the info for a mailbox (used in both SELECT and EXAMINE)
@@ -95,10 +220,20 @@ func writeMailboxInfo(c *Conn, m mailstore.Mailbox) {
 	fmt.Fprintf(c, "* %d RECENT\r\n", m.Recent())
 	fmt.Fprintf(c, "* OK [UNSEEN %d]\r\n", m.Unseen())
 	fmt.Fprintf(c, "* OK [UIDNEXT %d]\r\n", m.NextUID())
-	fmt.Fprintf(c, "* OK [UIDVALIDITY %d]\r\n", 250)
+	fmt.Fprintf(c, "* OK [UIDVALIDITY %d]\r\n", m.UIDValidity())
 	fmt.Fprintf(c, "* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n")
-}
 
-func cmdNA(args commandArgs, c *Conn) {
-	c.writeResponse(args.ID(), "BAD Not implemented")
+	// Any keyword may be stored, but nothing can be changed in a mailbox
+	// opened with EXAMINE
+	if c.mailboxWritable == readWrite {
+		fmt.Fprintf(c, "* OK [PERMANENTFLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft \\*)]\r\n")
+	} else {
+		fmt.Fprintf(c, "* OK [PERMANENTFLAGS ()]\r\n")
+	}
+
+	if highestModSeq, ok := mailstore.HighestModSeq(m); ok {
+		fmt.Fprintf(c, "* OK [HIGHESTMODSEQ %d]\r\n", highestModSeq)
+	} else {
+		fmt.Fprintf(c, "* OK [NOMODSEQ]\r\n")
+	}
 }
@@ -0,0 +1,179 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	"github.com/jordwest/imap-server/types"
+)
+
+// errNoModSeq is reported when a client uses CONDSTORE (RFC 7162) with a
+// mailbox which doesn't keep mod-sequences
+const errNoModSeq = "Mailbox does not support mod-sequences"
+
+func init() {
+	registerFetchHandler("MODSEQ", "MODSEQ$", fetchModSeq)
+}
+
+// fetchModSeq writes the mod-sequence of a message
+func fetchModSeq(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+	_, err := fmt.Fprintf(w, "MODSEQ (%d)", mailstore.ModSeq(m))
+	return err
+}
+
+// enableCondstore records that the client has used CONDSTORE. From then on
+// the UID and mod-sequence are sent with every change to a message's flags.
+func (c *Conn) enableCondstore() {
+	c.condstore = true
+}
+
+// enableQresync records that the client has enabled QRESYNC, which implies
+// CONDSTORE. From then on expunged messages are reported with VANISHED
+// rather than EXPUNGE.
+func (c *Conn) enableQresync() {
+	c.qresync = true
+	c.enableCondstore()
+}
+
+// hasModSeq returns true if the selected mailbox keeps mod-sequences.
+func (c *Conn) hasModSeq() bool {
+	_, ok := mailstore.HighestModSeq(c.SelectedMailbox)
+	return ok
+}
+
+// parseModifiers reads a parenthesised list of command modifiers, such as
+// (CHANGEDSINCE 12345), into a map of upper case names to their values.
+// Only the modifiers listed in allowed may be given; those which take a
+// value map to true. A value may be an atom or a list.
+func parseModifiers(list []parser.Arg, allowed map[string]bool) (map[string]parser.Arg, error) {
+	modifiers := make(map[string]parser.Arg, len(list))
+	for i := 0; i < len(list); i++ {
+		name := strings.ToUpper(list[i].Value)
+		takesValue, ok := allowed[name]
+		if list[i].Kind != parser.KindAtom || !ok {
+			return nil, fmt.Errorf("Unrecognised modifier %s", list[i])
+		}
+		if _, ok := modifiers[name]; ok {
+			return nil, fmt.Errorf("Modifier %s given twice", name)
+		}
+		var value parser.Arg
+		if takesValue {
+			i++
+			if i >= len(list) || (list[i].Kind != parser.KindAtom && list[i].Kind != parser.KindList) {
+				return nil, fmt.Errorf("Missing value for modifier %s", name)
+			}
+			value = list[i]
+		}
+		modifiers[name] = value
+	}
+	return modifiers, nil
+}
+
+// parseModSeq parses a mod-sequence given by a client. Mod-sequences are
+// limited to 63 bits.
+func parseModSeq(value string) (uint64, error) {
+	modSeq, err := strconv.ParseUint(value, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid mod-sequence %q", value)
+	}
+	return modSeq, nil
+}
+
+// qresyncParams are the state of a mailbox which a client has cached, as
+// given with the QRESYNC parameter of SELECT and EXAMINE
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   types.SequenceSet
+}
+
+// parseQresync reads the value of the QRESYNC parameter, which is
+// (uidvalidity modseq [known-uids [(seq-match-data)]]). The sequence match
+// data only helps servers which forget expunged messages, so its syntax is
+// checked but it is otherwise ignored.
+func parseQresync(arg parser.Arg) (*qresyncParams, error) {
+	list := arg.List
+	if arg.Kind != parser.KindList || len(list) < 2 || len(list) > 4 {
+		return nil, fmt.Errorf("Invalid QRESYNC parameter %s", arg)
+	}
+	for i := 0; i < len(list) && i < 3; i++ {
+		if list[i].Kind != parser.KindAtom {
+			return nil, fmt.Errorf("Invalid QRESYNC parameter %s", arg)
+		}
+	}
+
+	uidValidity, err := strconv.ParseUint(list[0].Value, 10, 32)
+	if err != nil || uidValidity == 0 {
+		return nil, fmt.Errorf("Invalid UIDVALIDITY %q", list[0].Value)
+	}
+	p := &qresyncParams{uidValidity: uint32(uidValidity)}
+	if p.modSeq, err = parseModSeq(list[1].Value); err != nil {
+		return nil, err
+	}
+	p.knownUIDs, _ = types.InterpretSequenceSet("1:*")
+	if len(list) > 2 {
+		if p.knownUIDs, err = types.InterpretSequenceSet(list[2].Value); err != nil {
+			return nil, fmt.Errorf("Invalid known UIDs %q", list[2].Value)
+		}
+	}
+	if len(list) > 3 {
+		match := list[3].List
+		if list[3].Kind != parser.KindList || len(match) != 2 ||
+			match[0].Kind != parser.KindAtom || match[1].Kind != parser.KindAtom {
+			return nil, fmt.Errorf("Invalid sequence match data %s", list[3])
+		}
+		for _, item := range match {
+			if _, err := types.InterpretSequenceSet(item.Value); err != nil {
+				return nil, fmt.Errorf("Invalid sequence match data %s", list[3])
+			}
+		}
+	}
+	return p, nil
+}
+
+// resync tells a client which has just selected a mailbox with QRESYNC what
+// has changed since it cached the mailbox: the messages expunged, in a
+// VANISHED (EARLIER) response, then the flags of every message changed.
+// Nothing is sent if the mailbox's UIDVALIDITY has changed, as the client
+// must then start again.
+func (c *Conn) resync(p *qresyncParams) error {
+	m := c.SelectedMailbox
+	if p.uidValidity != m.UIDValidity() || !c.hasModSeq() {
+		return nil
+	}
+
+	if err := c.writeVanishedEarlier(p.modSeq, p.knownUIDs); err != nil {
+		return err
+	}
+	msgs, err := c.messageSet(p.knownUIDs, true)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		modSeq := mailstore.ModSeq(msg)
+		if modSeq <= p.modSeq {
+			continue
+		}
+		flags := types.FlagSet{Flags: msg.Flags(), Keywords: msg.Keywords()}
+		c.writeResponse("", fmt.Sprintf("%d FETCH (UID %d MODSEQ (%d) FLAGS (%s))",
+			c.sequenceNumber(msg), msg.UID(), modSeq, flags))
+	}
+	return nil
+}
+
+// writeVanishedEarlier sends a VANISHED (EARLIER) response listing the
+// messages in a set of UIDs which have been expunged since a mod-sequence.
+func (c *Conn) writeVanishedEarlier(modSeq uint64, set types.SequenceSet) error {
+	vanished, err := mailstore.ExpungedSinceContext(c.Context(), c.SelectedMailbox, modSeq, set)
+	if err != nil {
+		return err
+	}
+	if len(vanished) > 0 {
+		c.writeResponse("", "VANISHED (EARLIER) "+vanished.String())
+	}
+	return nil
+}
@@ -2,20 +2,28 @@ package conn
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
 )
 
-type connState int
+// ConnState is the state of a client connection, as described in RFC 3501
+// section 3.
+type ConnState int
 
 const (
 	// StateNew is the initial state of a client connection; before a welcome
 	// message is sent.
-	StateNew connState = iota
+	StateNew ConnState = iota
 
 	// StateNotAuthenticated is when a welcome message has been sent but hasn't
 	// yet authenticated.
@@ -41,16 +49,71 @@ const (
 
 const lineEnding string = "\r\n"
 
+const (
+	// DefaultAutologoutTimeout is how long an authenticated client may stay
+	// silent before it is logged out. RFC 3501 requires at least 30 minutes.
+	DefaultAutologoutTimeout = 30 * time.Minute
+
+	// DefaultPreAuthTimeout is how long a client which hasn't logged in may
+	// stay silent.
+	DefaultPreAuthTimeout = time.Minute
+
+	// DefaultLiteralTimeout is how long to wait for more of a literal, once
+	// the client has been told to send it.
+	DefaultLiteralTimeout = 5 * time.Minute
+
+	// DefaultWriteTimeout is how long each write to the client may take.
+	DefaultWriteTimeout = time.Minute
+)
+
+// deadliner is implemented by connections which support timeouts, such as
+// net.Conn
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
 // Conn represents a client connection to the IMAP server
 type Conn struct {
-	state           connState
+	state           ConnState
 	Rwc             io.ReadWriteCloser
-	RwcScanner      *bufio.Scanner // Provides an interface for scanning lines from the connection
+	RwcReader       *bufio.Reader  // Buffers reads from the connection
+	commandReader   *parser.Reader // Parses commands from RwcReader
 	Transcript      io.Writer
 	Mailstore       mailstore.Mailstore // Pointer to the IMAP server's mailstore to which this connection belongs
 	User            mailstore.User
 	SelectedMailbox mailstore.Mailbox
-	mailboxWritable writeMode // True if write access is allowed to the currently selected mailbox
+	mailboxWritable writeMode       // True if write access is allowed to the currently selected mailbox
+	view            *mailboxView    // The client's view of the selected mailbox
+	condstore       bool            // Set once the client has used CONDSTORE (RFC 7162)
+	qresync         bool            // Set once the client has enabled QRESYNC (RFC 7162)
+	command         *parser.Command // The command currently being handled
+	TLSConfig       *tls.Config     // If set, clients may upgrade the connection with STARTTLS
+	Registry        *Registry       // The commands understood, or the built in ones if nil
+	AppendLimit     uint32          // The largest message APPEND accepts, or 0 for no limit (RFC 7889)
+	ctx             context.Context // Cancelled when the connection closes
+	cancel          context.CancelFunc
+	commandCtx      context.Context // Cancelled when the current command finishes
+
+	// Timeouts only apply if Rwc supports deadlines, as net.Conn does. A
+	// timeout of zero never expires. A client which times out while reading
+	// is sent BYE and disconnected.
+	AutologoutTimeout time.Duration // Silence allowed once authenticated, including during IDLE
+	PreAuthTimeout    time.Duration // Silence allowed before authenticating
+	LiteralTimeout    time.Duration // Wait for more of a literal the client was told to send
+	WriteTimeout      time.Duration // Time allowed for each write
+	readTimeout       time.Duration // The timeout for the next read
+	timedOut          bool          // Set when a read times out
+
+	readMu    sync.Mutex    // Guards watching and stopRead
+	watching  bool          // True while reading ahead to notice the client closing the connection
+	stopRead  bool          // Set to interrupt reading ahead
+	watchDone chan struct{} // Closed once reading ahead has finished
+
+	mu           sync.Mutex    // Guards waiting and shuttingDown
+	waiting      bool          // True while waiting for the next command
+	shuttingDown bool          // True once Shutdown has been called
+	shutdown     chan struct{} // Closed by Shutdown
 }
 
 // NewConn creates a new client connection. It's intended to be directly used
@@ -61,12 +124,68 @@ func NewConn(mailstore mailstore.Mailstore, netConn io.ReadWriteCloser, transcri
 	c.Mailstore = mailstore
 	c.Rwc = netConn
 	c.Transcript = transcript
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.shutdown = make(chan struct{})
+	c.AutologoutTimeout = DefaultAutologoutTimeout
+	c.PreAuthTimeout = DefaultPreAuthTimeout
+	c.LiteralTimeout = DefaultLiteralTimeout
+	c.WriteTimeout = DefaultWriteTimeout
 	return c
 }
 
+// Context returns the context of the command being handled, or of the
+// connection between commands. It is cancelled when the connection closes,
+// and should be passed to the mailstore so that work for a client which has
+// gone away can be abandoned.
+func (c *Conn) Context() context.Context {
+	if c.commandCtx != nil {
+		return c.commandCtx
+	}
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// IsTLS returns true if the connection is encrypted, either because it was
+// accepted on an implicit TLS listener or because of STARTTLS.
+func (c *Conn) IsTLS() bool {
+	_, ok := c.Rwc.(*tls.Conn)
+	return ok
+}
+
+// loginDisabled returns true if plain text authentication must wait until
+// the client has upgraded the connection with STARTTLS.
+func (c *Conn) loginDisabled() bool {
+	return c.TLSConfig != nil && !c.IsTLS()
+}
+
+// startTLS performs a TLS handshake on the connection and replaces the
+// connection's reader so that nothing sent before the handshake is read.
+func (c *Conn) startTLS() error {
+	netConn, ok := c.Rwc.(net.Conn)
+	if !ok {
+		return errors.New("Connection does not support TLS")
+	}
+
+	tlsConn := tls.Server(netConn, c.TLSConfig)
+	if c.PreAuthTimeout > 0 {
+		netConn.SetDeadline(time.Now().Add(c.PreAuthTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	c.Rwc = tlsConn
+	c.RwcReader = bufio.NewReader(connReader{c})
+	c.newCommandReader()
+	return nil
+}
+
 // SetState sets the state that an IMAP client is in. It also resets any mailbox
 // write access.
-func (c *Conn) SetState(state connState) {
+func (c *Conn) SetState(state ConnState) {
 	c.state = state
 
 	// As a precaution, reset any mailbox write access when changing states
@@ -80,29 +199,177 @@ func (c *Conn) SetReadOnly() { c.mailboxWritable = readOnly }
 // SetReadWrite sets the connection as read-write.
 func (c *Conn) SetReadWrite() { c.mailboxWritable = readWrite }
 
-func (c *Conn) handleRequest(req string) {
-	for _, cmd := range commands {
-		matches := cmd.match.FindStringSubmatch(req)
-		if len(matches) > 0 {
-			cmd.handler(matches, c)
-			return
-		}
+// selectMailbox makes a mailbox the selected mailbox and starts tracking
+// changes made to it.
+func (c *Conn) selectMailbox(m mailstore.Mailbox) {
+	c.deselectMailbox()
+	c.SelectedMailbox = m
+	c.syncView()
+	c.SetState(StateSelected)
+}
+
+// deselectMailbox clears the selected mailbox, if any.
+func (c *Conn) deselectMailbox() {
+	c.SelectedMailbox = nil
+	c.syncView()
+}
+
+func (c *Conn) handleRequest(req *parser.Command) {
+	cmd, ok := c.lookupCommand(req)
+	if !ok {
+		c.writeResponse(req.Tag, "BAD Command not understood")
+		return
 	}
 
-	c.writeResponse("", "BAD Command not understood")
+	c.syncView()
+	ctx, cancel := context.WithCancel(c.Context())
+	c.readTimeout = c.LiteralTimeout
+	c.command = req
+	c.commandCtx = ctx
+	c.watchForClose(cancel)
+	cmd.handler(req, c)
+	c.stopWatching()
+	c.command = nil
+	c.commandCtx = nil
+	cancel()
+}
+
+// Tell the client to go ahead and send a literal. The rest of the command
+// is read with LiteralTimeout, until the next command is awaited.
+func (c *Conn) sendContinuation() error {
+	c.readTimeout = c.LiteralTimeout
+	c.writeResponse("+", "go ahead, feed me your message")
+	return nil
 }
 
 // Write a response to the client. Implements io.Writer.
 func (c *Conn) Write(p []byte) (n int, err error) {
 	fmt.Fprintf(c.Transcript, "S: %s", p)
 
-	return c.Rwc.Write(p)
+	if d, ok := c.Rwc.(deadliner); ok && c.WriteTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	n, err = c.Rwc.Write(p)
+	if err != nil {
+		// The client can't be reached, or part of a response is lost, so
+		// give up on it
+		if c.cancel != nil {
+			c.cancel()
+		}
+		c.Rwc.Close()
+	}
+	return n, err
+}
+
+// connReader reads from the connection, applying the current read timeout
+// to each read.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	c := r.c
+	if d, ok := c.Rwc.(deadliner); ok {
+		// The deadline is set with readMu held so that stopWatching can't
+		// be missed
+		c.readMu.Lock()
+		deadline := time.Time{}
+		switch {
+		case c.stopRead:
+			deadline = time.Now()
+		case c.watching:
+			// Read ahead for as long as the command runs
+		case c.readTimeout > 0:
+			deadline = time.Now().Add(c.readTimeout)
+		}
+		d.SetReadDeadline(deadline)
+		c.readMu.Unlock()
+	}
+	n, err := c.Rwc.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.timedOut = true
+	}
+	return n, err
+}
+
+// watchForClose reads ahead in the background while a command runs, and
+// cancels the command if the client closes the connection, so that work for
+// a client which has gone away is abandoned. Anything which reads from the
+// client while a command runs must call stopWatching first. Nothing is done
+// unless Rwc is known to honour read deadlines, which are needed to
+// interrupt the read.
+func (c *Conn) watchForClose(cancel context.CancelFunc) {
+	if !honoursDeadlines(c.Rwc) || c.RwcReader == nil {
+		return
+	}
+	if c.RwcReader.Buffered() > 0 {
+		// The client has already sent more, so it's still there
+		return
+	}
+
+	c.readMu.Lock()
+	c.watching = true
+	c.readMu.Unlock()
+	done := make(chan struct{})
+	c.watchDone = done
+	go func() {
+		defer close(done)
+		_, err := c.RwcReader.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			fmt.Fprintf(c.Transcript, "Client closed the connection during a command\n")
+			cancel()
+		}
+	}()
+}
+
+// honoursDeadlines reports whether a read from the connection is certain to
+// return once its read deadline has passed. Other connections, including
+// wrappers which ignore deadlines, could leave a read ahead blocked forever.
+func honoursDeadlines(rwc io.ReadWriteCloser) bool {
+	switch conn := rwc.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	case *tls.Conn:
+		return honoursDeadlines(conn.NetConn())
+	}
+	return false
+}
+
+// stopWatching stops reading ahead for the client closing the connection,
+// and waits for the read to be interrupted so that the connection may be
+// read from again. Anything the client sent meanwhile stays buffered.
+func (c *Conn) stopWatching() {
+	if c.watchDone == nil {
+		return
+	}
+	c.readMu.Lock()
+	c.stopRead = true
+	c.Rwc.(deadliner).SetReadDeadline(time.Now())
+	c.readMu.Unlock()
+	<-c.watchDone
+
+	c.readMu.Lock()
+	c.watching = false
+	c.stopRead = false
+	c.readMu.Unlock()
+	c.watchDone = nil
+	c.timedOut = false
+}
+
+// autologout tells a client which has timed out that it's being
+// disconnected.
+func (c *Conn) autologout() {
+	fmt.Fprintf(c.Transcript, "Client timed out\n")
+	c.writeResponse("", "BYE Autologout; idle for too long")
 }
 
 // Write a response to the client.
 func (c *Conn) writeResponse(seq string, command string) {
 	if seq == "" {
 		seq = "*"
+	} else if seq != "+" {
+		// Report changes to the selected mailbox before completing a command
+		c.writeUpdates()
 	}
 	// Ensure the command is terminated with a line ending
 	if !strings.HasSuffix(command, lineEnding) {
@@ -157,42 +424,108 @@ func (c *Conn) assertSelected(seq string, writable writeMode) bool {
 	return true
 }
 
-// Close forces the server to close the client's connection.
+// Close forces the server to close the client's connection. Any command in
+// progress is interrupted. It may be called from any goroutine.
 func (c *Conn) Close() error {
 	fmt.Fprintf(c.Transcript, "Server closing connection\n")
+	if c.cancel != nil {
+		c.cancel()
+	}
 	return c.Rwc.Close()
 }
 
+// Shutdown tells the client that the server is shutting down and closes the
+// connection, without interrupting a command in progress. If a command is
+// being handled the connection is closed once it completes, except that IDLE
+// is ended straight away. It may be called from any goroutine, and returns
+// without waiting for the connection to close.
+func (c *Conn) Shutdown() {
+	c.mu.Lock()
+	if c.shuttingDown {
+		c.mu.Unlock()
+		return
+	}
+	c.shuttingDown = true
+	if c.shutdown != nil {
+		close(c.shutdown)
+	}
+	waiting := c.waiting
+	c.mu.Unlock()
+
+	if waiting {
+		// A client which isn't reading would hold up the caller until the
+		// write times out, so the goodbye is said in the background
+		go func() {
+			c.writeResponse("", "BYE Server shutting down")
+			c.Close()
+		}()
+	}
+}
+
+// setWaiting records whether the connection is waiting for a command, which
+// is when Shutdown may close it straight away. It returns false if the
+// connection is shutting down.
+func (c *Conn) setWaiting(waiting bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.waiting = waiting
+	return true
+}
+
 // ReadLine awaits a single line from the client.
 func (c *Conn) ReadLine() (text string, ok bool) {
-	ok = c.RwcScanner.Scan()
-	return c.RwcScanner.Text(), ok
+	c.stopWatching()
+	line, err := c.RwcReader.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
 }
 
-// ReadFixedLength reads data from the connection up to the specified length.
-func (c *Conn) ReadFixedLength(length int) (data []byte, err error) {
-	// Read the whole message into a buffer
-	data = make([]byte, length)
-	receivedLength := 0
-	for receivedLength < length {
-		bytesRead, err := c.Rwc.Read(data[receivedLength:])
-		if err != nil {
-			return data, err
-		}
-		receivedLength += bytesRead
+// newCommandReader starts parsing commands from RwcReader. The message
+// literal of APPEND is streamed into the mailbox rather than being read into
+// memory first.
+func (c *Conn) newCommandReader() {
+	c.commandReader = parser.NewReader(c.RwcReader, c.sendContinuation)
+	c.commandReader.StreamLiteral = func(cmd *parser.Command) bool {
+		return cmd.Name == "APPEND" && len(cmd.Args) > 0
 	}
-
-	return data, nil
 }
 
 // Start tells the server to start communicating with the client (after
 // the connection has been opened).
 func (c *Conn) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the context given to the mailstore is
+// derived from ctx, so cancelling ctx cancels any work in progress for the
+// client. The context is also cancelled when the connection closes.
+func (c *Conn) StartContext(ctx context.Context) error {
 	if c.Rwc == nil {
 		return errors.New("No connection exists")
 	}
+	if c.cancel == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	defer func() {
+		c.cancel()
+		c.deselectMailbox()
+		c.Rwc.Close()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.cancel()
+		case <-c.ctx.Done():
+		}
+	}()
 
-	c.RwcScanner = bufio.NewScanner(c.Rwc)
+	c.RwcReader = bufio.NewReader(connReader{c})
+	c.newCommandReader()
 
 	for c.state != StateLoggedOut {
 		// Always send welcome message if we are still in new connection state
@@ -200,19 +533,41 @@ func (c *Conn) Start() error {
 			c.sendWelcome()
 		}
 
+		if !c.setWaiting(true) {
+			// Shutdown was called while a command was being handled
+			c.writeResponse("", "BYE Server shutting down")
+			break
+		}
+
 		// Await requests from the client
-		req, ok := c.ReadLine()
-		if !ok {
+		c.readTimeout = c.AutologoutTimeout
+		if c.state == StateNotAuthenticated {
+			c.readTimeout = c.PreAuthTimeout
+		}
+		req, err := c.commandReader.ReadCommand()
+		if !c.setWaiting(false) {
+			// Shutdown has already said goodbye and closed the connection
+			break
+		}
+		if raw := c.commandReader.Raw(); raw != "" {
+			fmt.Fprintf(c.Transcript, "C: %s\n", raw)
+		}
+		if syntaxErr, ok := err.(*parser.SyntaxError); ok {
+			// Reply to the command if we managed to get its tag
+			c.writeResponse(req.Tag, "BAD "+syntaxErr.Error())
+			continue
+		}
+		if err != nil {
+			if c.timedOut {
+				c.autologout()
+			} else if err != io.EOF {
+				fmt.Fprintf(c.Transcript, "Read error: %s\n", err)
+			}
 			// The client has closed the connection
 			c.state = StateLoggedOut
 			break
 		}
-		fmt.Fprintf(c.Transcript, "C: %s\n", req)
 		c.handleRequest(req)
-
-		if c.RwcScanner.Err() != nil {
-			fmt.Fprintf(c.Transcript, "Scan error: %s\n", c.RwcScanner.Err())
-		}
 	}
 
 	return nil
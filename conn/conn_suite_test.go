@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net/textproto"
 	"strings"
 
@@ -51,6 +52,16 @@ func ExpectResponsePattern(pattern string) {
 	Expect(response, err).To(MatchRegexp(pattern))
 }
 
+// MessageContent reads the whole content of a message
+func MessageContent(msg mailstore.Message) string {
+	r, err := msg.Open()
+	Expect(err).ToNot(HaveOccurred())
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	Expect(err).ToNot(HaveOccurred())
+	return string(content)
+}
+
 // === SETUP ====
 var _ = BeforeEach(func() {
 	mStore = mailstore.NewDummyMailstore()
@@ -0,0 +1,28 @@
+package conn_test
+
+import (
+	"time"
+
+	"github.com/jordwest/imap-server/conn"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	BeforeEach(func() {
+		tConn.SetState(conn.StateAuthenticated)
+		tConn.User = mStore.User
+	})
+
+	It("should not wait for the client to read the goodbye", func() {
+		// Make sure the connection is waiting for a command
+		SendLine("abcd.123 NOOP")
+		ExpectResponse("abcd.123 OK NOOP Completed")
+
+		// Nothing is read from the connection until Shutdown returns
+		start := time.Now()
+		tConn.Shutdown()
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		ExpectResponse("* BYE Server shutting down")
+	})
+})
@@ -0,0 +1,245 @@
+package conn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/util"
+)
+
+// sectionRE matches the FETCH items BODY[section]<origin.octets> and
+// BODY.PEEK[section]<origin.octets>, as defined in RFC 3501 section 6.4.5.
+// The submatches are the section, the origin and the number of octets.
+const sectionRE = "BODY(?:\\.PEEK)?\\[(" +
+	"(?:\\d+(?:\\.\\d+)*(?:\\.(?:MIME|HEADER|TEXT|HEADER\\.FIELDS(?:\\.NOT)? \\([^)]*\\)))?)|" +
+	"(?:HEADER|TEXT|HEADER\\.FIELDS(?:\\.NOT)? \\([^)]*\\))|" +
+	")\\](?:<(\\d+)\\.(\\d+)>)?$"
+
+// sectionSpec is a parsed section specification, eg "1.2.HEADER"
+type sectionSpec struct {
+	// name is the specification formatted for the response
+	name string
+	// path holds the part numbers
+	path []int
+	// text is what to return from the part, eg HEADER or TEXT
+	text string
+	// fields holds the field names for HEADER.FIELDS and HEADER.FIELDS.NOT
+	fields []string
+}
+
+// fetchSection writes a section of a message, or part of one. The whole
+// message, its header, fields of its header and its text are read straight
+// from the message content, so large messages are never held in memory.
+// Sections of parts need the message to be parsed.
+func fetchSection(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+	spec := parseSectionSpec(args[1])
+
+	var data io.Reader
+	var size int64
+	ok := true
+	switch {
+	case len(spec.path) > 0:
+		root, err := parseMessage(c.Context(), m)
+		if err != nil {
+			return err
+		}
+		var section string
+		section, ok = spec.find(root)
+		data, size = strings.NewReader(section), int64(len(section))
+
+	default:
+		r, err := mailstore.OpenContext(c.Context(), m)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, size = r, int64(m.Size())
+
+		if spec.text != "" {
+			br := bufio.NewReader(r)
+			header, n, err := util.ReadHeader(br)
+			if err != nil {
+				return err
+			}
+			switch {
+			case spec.text == "HEADER":
+				header += "\r\n"
+				data, size = strings.NewReader(header), int64(len(header))
+			case strings.HasPrefix(spec.text, "HEADER.FIELDS"):
+				section, _ := spec.find(&util.MIMEPart{RawHeader: header})
+				data, size = strings.NewReader(section), int64(len(section))
+			default:
+				data, size = br, size-n
+			}
+		}
+	}
+
+	response := "BODY[" + spec.name + "]"
+	if args[2] != "" {
+		origin, _ := strconv.ParseInt(args[2], 10, 64)
+		octets, _ := strconv.ParseInt(args[3], 10, 64)
+		response += fmt.Sprintf("<%d>", origin)
+
+		if origin > size {
+			origin = size
+		}
+		if octets > size-origin {
+			octets = size - origin
+		}
+		if _, err := io.CopyN(ioutil.Discard, data, origin); err != nil {
+			return err
+		}
+		size = octets
+	}
+
+	if !ok {
+		_, err := io.WriteString(w, response+" NIL")
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+	if _, err := fmt.Fprintf(w, "%s {%d}\r\n", response, size); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, data, size)
+	return err
+}
+
+// parseSectionSpec parses a section specification matched by sectionRE.
+func parseSectionSpec(spec string) sectionSpec {
+	// The specification starts with the part numbers
+	var s sectionSpec
+	var path []string
+	rest := spec
+	for rest != "" {
+		segment := rest
+		if i := strings.IndexByte(rest, '.'); i >= 0 {
+			segment = rest[:i]
+		}
+		n, err := strconv.Atoi(segment)
+		if err != nil {
+			break
+		}
+		path = append(path, segment)
+		s.path = append(s.path, n)
+		rest = strings.TrimPrefix(rest[len(segment):], ".")
+	}
+
+	// And is followed by what to return from the part
+	text, fields := rest, ""
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		text, fields = rest[:i], rest[i+1:]
+	}
+	s.text = strings.ToUpper(text)
+
+	s.name = strings.Join(path, ".")
+	if s.text != "" {
+		if s.name != "" {
+			s.name += "."
+		}
+		s.name += s.text
+	}
+
+	if strings.HasPrefix(s.text, "HEADER.FIELDS") {
+		names := strings.Fields(strings.Trim(fields, "()"))
+		quoted := make([]string, len(names))
+		for i, field := range names {
+			names[i] = strings.Trim(field, "\"")
+			quoted[i] = "\"" + names[i] + "\""
+		}
+		s.fields = names
+		s.name += " (" + strings.Join(quoted, " ") + ")"
+	}
+	return s
+}
+
+// find returns the content of the section in a parsed message. If the
+// section doesn't exist ok is false.
+func (s sectionSpec) find(root *util.MIMEPart) (data string, ok bool) {
+	part := root
+	for i, n := range s.path {
+		if i == 0 && root.Type != "multipart" {
+			// The only part of a message which isn't multipart is its body,
+			// even when the body is itself a message
+			if n != 1 {
+				return "", false
+			}
+			continue
+		}
+		if part = part.Part(n); part == nil {
+			return "", false
+		}
+	}
+
+	// HEADER and TEXT refer to a whole message, which is either the
+	// message being fetched or one encapsulated in a message/rfc822 part
+	msg := root
+	if len(s.path) > 0 {
+		msg = part.Message
+	}
+
+	switch {
+	case s.text == "" && len(s.path) == 0:
+		return root.RawHeader + "\r\n" + root.Body, true
+	case s.text == "":
+		return part.Body, true
+	case s.text == "MIME":
+		return part.RawHeader + "\r\n", true
+	case msg == nil:
+		// Only message/rfc822 parts have a header and text
+		return "", false
+	case s.text == "HEADER":
+		return msg.RawHeader + "\r\n", true
+	case s.text == "TEXT":
+		return msg.Body, true
+	case s.text == "HEADER.FIELDS":
+		return headerFields(msg.RawHeader, s.fields, true) + "\r\n", true
+	}
+	return headerFields(msg.RawHeader, s.fields, false) + "\r\n", true
+}
+
+// headerFields returns the fields of a raw header whose names are given, or
+// if keep is false those whose names aren't. Fields are returned as they
+// appear in the header, in the same order and with their folded
+// continuation lines, and repeated fields are all returned.
+func headerFields(raw string, names []string, keep bool) string {
+	named := make(map[string]bool)
+	for _, name := range names {
+		named[strings.ToLower(name)] = true
+	}
+
+	var buf strings.Builder
+	include := false
+	for rest := raw; rest != ""; {
+		line := rest
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		// A line starting with white space continues the field before it
+		if line[0] != ' ' && line[0] != '\t' {
+			i := strings.IndexByte(line, ':')
+			if i < 0 {
+				// Malformed lines are left out, as they are when parsed
+				include = false
+				continue
+			}
+			name := strings.ToLower(strings.TrimRight(line[:i], " \t"))
+			include = named[name] == keep
+		}
+		if include {
+			buf.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				buf.WriteString("\r\n")
+			}
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,231 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/util"
+)
+
+// parseMessage reads a whole message and parses its MIME structure.
+func parseMessage(ctx context.Context, m mailstore.Message) (*util.MIMEPart, error) {
+	r, err := mailstore.OpenContext(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return util.ParseMIMEMessage(string(raw)), nil
+}
+
+func fetchEnvelope(args []string, c *Conn, m mailstore.Message, peekOnly bool) string {
+	return "ENVELOPE " + formatEnvelope(m.Header())
+}
+
+func fetchBodyStructure(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+	p, err := parseMessage(c.Context(), m)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "BODYSTRUCTURE "+formatBodyStructure(p, true))
+	return err
+}
+
+// The non-extensible form of BODYSTRUCTURE
+func fetchBodyNonExtensible(args []string, c *Conn, m mailstore.Message, peekOnly bool, w io.Writer) error {
+	p, err := parseMessage(c.Context(), m)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "BODY "+formatBodyStructure(p, false))
+	return err
+}
+
+// formatEnvelope formats the envelope structure of a message from its
+// header, as described in RFC 3501 section 7.4.2.
+func formatEnvelope(hdr textproto.MIMEHeader) string {
+	from := hdr.Get("From")
+	sender := hdr.Get("Sender")
+	if sender == "" {
+		sender = from
+	}
+	replyTo := hdr.Get("Reply-To")
+	if replyTo == "" {
+		replyTo = from
+	}
+
+	fields := []string{
+		util.FormatNString(hdr.Get("Date")),
+		util.FormatNString(hdr.Get("Subject")),
+		formatAddressList(from),
+		formatAddressList(sender),
+		formatAddressList(replyTo),
+		formatAddressList(hdr.Get("To")),
+		formatAddressList(hdr.Get("Cc")),
+		formatAddressList(hdr.Get("Bcc")),
+		util.FormatNString(hdr.Get("In-Reply-To")),
+		util.FormatNString(hdr.Get("Message-Id")),
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// formatAddressList formats an address header as a list of address
+// structures, or NIL if it is empty or can't be parsed.
+func formatAddressList(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = formatAddress(addr)
+	}
+	return "(" + strings.Join(formatted, "") + ")"
+}
+
+// formatAddress formats a single address as (name adl mailbox host).
+func formatAddress(addr *mail.Address) string {
+	// Names are sent as they would appear in a header, so any non-ASCII
+	// characters are encoded again
+	name := addr.Name
+	for _, r := range name {
+		if r > 0x7f {
+			name = mime.QEncoding.Encode("utf-8", name)
+			break
+		}
+	}
+
+	mailbox, host := addr.Address, ""
+	if i := strings.LastIndex(mailbox, "@"); i >= 0 {
+		mailbox, host = mailbox[:i], mailbox[i+1:]
+	}
+
+	return fmt.Sprintf("(%s NIL %s %s)",
+		util.FormatNString(name),
+		util.FormatNString(mailbox),
+		util.FormatNString(host))
+}
+
+// formatBodyStructure formats the body structure of a MIME part, as
+// described in RFC 3501 section 7.4.2. Extension data is only included if
+// extended is set, as the BODY fetch item leaves it out.
+func formatBodyStructure(p *util.MIMEPart, extended bool) string {
+	if p.Type == "multipart" {
+		var parts string
+		for _, child := range p.Parts {
+			parts += formatBodyStructure(child, extended)
+		}
+		fields := []string{util.FormatString(strings.ToUpper(p.Subtype))}
+		if extended {
+			fields = append(fields,
+				formatBodyParams(p.Params),
+				formatDisposition(p.Header),
+				formatLanguage(p.Header),
+				util.FormatNString(p.Header.Get("Content-Location")))
+		}
+		return "(" + parts + " " + strings.Join(fields, " ") + ")"
+	}
+
+	encoding := strings.ToUpper(p.Header.Get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fields := []string{
+		util.FormatString(strings.ToUpper(p.Type)),
+		util.FormatString(strings.ToUpper(p.Subtype)),
+		formatBodyParams(p.Params),
+		util.FormatNString(p.Header.Get("Content-Id")),
+		util.FormatNString(p.Header.Get("Content-Description")),
+		util.FormatString(encoding),
+		fmt.Sprintf("%d", len(p.Body)),
+	}
+
+	switch {
+	case p.Type == "text":
+		fields = append(fields, fmt.Sprintf("%d", p.Lines()))
+	case p.Message != nil:
+		fields = append(fields,
+			formatEnvelope(p.Message.Header),
+			formatBodyStructure(p.Message, extended),
+			fmt.Sprintf("%d", p.Lines()))
+	}
+
+	if extended {
+		fields = append(fields,
+			util.FormatNString(p.Header.Get("Content-Md5")),
+			formatDisposition(p.Header),
+			formatLanguage(p.Header),
+			util.FormatNString(p.Header.Get("Content-Location")))
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// formatBodyParams formats Content-Type or Content-Disposition parameters as
+// a list of names and values, sorted by name.
+func formatBodyParams(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, 0, len(params)*2)
+	for _, name := range names {
+		formatted = append(formatted,
+			util.FormatString(strings.ToUpper(name)),
+			util.FormatString(params[name]))
+	}
+	return "(" + strings.Join(formatted, " ") + ")"
+}
+
+// formatDisposition formats the Content-Disposition of a part, or NIL if it
+// has none.
+func formatDisposition(hdr textproto.MIMEHeader) string {
+	value := hdr.Get("Content-Disposition")
+	if value == "" {
+		return "NIL"
+	}
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil && disposition == "" {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)",
+		util.FormatString(strings.ToUpper(disposition)),
+		formatBodyParams(params))
+}
+
+// formatLanguage formats the Content-Language of a part, which may list
+// several languages.
+func formatLanguage(hdr textproto.MIMEHeader) string {
+	var languages []string
+	for _, language := range strings.Split(hdr.Get("Content-Language"), ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, util.FormatString(language))
+		}
+	}
+	switch len(languages) {
+	case 0:
+		return "NIL"
+	case 1:
+		return languages[0]
+	}
+	return "(" + strings.Join(languages, " ") + ")"
+}
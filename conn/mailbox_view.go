@@ -0,0 +1,289 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/types"
+)
+
+// mailboxView tracks the messages of the selected mailbox as the client
+// currently knows them. Sequence numbers sent by the client refer to the
+// view rather than to the mailbox, which may have changed since the client
+// was last told about it. Changes made by other connections are held until
+// they may be reported, at which point the view is brought up to date.
+type mailboxView struct {
+	mailbox mailstore.Mailbox
+	watcher *mailstore.Watcher
+
+	// uids holds the UID of each message the client knows about, in
+	// sequence number order. As UIDs are strictly ascending it can be
+	// binary searched.
+	uids  []uint32
+	flags map[uint32]types.FlagSet
+
+	// pending holds updates collected from the watcher which haven't been
+	// reported to the client yet
+	pending []mailstore.Update
+}
+
+// newMailboxView takes a snapshot of the mailbox and starts watching it for
+// changes, if the mailbox supports it.
+func newMailboxView(m mailstore.Mailbox) *mailboxView {
+	v := &mailboxView{
+		mailbox: m,
+		uids:    make([]uint32, 0, m.Messages()),
+		flags:   make(map[uint32]types.FlagSet),
+	}
+	if notifier, ok := m.(mailstore.Notifier); ok {
+		v.watcher = notifier.Watch()
+	}
+
+	count := m.Messages()
+	for seqNo := uint32(1); seqNo <= count; seqNo++ {
+		msg := m.MessageBySequenceNumber(seqNo)
+		if msg == nil {
+			continue
+		}
+		v.uids = append(v.uids, msg.UID())
+		v.flags[msg.UID()] = types.FlagSet{Flags: msg.Flags(), Keywords: msg.Keywords()}
+	}
+	return v
+}
+
+// close stops watching the mailbox for changes.
+func (v *mailboxView) close() {
+	if v.watcher != nil {
+		v.watcher.Close()
+	}
+}
+
+// ready returns a channel that receives a value when there are changes to
+// report. It returns nil if the mailbox can't be watched.
+func (v *mailboxView) ready() <-chan struct{} {
+	if v.watcher == nil {
+		return nil
+	}
+	return v.watcher.Ready()
+}
+
+// sequenceNumber returns the sequence number of a UID as known by the client,
+// or 0 if the client doesn't know about the message.
+func (v *mailboxView) sequenceNumber(uid uint32) uint32 {
+	i := sort.Search(len(v.uids), func(i int) bool { return v.uids[i] >= uid })
+	if i < len(v.uids) && v.uids[i] == uid {
+		return uint32(i) + 1
+	}
+	return 0
+}
+
+// setFlags records flags which have been sent to the client, so that the
+// same change isn't reported again.
+func (v *mailboxView) setFlags(uid uint32, flags types.FlagSet) {
+	if _, ok := v.flags[uid]; ok {
+		v.flags[uid] = flags
+	}
+}
+
+// expunge removes a message from the view and returns the sequence number it
+// had, or 0 if the client didn't know about the message.
+func (v *mailboxView) expunge(uid uint32) uint32 {
+	seqNo := v.sequenceNumber(uid)
+	if seqNo != 0 {
+		v.uids = append(v.uids[:seqNo-1], v.uids[seqNo:]...)
+		delete(v.flags, uid)
+	}
+	return seqNo
+}
+
+// messagesBySequenceNumber returns the messages in the set, numbered as the
+// client knows them. Messages which have been expunged by another connection
+// but not yet reported are skipped.
+func (v *mailboxView) messagesBySequenceNumber(ctx context.Context, set types.SequenceSet) ([]mailstore.Message, error) {
+	msgs := make([]mailstore.Message, 0)
+	last := uint32(len(v.uids))
+	add := func(seqNo uint32) {
+		if seqNo == 0 || seqNo > last || ctx.Err() != nil {
+			return
+		}
+		if msg := v.mailbox.MessageByUID(v.uids[seqNo-1]); msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	for _, msgRange := range set {
+		start, end := msgRange.Bounds(last)
+		for seqNo := start; seqNo <= end && seqNo <= last; seqNo++ {
+			add(seqNo)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// messagesByUID returns the messages in the set which the client knows
+// about. New messages are left out until the client has been told about
+// them, and messages which have been expunged but not yet reported are
+// skipped.
+func (v *mailboxView) messagesByUID(ctx context.Context, set types.SequenceSet) ([]mailstore.Message, error) {
+	found, err := mailstore.MessageSetByUIDContext(ctx, v.mailbox, set)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]mailstore.Message, 0, len(found))
+	for _, msg := range found {
+		if msg != nil && v.sequenceNumber(msg.UID()) != 0 {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// syncView makes sure the view matches the selected mailbox. The selected
+// mailbox may be set directly rather than with SELECT.
+func (c *Conn) syncView() {
+	if c.SelectedMailbox == nil {
+		if c.view != nil {
+			c.view.close()
+			c.view = nil
+		}
+		return
+	}
+	if c.view == nil || c.view.mailbox != c.SelectedMailbox {
+		if c.view != nil {
+			c.view.close()
+		}
+		c.view = newMailboxView(c.SelectedMailbox)
+	}
+}
+
+// messageSet returns the messages in a sequence set given by the client,
+// interpreted as UIDs if byUID is set.
+func (c *Conn) messageSet(set types.SequenceSet, byUID bool) ([]mailstore.Message, error) {
+	ctx := c.Context()
+	if c.view == nil {
+		if byUID {
+			return mailstore.MessageSetByUIDContext(ctx, c.SelectedMailbox, set)
+		}
+		return mailstore.MessageSetBySequenceNumberContext(ctx, c.SelectedMailbox, set)
+	}
+	if byUID {
+		return c.view.messagesByUID(ctx, set)
+	}
+	return c.view.messagesBySequenceNumber(ctx, set)
+}
+
+// sequenceNumber returns the sequence number of a message as known by the
+// client.
+func (c *Conn) sequenceNumber(msg mailstore.Message) uint32 {
+	if c.view == nil {
+		return msg.SequenceNumber()
+	}
+	return c.view.sequenceNumber(msg.UID())
+}
+
+// expungeAllowed returns true if EXPUNGE responses may be sent now. RFC 3501
+// forbids them while no command is in progress, and during FETCH, STORE and
+// SEARCH as the client relies on sequence numbers staying the same.
+func (c *Conn) expungeAllowed() bool {
+	if c.command == nil {
+		return false
+	}
+	if c.command.UID {
+		return true
+	}
+	switch c.command.Name {
+	case "FETCH", "STORE", "SEARCH":
+		return false
+	}
+	return true
+}
+
+// writeExpunged removes messages from the client's view and tells the client
+// they have gone. Once QRESYNC is enabled they are listed by UID in a single
+// VANISHED response; otherwise each gets an EXPUNGE response, numbered from
+// the client's view as each one renumbers the messages after it.
+func (c *Conn) writeExpunged(uids []uint32) {
+	var vanished []uint32
+	for _, uid := range uids {
+		seqNo := c.view.expunge(uid)
+		if seqNo == 0 {
+			continue
+		}
+		if c.qresync {
+			vanished = append(vanished, uid)
+		} else {
+			c.writeResponse("", fmt.Sprintf("%d EXPUNGE", seqNo))
+		}
+	}
+	if len(vanished) > 0 {
+		sort.Slice(vanished, func(i, j int) bool { return vanished[i] < vanished[j] })
+		c.writeResponse("", "VANISHED "+types.NewSequenceSet(vanished).String())
+	}
+}
+
+// writeUpdates sends the client untagged responses for any changes made to
+// the selected mailbox since they were last checked. Changes are reported in
+// the order they happened, so if an EXPUNGE may not be sent now then it and
+// every later change are held back.
+func (c *Conn) writeUpdates() {
+	v := c.view
+	if v == nil || v.watcher == nil {
+		return
+	}
+	v.pending = append(v.pending, v.watcher.Updates()...)
+
+	exists := len(v.uids)
+	writeExists := func() {
+		if len(v.uids) != exists {
+			exists = len(v.uids)
+			c.writeResponse("", fmt.Sprintf("%d EXISTS", exists))
+		}
+	}
+
+	allowExpunge := c.expungeAllowed()
+	n := 0
+updates:
+	for ; n < len(v.pending); n++ {
+		update := v.pending[n]
+		switch update.Type {
+		case mailstore.UpdateExists:
+			if v.sequenceNumber(update.UID) == 0 {
+				v.uids = append(v.uids, update.UID)
+				v.flags[update.UID] = types.FlagSet{Flags: update.Flags, Keywords: update.Keywords}
+			}
+		case mailstore.UpdateExpunge:
+			if v.sequenceNumber(update.UID) == 0 {
+				continue
+			}
+			if !allowExpunge {
+				break updates
+			}
+			// The client must know about a message before it is mentioned
+			writeExists()
+			c.writeExpunged([]uint32{update.UID})
+			exists = len(v.uids)
+		case mailstore.UpdateFlags:
+			seqNo := v.sequenceNumber(update.UID)
+			flags := types.FlagSet{Flags: update.Flags, Keywords: update.Keywords}
+			if seqNo == 0 || v.flags[update.UID].Equal(flags) {
+				continue
+			}
+			v.flags[update.UID] = flags
+			writeExists()
+			if c.condstore && update.ModSeq != 0 {
+				c.writeResponse("", fmt.Sprintf("%d FETCH (UID %d MODSEQ (%d) FLAGS (%s))",
+					seqNo, update.UID, update.ModSeq, flags))
+			} else {
+				c.writeResponse("", fmt.Sprintf("%d FETCH (FLAGS (%s))", seqNo, flags))
+			}
+		}
+	}
+	v.pending = v.pending[n:]
+
+	writeExists()
+}
@@ -0,0 +1,70 @@
+package conn_test
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jordwest/imap-server/conn"
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/parser"
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Registry", func() {
+	BeforeEach(func() {
+		tConn.SetState(conn.StateSelected)
+		tConn.SetReadWrite()
+		tConn.User = mStore.User
+		tConn.SelectedMailbox = tConn.User.Mailboxes()[0]
+
+		registry := conn.NewRegistry()
+		registry.HandleFunc("ID", func(s *conn.Session, cmd *parser.Command) {
+			s.WriteResponse("", `ID ("name" "test")`)
+			s.WriteResponse(cmd.Tag, "OK ID completed")
+		})
+		registry.AddCapability("ID")
+		registry.HandleFunc("NOOP", func(s *conn.Session, cmd *parser.Command) {
+			s.WriteResponse(cmd.Tag, "OK "+s.SelectedMailbox().Name())
+		})
+		registry.Disable("IDLE")
+		registry.HandleFetch("X-SEQ", func(s *conn.Session, m mailstore.Message, w io.Writer) error {
+			_, err := fmt.Fprintf(w, "X-SEQ %d", m.SequenceNumber())
+			return err
+		})
+		registry.DisableFetch("ENVELOPE")
+		tConn.Registry = registry
+	})
+
+	It("should handle added commands", func() {
+		SendLine("abcd.123 ID NIL")
+		ExpectResponse(`* ID ("name" "test")`)
+		ExpectResponse("abcd.123 OK ID completed")
+	})
+
+	It("should list capabilities for the registered commands", func() {
+		SendLine("abcd.123 CAPABILITY")
+		ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE ID")
+		ExpectResponse("abcd.123 OK CAPABILITY completed")
+	})
+
+	It("should override built in commands", func() {
+		SendLine("abcd.123 NOOP")
+		ExpectResponse("abcd.123 OK INBOX")
+	})
+
+	It("should refuse disabled commands", func() {
+		SendLine("abcd.123 IDLE")
+		ExpectResponse("abcd.123 BAD Command not understood")
+	})
+
+	It("should fetch added items", func() {
+		SendLine("abcd.123 FETCH 2 (x-seq UID)")
+		ExpectResponse("* 2 FETCH (X-SEQ 2 UID 11)")
+		ExpectResponse("abcd.123 OK FETCH Completed")
+	})
+
+	It("should refuse disabled items", func() {
+		SendLine("abcd.123 FETCH 2 (ENVELOPE)")
+		ExpectResponse("abcd.123 BAD Unrecognised Parameter")
+	})
+})
@@ -0,0 +1,92 @@
+package conn
+
+import (
+	"context"
+
+	"github.com/jordwest/imap-server/mailstore"
+)
+
+// Session is the view of a client connection given to command handlers
+// registered with a Registry. It is only valid while the handler runs.
+type Session struct {
+	c *Conn
+}
+
+// Context returns the context of the command, which is cancelled if the
+// connection closes.
+func (s *Session) Context() context.Context {
+	return s.c.Context()
+}
+
+// State returns the state of the connection.
+func (s *Session) State() ConnState {
+	return s.c.state
+}
+
+// Mailstore returns the mailstore the connection belongs to.
+func (s *Session) Mailstore() mailstore.Mailstore {
+	return s.c.Mailstore
+}
+
+// User returns the user who has logged in, or nil.
+func (s *Session) User() mailstore.User {
+	return s.c.User
+}
+
+// Login authenticates the connection as a user, as LOGIN does.
+func (s *Session) Login(user mailstore.User) {
+	s.c.User = user
+	s.c.SetState(StateAuthenticated)
+}
+
+// SelectedMailbox returns the selected mailbox, or nil.
+func (s *Session) SelectedMailbox() mailstore.Mailbox {
+	return s.c.SelectedMailbox
+}
+
+// ReadOnly returns true if the selected mailbox may not be changed, eg
+// because it was opened with EXAMINE.
+func (s *Session) ReadOnly() bool {
+	return s.c.mailboxWritable != readWrite
+}
+
+// IsTLS returns true if the connection is encrypted.
+func (s *Session) IsTLS() bool {
+	return s.c.IsTLS()
+}
+
+// RequireAuthenticated checks that the user has logged in, and otherwise
+// responds to the command with an error and returns false.
+func (s *Session) RequireAuthenticated(tag string) bool {
+	return s.c.assertAuthenticated(tag)
+}
+
+// RequireSelected checks that a mailbox is selected, and writable if
+// writable is set, and otherwise responds to the command with an error and
+// returns false.
+func (s *Session) RequireSelected(tag string, writable bool) bool {
+	return s.c.assertSelected(tag, writeMode(writable))
+}
+
+// WriteResponse sends a response line, which is untagged if tag is empty. A
+// line ending is added if needed. Changes to the selected mailbox are
+// reported before a tagged response, as the built in commands do.
+func (s *Session) WriteResponse(tag string, text string) {
+	s.c.writeResponse(tag, text)
+}
+
+// Write sends raw data to the client, eg a literal.
+func (s *Session) Write(p []byte) (int, error) {
+	return s.c.Write(p)
+}
+
+// ReadLine reads a line sent by the client, eg the end of a command which
+// waits for the client.
+func (s *Session) ReadLine() (text string, ok bool) {
+	return s.c.ReadLine()
+}
+
+// Close ends the session, closing the connection once the handler returns.
+func (s *Session) Close() {
+	s.c.SetState(StateLoggedOut)
+}
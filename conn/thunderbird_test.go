@@ -7,7 +7,7 @@ var _ = Describe("Thunderbird mail client", func() {
 		It("should download messages, mark a message as seen and then flagged", func() {
 			ExpectResponse("* OK IMAP4rev1 Service Ready")
 			SendLine("1 capability")
-			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN")
+			ExpectResponse("* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE")
 			ExpectResponse("1 OK CAPABILITY completed")
 			SendLine("2 authenticate plain")
 			ExpectResponse("+")
@@ -21,6 +21,8 @@ var _ = Describe("Thunderbird mail client", func() {
 			ExpectResponse("* OK [UIDNEXT 13]")
 			ExpectResponse("* OK [UIDVALIDITY 250]")
 			ExpectResponse("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)")
+			ExpectResponse("* OK [PERMANENTFLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft \\*)]")
+			ExpectResponse("* OK [HIGHESTMODSEQ 4]")
 			ExpectResponse("3 OK [READ-WRITE] SELECT completed")
 			SendLine("4 UID fetch 1:* (FLAGS)")
 			ExpectResponse("* 1 FETCH (FLAGS (\\Recent) UID 10)")
@@ -0,0 +1,56 @@
+package mailstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/mailstore/mailstoretest"
+)
+
+func tempDir(t *testing.T) string {
+	root, err := ioutil.TempDir("", "mailstore")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root
+}
+
+func checkPassword(username, password string) bool {
+	return username == "username" && password == "password"
+}
+
+func TestDummyConformance(t *testing.T) {
+	mailstoretest.Run(t, func(t *testing.T) (mailstore.Mailstore, string, string) {
+		return mailstore.NewDummyMailstore(), "username", "password"
+	})
+}
+
+func TestMaildirConformance(t *testing.T) {
+	mailstoretest.Run(t, func(t *testing.T) (mailstore.Mailstore, string, string) {
+		return mailstore.NewMaildirMailstore(tempDir(t), checkPassword), "username", "password"
+	})
+}
+
+func TestMboxConformance(t *testing.T) {
+	mailstoretest.Run(t, func(t *testing.T) (mailstore.Mailstore, string, string) {
+		return mailstore.NewMboxMailstore(tempDir(t), checkPassword), "username", "password"
+	})
+}
+
+func TestKVConformance(t *testing.T) {
+	mailstoretest.Run(t, func(t *testing.T) (mailstore.Mailstore, string, string) {
+		store, err := mailstore.OpenKVMailstore(filepath.Join(tempDir(t), "mail.db"))
+		if err != nil {
+			t.Fatalf("Error opening mailstore: %s", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		if err := store.AddUser("username", "password"); err != nil {
+			t.Fatalf("Error adding user: %s", err)
+		}
+		return store, "username", "password"
+	})
+}
@@ -0,0 +1,157 @@
+package mailstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// ContextMailstore may optionally be implemented by a Mailstore whose
+// operations can be cancelled, eg because they query a database. The
+// context is cancelled when the client disconnects or the server shuts down.
+type ContextMailstore interface {
+	AuthenticateContext(ctx context.Context, username string, password string) (User, error)
+}
+
+// ContextUser may optionally be implemented by a User whose operations can
+// be cancelled.
+type ContextUser interface {
+	MailboxesContext(ctx context.Context) ([]Mailbox, error)
+
+	MailboxByNameContext(ctx context.Context, name string) (Mailbox, error)
+}
+
+// ContextMailbox may optionally be implemented by a Mailbox whose operations
+// can be cancelled.
+type ContextMailbox interface {
+	MessageSetByUIDContext(ctx context.Context, set types.SequenceSet) ([]Message, error)
+
+	MessageSetBySequenceNumberContext(ctx context.Context, set types.SequenceSet) ([]Message, error)
+
+	DeleteFlaggedMessagesContext(ctx context.Context) ([]Message, error)
+}
+
+// ContextMessage may optionally be implemented by a Message whose content
+// is read or saved by operations which can be cancelled.
+type ContextMessage interface {
+	// OpenContext is like Open. The context applies to reading the message
+	// as well as opening it.
+	OpenContext(ctx context.Context) (io.ReadCloser, error)
+
+	SaveContext(ctx context.Context) (Message, error)
+}
+
+// The functions below adapt any implementation to the context-aware
+// interfaces. They call the context-aware method if there is one, and
+// otherwise check that the context hasn't been cancelled before calling the
+// plain method.
+
+// AuthenticateContext authenticates a user, giving up if ctx is cancelled.
+func AuthenticateContext(ctx context.Context, s Mailstore, username string, password string) (User, error) {
+	if cs, ok := s.(ContextMailstore); ok {
+		return cs.AuthenticateContext(ctx, username, password)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Authenticate(username, password)
+}
+
+// MailboxesContext lists a user's mailboxes, giving up if ctx is cancelled.
+func MailboxesContext(ctx context.Context, u User) ([]Mailbox, error) {
+	if cu, ok := u.(ContextUser); ok {
+		return cu.MailboxesContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.Mailboxes(), nil
+}
+
+// MailboxByNameContext gets a user's mailbox, giving up if ctx is cancelled.
+func MailboxByNameContext(ctx context.Context, u User, name string) (Mailbox, error) {
+	if cu, ok := u.(ContextUser); ok {
+		return cu.MailboxByNameContext(ctx, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.MailboxByName(name)
+}
+
+// MessageSetByUIDContext gets the messages in a set of UIDs, giving up if
+// ctx is cancelled.
+func MessageSetByUIDContext(ctx context.Context, m Mailbox, set types.SequenceSet) ([]Message, error) {
+	if cm, ok := m.(ContextMailbox); ok {
+		return cm.MessageSetByUIDContext(ctx, set)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.MessageSetByUID(set), nil
+}
+
+// MessageSetBySequenceNumberContext gets the messages in a set of sequence
+// numbers, giving up if ctx is cancelled.
+func MessageSetBySequenceNumberContext(ctx context.Context, m Mailbox, set types.SequenceSet) ([]Message, error) {
+	if cm, ok := m.(ContextMailbox); ok {
+		return cm.MessageSetBySequenceNumberContext(ctx, set)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.MessageSetBySequenceNumber(set), nil
+}
+
+// DeleteFlaggedMessagesContext deletes the messages marked with the Deleted
+// flag, giving up if ctx is cancelled.
+func DeleteFlaggedMessagesContext(ctx context.Context, m Mailbox) ([]Message, error) {
+	if cm, ok := m.(ContextMailbox); ok {
+		return cm.DeleteFlaggedMessagesContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.DeleteFlaggedMessages()
+}
+
+// OpenContext opens a message for reading. Reading fails once ctx is
+// cancelled, so that sending a large message can be interrupted.
+func OpenContext(ctx context.Context, msg Message) (io.ReadCloser, error) {
+	if cm, ok := msg.(ContextMessage); ok {
+		return cm.OpenContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{contextReader{ctx, r}, r}, nil
+}
+
+// SaveContext saves any changes to a message, giving up if ctx is cancelled.
+func SaveContext(ctx context.Context, msg Message) (Message, error) {
+	if cm, ok := msg.(ContextMessage); ok {
+		return cm.SaveContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return msg.Save()
+}
+
+// contextReader fails reads once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
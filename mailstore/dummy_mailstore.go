@@ -3,7 +3,11 @@ package mailstore
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/textproto"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jordwest/imap-server/types"
@@ -16,11 +20,18 @@ type DummyMailstore struct {
 	User *DummyUser
 }
 
+// dummyDelimiter separates levels in the mailbox hierarchy
+const dummyDelimiter = "/"
+
+// dummyUIDValidity is the UIDVALIDITY of the first mailbox created
+const dummyUIDValidity = 250
+
 func newDummyMailbox(name string) *DummyMailbox {
 	return &DummyMailbox{
-		name:     name,
-		messages: make([]Message, 0),
-		nextuid:  10,
+		name:          name,
+		messages:      make([]Message, 0),
+		nextuid:       10,
+		highestModSeq: 1,
 	}
 }
 
@@ -30,30 +41,32 @@ func NewDummyMailstore() *DummyMailstore {
 	ms := &DummyMailstore{
 		User: &DummyUser{
 			authenticated: false,
-			mailboxes:     make([]*DummyMailbox, 2),
+			mailboxes:     make([]*DummyMailbox, 0),
+			subscriptions: []string{"INBOX", "Trash"},
 		},
 	}
 	ms.User.mailstore = ms
-	ms.User.mailboxes[0] = newDummyMailbox("INBOX")
-	ms.User.mailboxes[0].ID = 0
-	ms.User.mailboxes[0].mailstore = ms
+	ms.User.addMailbox("INBOX")
 	// Mon Jan 2 15:04:05 -0700 MST 2006
 	mailTime, _ := time.Parse("02-Jan-2006 15:04:05 -0700", "28-Oct-2014 00:09:00 +0700")
 	ms.User.mailboxes[0].addEmail("me@test.com", "you@test.com", "Test email", mailTime,
 		"Test email\r\n"+
 			"Regards,\r\n"+
-			"Me")
+			"Me\r\n")
 	ms.User.mailboxes[0].addEmail("me@test.com", "you@test.com", "Another test email", mailTime,
-		"Another test email")
+		"Another test email\r\n")
 	ms.User.mailboxes[0].addEmail("me@test.com", "you@test.com", "Last email", mailTime,
-		"Hello")
+		"Hello\r\n")
 
-	ms.User.mailboxes[1] = newDummyMailbox("Trash")
-	ms.User.mailboxes[1].ID = 1
-	ms.User.mailboxes[1].mailstore = ms
+	ms.User.addMailbox("Trash")
 	return ms
 }
 
+// MailboxType implements the MailboxTyper interface
+func (d *DummyMailstore) MailboxType() Mailbox {
+	return &DummyMailbox{}
+}
+
 // Authenticate implements the Authenticate method on the Mailstore interface
 func (d *DummyMailstore) Authenticate(username string, password string) (User, error) {
 	if username != "username" {
@@ -72,9 +85,57 @@ func (d *DummyMailstore) Authenticate(username string, password string) (User, e
 type DummyUser struct {
 	authenticated bool
 	mailboxes     []*DummyMailbox
+	nextMailboxID uint32
+	subscriptions []string
 	mailstore     *DummyMailstore
 }
 
+// addMailbox creates a new mailbox with the next available ID.
+func (u *DummyUser) addMailbox(name string) *DummyMailbox {
+	mailbox := newDummyMailbox(name)
+	mailbox.ID = u.nextMailboxID
+	// IDs are never reused, so a recreated mailbox gets a new UIDVALIDITY
+	mailbox.uidValidity = dummyUIDValidity + mailbox.ID
+	mailbox.mailstore = u.mailstore
+	u.nextMailboxID++
+	u.mailboxes = append(u.mailboxes, mailbox)
+	return mailbox
+}
+
+// mailboxByID returns the mailbox with the given ID, or nil if it has been
+// deleted.
+func (u *DummyUser) mailboxByID(id uint32) *DummyMailbox {
+	for _, mailbox := range u.mailboxes {
+		if mailbox.ID == id {
+			return mailbox
+		}
+	}
+	return nil
+}
+
+// dummyMailboxByName is like MailboxByName but returns the concrete type, or
+// nil if the mailbox does not exist.
+func (u *DummyUser) dummyMailboxByName(name string) *DummyMailbox {
+	for _, mailbox := range u.mailboxes {
+		if mailbox.Name() == name {
+			return mailbox
+		}
+	}
+	return nil
+}
+
+// createSuperiors creates any missing mailboxes above the given name in the
+// hierarchy, eg "a" and "a/b" for "a/b/c".
+func (u *DummyUser) createSuperiors(name string) {
+	levels := strings.Split(name, dummyDelimiter)
+	for i := 1; i < len(levels); i++ {
+		superior := strings.Join(levels[:i], dummyDelimiter)
+		if superior != "" && u.dummyMailboxByName(superior) == nil {
+			u.addMailbox(superior)
+		}
+	}
+}
+
 // Mailboxes implements the Mailboxes method on the User interface
 func (u *DummyUser) Mailboxes() []Mailbox {
 	mailboxes := make([]Mailbox, len(u.mailboxes))
@@ -88,23 +149,148 @@ func (u *DummyUser) Mailboxes() []Mailbox {
 
 // MailboxByName returns a DummyMailbox object, given the mailbox's name
 func (u *DummyUser) MailboxByName(name string) (Mailbox, error) {
-	for _, mailbox := range u.mailboxes {
+	mailbox := u.dummyMailboxByName(name)
+	if mailbox == nil {
+		return nil, errors.New("Invalid mailbox")
+	}
+	return mailbox, nil
+}
+
+// CreateMailbox implements the CreateMailbox method on the MailboxManager
+// interface
+func (u *DummyUser) CreateMailbox(name string) (Mailbox, error) {
+	name = strings.TrimSuffix(name, dummyDelimiter)
+	if name == "" || strings.HasPrefix(name, dummyDelimiter) ||
+		strings.Contains(name, dummyDelimiter+dummyDelimiter) {
+		return nil, errors.New("Invalid mailbox name")
+	}
+	if strings.EqualFold(name, "INBOX") || u.dummyMailboxByName(name) != nil {
+		return nil, errors.New("Mailbox already exists")
+	}
+
+	u.createSuperiors(name)
+	return u.addMailbox(name), nil
+}
+
+// DeleteMailbox implements the DeleteMailbox method on the MailboxManager
+// interface
+func (u *DummyUser) DeleteMailbox(name string) error {
+	if strings.EqualFold(name, "INBOX") {
+		return errors.New("Cannot delete INBOX")
+	}
+	for i, mailbox := range u.mailboxes {
 		if mailbox.Name() == name {
-			return mailbox, nil
+			u.mailboxes = append(u.mailboxes[:i], u.mailboxes[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Invalid mailbox")
+}
+
+// RenameMailbox implements the RenameMailbox method on the MailboxManager
+// interface
+func (u *DummyUser) RenameMailbox(oldName string, newName string) error {
+	mailbox := u.dummyMailboxByName(oldName)
+	if mailbox == nil {
+		return errors.New("Invalid mailbox")
+	}
+	if newName == "" || strings.HasPrefix(newName, dummyDelimiter) ||
+		strings.HasSuffix(newName, dummyDelimiter) {
+		return errors.New("Invalid mailbox name")
+	}
+	if strings.EqualFold(newName, "INBOX") || u.dummyMailboxByName(newName) != nil {
+		return errors.New("Mailbox already exists")
+	}
+	if strings.HasPrefix(newName, oldName+dummyDelimiter) {
+		return errors.New("Cannot rename a mailbox to one of its inferiors")
+	}
+
+	if oldName == "INBOX" {
+		// Move all messages out of INBOX into a new mailbox. The new mailbox
+		// continues INBOX's UIDs so that no UID is ever reused in either.
+		u.createSuperiors(newName)
+		target := u.addMailbox(newName)
+		target.nextuid = mailbox.nextuid
+		var uids []uint32
+		for _, msg := range mailbox.messages {
+			uids = append(uids, msg.UID())
+		}
+		target.highestModSeq = mailbox.recordExpunged(uids)
+		target.messages = mailbox.messages
+		for _, msg := range target.messages {
+			msg.(*DummyMessage).mailboxID = target.ID
+		}
+		mailbox.messages = make([]Message, 0)
+		for _, uid := range uids {
+			mailbox.updates.Notify(Update{Type: UpdateExpunge, UID: uid})
+		}
+		for _, msg := range target.messages {
+			m := msg.(*DummyMessage)
+			target.updates.Notify(Update{Type: UpdateExists, UID: m.uid, Flags: m.flags,
+				Keywords: m.keywords, ModSeq: m.modSeq})
+		}
+		return nil
+	}
+
+	u.createSuperiors(newName)
+	prefix := oldName + dummyDelimiter
+	for _, inferior := range u.mailboxes {
+		if strings.HasPrefix(inferior.name, prefix) {
+			inferior.name = newName + dummyDelimiter + strings.TrimPrefix(inferior.name, prefix)
 		}
 	}
-	return nil, errors.New("Invalid mailbox")
+	mailbox.name = newName
+	return nil
+}
+
+// Subscribe implements the Subscribe method on the SubscriptionManager
+// interface
+func (u *DummyUser) Subscribe(name string) error {
+	for _, subscription := range u.subscriptions {
+		if subscription == name {
+			return nil
+		}
+	}
+	u.subscriptions = append(u.subscriptions, name)
+	return nil
+}
+
+// Unsubscribe implements the Unsubscribe method on the SubscriptionManager
+// interface
+func (u *DummyUser) Unsubscribe(name string) error {
+	for i, subscription := range u.subscriptions {
+		if subscription == name {
+			u.subscriptions = append(u.subscriptions[:i], u.subscriptions[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Not subscribed to mailbox")
+}
+
+// Subscriptions implements the Subscriptions method on the
+// SubscriptionManager interface
+func (u *DummyUser) Subscriptions() []string {
+	subscriptions := make([]string, len(u.subscriptions))
+	copy(subscriptions, u.subscriptions)
+	return subscriptions
 }
 
 // DummyMailbox is an in-memory implementation of a Mailstore Mailbox
 type DummyMailbox struct {
-	ID        uint32
-	name      string
-	nextuid   uint32
-	messages  []Message
-	mailstore *DummyMailstore
+	ID            uint32
+	name          string
+	uidValidity   uint32
+	nextuid       uint32
+	highestModSeq uint64
+	expunged      []dummyExpunge
+	messages      []Message
+	mailstore     *DummyMailstore
+	updates       Broadcaster
 }
 
+// Watch implements the Watch method on the Notifier interface
+func (m *DummyMailbox) Watch() *Watcher { return m.updates.Watch() }
+
 // DebugPrintMailbox prints out all messages in the mailbox to the command line
 // for debugging purposes
 func (m *DummyMailbox) DebugPrintMailbox() {
@@ -114,6 +300,46 @@ func (m *DummyMailbox) DebugPrintMailbox() {
 // Name returns the Mailbox's name
 func (m *DummyMailbox) Name() string { return m.name }
 
+// UIDValidity implements the UIDValidity method on the Mailbox interface
+func (m *DummyMailbox) UIDValidity() uint32 { return m.uidValidity }
+
+// HighestModSeq implements the ModSeqMailbox interface
+func (m *DummyMailbox) HighestModSeq() uint64 { return m.highestModSeq }
+
+// dummyExpunge records a message expunged from a DummyMailbox
+type dummyExpunge struct {
+	uid    uint32
+	modSeq uint64
+}
+
+// ExpungedSince implements the ExpungeTracker interface
+func (m *DummyMailbox) ExpungedSince(modSeq uint64) []uint32 {
+	var uids []uint32
+	for _, e := range m.expunged {
+		if e.modSeq > modSeq {
+			uids = append(uids, e.uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// recordExpunged remembers that messages have been expunged from the mailbox
+// as one change, and returns its mod-sequence.
+func (m *DummyMailbox) recordExpunged(uids []uint32) uint64 {
+	modSeq := m.nextModSeq()
+	for _, uid := range uids {
+		m.expunged = append(m.expunged, dummyExpunge{uid: uid, modSeq: modSeq})
+	}
+	return modSeq
+}
+
+// nextModSeq returns the mod-sequence for a new change to the mailbox.
+func (m *DummyMailbox) nextModSeq() uint64 {
+	m.highestModSeq++
+	return m.highestModSeq
+}
+
 // NextUID returns the UID that is likely to be assigned to the next
 // new message in the Mailbox
 func (m *DummyMailbox) NextUID() uint32 { return m.nextuid }
@@ -160,7 +386,7 @@ func (m *DummyMailbox) Unseen() uint32 {
 
 // MessageBySequenceNumber returns a single message given the message's sequence number
 func (m *DummyMailbox) MessageBySequenceNumber(seqno uint32) Message {
-	if seqno > uint32(len(m.messages)) {
+	if seqno == 0 || seqno > uint32(len(m.messages)) {
 		return nil
 	}
 	return m.messages[seqno-1]
@@ -300,7 +526,7 @@ func (m *DummyMailbox) MessageSetBySequenceNumber(set types.SequenceSet) []Messa
 		// storage system using eg SQL might
 		// instead perform a query here using
 		// the range values instead.
-		for seqNo := start; seqNo <= end; seqNo++ {
+		for seqNo := start; seqNo <= end && seqNo <= m.Messages(); seqNo++ {
 			msgs = append(msgs, m.MessageBySequenceNumber(seqNo))
 		}
 	}
@@ -341,6 +567,8 @@ func (m *DummyMailbox) addEmail(from string, to string, subject string, date tim
 		internalDate:   date,
 	}
 	newMessage = newMessage.AddFlags(types.FlagRecent).(*DummyMessage)
+	newMessage.modSeq = m.nextModSeq()
+	newMessage.saved = newMessage.flagSet()
 	newMessage.mailboxID = m.ID
 	newMessage.mailstore = m.mailstore
 	m.messages = append(m.messages, newMessage)
@@ -354,9 +582,13 @@ type DummyMessage struct {
 	header         textproto.MIMEHeader
 	internalDate   time.Time
 	flags          types.Flags
+	keywords       []string
+	modSeq         uint64
+	saved          types.FlagSet // The flags and keywords as of the last save
 	mailboxID      uint32
 	mailstore      *DummyMailstore
 	body           string
+	err            error // Set if the body couldn't be read
 }
 
 // Header returns the message's MIME Header.
@@ -373,8 +605,7 @@ func (m *DummyMessage) SequenceNumber() uint32 { return m.sequenceNumber }
 // Size returns the message's full RFC822 size, including full message header
 // and body.
 func (m *DummyMessage) Size() uint32 {
-	hdrStr := fmt.Sprintf("%s\r\n", m.Header())
-	return uint32(len(hdrStr)) + uint32(len(m.Body()))
+	return uint32(len(m.content()))
 }
 
 // InternalDate returns the internally stored date of the message
@@ -382,16 +613,44 @@ func (m *DummyMessage) InternalDate() time.Time {
 	return m.internalDate
 }
 
-// Body returns the full body of the message
-func (m *DummyMessage) Body() string {
-	return m.body
+// Open returns the full message, header and body.
+func (m *DummyMessage) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(m.content())), nil
+}
+
+// content returns the message as it is read from Open.
+func (m *DummyMessage) content() string {
+	return util.MIMEHeaderToString(m.header) + "\r\n" + m.body
 }
 
 // Keywords returns any keywords associated with the message
 func (m *DummyMessage) Keywords() []string {
-	var f []string
-	//f[0] = "Test"
-	return f
+	if m.keywords == nil {
+		return []string{}
+	}
+	return m.keywords
+}
+
+// AddKeywords adds the given keywords to the message.
+func (m *DummyMessage) AddKeywords(keywords ...string) Message {
+	m.keywords = types.AddKeywords(m.keywords, keywords...)
+	return m
+}
+
+// RemoveKeywords removes the given keywords from the message.
+func (m *DummyMessage) RemoveKeywords(keywords ...string) Message {
+	m.keywords = types.RemoveKeywords(m.keywords, keywords...)
+	return m
+}
+
+// ModSeq implements the ModSeqMessage interface
+func (m *DummyMessage) ModSeq() uint64 { return m.modSeq }
+
+// flagSet returns the flags and keywords which affect the message's
+// mod-sequence. The Recent flag belongs to a session rather than the
+// message, so it is left out.
+func (m *DummyMessage) flagSet() types.FlagSet {
+	return types.FlagSet{Flags: m.flags.ResetFlags(types.FlagRecent), Keywords: m.keywords}
 }
 
 // Flags returns any flags on the message.
@@ -423,24 +682,45 @@ func (m *DummyMessage) SetHeaders(newHeader textproto.MIMEHeader) Message {
 	return m
 }
 
-// SetBody sets the body of the message.
-func (m *DummyMessage) SetBody(newBody string) Message {
-	m.body = newBody
+// SetBody sets the body of the message. As the message is kept in memory,
+// the body is read straight away.
+func (m *DummyMessage) SetBody(newBody io.Reader) Message {
+	body, err := ioutil.ReadAll(newBody)
+	if err != nil {
+		m.err = err
+	}
+	m.body = string(body)
 	return m
 }
 
 // Save saves the message to the mailbox it belongs to.
 func (m *DummyMessage) Save() (Message, error) {
-	mailbox := m.mailstore.User.mailboxes[m.mailboxID]
+	if m.err != nil {
+		return m, m.err
+	}
+	mailbox := m.mailstore.User.mailboxByID(m.mailboxID)
+	if mailbox == nil {
+		return m, errors.New("Mailbox has been deleted")
+	}
 	if m.sequenceNumber == 0 {
 		// Message is new
 		m.uid = mailbox.nextuid
 		mailbox.nextuid++
-		m.sequenceNumber = uint32(len(mailbox.messages))
 		mailbox.messages = append(mailbox.messages, m)
+		m.sequenceNumber = uint32(len(mailbox.messages))
+		m.modSeq = mailbox.nextModSeq()
+		m.saved = m.flagSet()
+		mailbox.updates.Notify(Update{Type: UpdateExists, UID: m.uid, Flags: m.flags, Keywords: m.keywords,
+			ModSeq: m.modSeq})
 	} else {
 		// Message exists
 		mailbox.messages[m.sequenceNumber-1] = m
+		if !m.flagSet().Equal(m.saved) {
+			m.modSeq = mailbox.nextModSeq()
+			m.saved = m.flagSet()
+		}
+		mailbox.updates.Notify(Update{Type: UpdateFlags, UID: m.uid, Flags: m.flags, Keywords: m.keywords,
+			ModSeq: m.modSeq})
 	}
 	return m, nil
 }
@@ -448,11 +728,26 @@ func (m *DummyMessage) Save() (Message, error) {
 // DeleteFlaggedMessages deletes messages marked with the Delete flag and
 // returns them.
 func (m *DummyMailbox) DeleteFlaggedMessages() ([]Message, error) {
+	return m.deleteFlagged(nil)
+}
+
+// DeleteFlaggedMessagesByUID implements the UIDExpunger interface
+func (m *DummyMailbox) DeleteFlaggedMessagesByUID(set types.SequenceSet) ([]Message, error) {
+	return m.deleteFlagged(set)
+}
+
+// deleteFlagged deletes the flagged messages whose UIDs are in set, or all
+// of them if set is nil.
+func (m *DummyMailbox) deleteFlagged(set types.SequenceSet) ([]Message, error) {
 	var delIDs []int
 	var delMsgs []Message
+	last := m.LastUID()
 
 	// Find messages to be deleted.
 	for i, msg := range m.messages {
+		if set != nil && !inSequenceSet(set, msg.UID(), last) {
+			continue
+		}
 		if msg.Flags().HasFlags(types.FlagDeleted) {
 			delIDs = append(delIDs, i)
 			delMsgs = append(delMsgs, msg)
@@ -474,9 +769,73 @@ func (m *DummyMailbox) DeleteFlaggedMessages() ([]Message, error) {
 		dmsg.sequenceNumber = uint32(i) + 1
 	}
 
+	if len(delMsgs) > 0 {
+		uids := make([]uint32, len(delMsgs))
+		for i, msg := range delMsgs {
+			uids[i] = msg.UID()
+		}
+		m.recordExpunged(uids)
+	}
+	for _, msg := range delMsgs {
+		m.updates.Notify(Update{Type: UpdateExpunge, UID: msg.UID()})
+	}
+
 	return delMsgs, nil
 }
 
+// MoveMessages implements the Mover interface
+func (m *DummyMailbox) MoveMessages(msgs []Message, dest Mailbox) ([]Message, error) {
+	target, ok := dest.(*DummyMailbox)
+	if !ok || target.mailstore != m.mailstore {
+		return nil, ErrCannotMove
+	}
+
+	moving := make(map[uint32]bool, len(msgs))
+	for _, msg := range msgs {
+		if m.MessageByUID(msg.UID()) == nil {
+			return nil, errors.New("Message has been deleted")
+		}
+		moving[msg.UID()] = true
+	}
+
+	var kept []Message
+	var expunged []uint32
+	byUID := make(map[uint32]*DummyMessage, len(msgs))
+	for _, msg := range m.messages {
+		if !moving[msg.UID()] {
+			kept = append(kept, msg)
+			continue
+		}
+		byUID[msg.UID()] = msg.(*DummyMessage)
+		expunged = append(expunged, msg.UID())
+	}
+	m.messages = kept
+	m.recordExpunged(expunged)
+	for i, msg := range m.messages {
+		msg.(*DummyMessage).sequenceNumber = uint32(i) + 1
+	}
+	for _, uid := range expunged {
+		m.updates.Notify(Update{Type: UpdateExpunge, UID: uid})
+	}
+
+	// The moved messages are numbered in the order they were given
+	moved := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		copied := *byUID[msg.UID()]
+		copied.uid = target.nextuid
+		target.nextuid++
+		copied.mailboxID = target.ID
+		copied.flags = copied.flags.SetFlags(types.FlagRecent)
+		copied.modSeq = target.nextModSeq()
+		target.messages = append(target.messages, &copied)
+		copied.sequenceNumber = uint32(len(target.messages))
+		target.updates.Notify(Update{Type: UpdateExists, UID: copied.uid, Flags: copied.flags,
+			Keywords: copied.keywords, ModSeq: copied.modSeq})
+		moved = append(moved, &copied)
+	}
+	return moved, nil
+}
+
 func debugPrintMessages(messages []Message) {
 	fmt.Printf("SeqNo  |UID    |From      |To        |Subject\n")
 	fmt.Printf("-------+-------+----------+----------+-------\n")
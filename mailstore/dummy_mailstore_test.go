@@ -1,9 +1,13 @@
 package mailstore
 
 import (
+	"bufio"
+	"context"
+	"io/ioutil"
 	"testing"
 
 	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
 )
 
 func getDefaultInbox(t *testing.T) *DummyMailbox {
@@ -40,6 +44,24 @@ func assertMessageUIDs(t *testing.T, msgs []Message, uids []uint32) {
 	}
 }
 
+// messageBody reads the body of a message, after its header.
+func messageBody(t *testing.T, msg Message) string {
+	r, err := msg.Open()
+	if err != nil {
+		t.Fatalf("Error opening message: %s", err)
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	if _, _, err := util.ReadHeader(br); err != nil {
+		t.Fatalf("Error reading header: %s", err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Error reading body: %s", err)
+	}
+	return string(body)
+}
+
 func TestMessageSetBySequenceNumber(t *testing.T) {
 	inbox := getDefaultInbox(t)
 	msgs := inbox.MessageSetBySequenceNumber(types.SequenceSet{
@@ -76,3 +98,100 @@ func TestMessageSetByUID(t *testing.T) {
 	})
 	assertMessageUIDs(t, msgs, []uint32{12})
 }
+
+func TestDummyModSeq(t *testing.T) {
+	inbox := getDefaultInbox(t)
+	highest := inbox.HighestModSeq()
+	msg := inbox.MessageByUID(12)
+	if ModSeq(msg) != highest {
+		t.Fatalf("Expected the last message to have mod-sequence %d, got %d", highest, ModSeq(msg))
+	}
+
+	// The Recent flag doesn't belong to the message, so it isn't a change
+	if _, err := msg.RemoveFlags(types.FlagRecent).Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if inbox.HighestModSeq() != highest || ModSeq(msg) != highest {
+		t.Errorf("Expected removing the Recent flag to leave the mod-sequence alone")
+	}
+
+	if _, err := msg.AddFlags(types.FlagDeleted).AddKeywords("$Junk").Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if inbox.HighestModSeq() != highest+1 || ModSeq(msg) != highest+1 {
+		t.Errorf("Expected a change to raise the mod-sequence to %d, got %d",
+			highest+1, ModSeq(msg))
+	}
+
+	if _, err := inbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if inbox.HighestModSeq() != highest+2 {
+		t.Errorf("Expected an expunge to raise the highest mod-sequence")
+	}
+
+	// The expunge is remembered for QRESYNC
+	if uids := inbox.ExpungedSince(highest + 1); len(uids) != 1 || uids[0] != 12 {
+		t.Errorf("Expected UID 12 to have been expunged, got %v", uids)
+	}
+	if uids := inbox.ExpungedSince(highest + 2); len(uids) != 0 {
+		t.Errorf("Expected nothing to have been expunged since, got %v", uids)
+	}
+}
+
+func TestExpungedSinceContext(t *testing.T) {
+	inbox := getDefaultInbox(t)
+	if _, err := inbox.MessageByUID(11).AddFlags(types.FlagDeleted).Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := inbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	set, _ := types.InterpretSequenceSet("5:*")
+	uids, err := ExpungedSinceContext(context.Background(), inbox, 1, set)
+	if err != nil || uids.String() != "11" {
+		t.Errorf("Expected UID 11 to have been expunged, got %v (%v)", uids, err)
+	}
+
+	// Without a record of expunges every missing UID is reported
+	untracked := struct{ Mailbox }{inbox}
+	uids, err = ExpungedSinceContext(context.Background(), untracked, 1, set)
+	if err != nil || uids.String() != "5:9,11" {
+		t.Errorf("Expected UIDs 5:9,11 to be reported, got %v (%v)", uids, err)
+	}
+
+	// Which are found without trying every UID up to UIDNEXT
+	set, _ = types.InterpretSequenceSet("3,12:*,1:4,10")
+	uids, err = ExpungedSinceContext(context.Background(), manyUIDs{untracked}, 1, set)
+	if err != nil || uids.String() != "1:4,13:4000000000" {
+		t.Errorf("Expected UIDs 1:4,13:4000000000 to be reported, got %v (%v)", uids, err)
+	}
+}
+
+// manyUIDs is a mailbox which has assigned many more UIDs than it has
+// messages.
+type manyUIDs struct{ Mailbox }
+
+func (m manyUIDs) NextUID() uint32 { return 4000000001 }
+
+func TestRenameInboxNotifies(t *testing.T) {
+	inbox := getDefaultInbox(t)
+	watcher := inbox.Watch()
+	defer watcher.Close()
+
+	user := inbox.mailstore.User
+	if err := user.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatalf("Error renaming INBOX: %s", err)
+	}
+
+	updates := watcher.Updates()
+	if len(updates) != 3 {
+		t.Fatalf("Expected 3 updates, got %v", updates)
+	}
+	for i, update := range updates {
+		if update.Type != UpdateExpunge || update.UID != uint32(10+i) {
+			t.Errorf("Expected UID %d to be expunged, got %v", 10+i, update)
+		}
+	}
+}
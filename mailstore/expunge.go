@@ -0,0 +1,44 @@
+package mailstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// ErrUIDExpungeNotSupported is returned by DeleteFlaggedMessagesByUIDContext
+// for mailboxes which don't implement UIDExpunger.
+var ErrUIDExpungeNotSupported = errors.New("UID EXPUNGE not supported")
+
+// UIDExpunger may optionally be implemented by a Mailbox to delete only
+// some of the messages marked with the Deleted flag, as the UID EXPUNGE
+// command does. Mailboxes that do not implement it don't support UID
+// EXPUNGE, as their other deleted messages could only be kept by changing
+// their flags, which other connections would see.
+type UIDExpunger interface {
+	// DeleteFlaggedMessagesByUID is like DeleteFlaggedMessages, but only
+	// deletes messages whose UIDs are in the set.
+	DeleteFlaggedMessagesByUID(set types.SequenceSet) ([]Message, error)
+}
+
+// SupportsUIDExpunge reports whether the mailboxes of a mailstore implement
+// UIDExpunger.
+func SupportsUIDExpunge(m Mailstore) bool {
+	_, ok := mailboxType(m).(UIDExpunger)
+	return ok
+}
+
+// DeleteFlaggedMessagesByUIDContext deletes the messages in a set of UIDs
+// which are marked with the Deleted flag, giving up if ctx is cancelled. It
+// returns ErrUIDExpungeNotSupported if m doesn't implement UIDExpunger.
+func DeleteFlaggedMessagesByUIDContext(ctx context.Context, m Mailbox, set types.SequenceSet) ([]Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e, ok := m.(UIDExpunger)
+	if !ok {
+		return nil, ErrUIDExpungeNotSupported
+	}
+	return e.DeleteFlaggedMessagesByUID(set)
+}
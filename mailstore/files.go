@@ -0,0 +1,253 @@
+package mailstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lockTimeout is how long to wait for another process to release a lock
+	// file, and staleLock is the age at which a lock file without a process
+	// ID, or whose process can't be looked for, is assumed to have been left
+	// behind by a crashed process
+	lockTimeout = 10 * time.Second
+	staleLock   = 2 * time.Minute
+)
+
+// dotLock creates a lock file holding the process ID, waiting for any other
+// process holding it to finish. It returns a function to release the lock.
+func dotLock(lockPath string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if lockStale(lockPath) {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out waiting for mailbox lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lockStale returns true if a lock file was left behind by a process which
+// has gone. Lock files hold the ID of the process which created them, as
+// other mail programs' usually do too, and are only stale once it has
+// exited, however long it holds them. Empty lock files, and those whose
+// process can't be looked for, are stale once they are old.
+func lockStale(lockPath string) bool {
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return false
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+		if running, known := processRunning(pid); known {
+			return !running
+		}
+	}
+	info, err := os.Stat(lockPath)
+	return err == nil && time.Since(info.ModTime()) > staleLock
+}
+
+// validUsername returns true if a username can safely be used as the name of
+// the directory holding the user's mail.
+func validUsername(username string) bool {
+	return username != "" && !strings.HasPrefix(username, ".") &&
+		!strings.ContainsAny(username, "/\\\x00")
+}
+
+// lastUIDValidity is the last value returned by newUIDValidity
+var lastUIDValidity uint32
+
+// newUIDValidity returns a UIDVALIDITY value for a new mailbox. The current
+// time is used so that a recreated mailbox never reuses an old value, and
+// values are never repeated within a process, even if a mailbox is deleted
+// and recreated within a second.
+func newUIDValidity() uint32 {
+	for {
+		last := atomic.LoadUint32(&lastUIDValidity)
+		validity := uint32(time.Now().Unix())
+		if validity <= last {
+			validity = last + 1
+		}
+		if atomic.CompareAndSwapUint32(&lastUIDValidity, last, validity) {
+			return validity
+		}
+	}
+}
+
+// readSubscriptions reads a subscriptions file, which lists one mailbox name
+// per line.
+func readSubscriptions(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{}
+	}
+	subscriptions := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			subscriptions = append(subscriptions, line)
+		}
+	}
+	return subscriptions
+}
+
+// subscribe adds a mailbox name to a subscriptions file.
+func subscribe(path string, name string) error {
+	subscriptions := readSubscriptions(path)
+	for _, subscription := range subscriptions {
+		if subscription == name {
+			return nil
+		}
+	}
+	return writeSubscriptions(path, append(subscriptions, name))
+}
+
+// unsubscribe removes a mailbox name from a subscriptions file.
+func unsubscribe(path string, name string) error {
+	subscriptions := readSubscriptions(path)
+	for i, subscription := range subscriptions {
+		if subscription == name {
+			return writeSubscriptions(path, append(subscriptions[:i], subscriptions[i+1:]...))
+		}
+	}
+	return errors.New("Not subscribed to mailbox")
+}
+
+func writeSubscriptions(path string, subscriptions []string) error {
+	var data string
+	for _, subscription := range subscriptions {
+		data += subscription + "\n"
+	}
+	return writeFileAtomic(path, []byte(data))
+}
+
+// writeFileAtomic replaces a file so that readers see either the old or the
+// new contents, never a mixture.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func parseUint32(s string) uint32 {
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
+
+// lineReader reads lines from r with their line endings, either CRLF or a
+// bare LF, replaced by ending. It keeps no more than one buffer of r in
+// memory, however long the lines are.
+type lineReader struct {
+	r      *bufio.Reader
+	ending string
+
+	// edit may change the start of each line, which it is given without its
+	// line ending. Very long lines are given only up to the size of r's
+	// buffer. The line is left out if it returns nil.
+	edit func(line []byte) []byte
+
+	// terminate gives a last line without a line ending the ending
+	terminate bool
+
+	out      []byte // Data waiting to be read
+	midLine  bool   // Part of the current line has been read
+	dropping bool   // The current line is being left out
+	cr       bool   // A CR was held back in case a LF follows it
+	err      error
+}
+
+func newLineReader(r io.Reader, ending string) *lineReader {
+	return &lineReader{r: bufio.NewReader(r), ending: ending}
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	for len(l.out) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		l.fill()
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
+
+// fill converts the next line, or as much of it as fits in r's buffer.
+func (l *lineReader) fill() {
+	chunk, err := l.r.ReadSlice('\n')
+	ended := err == nil
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+
+	line := chunk
+	if ended {
+		line = line[:len(line)-1]
+	}
+	var out []byte
+	if l.cr && !l.dropping && len(line) > 0 {
+		// The CR held back wasn't the end of the line after all
+		out = append(out, '\r')
+	}
+	l.cr = false
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+		l.cr = !ended && err == nil
+	}
+
+	if !l.midLine && len(chunk) > 0 && l.edit != nil {
+		if line = l.edit(line); line == nil {
+			l.dropping = true
+		}
+	}
+	if !l.dropping {
+		out = append(out, line...)
+		if ended || err != nil && l.terminate && (l.midLine || len(chunk) > 0) {
+			out = append(out, l.ending...)
+		}
+	}
+
+	l.midLine = !ended && len(chunk) > 0
+	if ended {
+		l.dropping = false
+	}
+	l.out, l.err = out, err
+}
+
+// readCloser reads from one source and closes another, usually the file
+// underneath the reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
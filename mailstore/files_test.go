@@ -0,0 +1,140 @@
+package mailstore
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineReader(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	tests := []struct {
+		input, ending string
+		terminate     bool
+		expected      string
+	}{
+		{"a\nb\r\nc", "\r\n", false, "a\r\nb\r\nc"},
+		{"a\nb\r\nc", "\r\n", true, "a\r\nb\r\nc\r\n"},
+		{"a\r\n\r\nb\n", "\n", true, "a\n\nb\n"},
+		{"a\rb\r", "\n", false, "a\rb"},
+		{"", "\r\n", true, ""},
+		{long + "\r\n" + long, "\n", true, long + "\n" + long + "\n"},
+	}
+	for _, test := range tests {
+		r := newLineReader(strings.NewReader(test.input), test.ending)
+		r.terminate = test.terminate
+		output, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(output) != test.expected {
+			t.Errorf("Expected %q to be read as %q, got %q", test.input, test.expected, output)
+		}
+	}
+}
+
+func TestLineReaderEdit(t *testing.T) {
+	// A CR at the end of a full buffer must still be joined with its LF
+	input := strings.Repeat("y", 4095) + "\r\nDrop me\r\n continued\nFrom x\n"
+	r := &lineReader{r: bufio.NewReaderSize(strings.NewReader(input), 4096), ending: "\n"}
+	dropping := false
+	r.edit = func(line []byte) []byte {
+		if bytes.HasPrefix(line, []byte(" ")) && dropping {
+			return nil
+		}
+		dropping = bytes.HasPrefix(line, []byte("Drop"))
+		if dropping {
+			return nil
+		}
+		return quoteMboxLine(line)
+	}
+	output, _ := ioutil.ReadAll(r)
+	expected := strings.Repeat("y", 4095) + "\n>From x\n"
+	if string(output) != expected {
+		t.Errorf("Expected lines to be edited, got %q", output)
+	}
+}
+
+func TestDotLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-lock")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "mbox.lock")
+
+	unlock, err := dotLock(lockPath)
+	if err != nil {
+		t.Fatalf("Error locking: %s", err)
+	}
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil || string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("Expected the lock file to hold the process ID, got %q (%v)", data, err)
+	}
+
+	// However old it is, a lock held by a running process isn't stale
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatalf("Error changing lock time: %s", err)
+	}
+	if runtime.GOOS != "windows" && lockStale(lockPath) {
+		t.Errorf("Expected a lock held by a running process not to be stale")
+	}
+	unlock()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock file to be removed, got %v", err)
+	}
+
+	// An empty lock file is only stale once it is old
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatalf("Error writing lock file: %s", err)
+	}
+	if lockStale(lockPath) {
+		t.Errorf("Expected a new empty lock file not to be stale")
+	}
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatalf("Error changing lock time: %s", err)
+	}
+	if !lockStale(lockPath) {
+		t.Errorf("Expected an old empty lock file to be stale")
+	}
+}
+
+func TestDotLockProcessGone(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Processes can't be looked for")
+	}
+	dir, err := ioutil.TempDir("", "imap-lock")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "mbox.lock")
+
+	// A process which has exited leaves its lock stale straight away
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Error running process: %s", err)
+	}
+	pid := strconv.Itoa(cmd.Process.Pid) + "\n"
+	if err := ioutil.WriteFile(lockPath, []byte(pid), 0600); err != nil {
+		t.Fatalf("Error writing lock file: %s", err)
+	}
+	if !lockStale(lockPath) {
+		t.Errorf("Expected a lock left by an exited process to be stale")
+	}
+
+	unlock, err := dotLock(lockPath)
+	if err != nil {
+		t.Fatalf("Error locking: %s", err)
+	}
+	unlock()
+}
@@ -0,0 +1,467 @@
+package mailstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// kvMagic starts every database file
+	kvMagic = "IMAPKV1\n"
+
+	// kvCompactSize is the smallest file which is compacted, and
+	// kvCompactRatio how many times larger than its live data a file must
+	// grow before it is compacted
+	kvCompactSize  = 1 << 20
+	kvCompactRatio = 4
+
+	kvOpPut    = 1
+	kvOpDelete = 2
+)
+
+var kvCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errKVCorrupt is returned for a record which is complete but fails its
+// checksum or can't be decoded
+var errKVCorrupt = errors.New("Corrupt record")
+
+// kvDB is a small embedded key-value database kept in a single file. Each
+// transaction is appended to the file as one checksummed record and synced
+// before it takes effect, so a crash can only lose a transaction which was
+// still being committed. A partly written record at the end of the file is
+// discarded when it is next opened; a damaged record anywhere else stops the
+// file being opened at all, rather than losing the transactions after it.
+//
+// The whole database is also kept in memory, and the file is rewritten from
+// it once most of the file is taken up by values which have since been
+// overwritten or deleted.
+type kvDB struct {
+	path string
+
+	mu   sync.RWMutex
+	f    *os.File
+	data map[string][]byte
+	keys []string // Sorted, for prefix scans
+	size int64    // The size of the file
+	live int64    // The size a compacted file would be
+}
+
+// kvTx is a transaction on a kvDB. Writes are only seen by the transaction
+// until it is committed.
+type kvTx struct {
+	db       *kvDB
+	writable bool
+	writes   map[string][]byte
+	deletes  map[string]bool
+}
+
+// openKVDB opens a database file, creating it if it doesn't exist. The file
+// is locked, so that another process can't open it at the same time.
+func openKVDB(path string) (*kvDB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.New("Database is in use by another process: " + path)
+	}
+	db := &kvDB{path: path, f: f, data: make(map[string][]byte)}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the file into memory.
+func (db *kvDB) load() error {
+	info, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := db.f.Write([]byte(kvMagic)); err != nil {
+			return err
+		}
+		db.size = int64(len(kvMagic))
+		return db.f.Sync()
+	}
+
+	r := bufio.NewReader(db.f)
+	magic := make([]byte, len(kvMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != kvMagic {
+		return errors.New("Not a mailstore database: " + db.path)
+	}
+
+	// Apply each complete record. A record cut short by the end of the
+	// file, or a damaged last record, is left from a commit which didn't
+	// finish, and is removed.
+	offset := int64(len(kvMagic))
+	for {
+		payload, err := readKVRecord(r, info.Size()-offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		end := offset + int64(8+len(payload))
+		if err == nil {
+			err = db.apply(payload)
+		}
+		if err == errKVCorrupt {
+			if end == info.Size() {
+				break
+			}
+			return fmt.Errorf("Corrupt record at offset %d in %s", offset, db.path)
+		}
+		if err != nil {
+			return err
+		}
+		offset = end
+	}
+	if offset < info.Size() {
+		if err := db.f.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	db.size = offset
+	_, err = db.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readKVRecord reads one record from the remaining bytes of the file,
+// checking it hasn't been corrupted. A record which runs past the end of the
+// file gives io.ErrUnexpectedEOF, so its length is never trusted further
+// than that. A corrupt record's payload is returned along with errKVCorrupt.
+func readKVRecord(r io.Reader, remaining int64) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > remaining-int64(len(header)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, kvCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+		return payload, errKVCorrupt
+	}
+	return payload, nil
+}
+
+// apply makes the changes in a record to the in-memory database. The record
+// is checked before anything is changed.
+func (db *kvDB) apply(payload []byte) error {
+	type op struct {
+		put        bool
+		key, value []byte
+	}
+	var ops []op
+	for rest := payload; len(rest) > 0; {
+		o := op{put: rest[0] == kvOpPut}
+		if rest[0] != kvOpPut && rest[0] != kvOpDelete {
+			return errKVCorrupt
+		}
+		var ok bool
+		if o.key, rest, ok = readKVBytes(rest[1:]); !ok {
+			return errKVCorrupt
+		}
+		if o.put {
+			if o.value, rest, ok = readKVBytes(rest); !ok {
+				return errKVCorrupt
+			}
+		}
+		ops = append(ops, o)
+	}
+
+	for _, o := range ops {
+		if o.put {
+			db.set(string(o.key), o.value)
+		} else {
+			db.remove(string(o.key))
+		}
+	}
+	return nil
+}
+
+// appendKVOp adds an operation to a record's payload.
+func appendKVOp(payload []byte, op byte, key string, value []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	payload = append(payload, op)
+	payload = append(payload, buf[:binary.PutUvarint(buf[:], uint64(len(key)))]...)
+	payload = append(payload, key...)
+	if op == kvOpPut {
+		payload = append(payload, buf[:binary.PutUvarint(buf[:], uint64(len(value)))]...)
+		payload = append(payload, value...)
+	}
+	return payload
+}
+
+// encodeKVRecord adds the length and checksum to a record's payload.
+func encodeKVRecord(payload []byte) []byte {
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, kvCRCTable))
+	copy(record[8:], payload)
+	return record
+}
+
+func readKVBytes(b []byte) (value []byte, rest []byte, ok bool) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || uint64(len(b)-size) < n {
+		return nil, nil, false
+	}
+	return b[size : size+int(n)], b[size+int(n):], true
+}
+
+// kvEntrySize is the size of a key and value when written to a compacted
+// file.
+func kvEntrySize(key string, value []byte) int64 {
+	return int64(9 + 2*binary.MaxVarintLen32 + len(key) + len(value))
+}
+
+func (db *kvDB) set(key string, value []byte) {
+	if old, ok := db.data[key]; ok {
+		db.live -= kvEntrySize(key, old)
+	} else {
+		i := sort.SearchStrings(db.keys, key)
+		db.keys = append(db.keys, "")
+		copy(db.keys[i+1:], db.keys[i:])
+		db.keys[i] = key
+	}
+	db.data[key] = value
+	db.live += kvEntrySize(key, value)
+}
+
+func (db *kvDB) remove(key string) {
+	old, ok := db.data[key]
+	if !ok {
+		return
+	}
+	db.live -= kvEntrySize(key, old)
+	delete(db.data, key)
+	i := sort.SearchStrings(db.keys, key)
+	db.keys = append(db.keys[:i], db.keys[i+1:]...)
+}
+
+// close closes the database file.
+func (db *kvDB) close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Close()
+	db.f = nil
+	return err
+}
+
+// view runs a read-only transaction.
+func (db *kvDB) view(fn func(tx *kvTx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(&kvTx{db: db})
+}
+
+// update runs a transaction which may change the database. The changes are
+// committed if fn returns nil, and discarded otherwise. Only one update runs
+// at a time.
+func (db *kvDB) update(fn func(tx *kvTx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return errors.New("Database is closed")
+	}
+
+	tx := &kvTx{
+		db:       db,
+		writable: true,
+		writes:   make(map[string][]byte),
+		deletes:  make(map[string]bool),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return db.commit(tx)
+}
+
+// commit writes a transaction's changes to the file, then applies them.
+func (db *kvDB) commit(tx *kvTx) error {
+	if len(tx.writes) == 0 && len(tx.deletes) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	for key := range tx.deletes {
+		payload = appendKVOp(payload, kvOpDelete, key, nil)
+	}
+	for key, value := range tx.writes {
+		payload = appendKVOp(payload, kvOpPut, key, value)
+	}
+
+	if err := db.write(payload); err != nil {
+		return err
+	}
+	for key := range tx.deletes {
+		db.remove(key)
+	}
+	for key, value := range tx.writes {
+		db.set(key, value)
+	}
+
+	if db.size > kvCompactSize && db.size > kvCompactRatio*db.live {
+		// The transaction has been committed even if this fails
+		db.compact()
+	}
+	return nil
+}
+
+// write appends a record to the file and syncs it.
+func (db *kvDB) write(payload []byte) error {
+	record := encodeKVRecord(payload)
+	_, err := db.f.Write(record)
+	if err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		// Don't leave part of the record behind for later records to follow
+		db.f.Truncate(db.size)
+		db.f.Seek(db.size, io.SeekStart)
+		return err
+	}
+	db.size += int64(len(record))
+	return nil
+}
+
+// compact replaces the file with one holding only the current values.
+func (db *kvDB) compact() error {
+	tmpPath := filepath.Join(filepath.Dir(db.path), "."+filepath.Base(db.path)+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	compacted := &kvDB{path: db.path, f: tmp}
+	// The new file is locked before it replaces the old one, so it is
+	// never left open to another process
+	err = lockFile(tmp)
+	if err == nil {
+		err = compacted.writeAll(db)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(db.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	db.f.Close()
+	db.f = tmp
+	db.size = compacted.size
+	return nil
+}
+
+// writeAll writes every value in another database to an empty file.
+func (db *kvDB) writeAll(from *kvDB) error {
+	if _, err := db.f.Write([]byte(kvMagic)); err != nil {
+		return err
+	}
+	db.size = int64(len(kvMagic))
+
+	for _, key := range from.keys {
+		record := encodeKVRecord(appendKVOp(nil, kvOpPut, key, from.data[key]))
+		if _, err := db.f.Write(record); err != nil {
+			return err
+		}
+		db.size += int64(len(record))
+	}
+	return db.f.Sync()
+}
+
+// get returns the value of a key, or nil if it isn't set. The value must not
+// be modified.
+func (tx *kvTx) get(key string) []byte {
+	value, _ := tx.lookup(key)
+	return value
+}
+
+// lookup returns the value of a key, and whether it is set.
+func (tx *kvTx) lookup(key string) ([]byte, bool) {
+	if tx.writable {
+		if tx.deletes[key] {
+			return nil, false
+		}
+		if value, ok := tx.writes[key]; ok {
+			return value, true
+		}
+	}
+	value, ok := tx.db.data[key]
+	return value, ok
+}
+
+// put sets the value of a key.
+func (tx *kvTx) put(key string, value []byte) {
+	if !tx.writable {
+		panic("put in a read-only transaction")
+	}
+	delete(tx.deletes, key)
+	tx.writes[key] = append(make([]byte, 0, len(value)), value...)
+}
+
+// delete removes a key.
+func (tx *kvTx) delete(key string) {
+	if !tx.writable {
+		panic("delete in a read-only transaction")
+	}
+	delete(tx.writes, key)
+	tx.deletes[key] = true
+}
+
+// scan calls fn for each key with the given prefix, in order, until it
+// returns false.
+func (tx *kvTx) scan(prefix string, fn func(key string, value []byte) bool) {
+	keys := tx.db.keys[sort.SearchStrings(tx.db.keys, prefix):]
+	var written []string
+	for key := range tx.writes {
+		if _, ok := tx.db.data[key]; !ok && strings.HasPrefix(key, prefix) {
+			written = append(written, key)
+		}
+	}
+	sort.Strings(written)
+
+	// Merge the keys in the database with keys only written by the
+	// transaction
+	for len(keys) > 0 || len(written) > 0 {
+		var key string
+		if len(written) == 0 || len(keys) > 0 && keys[0] < written[0] {
+			key, keys = keys[0], keys[1:]
+			if !strings.HasPrefix(key, prefix) {
+				keys = nil
+				continue
+			}
+		} else {
+			key, written = written[0], written[1:]
+		}
+		if value, ok := tx.lookup(key); ok {
+			if !fn(key, value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mailstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func openTestKVDB(t *testing.T, path string) *kvDB {
+	db, err := openKVDB(path)
+	if err != nil {
+		t.Fatalf("Error opening database: %s", err)
+	}
+	return db
+}
+
+func TestKVDBTransactions(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "test.db")
+
+	db := openTestKVDB(t, path)
+	db.update(func(tx *kvTx) error {
+		tx.put("a/1", []byte("one"))
+		tx.put("a/2", []byte("two"))
+		tx.put("b/1", []byte("three"))
+		return nil
+	})
+
+	// A failed transaction changes nothing
+	db.update(func(tx *kvTx) error {
+		tx.delete("a/1")
+		tx.put("a/3", []byte("four"))
+		if tx.get("a/1") != nil || string(tx.get("a/3")) != "four" {
+			t.Errorf("Expected a transaction to see its own changes")
+		}
+		return errors.New("Failed")
+	})
+
+	db.update(func(tx *kvTx) error {
+		tx.delete("a/2")
+		tx.put("a/0", []byte("zero"))
+		var keys []string
+		tx.scan("a/", func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if len(keys) != 2 || keys[0] != "a/0" || keys[1] != "a/1" {
+			t.Errorf("Expected scan to include uncommitted changes, got %v", keys)
+		}
+		return nil
+	})
+	db.close()
+
+	db = openTestKVDB(t, path)
+	defer db.close()
+	db.view(func(tx *kvTx) error {
+		if string(tx.get("a/0")) != "zero" || string(tx.get("a/1")) != "one" ||
+			tx.get("a/2") != nil || tx.get("a/3") != nil {
+			t.Errorf("Expected committed transactions to be kept")
+		}
+		return nil
+	})
+}
+
+func TestKVDBRecovery(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "test.db")
+
+	db := openTestKVDB(t, path)
+	db.update(func(tx *kvTx) error {
+		tx.put("key", []byte("value"))
+		return nil
+	})
+	size := db.size
+	db.close()
+
+	// Simulate a crash part way through writing a record
+	record := encodeKVRecord(appendKVOp(nil, kvOpPut, "key", []byte("changed")))
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write(record[:len(record)-3])
+	f.Close()
+
+	db = openTestKVDB(t, path)
+	defer db.close()
+	db.view(func(tx *kvTx) error {
+		if string(tx.get("key")) != "value" {
+			t.Errorf("Expected the partial record to be ignored, got %q", tx.get("key"))
+		}
+		return nil
+	})
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Errorf("Expected the partial record to be removed")
+	}
+
+	db.update(func(tx *kvTx) error {
+		tx.put("key", []byte("updated"))
+		return nil
+	})
+	db.close()
+	db = openTestKVDB(t, path)
+	db.view(func(tx *kvTx) error {
+		if string(tx.get("key")) != "updated" {
+			t.Errorf("Expected records after recovery to be kept, got %q", tx.get("key"))
+		}
+		return nil
+	})
+}
+
+func TestKVDBCorruption(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "test.db")
+
+	db := openTestKVDB(t, path)
+	db.update(func(tx *kvTx) error {
+		tx.put("first", []byte("one"))
+		return nil
+	})
+	damaged := int64(len(kvMagic)) + 8 // The first record's payload
+	db.update(func(tx *kvTx) error {
+		tx.put("second", []byte("two"))
+		return nil
+	})
+	size := db.size
+	db.close()
+
+	// A damaged record followed by others isn't a torn write, so the file
+	// is left alone rather than losing the later transactions
+	f, _ := os.OpenFile(path, os.O_RDWR, 0600)
+	f.WriteAt([]byte("X"), damaged)
+	f.Close()
+	if _, err := openKVDB(path); err == nil {
+		t.Errorf("Expected a corrupt database not to open")
+	}
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Errorf("Expected the corrupt database not to be truncated")
+	}
+}
+
+func TestKVDBCompaction(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "test.db")
+
+	db := openTestKVDB(t, path)
+	value := bytes.Repeat([]byte("x"), 10000)
+	for i := 0; i < 500; i++ {
+		value[0] = byte(i)
+		db.update(func(tx *kvTx) error {
+			tx.put("key", value)
+			return nil
+		})
+	}
+	db.close()
+
+	if info, _ := os.Stat(path); info.Size() > kvCompactSize {
+		t.Errorf("Expected the file to be compacted, but it is %d bytes", info.Size())
+	}
+	db = openTestKVDB(t, path)
+	defer db.close()
+	db.view(func(tx *kvTx) error {
+		if got := tx.get("key"); !bytes.Equal(got, value) {
+			t.Errorf("Expected the last value to be kept")
+		}
+		return nil
+	})
+}
+
+func TestKVDBLocked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Files aren't locked on Windows")
+	}
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "test.db")
+
+	db := openTestKVDB(t, path)
+	if _, err := openKVDB(path); err == nil {
+		t.Fatalf("Expected the database to be locked")
+	}
+
+	// The compacted file replacing the original is locked too
+	db.update(func(tx *kvTx) error {
+		tx.put("key", []byte("value"))
+		return nil
+	})
+	if err := db.compact(); err != nil {
+		t.Fatalf("Error compacting database: %s", err)
+	}
+	if _, err := openKVDB(path); err == nil {
+		t.Fatalf("Expected the compacted database to be locked")
+	}
+
+	db.close()
+	db = openTestKVDB(t, path)
+	db.close()
+}
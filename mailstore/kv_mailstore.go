@@ -0,0 +1,985 @@
+package mailstore
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+// kvPasswordIterations is the number of PBKDF2 iterations used to hash
+// passwords
+const kvPasswordIterations = 10000
+
+// Keys in the database are made of parts separated by NUL, which can't
+// appear in usernames or mailbox names. The first part gives the kind of
+// record:
+//
+//	u user         kvUserRecord
+//	m user mailbox kvMailboxRecord
+//	i user mailbox uid  kvMessageRecord, the state of a message
+//	c user mailbox uid  the name of the file holding the message
+//	s user mailbox      a subscription, with an empty value
+//	v              the last UIDVALIDITY given to a mailbox
+//
+// UIDs are written as fixed width hex, so that messages are kept in UID
+// order.
+const kvSeparator = "\x00"
+
+func kvKey(parts ...string) string {
+	return strings.Join(parts, kvSeparator)
+}
+
+func kvUIDKey(kind string, user string, mailbox string, uid uint32) string {
+	return kvKey(kind, user, mailbox, fmt.Sprintf("%08x", uid))
+}
+
+type kvUserRecord struct {
+	Salt []byte
+	Hash []byte
+}
+
+type kvMailboxRecord struct {
+	UIDValidity uint32
+	NextUID     uint32
+}
+
+type kvMessageRecord struct {
+	UID          uint32
+	Flags        types.Flags
+	Keywords     []string
+	InternalDate time.Time
+	Size         uint32
+}
+
+// KVMailstore is a Mailstore which keeps users, mailboxes and the state of
+// messages in a single database file. Every change is made in a transaction
+// which is written to disk before it takes effect, so the file is never left
+// inconsistent by a crash. Only one process may open the file at a time.
+//
+// Each message's content is kept in its own file, in a directory named after
+// the database file with ".messages" added, so that messages needn't be held
+// in memory. A file is written before the transaction which refers to it, and
+// never changed afterwards.
+type KVMailstore struct {
+	db  *kvDB
+	dir string // Holds the message files
+
+	mu        sync.Mutex
+	mailboxes map[string]*KVMailbox // By key, shared so watchers are notified
+}
+
+// OpenKVMailstore opens a database file, creating it if it doesn't exist.
+func OpenKVMailstore(path string) (*KVMailstore, error) {
+	db, err := openKVDB(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &KVMailstore{db: db, dir: path + ".messages", mailboxes: make(map[string]*KVMailbox)}
+	if err := s.removeUnused(); err != nil {
+		db.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// removeUnused creates the directory of message files if needed, and removes
+// any files which no message refers to. They are left by a crash between a
+// file being written and its transaction being committed, or between a
+// message being deleted and its file being removed.
+func (s *KVMailstore) removeUnused() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	s.db.view(func(tx *kvTx) error {
+		tx.scan(kvKey("c", ""), func(key string, value []byte) bool {
+			used[string(value)] = true
+			return true
+		})
+		return nil
+	})
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !used[file.Name()] {
+			os.Remove(filepath.Join(s.dir, file.Name()))
+		}
+	}
+	return nil
+}
+
+// removeFiles removes message files once the messages have been deleted.
+func (s *KVMailstore) removeFiles(names []string) {
+	for _, name := range names {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+}
+
+// Close closes the database file.
+func (s *KVMailstore) Close() error {
+	return s.db.close()
+}
+
+// AddUser creates a user with an empty INBOX.
+func (s *KVMailstore) AddUser(username string, password string) error {
+	if username == "" || strings.Contains(username, kvSeparator) {
+		return errors.New("Invalid username")
+	}
+	return s.db.update(func(tx *kvTx) error {
+		if tx.get(kvKey("u", username)) != nil {
+			return errors.New("User already exists")
+		}
+		if err := putKVPassword(tx, username, password); err != nil {
+			return err
+		}
+		return createKVMailbox(tx, username, "INBOX")
+	})
+}
+
+// SetPassword changes a user's password.
+func (s *KVMailstore) SetPassword(username string, password string) error {
+	return s.db.update(func(tx *kvTx) error {
+		if tx.get(kvKey("u", username)) == nil {
+			return errors.New("No such user")
+		}
+		return putKVPassword(tx, username, password)
+	})
+}
+
+func putKVPassword(tx *kvTx, username string, password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	return putKVRecord(tx, kvKey("u", username), &kvUserRecord{
+		Salt: salt,
+		Hash: hashKVPassword(password, salt),
+	})
+}
+
+// hashKVPassword derives a key from a password with PBKDF2-HMAC-SHA256.
+func hashKVPassword(password string, salt []byte) []byte {
+	return pbkdf2SHA256([]byte(password), salt, kvPasswordIterations, sha256.Size)
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes with PBKDF2 (RFC 8018), using
+// HMAC-SHA256. It is written out here rather than taken from
+// golang.org/x/crypto/pbkdf2 so that the package needs nothing outside the
+// standard library, and is tested against the RFC 7914 test vectors.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// kvUnknownUserSalt is hashed with the password given for a user who doesn't
+// exist, so that refusing them takes as long as refusing a wrong password,
+// and doesn't reveal which usernames exist
+var kvUnknownUserSalt = make([]byte, 16)
+
+// MailboxType implements the MailboxTyper interface
+func (s *KVMailstore) MailboxType() Mailbox {
+	return &KVMailbox{}
+}
+
+// Authenticate implements the Authenticate method on the Mailstore interface
+func (s *KVMailstore) Authenticate(username string, password string) (User, error) {
+	var record kvUserRecord
+	err := s.db.view(func(tx *kvTx) error {
+		return getKVRecord(tx, kvKey("u", username), &record)
+	})
+	if err != nil {
+		record = kvUserRecord{Salt: kvUnknownUserSalt}
+	}
+	hash := hashKVPassword(password, record.Salt)
+	if err != nil || subtle.ConstantTimeCompare(hash, record.Hash) != 1 {
+		return nil, errors.New("Invalid username or password")
+	}
+	return &KVUser{store: s, name: username}, nil
+}
+
+// mailbox returns the shared mailbox with the given name.
+func (s *KVMailstore) mailbox(user string, name string) *KVMailbox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := kvKey("m", user, name)
+	mailbox, ok := s.mailboxes[key]
+	if !ok {
+		mailbox = &KVMailbox{store: s, user: user, name: name}
+		s.mailboxes[key] = mailbox
+	}
+	return mailbox
+}
+
+// forget drops shared mailboxes which have been deleted or renamed.
+func (s *KVMailstore) forget(user string, names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		delete(s.mailboxes, kvKey("m", user, name))
+	}
+}
+
+func getKVRecord(tx *kvTx, key string, record interface{}) error {
+	value := tx.get(key)
+	if value == nil {
+		return errors.New("Not found")
+	}
+	return json.Unmarshal(value, record)
+}
+
+func putKVRecord(tx *kvTx, key string, record interface{}) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tx.put(key, value)
+	return nil
+}
+
+// createKVMailbox creates an empty mailbox with a UIDVALIDITY no other
+// mailbox has had.
+func createKVMailbox(tx *kvTx, user string, name string) error {
+	validity := newUIDValidity()
+	if last := tx.get(kvKey("v")); len(last) == 4 && binary.BigEndian.Uint32(last) >= validity {
+		validity = binary.BigEndian.Uint32(last) + 1
+	}
+	var last [4]byte
+	binary.BigEndian.PutUint32(last[:], validity)
+	tx.put(kvKey("v"), last[:])
+
+	return putKVRecord(tx, kvKey("m", user, name), &kvMailboxRecord{
+		UIDValidity: validity,
+		NextUID:     1,
+	})
+}
+
+// KVUser is a user in a KVMailstore.
+type KVUser struct {
+	store *KVMailstore
+	name  string
+}
+
+// kvMailboxName returns the name a mailbox is stored under. INBOX is case
+// insensitive.
+func kvMailboxName(name string) (string, error) {
+	levels := strings.Split(name, "/")
+	if strings.EqualFold(levels[0], "INBOX") {
+		levels[0] = "INBOX"
+	}
+	for _, level := range levels {
+		if level == "" || strings.Contains(level, kvSeparator) {
+			return "", errors.New("Invalid mailbox name")
+		}
+	}
+	return strings.Join(levels, "/"), nil
+}
+
+// mailboxNames returns the names of all the user's mailboxes, sorted.
+func (u *KVUser) mailboxNames(tx *kvTx) []string {
+	prefix := kvKey("m", u.name, "")
+	var names []string
+	tx.scan(prefix, func(key string, value []byte) bool {
+		names = append(names, strings.TrimPrefix(key, prefix))
+		return true
+	})
+	return names
+}
+
+// Mailboxes implements the Mailboxes method on the User interface
+func (u *KVUser) Mailboxes() []Mailbox {
+	var names []string
+	u.store.db.view(func(tx *kvTx) error {
+		names = u.mailboxNames(tx)
+		return nil
+	})
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i] == "INBOX" && names[j] != "INBOX"
+	})
+
+	mailboxes := make([]Mailbox, len(names))
+	for i, name := range names {
+		mailboxes[i] = u.store.mailbox(u.name, name)
+	}
+	return mailboxes
+}
+
+// MailboxByName implements the MailboxByName method on the User interface
+func (u *KVUser) MailboxByName(name string) (Mailbox, error) {
+	name, err := kvMailboxName(name)
+	if err != nil {
+		return nil, errors.New("Invalid mailbox")
+	}
+	var exists bool
+	u.store.db.view(func(tx *kvTx) error {
+		exists = tx.get(kvKey("m", u.name, name)) != nil
+		return nil
+	})
+	if !exists {
+		return nil, errors.New("Invalid mailbox")
+	}
+	return u.store.mailbox(u.name, name), nil
+}
+
+// CreateMailbox implements the CreateMailbox method on the MailboxManager
+// interface
+func (u *KVUser) CreateMailbox(name string) (Mailbox, error) {
+	name, err := kvMailboxName(strings.TrimSuffix(name, "/"))
+	if err != nil {
+		return nil, err
+	}
+	err = u.store.db.update(func(tx *kvTx) error {
+		if tx.get(kvKey("m", u.name, name)) != nil {
+			return errors.New("Mailbox already exists")
+		}
+		levels := strings.Split(name, "/")
+		for i := 1; i <= len(levels); i++ {
+			superior := strings.Join(levels[:i], "/")
+			if tx.get(kvKey("m", u.name, superior)) != nil {
+				continue
+			}
+			if err := createKVMailbox(tx, u.name, superior); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.store.mailbox(u.name, name), nil
+}
+
+// DeleteMailbox implements the DeleteMailbox method on the MailboxManager
+// interface
+func (u *KVUser) DeleteMailbox(name string) error {
+	name, err := kvMailboxName(name)
+	if err != nil {
+		return errors.New("Invalid mailbox")
+	}
+	if name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	var files []string
+	err = u.store.db.update(func(tx *kvTx) error {
+		if tx.get(kvKey("m", u.name, name)) == nil {
+			return errors.New("Invalid mailbox")
+		}
+		tx.delete(kvKey("m", u.name, name))
+		for _, kind := range []string{"i", "c"} {
+			tx.scan(kvKey(kind, u.name, name, ""), func(key string, value []byte) bool {
+				if kind == "c" {
+					files = append(files, string(value))
+				}
+				tx.delete(key)
+				return true
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.store.removeFiles(files)
+	u.store.forget(u.name, name)
+	return nil
+}
+
+// RenameMailbox implements the RenameMailbox method on the MailboxManager
+// interface
+func (u *KVUser) RenameMailbox(oldName string, newName string) error {
+	oldName, err := kvMailboxName(oldName)
+	if err != nil {
+		return errors.New("Invalid mailbox")
+	}
+	newName, err = kvMailboxName(newName)
+	if err != nil {
+		return errors.New("Invalid mailbox name")
+	}
+	if strings.HasPrefix(newName, oldName+"/") && oldName != "INBOX" {
+		return errors.New("Cannot rename a mailbox to one of its inferiors")
+	}
+
+	var renamed []string
+	err = u.store.db.update(func(tx *kvTx) error {
+		if tx.get(kvKey("m", u.name, oldName)) == nil {
+			return errors.New("Invalid mailbox")
+		}
+		if tx.get(kvKey("m", u.name, newName)) != nil {
+			return errors.New("Mailbox already exists")
+		}
+
+		// Find the mailboxes to move. INBOX's inferiors stay where they are.
+		moves := map[string]string{oldName: newName}
+		if oldName != "INBOX" {
+			for _, name := range u.mailboxNames(tx) {
+				if strings.HasPrefix(name, oldName+"/") {
+					moves[name] = newName + strings.TrimPrefix(name, oldName)
+				}
+			}
+		}
+
+		// Create any missing superiors of the new name
+		levels := strings.Split(newName, "/")
+		for i := 1; i < len(levels); i++ {
+			superior := strings.Join(levels[:i], "/")
+			if tx.get(kvKey("m", u.name, superior)) == nil {
+				if err := createKVMailbox(tx, u.name, superior); err != nil {
+					return err
+				}
+			}
+		}
+
+		for from, to := range moves {
+			moveKVMailbox(tx, u.name, from, to)
+			renamed = append(renamed, from)
+		}
+
+		// INBOX always exists
+		if oldName == "INBOX" {
+			return createKVMailbox(tx, u.name, "INBOX")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.store.forget(u.name, renamed...)
+	return nil
+}
+
+// moveKVMailbox moves a mailbox and its messages to a new name. The messages
+// keep their UIDs, so the mailbox keeps its UIDVALIDITY.
+func moveKVMailbox(tx *kvTx, user string, from string, to string) {
+	for _, kind := range []string{"m", "i", "c"} {
+		prefix := kvKey(kind, user, from)
+		var keys []string
+		tx.scan(prefix, func(key string, value []byte) bool {
+			rest := strings.TrimPrefix(key, prefix)
+			if rest == "" || strings.HasPrefix(rest, kvSeparator) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			tx.put(kvKey(kind, user, to)+strings.TrimPrefix(key, prefix), tx.get(key))
+			tx.delete(key)
+		}
+	}
+}
+
+// Subscribe implements the Subscribe method on the SubscriptionManager
+// interface
+func (u *KVUser) Subscribe(name string) error {
+	if strings.Contains(name, kvSeparator) {
+		return errors.New("Invalid mailbox name")
+	}
+	return u.store.db.update(func(tx *kvTx) error {
+		tx.put(kvKey("s", u.name, name), []byte{})
+		return nil
+	})
+}
+
+// Unsubscribe implements the Unsubscribe method on the SubscriptionManager
+// interface
+func (u *KVUser) Unsubscribe(name string) error {
+	return u.store.db.update(func(tx *kvTx) error {
+		if _, ok := tx.lookup(kvKey("s", u.name, name)); !ok {
+			return errors.New("Not subscribed to mailbox")
+		}
+		tx.delete(kvKey("s", u.name, name))
+		return nil
+	})
+}
+
+// Subscriptions implements the Subscriptions method on the
+// SubscriptionManager interface
+func (u *KVUser) Subscriptions() []string {
+	subscriptions := []string{}
+	prefix := kvKey("s", u.name, "")
+	u.store.db.view(func(tx *kvTx) error {
+		tx.scan(prefix, func(key string, value []byte) bool {
+			subscriptions = append(subscriptions, strings.TrimPrefix(key, prefix))
+			return true
+		})
+		return nil
+	})
+	return subscriptions
+}
+
+// KVMailbox is a mailbox in a KVMailstore.
+type KVMailbox struct {
+	store   *KVMailstore
+	user    string
+	name    string
+	updates Broadcaster
+}
+
+// Watch implements the Watch method on the Notifier interface
+func (m *KVMailbox) Watch() *Watcher { return m.updates.Watch() }
+
+// Name implements the Name method on the Mailbox interface
+func (m *KVMailbox) Name() string { return m.name }
+
+// record returns the mailbox's record, which is empty if the mailbox has
+// been deleted.
+func (m *KVMailbox) record() kvMailboxRecord {
+	var record kvMailboxRecord
+	m.store.db.view(func(tx *kvTx) error {
+		return getKVRecord(tx, kvKey("m", m.user, m.name), &record)
+	})
+	return record
+}
+
+// messages returns the state of every message in the mailbox, in UID order.
+func (m *KVMailbox) messages(tx *kvTx) []*kvMessageRecord {
+	var records []*kvMessageRecord
+	tx.scan(kvKey("i", m.user, m.name, ""), func(key string, value []byte) bool {
+		record := &kvMessageRecord{}
+		if json.Unmarshal(value, record) == nil {
+			records = append(records, record)
+		}
+		return true
+	})
+	return records
+}
+
+// snapshot returns the state of every message in the mailbox.
+func (m *KVMailbox) snapshot() []*kvMessageRecord {
+	var records []*kvMessageRecord
+	m.store.db.view(func(tx *kvTx) error {
+		records = m.messages(tx)
+		return nil
+	})
+	return records
+}
+
+// message returns a message given its state and sequence number.
+func (m *KVMailbox) message(record *kvMessageRecord, seqno int) *KVMessage {
+	return &KVMessage{
+		mailbox:        m,
+		uid:            record.UID,
+		sequenceNumber: uint32(seqno),
+		flags:          record.Flags,
+		keywords:       record.Keywords,
+		internalDate:   record.InternalDate,
+		size:           record.Size,
+	}
+}
+
+// UIDValidity returns the UIDVALIDITY of the mailbox. It is different for
+// every mailbox ever created in the database.
+func (m *KVMailbox) UIDValidity() uint32 { return m.record().UIDValidity }
+
+// NextUID implements the NextUID method on the Mailbox interface
+func (m *KVMailbox) NextUID() uint32 { return m.record().NextUID }
+
+// LastUID implements the LastUID method on the Mailbox interface
+func (m *KVMailbox) LastUID() uint32 {
+	records := m.snapshot()
+	if len(records) == 0 {
+		return m.NextUID()
+	}
+	return records[len(records)-1].UID
+}
+
+// Recent implements the Recent method on the Mailbox interface
+func (m *KVMailbox) Recent() uint32 {
+	var count uint32
+	for _, record := range m.snapshot() {
+		if record.Flags.HasFlags(types.FlagRecent) {
+			count++
+		}
+	}
+	return count
+}
+
+// Messages implements the Messages method on the Mailbox interface
+func (m *KVMailbox) Messages() uint32 { return uint32(len(m.snapshot())) }
+
+// Unseen implements the Unseen method on the Mailbox interface
+func (m *KVMailbox) Unseen() uint32 {
+	var count uint32
+	for _, record := range m.snapshot() {
+		if !record.Flags.HasFlags(types.FlagSeen) {
+			count++
+		}
+	}
+	return count
+}
+
+// MessageBySequenceNumber implements the MessageBySequenceNumber method on
+// the Mailbox interface
+func (m *KVMailbox) MessageBySequenceNumber(seqno uint32) Message {
+	records := m.snapshot()
+	if seqno == 0 || seqno > uint32(len(records)) {
+		return nil
+	}
+	return m.message(records[seqno-1], int(seqno))
+}
+
+// MessageByUID implements the MessageByUID method on the Mailbox interface
+func (m *KVMailbox) MessageByUID(uidno uint32) Message {
+	records := m.snapshot()
+	i := sort.Search(len(records), func(i int) bool { return records[i].UID >= uidno })
+	if i == len(records) || records[i].UID != uidno {
+		return nil
+	}
+	return m.message(records[i], i+1)
+}
+
+// MessageSetByUID implements the MessageSetByUID method on the Mailbox
+// interface
+func (m *KVMailbox) MessageSetByUID(set types.SequenceSet) []Message {
+	records := m.snapshot()
+	msgs := make([]Message, 0)
+	if len(records) == 0 {
+		return msgs
+	}
+	last := records[len(records)-1].UID
+	for i, record := range records {
+		if inSequenceSet(set, record.UID, last) {
+			msgs = append(msgs, m.message(record, i+1))
+		}
+	}
+	return msgs
+}
+
+// MessageSetBySequenceNumber implements the MessageSetBySequenceNumber
+// method on the Mailbox interface
+func (m *KVMailbox) MessageSetBySequenceNumber(set types.SequenceSet) []Message {
+	records := m.snapshot()
+	msgs := make([]Message, 0)
+	for i, record := range records {
+		if inSequenceSet(set, uint32(i)+1, uint32(len(records))) {
+			msgs = append(msgs, m.message(record, i+1))
+		}
+	}
+	return msgs
+}
+
+// NewMessage implements the NewMessage method on the Mailbox interface
+func (m *KVMailbox) NewMessage() Message {
+	return &KVMessage{
+		mailbox:      m,
+		header:       make(textproto.MIMEHeader),
+		internalDate: time.Now(),
+	}
+}
+
+// DeleteFlaggedMessages implements the DeleteFlaggedMessages method on the
+// Mailbox interface
+func (m *KVMailbox) DeleteFlaggedMessages() ([]Message, error) {
+	return m.deleteFlagged(nil)
+}
+
+// DeleteFlaggedMessagesByUID implements the UIDExpunger interface
+func (m *KVMailbox) DeleteFlaggedMessagesByUID(set types.SequenceSet) ([]Message, error) {
+	return m.deleteFlagged(set)
+}
+
+// deleteFlagged deletes the flagged messages whose UIDs are in set, or all
+// of them if set is nil.
+func (m *KVMailbox) deleteFlagged(set types.SequenceSet) ([]Message, error) {
+	var deleted []Message
+	var files []string
+	err := m.store.db.update(func(tx *kvTx) error {
+		records := m.messages(tx)
+		for i, record := range records {
+			if !record.Flags.HasFlags(types.FlagDeleted) {
+				continue
+			}
+			if set != nil && !inSequenceSet(set, record.UID, records[len(records)-1].UID) {
+				continue
+			}
+			files = append(files, string(tx.get(kvUIDKey("c", m.user, m.name, record.UID))))
+			tx.delete(kvUIDKey("i", m.user, m.name, record.UID))
+			tx.delete(kvUIDKey("c", m.user, m.name, record.UID))
+			deleted = append(deleted, m.message(record, i+1))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.store.removeFiles(files)
+
+	for _, msg := range deleted {
+		m.updates.Notify(Update{Type: UpdateExpunge, UID: msg.UID()})
+	}
+	return deleted, nil
+}
+
+// KVMessage is a message in a KVMailstore. Its header is read from the
+// database when first needed.
+type KVMessage struct {
+	mailbox        *KVMailbox
+	uid            uint32
+	sequenceNumber uint32
+	flags          types.Flags
+	keywords       []string
+	internalDate   time.Time
+	size           uint32
+
+	header    textproto.MIMEHeader // nil until the header has been read
+	headerSet bool                 // The header has been replaced
+	body      io.Reader            // The new body, if it has been replaced
+}
+
+// open opens the file holding the message as it is stored.
+func (m *KVMessage) open() (*os.File, error) {
+	var name []byte
+	m.mailbox.store.db.view(func(tx *kvTx) error {
+		name = tx.get(kvUIDKey("c", m.mailbox.user, m.mailbox.name, m.uid))
+		return nil
+	})
+	if name == nil {
+		return nil, errors.New("Message has been deleted")
+	}
+	return os.Open(filepath.Join(m.mailbox.store.dir, string(name)))
+}
+
+// Header implements the Header method on the Message interface
+func (m *KVMessage) Header() textproto.MIMEHeader {
+	if m.header == nil {
+		var header string
+		if f, err := m.open(); err == nil {
+			header, _, _ = util.ReadHeader(bufio.NewReader(f))
+			f.Close()
+		}
+		m.header = util.ParseHeader(header)
+	}
+	return m.header
+}
+
+// UID implements the UID method on the Message interface
+func (m *KVMessage) UID() uint32 { return m.uid }
+
+// SequenceNumber implements the SequenceNumber method on the Message
+// interface
+func (m *KVMessage) SequenceNumber() uint32 { return m.sequenceNumber }
+
+// Size implements the Size method on the Message interface
+func (m *KVMessage) Size() uint32 { return m.size }
+
+// InternalDate implements the InternalDate method on the Message interface
+func (m *KVMessage) InternalDate() time.Time { return m.internalDate }
+
+// Open implements the Open method on the Message interface. Changes to the
+// message aren't seen until it has been saved.
+func (m *KVMessage) Open() (io.ReadCloser, error) {
+	if m.uid == 0 {
+		return nil, errors.New("Message has not been saved")
+	}
+	return m.open()
+}
+
+// Keywords implements the Keywords method on the Message interface
+func (m *KVMessage) Keywords() []string {
+	if m.keywords == nil {
+		return []string{}
+	}
+	return m.keywords
+}
+
+// AddKeywords implements the AddKeywords method on the Message interface
+func (m *KVMessage) AddKeywords(keywords ...string) Message {
+	m.keywords = types.AddKeywords(m.keywords, keywords...)
+	return m
+}
+
+// RemoveKeywords implements the RemoveKeywords method on the Message
+// interface
+func (m *KVMessage) RemoveKeywords(keywords ...string) Message {
+	m.keywords = types.RemoveKeywords(m.keywords, keywords...)
+	return m
+}
+
+// Flags implements the Flags method on the Message interface
+func (m *KVMessage) Flags() types.Flags { return m.flags }
+
+// OverwriteFlags implements the OverwriteFlags method on the Message
+// interface
+func (m *KVMessage) OverwriteFlags(newFlags types.Flags) Message {
+	m.flags = newFlags
+	return m
+}
+
+// AddFlags implements the AddFlags method on the Message interface
+func (m *KVMessage) AddFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.SetFlags(newFlags)
+	return m
+}
+
+// RemoveFlags implements the RemoveFlags method on the Message interface
+func (m *KVMessage) RemoveFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.ResetFlags(newFlags)
+	return m
+}
+
+// SetHeaders implements the SetHeaders method on the Message interface
+func (m *KVMessage) SetHeaders(newHeader textproto.MIMEHeader) Message {
+	m.header = newHeader
+	m.headerSet = true
+	return m
+}
+
+// SetBody implements the SetBody method on the Message interface. The body
+// is read when the message is saved.
+func (m *KVMessage) SetBody(newBody io.Reader) Message {
+	m.body = newBody
+	return m
+}
+
+// writeContent writes the message to be stored to a new file, from its new
+// header and body with CRLF line endings. Whichever hasn't been replaced is
+// kept from the stored message. It returns the name and size of the file.
+func (m *KVMessage) writeContent() (string, uint32, error) {
+	header := m.Header()
+	body := m.body
+	if body == nil {
+		body = strings.NewReader("")
+		if m.uid != 0 {
+			old, err := m.open()
+			if err != nil {
+				return "", 0, err
+			}
+			defer old.Close()
+			r := bufio.NewReader(old)
+			util.ReadHeader(r)
+			body = r
+		}
+	}
+
+	f, err := ioutil.TempFile(m.mailbox.store.dir, "msg-")
+	if err != nil {
+		return "", 0, err
+	}
+	w := bufio.NewWriter(f)
+	n, err := util.WriteMIMEHeader(w, header)
+	size := int64(n)
+	if err == nil {
+		n, err = w.WriteString("\r\n")
+		size += int64(n)
+	}
+	if err == nil {
+		var copied int64
+		copied, err = io.Copy(w, newLineReader(body, "\r\n"))
+		size += copied
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return filepath.Base(f.Name()), uint32(size), nil
+}
+
+// Save implements the Save method on the Message interface. The message's
+// state and content are saved in a single transaction.
+func (m *KVMessage) Save() (Message, error) {
+	mailbox := m.mailbox
+	saved := *m
+	changed := saved.headerSet || saved.body != nil || saved.uid == 0
+	var file, oldFile string
+	if changed {
+		var err error
+		if file, saved.size, err = saved.writeContent(); err != nil {
+			return m, err
+		}
+	}
+	if saved.uid == 0 {
+		// Messages are recent in the mailbox they are added to
+		saved.flags = saved.flags.SetFlags(types.FlagRecent)
+	}
+
+	update := UpdateFlags
+	err := mailbox.store.db.update(func(tx *kvTx) error {
+		var record kvMailboxRecord
+		if err := getKVRecord(tx, kvKey("m", mailbox.user, mailbox.name), &record); err != nil {
+			return errors.New("Mailbox has been deleted")
+		}
+
+		if saved.uid == 0 {
+			update = UpdateExists
+			saved.uid = record.NextUID
+			record.NextUID++
+			if err := putKVRecord(tx, kvKey("m", mailbox.user, mailbox.name), &record); err != nil {
+				return err
+			}
+			saved.sequenceNumber = uint32(len(mailbox.messages(tx))) + 1
+		} else if tx.get(kvUIDKey("i", mailbox.user, mailbox.name, saved.uid)) == nil {
+			return errors.New("Message has been deleted")
+		}
+
+		if changed {
+			key := kvUIDKey("c", mailbox.user, mailbox.name, saved.uid)
+			oldFile = string(tx.get(key))
+			tx.put(key, []byte(file))
+		}
+		return putKVRecord(tx, kvUIDKey("i", mailbox.user, mailbox.name, saved.uid), &kvMessageRecord{
+			UID:          saved.uid,
+			Flags:        saved.flags,
+			Keywords:     saved.keywords,
+			InternalDate: saved.internalDate,
+			Size:         saved.size,
+		})
+	})
+	if err != nil {
+		if changed {
+			mailbox.store.removeFiles([]string{file})
+		}
+		return m, err
+	}
+	if oldFile != "" {
+		mailbox.store.removeFiles([]string{oldFile})
+	}
+
+	saved.headerSet, saved.body = false, nil
+	mailbox.updates.Notify(Update{Type: update, UID: saved.uid, Flags: saved.flags, Keywords: saved.keywords})
+	return &saved, nil
+}
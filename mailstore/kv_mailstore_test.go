@@ -0,0 +1,269 @@
+package mailstore
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+func openTestKVMailstore(t *testing.T, path string) *KVMailstore {
+	store, err := OpenKVMailstore(path)
+	if err != nil {
+		t.Fatalf("Error opening mailstore: %s", err)
+	}
+	return store
+}
+
+func kvTestInbox(t *testing.T, store *KVMailstore) *KVMailbox {
+	user, err := store.Authenticate("username", "password")
+	if err != nil {
+		t.Fatalf("Error getting user: %s", err)
+	}
+	mailbox, err := user.MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Error getting INBOX: %s", err)
+	}
+	return mailbox.(*KVMailbox)
+}
+
+func addKVTestMessage(t *testing.T, mailbox Mailbox, subject string) Message {
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Subject", subject)
+	msg, err := mailbox.NewMessage().SetHeaders(hdr).SetBody(strings.NewReader("Hello\r\n")).Save()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return msg
+}
+
+func TestKVAuthenticate(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	store := openTestKVMailstore(t, filepath.Join(root, "mail.db"))
+	defer store.Close()
+
+	if err := store.AddUser("username", "password"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := store.AddUser("username", "other"); err == nil {
+		t.Errorf("Expected an error adding an existing user")
+	}
+	if _, err := store.Authenticate("username", "wrong"); err == nil {
+		t.Errorf("Expected an incorrect password to be refused")
+	}
+	if _, err := store.Authenticate("nobody", "password"); err == nil {
+		t.Errorf("Expected an unknown user to be refused")
+	}
+
+	store.SetPassword("username", "changed")
+	if _, err := store.Authenticate("username", "changed"); err != nil {
+		t.Errorf("Expected the new password to be accepted")
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// The test vectors from RFC 7914 section 11
+	vectors := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, v := range vectors {
+		key := pbkdf2SHA256([]byte(v.password), []byte(v.salt), v.iterations, 64)
+		if hex.EncodeToString(key) != v.key {
+			t.Errorf("Expected %s for %q and %q, got %x", v.key, v.password, v.salt, key)
+		}
+	}
+}
+
+func TestKVMessages(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "mail.db")
+
+	store := openTestKVMailstore(t, path)
+	store.AddUser("username", "password")
+	inbox := kvTestInbox(t, store)
+	watcher := inbox.Watch()
+	defer watcher.Close()
+
+	for _, subject := range []string{"One", "Two", "Three"} {
+		addKVTestMessage(t, inbox, subject)
+	}
+	msg := inbox.MessageByUID(2).AddFlags(types.FlagDeleted)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	deleted, err := inbox.DeleteFlaggedMessages()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assertMessageUIDs(t, deleted, []uint32{2})
+
+	updates := watcher.Updates()
+	if len(updates) != 5 || updates[4].Type != UpdateExpunge {
+		t.Errorf("Expected 3 new messages, a flag change and an expunge, got %v", updates)
+	}
+	validity := inbox.UIDValidity()
+	store.Close()
+
+	store = openTestKVMailstore(t, path)
+	defer store.Close()
+	inbox = kvTestInbox(t, store)
+	if inbox.UIDValidity() != validity || inbox.NextUID() != 4 {
+		t.Errorf("Expected UIDVALIDITY and next UID to be kept")
+	}
+	msgs := inbox.MessageSetBySequenceNumber(types.SequenceSet{{Min: "1", Max: "*"}})
+	assertMessageUIDs(t, msgs, []uint32{1, 3})
+	if msgs[1].Header().Get("Subject") != "Three" || messageBody(t, msgs[1]) != "Hello\r\n" {
+		t.Errorf("Expected the message content to be kept")
+	}
+	if msgs[1].SequenceNumber() != 2 || !msgs[1].Flags().HasFlags(types.FlagRecent) {
+		t.Errorf("Expected sequence number 2 and \\Recent, got %d and %s",
+			msgs[1].SequenceNumber(), msgs[1].Flags())
+	}
+}
+
+func TestKVConcurrentAppends(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	store := openTestKVMailstore(t, filepath.Join(root, "mail.db"))
+	defer store.Close()
+	store.AddUser("username", "password")
+	inbox := kvTestInbox(t, store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addKVTestMessage(t, inbox, "Concurrent")
+		}()
+	}
+	wg.Wait()
+
+	if inbox.Messages() != 10 || inbox.NextUID() != 11 {
+		t.Errorf("Expected 10 messages with distinct UIDs, got %d and next UID %d",
+			inbox.Messages(), inbox.NextUID())
+	}
+}
+
+func TestKVFolders(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	store := openTestKVMailstore(t, filepath.Join(root, "mail.db"))
+	defer store.Close()
+	store.AddUser("username", "password")
+	user, _ := store.Authenticate("username", "password")
+	manager := user.(*KVUser)
+
+	work, err := manager.CreateMailbox("Work/Project")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	addKVTestMessage(t, work, "Plans")
+	addKVTestMessage(t, kvTestInbox(t, store), "Hi")
+
+	if err := manager.RenameMailbox("Work", "Archive/Work"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := manager.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var names []string
+	for _, mailbox := range user.Mailboxes() {
+		names = append(names, mailbox.Name())
+	}
+	expected := "INBOX Archive Archive/Work Archive/Work/Project Old"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected mailboxes %s, got %s", expected, strings.Join(names, " "))
+	}
+
+	project, _ := user.MailboxByName("Archive/Work/Project")
+	if project.Messages() != 1 || project.MessageByUID(1).Header().Get("Subject") != "Plans" {
+		t.Errorf("Expected messages to move with their mailbox")
+	}
+	if inbox := kvTestInbox(t, store); inbox.Messages() != 0 {
+		t.Errorf("Expected INBOX to be empty after renaming it")
+	}
+
+	if err := manager.DeleteMailbox("Old"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := user.MailboxByName("Old"); err == nil {
+		t.Errorf("Expected the mailbox to be deleted")
+	}
+}
+
+func TestKVMessageFiles(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := filepath.Join(root, "mail.db")
+	store := openTestKVMailstore(t, path)
+	store.AddUser("username", "password")
+	inbox := kvTestInbox(t, store)
+
+	// Message content is streamed from its own file, not the database
+	body := strings.Repeat("Large attachment\r\n", 100000)
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Subject", "Large")
+	msg, err := inbox.NewMessage().SetHeaders(hdr).SetBody(strings.NewReader(body)).Save()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info, _ := os.Stat(path); info.Size() > int64(len(body))/10 {
+		t.Errorf("Expected the content to be kept out of the database, which is %d bytes", info.Size())
+	}
+	r, err := msg.Open()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := r.(*os.File); !ok {
+		t.Errorf("Expected the content to be read from a file, got %T", r)
+	}
+	r.Close()
+	if !strings.HasSuffix(messageBody(t, msg), body) || msg.Size() != uint32(len("Subject: Large\r\n\r\n")+len(body)) {
+		t.Errorf("Expected the content to be kept")
+	}
+
+	// Replacing the content replaces the file
+	hdr.Set("Subject", "Renamed")
+	if msg, err = msg.SetHeaders(hdr).Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasSuffix(messageBody(t, msg), body) || inbox.MessageByUID(1).Header().Get("Subject") != "Renamed" {
+		t.Errorf("Expected the body to be kept with the new header")
+	}
+	if files, _ := ioutil.ReadDir(store.dir); len(files) != 1 {
+		t.Errorf("Expected the old file to be removed, got %d files", len(files))
+	}
+
+	// Deleted messages' files are removed, and so are files left by a crash
+	msg.AddFlags(types.FlagDeleted).Save()
+	if _, err := inbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(store.dir); len(files) != 0 {
+		t.Errorf("Expected the file to be removed, got %d files", len(files))
+	}
+	ioutil.WriteFile(filepath.Join(store.dir, "msg-unused"), []byte(body), 0600)
+	store.Close()
+	store = openTestKVMailstore(t, path)
+	defer store.Close()
+	if files, _ := ioutil.ReadDir(store.dir); len(files) != 0 {
+		t.Errorf("Expected unused files to be removed, got %d files", len(files))
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package mailstore
+
+import "os"
+
+// lockFile does nothing where flock isn't available, so only one process
+// must be trusted to open a file at a time.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// processRunning can't tell whether a process is running here, so lock
+// files are only taken to be stale by their age.
+func processRunning(pid int) (running bool, known bool) {
+	return false, false
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package mailstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on an open file, failing straight away
+// if another process holds it. The lock is released when the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// processRunning returns whether a process is running, which can always be
+// told here. A process owned by another user still exists if signalling it
+// isn't permitted.
+func processRunning(pid int) (running bool, known bool) {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM, true
+}
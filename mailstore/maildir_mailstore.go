@@ -0,0 +1,1558 @@
+package mailstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+const (
+	// maildirDelimiter separates the levels of mailbox names shown to clients
+	maildirDelimiter = "/"
+
+	// maildirUIDList is the file in each Maildir folder which records the
+	// UID of each message, in the format used by Dovecot
+	maildirUIDList = "dovecot-uidlist"
+
+	// maildirKeywordList is the file in each Maildir folder which gives the
+	// keyword recorded by each lowercase letter in filenames, in the format
+	// used by Dovecot
+	maildirKeywordList = "dovecot-keywords"
+
+	// maildirMaxKeywords is the number of keywords a folder can hold, one
+	// for each lowercase letter
+	maildirMaxKeywords = 26
+)
+
+// maildirFlags maps the letters used in the info part of a Maildir filename
+// to IMAP flags
+var maildirFlags = map[byte]types.Flags{
+	'D': types.FlagDraft,
+	'F': types.FlagFlagged,
+	'R': types.FlagAnswered,
+	'S': types.FlagSeen,
+	'T': types.FlagDeleted,
+}
+
+// maildirDeliveries counts the messages delivered by this process, to keep
+// filenames unique
+var maildirDeliveries uint32
+
+// MaildirMailstore is a Mailstore which keeps each user's mail in a Maildir,
+// with folders in the Maildir++ layout. UIDs are recorded in the same
+// dovecot-uidlist files as Dovecot uses, so an existing mail spool can be
+// served without renumbering messages.
+type MaildirMailstore struct {
+	// Root is the directory holding each user's Maildir, named after the
+	// user. Maildirs are created as users first log in.
+	Root string
+
+	// CheckPassword returns true if the password is correct for the user. If
+	// it is nil, every login is refused.
+	CheckPassword func(username string, password string) bool
+
+	mu    sync.Mutex
+	users map[string]*MaildirUser
+}
+
+// NewMaildirMailstore creates a Mailstore serving the Maildirs in the root
+// directory.
+func NewMaildirMailstore(root string, checkPassword func(username string, password string) bool) *MaildirMailstore {
+	return &MaildirMailstore{
+		Root:          root,
+		CheckPassword: checkPassword,
+		users:         make(map[string]*MaildirUser),
+	}
+}
+
+// MailboxType implements the MailboxTyper interface
+func (s *MaildirMailstore) MailboxType() Mailbox {
+	return &MaildirMailbox{}
+}
+
+// Authenticate implements the Authenticate method on the Mailstore interface
+func (s *MaildirMailstore) Authenticate(username string, password string) (User, error) {
+	if s.CheckPassword == nil || !s.CheckPassword(username, password) {
+		return nil, errors.New("Invalid username or password")
+	}
+	if !validUsername(username) {
+		return nil, errors.New("Invalid username")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == nil {
+		s.users = make(map[string]*MaildirUser)
+	}
+
+	// Users are shared between connections, so that changes made by one
+	// connection are seen by the others
+	user, ok := s.users[username]
+	if !ok {
+		user = &MaildirUser{
+			path:      filepath.Join(s.Root, username),
+			mailboxes: make(map[string]*MaildirMailbox),
+		}
+		if err := createMaildir(user.path, false); err != nil {
+			return nil, err
+		}
+		s.users[username] = user
+	}
+	return user, nil
+}
+
+// MaildirUser is a user's Maildir. The Maildir itself is INBOX, and other
+// mailboxes are Maildir++ folders within it.
+type MaildirUser struct {
+	path string
+
+	mu        sync.Mutex
+	mailboxes map[string]*MaildirMailbox // By folder path
+}
+
+// maildirFolder returns the name of the Maildir++ folder holding a mailbox,
+// or "" for INBOX. Each level of the name is escaped, as "." separates
+// levels on disk.
+func maildirFolder(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") {
+		return "", nil
+	}
+	levels := strings.Split(name, maildirDelimiter)
+	for i, level := range levels {
+		if level == "" {
+			return "", errors.New("Invalid mailbox name")
+		}
+		level = strings.Replace(level, "%", "%25", -1)
+		levels[i] = strings.Replace(level, ".", "%2E", -1)
+	}
+	return "." + strings.Join(levels, "."), nil
+}
+
+// maildirMailboxName reverses maildirFolder.
+func maildirMailboxName(folder string) string {
+	levels := strings.Split(strings.TrimPrefix(folder, "."), ".")
+	for i, level := range levels {
+		level = strings.Replace(level, "%2E", ".", -1)
+		levels[i] = strings.Replace(level, "%25", "%", -1)
+	}
+	return strings.Join(levels, maildirDelimiter)
+}
+
+// mailbox returns the shared mailbox for a folder.
+func (u *MaildirUser) mailbox(folder string) *MaildirMailbox {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	path := filepath.Join(u.path, folder)
+	mailbox, ok := u.mailboxes[path]
+	if !ok {
+		name := "INBOX"
+		if folder != "" {
+			name = maildirMailboxName(folder)
+		}
+		mailbox = &MaildirMailbox{name: name, path: path}
+		u.mailboxes[path] = mailbox
+	}
+	return mailbox
+}
+
+// forget drops shared mailboxes for folders which have been deleted or
+// renamed.
+func (u *MaildirUser) forget(folders ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, folder := range folders {
+		delete(u.mailboxes, filepath.Join(u.path, folder))
+	}
+}
+
+// folders returns the names of all Maildir++ folders, in sorted order.
+func (u *MaildirUser) folders() []string {
+	entries, err := ioutil.ReadDir(u.path)
+	if err != nil {
+		return nil
+	}
+	folders := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if isDir(filepath.Join(u.path, name, "cur")) {
+			folders = append(folders, name)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// Mailboxes implements the Mailboxes method on the User interface
+func (u *MaildirUser) Mailboxes() []Mailbox {
+	mailboxes := []Mailbox{u.mailbox("")}
+	for _, folder := range u.folders() {
+		mailboxes = append(mailboxes, u.mailbox(folder))
+	}
+	return mailboxes
+}
+
+// MailboxByName implements the MailboxByName method on the User interface
+func (u *MaildirUser) MailboxByName(name string) (Mailbox, error) {
+	folder, err := maildirFolder(name)
+	if err != nil || !isDir(filepath.Join(u.path, folder, "cur")) {
+		return nil, errors.New("Invalid mailbox")
+	}
+	return u.mailbox(folder), nil
+}
+
+// createSuperiors creates any missing folders above the given name in the
+// hierarchy.
+func (u *MaildirUser) createSuperiors(name string) error {
+	levels := strings.Split(name, maildirDelimiter)
+	for i := 1; i < len(levels); i++ {
+		folder, err := maildirFolder(strings.Join(levels[:i], maildirDelimiter))
+		if err != nil {
+			return err
+		}
+		if err := createMaildir(filepath.Join(u.path, folder), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateMailbox implements the CreateMailbox method on the MailboxManager
+// interface
+func (u *MaildirUser) CreateMailbox(name string) (Mailbox, error) {
+	name = strings.TrimSuffix(name, maildirDelimiter)
+	folder, err := maildirFolder(name)
+	if err != nil {
+		return nil, err
+	}
+	if folder == "" || isDir(filepath.Join(u.path, folder)) {
+		return nil, errors.New("Mailbox already exists")
+	}
+
+	if err := u.createSuperiors(name); err != nil {
+		return nil, err
+	}
+	if err := createMaildir(filepath.Join(u.path, folder), true); err != nil {
+		return nil, err
+	}
+	return u.mailbox(folder), nil
+}
+
+// DeleteMailbox implements the DeleteMailbox method on the MailboxManager
+// interface. Inferior mailboxes are separate folders in Maildir++, so they
+// are left untouched.
+func (u *MaildirUser) DeleteMailbox(name string) error {
+	folder, err := maildirFolder(name)
+	if err != nil {
+		return errors.New("Invalid mailbox")
+	}
+	if folder == "" {
+		return errors.New("Cannot delete INBOX")
+	}
+	path := filepath.Join(u.path, folder)
+	if !isDir(path) {
+		return errors.New("Invalid mailbox")
+	}
+
+	u.forget(folder)
+	return os.RemoveAll(path)
+}
+
+// RenameMailbox implements the RenameMailbox method on the MailboxManager
+// interface
+func (u *MaildirUser) RenameMailbox(oldName string, newName string) error {
+	oldFolder, err := maildirFolder(oldName)
+	if err != nil || !isDir(filepath.Join(u.path, oldFolder, "cur")) {
+		return errors.New("Invalid mailbox")
+	}
+	newFolder, err := maildirFolder(newName)
+	if err != nil {
+		return errors.New("Invalid mailbox name")
+	}
+	if newFolder == "" || isDir(filepath.Join(u.path, newFolder)) {
+		return errors.New("Mailbox already exists")
+	}
+	if oldFolder != "" && strings.HasPrefix(newFolder, oldFolder+".") {
+		return errors.New("Cannot rename a mailbox to one of its inferiors")
+	}
+	if err := u.createSuperiors(newName); err != nil {
+		return err
+	}
+
+	if oldFolder == "" {
+		return u.renameInbox(newFolder)
+	}
+
+	// Inferior folders share the folder's prefix, and are renamed with it
+	var renamed []string
+	for _, folder := range u.folders() {
+		if folder != oldFolder && !strings.HasPrefix(folder, oldFolder+".") {
+			continue
+		}
+		target := newFolder + strings.TrimPrefix(folder, oldFolder)
+		if err := os.Rename(filepath.Join(u.path, folder), filepath.Join(u.path, target)); err != nil {
+			return err
+		}
+		renamed = append(renamed, folder)
+	}
+	u.forget(renamed...)
+	return nil
+}
+
+// renameInbox moves every message in INBOX to a new folder. The messages
+// keep their UIDs, and INBOX continues from its next UID, so that no UID is
+// ever reused in either.
+func (u *MaildirUser) renameInbox(newFolder string) error {
+	inbox := u.mailbox("")
+	inbox.mu.Lock()
+	defer inbox.mu.Unlock()
+
+	unlock, err := lockUIDList(inbox.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	list, err := readUIDList(inbox.path)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(u.path, newFolder)
+	if err := createMaildir(target, true); err != nil {
+		return err
+	}
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(inbox.path, dir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			err := os.Rename(filepath.Join(inbox.path, dir, entry.Name()),
+				filepath.Join(target, dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	moved := &uidList{validity: newUIDValidity(), next: list.next, uids: list.uids}
+	if err := moved.write(target); err != nil {
+		return err
+	}
+	list.uids = make(map[string]uint32)
+	if err := list.write(inbox.path); err != nil {
+		return err
+	}
+
+	// Make sure INBOX notices its messages have gone. The UID list is
+	// already locked, so it is rescanned directly rather than with sync.
+	return inbox.rescan()
+}
+
+// Subscribe implements the Subscribe method on the SubscriptionManager
+// interface
+func (u *MaildirUser) Subscribe(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return subscribe(filepath.Join(u.path, "subscriptions"), name)
+}
+
+// Unsubscribe implements the Unsubscribe method on the SubscriptionManager
+// interface
+func (u *MaildirUser) Unsubscribe(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return unsubscribe(filepath.Join(u.path, "subscriptions"), name)
+}
+
+// Subscriptions implements the Subscriptions method on the
+// SubscriptionManager interface
+func (u *MaildirUser) Subscriptions() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return readSubscriptions(filepath.Join(u.path, "subscriptions"))
+}
+
+// MaildirMailbox is a Maildir folder. Its messages are kept in cur and new,
+// and the folder is rescanned whenever either directory changes, so mail
+// delivered by other programs shows up.
+type MaildirMailbox struct {
+	name string
+	path string
+
+	mu          sync.Mutex
+	loaded      bool
+	uidValidity uint32
+	nextUID     uint32
+	messages    []*maildirEntry // In UID order
+	keywords    []string        // Indexed by letter, "" if unused
+	newModTime  time.Time
+	curModTime  time.Time
+	updates     Broadcaster
+}
+
+// maildirEntry is a message file in a Maildir folder
+type maildirEntry struct {
+	uid          uint32
+	base         string // The unique part of the filename, before the info
+	flags        types.Flags
+	extra        string // Info letters which aren't IMAP flags, eg P for passed
+	internalDate time.Time
+	size         uint32
+}
+
+// filename returns the name of the message's file in cur.
+func (e *maildirEntry) filename() string {
+	return e.base + ":2," + maildirInfo(e.flags, e.extra)
+}
+
+// maildirInfo builds the info part of a filename from flags. The letters
+// must be in ASCII order.
+func maildirInfo(flags types.Flags, extra string) string {
+	letters := []byte(extra)
+	for letter, flag := range maildirFlags {
+		if flags.HasFlags(flag) {
+			letters = append(letters, letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters)
+}
+
+// parseMaildirFilename splits a filename into its unique part and flags.
+func parseMaildirFilename(filename string) (base string, flags types.Flags, extra string) {
+	base, info := filename, ""
+	if i := strings.Index(filename, ":"); i >= 0 {
+		base, info = filename[:i], filename[i+1:]
+	}
+	if !strings.HasPrefix(info, "2,") {
+		return base, 0, ""
+	}
+	for _, letter := range []byte(info[2:]) {
+		if flag, ok := maildirFlags[letter]; ok {
+			flags = flags.SetFlags(flag)
+		} else {
+			extra += string(letter)
+		}
+	}
+	return base, flags, extra
+}
+
+// maildirSize returns the size of a message with CRLF line endings, which
+// Dovecot records in the filename as W=<size>. It returns 0 if the filename
+// doesn't have the size, which then has to be counted.
+func maildirSize(base string) uint32 {
+	for _, field := range strings.Split(base, ",") {
+		if strings.HasPrefix(field, "W=") {
+			if size, err := strconv.ParseUint(field[2:], 10, 32); err == nil {
+				return uint32(size)
+			}
+		}
+	}
+	return 0
+}
+
+// Watch implements the Watch method on the Notifier interface. The folder is
+// scanned first, so that only changes made after watching starts are
+// reported.
+func (m *MaildirMailbox) Watch() *Watcher {
+	m.load()
+	defer m.mu.Unlock()
+	return m.updates.Watch()
+}
+
+// sync rescans the folder if anything has changed since it was last
+// scanned. The mailbox must be locked.
+func (m *MaildirMailbox) sync() error {
+	if m.loaded {
+		newInfo, err := os.Stat(filepath.Join(m.path, "new"))
+		if err != nil {
+			return err
+		}
+		curInfo, err := os.Stat(filepath.Join(m.path, "cur"))
+		if err != nil {
+			return err
+		}
+		if newInfo.ModTime().Equal(m.newModTime) && curInfo.ModTime().Equal(m.curModTime) {
+			return nil
+		}
+	}
+
+	unlock, err := lockUIDList(m.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.rescan()
+}
+
+// rescan reads the folder and brings the UID list up to date. The mailbox
+// and the UID list must be locked. Connections watching the mailbox are told
+// about any messages which have been added or removed, and any flags which
+// have changed.
+func (m *MaildirMailbox) rescan() error {
+	list, err := readUIDList(m.path)
+	if err != nil {
+		return err
+	}
+	keywords, err := readKeywordList(m.path)
+	if err != nil {
+		return err
+	}
+	m.keywords = keywords
+	listChanged := false
+	if list.validity == 0 {
+		list.validity = newUIDValidity()
+		listChanged = true
+	}
+
+	// Messages in new haven't been seen by any client, so they are recent.
+	// They are moved to cur now that a client is about to see them.
+	recent := make(map[string]bool)
+	newEntries, err := ioutil.ReadDir(filepath.Join(m.path, "new"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range newEntries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		base, flags, extra := parseMaildirFilename(entry.Name())
+		moved := &maildirEntry{base: base, flags: flags, extra: extra}
+		err := os.Rename(filepath.Join(m.path, "new", entry.Name()),
+			filepath.Join(m.path, "cur", moved.filename()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		recent[base] = true
+	}
+
+	newInfo, err := os.Stat(filepath.Join(m.path, "new"))
+	if err != nil {
+		return err
+	}
+	curInfo, err := os.Stat(filepath.Join(m.path, "cur"))
+	if err != nil {
+		return err
+	}
+	curEntries, err := ioutil.ReadDir(filepath.Join(m.path, "cur"))
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[uint32]*maildirEntry, len(m.messages))
+	for _, entry := range m.messages {
+		previous[entry.uid] = entry
+	}
+
+	messages := make([]*maildirEntry, 0, len(curEntries))
+	var unnumbered []*maildirEntry
+	found := make(map[string]bool, len(curEntries))
+	for _, file := range curEntries {
+		if strings.HasPrefix(file.Name(), ".") || file.IsDir() {
+			continue
+		}
+		base, flags, extra := parseMaildirFilename(file.Name())
+		entry := &maildirEntry{
+			base:         base,
+			flags:        flags,
+			extra:        extra,
+			internalDate: file.ModTime(),
+			size:         maildirSize(base),
+		}
+		found[base] = true
+
+		uid, ok := list.uids[base]
+		if !ok {
+			unnumbered = append(unnumbered, entry)
+			continue
+		}
+		entry.uid = uid
+		if recent[base] || previous[uid] != nil && previous[uid].flags.HasFlags(types.FlagRecent) {
+			entry.flags = entry.flags.SetFlags(types.FlagRecent)
+		}
+		messages = append(messages, entry)
+	}
+
+	// Forget the UIDs of messages which have been removed
+	for base := range list.uids {
+		if !found[base] {
+			delete(list.uids, base)
+			listChanged = true
+		}
+	}
+
+	// New messages are numbered in the order they were delivered. Maildir
+	// filenames begin with the delivery time.
+	sort.Slice(unnumbered, func(i, j int) bool {
+		if !unnumbered[i].internalDate.Equal(unnumbered[j].internalDate) {
+			return unnumbered[i].internalDate.Before(unnumbered[j].internalDate)
+		}
+		return unnumbered[i].base < unnumbered[j].base
+	})
+	for _, entry := range unnumbered {
+		entry.uid = list.next
+		list.next++
+		list.uids[entry.base] = entry.uid
+		entry.flags = entry.flags.SetFlags(types.FlagRecent)
+		messages = append(messages, entry)
+		listChanged = true
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].uid < messages[j].uid })
+
+	if listChanged {
+		if err := list.write(m.path); err != nil {
+			return err
+		}
+	}
+
+	if m.loaded {
+		m.notifyChanges(previous, messages)
+	}
+	m.loaded = true
+	m.uidValidity = list.validity
+	m.nextUID = list.next
+	m.messages = messages
+	m.newModTime = newInfo.ModTime()
+	m.curModTime = curInfo.ModTime()
+	return nil
+}
+
+// notifyChanges tells watchers about the differences between two scans.
+func (m *MaildirMailbox) notifyChanges(previous map[uint32]*maildirEntry, messages []*maildirEntry) {
+	current := make(map[uint32]bool, len(messages))
+	for _, entry := range messages {
+		current[entry.uid] = true
+	}
+	for _, entry := range m.messages {
+		if !current[entry.uid] {
+			m.updates.Notify(Update{Type: UpdateExpunge, UID: entry.uid})
+		}
+	}
+	for _, entry := range messages {
+		old, ok := previous[entry.uid]
+		if !ok {
+			m.updates.Notify(Update{Type: UpdateExists, UID: entry.uid, Flags: entry.flags,
+				Keywords: m.keywordsOf(entry.extra)})
+		} else if old.flags != entry.flags || old.extra != entry.extra {
+			m.updates.Notify(Update{Type: UpdateFlags, UID: entry.uid, Flags: entry.flags,
+				Keywords: m.keywordsOf(entry.extra)})
+		}
+	}
+}
+
+// load brings the mailbox up to date and locks it. Errors are ignored, as
+// the methods of the Mailbox interface have no way to report them; the
+// mailbox is left as it was last seen.
+func (m *MaildirMailbox) load() {
+	m.mu.Lock()
+	m.sync()
+}
+
+// Name implements the Name method on the Mailbox interface
+func (m *MaildirMailbox) Name() string { return m.name }
+
+// UIDValidity returns the UIDVALIDITY of the folder, which changes if its
+// UIDs are ever reassigned.
+func (m *MaildirMailbox) UIDValidity() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return m.uidValidity
+}
+
+// NextUID implements the NextUID method on the Mailbox interface
+func (m *MaildirMailbox) NextUID() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return m.nextUID
+}
+
+// LastUID implements the LastUID method on the Mailbox interface
+func (m *MaildirMailbox) LastUID() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		return m.nextUID
+	}
+	return m.messages[len(m.messages)-1].uid
+}
+
+// Recent implements the Recent method on the Mailbox interface
+func (m *MaildirMailbox) Recent() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	var count uint32
+	for _, entry := range m.messages {
+		if entry.flags.HasFlags(types.FlagRecent) {
+			count++
+		}
+	}
+	return count
+}
+
+// Messages implements the Messages method on the Mailbox interface
+func (m *MaildirMailbox) Messages() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return uint32(len(m.messages))
+}
+
+// Unseen implements the Unseen method on the Mailbox interface
+func (m *MaildirMailbox) Unseen() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	var count uint32
+	for _, entry := range m.messages {
+		if !entry.flags.HasFlags(types.FlagSeen) {
+			count++
+		}
+	}
+	return count
+}
+
+// message returns a copy of the message at the given index. The mailbox
+// must be locked.
+func (m *MaildirMailbox) message(index int) *MaildirMessage {
+	entry := m.messages[index]
+	return &MaildirMessage{
+		mailbox:        m,
+		uid:            entry.uid,
+		sequenceNumber: uint32(index) + 1,
+		base:           entry.base,
+		flags:          entry.flags,
+		keywords:       m.keywordsOf(entry.extra),
+		internalDate:   entry.internalDate,
+		size:           entry.size,
+	}
+}
+
+// indexOf returns the index of the message with the given UID, or -1. The
+// mailbox must be locked.
+func (m *MaildirMailbox) indexOf(uid uint32) int {
+	i := sort.Search(len(m.messages), func(i int) bool { return m.messages[i].uid >= uid })
+	if i < len(m.messages) && m.messages[i].uid == uid {
+		return i
+	}
+	return -1
+}
+
+// MessageBySequenceNumber implements the MessageBySequenceNumber method on
+// the Mailbox interface
+func (m *MaildirMailbox) MessageBySequenceNumber(seqno uint32) Message {
+	m.load()
+	defer m.mu.Unlock()
+	if seqno == 0 || seqno > uint32(len(m.messages)) {
+		return nil
+	}
+	return m.message(int(seqno) - 1)
+}
+
+// MessageByUID implements the MessageByUID method on the Mailbox interface
+func (m *MaildirMailbox) MessageByUID(uidno uint32) Message {
+	m.load()
+	defer m.mu.Unlock()
+	i := m.indexOf(uidno)
+	if i < 0 {
+		return nil
+	}
+	return m.message(i)
+}
+
+// MessageSetByUID implements the MessageSetByUID method on the Mailbox
+// interface
+func (m *MaildirMailbox) MessageSetByUID(set types.SequenceSet) []Message {
+	m.load()
+	defer m.mu.Unlock()
+	msgs := make([]Message, 0)
+	if len(m.messages) == 0 {
+		return msgs
+	}
+	last := m.messages[len(m.messages)-1].uid
+	for i, entry := range m.messages {
+		if inSequenceSet(set, entry.uid, last) {
+			msgs = append(msgs, m.message(i))
+		}
+	}
+	return msgs
+}
+
+// MessageSetBySequenceNumber implements the MessageSetBySequenceNumber
+// method on the Mailbox interface
+func (m *MaildirMailbox) MessageSetBySequenceNumber(set types.SequenceSet) []Message {
+	m.load()
+	defer m.mu.Unlock()
+	msgs := make([]Message, 0)
+	last := uint32(len(m.messages))
+	for i := range m.messages {
+		if inSequenceSet(set, uint32(i)+1, last) {
+			msgs = append(msgs, m.message(i))
+		}
+	}
+	return msgs
+}
+
+// NewMessage implements the NewMessage method on the Mailbox interface
+func (m *MaildirMailbox) NewMessage() Message {
+	return &MaildirMessage{
+		mailbox:      m,
+		header:       make(textproto.MIMEHeader),
+		internalDate: time.Now(),
+	}
+}
+
+// DeleteFlaggedMessages implements the DeleteFlaggedMessages method on the
+// Mailbox interface
+func (m *MaildirMailbox) DeleteFlaggedMessages() ([]Message, error) {
+	return m.deleteFlagged(nil)
+}
+
+// DeleteFlaggedMessagesByUID implements the UIDExpunger interface
+func (m *MaildirMailbox) DeleteFlaggedMessagesByUID(set types.SequenceSet) ([]Message, error) {
+	return m.deleteFlagged(set)
+}
+
+// deleteFlagged deletes the flagged messages whose UIDs are in set, or all
+// of them if set is nil.
+func (m *MaildirMailbox) deleteFlagged(set types.SequenceSet) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unlock, err := lockUIDList(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := m.rescan(); err != nil {
+		return nil, err
+	}
+
+	var deleted []Message
+	for i, entry := range m.messages {
+		if !entry.flags.HasFlags(types.FlagDeleted) {
+			continue
+		}
+		if set != nil && !inSequenceSet(set, entry.uid, m.messages[len(m.messages)-1].uid) {
+			continue
+		}
+		err := os.Remove(filepath.Join(m.path, "cur", entry.filename()))
+		if err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, m.message(i))
+	}
+
+	// Rescanning removes the messages from the UID list and tells watchers
+	// they have gone
+	return deleted, m.rescan()
+}
+
+// MoveMessages implements the Mover interface. Messages moved to another
+// Maildir folder are renamed into it, keeping their flags. Their keywords
+// are given the target folder's letters once the files are there.
+func (m *MaildirMailbox) MoveMessages(msgs []Message, dest Mailbox) ([]Message, error) {
+	target, ok := dest.(*MaildirMailbox)
+	if !ok || target.path == m.path {
+		return nil, ErrCannotMove
+	}
+
+	bases, keywords, err := m.moveFiles(msgs, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// The files are numbered by rescanning the target folder
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	unlock, err := lockUIDList(target.path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := target.rescan(); err != nil {
+		return nil, err
+	}
+	moved := make([]Message, 0, len(bases))
+	for n, base := range bases {
+		i := -1
+		for j, entry := range target.messages {
+			if entry.base == base {
+				i = j
+				break
+			}
+		}
+		if i == -1 {
+			return moved, errors.New("Message was removed while being moved")
+		}
+		if len(keywords[n]) > 0 {
+			if err := target.setKeywords(target.messages[i], keywords[n]); err != nil {
+				return moved, err
+			}
+		}
+		moved = append(moved, target.message(i))
+	}
+	return moved, nil
+}
+
+// moveFiles renames the files of messages into the cur directory of another
+// folder, and returns their base names and keywords in the same order. The
+// keyword letters are left out of the new names, as they only mean anything
+// in this folder.
+func (m *MaildirMailbox) moveFiles(msgs []Message, target *MaildirMailbox) ([]string, [][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unlock, err := lockUIDList(m.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+	if err := m.rescan(); err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]*maildirEntry, len(msgs))
+	for i, msg := range msgs {
+		index := m.indexOf(msg.UID())
+		if index == -1 {
+			return nil, nil, errors.New("Message has been deleted")
+		}
+		entries[i] = m.messages[index]
+	}
+
+	bases := make([]string, 0, len(entries))
+	keywords := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		moved := *entry
+		moved.flags = moved.flags.ResetFlags(types.FlagRecent)
+		moved.extra, _ = m.keywordInfo(moved.extra, nil)
+		err := os.Rename(filepath.Join(m.path, "cur", entry.filename()),
+			filepath.Join(target.path, "cur", moved.filename()))
+		if err != nil {
+			// Rescanning tells watchers about the messages already moved
+			m.rescan()
+			return nil, nil, err
+		}
+		bases = append(bases, entry.base)
+		keywords = append(keywords, m.keywordsOf(entry.extra))
+	}
+
+	// Rescanning removes the messages from the UID list and tells watchers
+	// they have gone
+	return bases, keywords, m.rescan()
+}
+
+// deliver adds a new message file to the folder and returns its UID. The
+// file is written with CRLF line endings, as it will be read.
+func (m *MaildirMailbox) deliver(header textproto.MIMEHeader, body io.Reader, flags types.Flags, keywords []string, internalDate time.Time) (uint32, error) {
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	now := time.Now()
+	base := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint32(&maildirDeliveries, 1), hostname)
+
+	// Write to tmp first so that no other program sees a partial message
+	tmpPath := filepath.Join(m.path, "tmp", base)
+	size, err := writeMaildirFile(tmpPath, io.MultiReader(
+		strings.NewReader(util.MIMEHeaderToString(header)+"\r\n"), body))
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := os.Chtimes(tmpPath, internalDate, internalDate); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	// The size is only known once the message has been written, so it is
+	// added to the name as the file is moved to cur
+	base += fmt.Sprintf(",S=%d,W=%d", size, size)
+	entry := &maildirEntry{base: base, flags: flags.ResetFlags(types.FlagRecent)}
+
+	// The folder is locked before the file is moved to cur, so that its
+	// keywords can be given letters
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	unlock, err := lockUIDList(m.path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	defer unlock()
+	if err := m.assignKeywords(keywords); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	entry.extra, _ = m.keywordInfo("", keywords)
+	if err := os.Rename(tmpPath, filepath.Join(m.path, "cur", entry.filename())); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := m.rescan(); err != nil {
+		return 0, err
+	}
+	for _, entry := range m.messages {
+		if entry.base == base {
+			return entry.uid, nil
+		}
+	}
+	return 0, errors.New("Message was removed while being saved")
+}
+
+// update renames a message file to record new flags and keywords, and tells
+// watchers.
+func (m *MaildirMailbox) update(base string, flags types.Flags, keywords []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sync()
+
+	var entry *maildirEntry
+	for _, e := range m.messages {
+		if e.base == base {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		return errors.New("Message has been deleted")
+	}
+	extra, ok := m.keywordInfo(entry.extra, keywords)
+	if !ok {
+		unlock, err := lockUIDList(m.path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := m.assignKeywords(keywords); err != nil {
+			return err
+		}
+		extra, _ = m.keywordInfo(entry.extra, keywords)
+	}
+	if entry.flags == flags && entry.extra == extra {
+		return nil
+	}
+
+	// If nothing else has changed the folder, the rename doesn't need a
+	// rescan to be noticed
+	curInfo, err := os.Stat(filepath.Join(m.path, "cur"))
+	upToDate := err == nil && curInfo.ModTime().Equal(m.curModTime)
+
+	oldName := entry.filename()
+	updated := *entry
+	updated.flags, updated.extra = flags, extra
+	if oldName != updated.filename() {
+		err := os.Rename(filepath.Join(m.path, "cur", oldName),
+			filepath.Join(m.path, "cur", updated.filename()))
+		if err != nil {
+			return err
+		}
+	}
+	*entry = updated
+
+	if upToDate {
+		if curInfo, err := os.Stat(filepath.Join(m.path, "cur")); err == nil {
+			m.curModTime = curInfo.ModTime()
+		}
+	}
+	m.updates.Notify(Update{Type: UpdateFlags, UID: entry.uid, Flags: entry.flags,
+		Keywords: m.keywordsOf(entry.extra)})
+	return nil
+}
+
+// setKeywords renames a message file to record new keywords, and tells
+// watchers. The mailbox and the UID list must be locked.
+func (m *MaildirMailbox) setKeywords(entry *maildirEntry, keywords []string) error {
+	if err := m.assignKeywords(keywords); err != nil {
+		return err
+	}
+	oldName := entry.filename()
+	entry.extra, _ = m.keywordInfo(entry.extra, keywords)
+	err := os.Rename(filepath.Join(m.path, "cur", oldName),
+		filepath.Join(m.path, "cur", entry.filename()))
+	if err != nil {
+		return err
+	}
+	m.updates.Notify(Update{Type: UpdateFlags, UID: entry.uid, Flags: entry.flags,
+		Keywords: m.keywordsOf(entry.extra)})
+	return nil
+}
+
+// keywordsOf returns the keywords recorded by the letters of a filename's
+// info. The mailbox must be locked.
+func (m *MaildirMailbox) keywordsOf(extra string) []string {
+	keywords := []string{}
+	for _, letter := range []byte(extra) {
+		if i := int(letter) - 'a'; i >= 0 && i < len(m.keywords) && m.keywords[i] != "" {
+			keywords = append(keywords, m.keywords[i])
+		}
+	}
+	return keywords
+}
+
+// keywordIndex returns the index of a keyword's letter, or -1 if it hasn't
+// been given one. The mailbox must be locked.
+func (m *MaildirMailbox) keywordIndex(keyword string) int {
+	for i, k := range m.keywords {
+		if k != "" && strings.EqualFold(k, keyword) {
+			return i
+		}
+	}
+	return -1
+}
+
+// keywordInfo replaces the keyword letters in the extra part of a
+// filename's info with the letters of the given keywords. It returns false
+// if a keyword hasn't been given a letter. The mailbox must be locked.
+func (m *MaildirMailbox) keywordInfo(extra string, keywords []string) (string, bool) {
+	var letters []byte
+	for _, letter := range []byte(extra) {
+		if i := int(letter) - 'a'; i < 0 || i >= len(m.keywords) || m.keywords[i] == "" {
+			letters = append(letters, letter)
+		}
+	}
+	for _, keyword := range keywords {
+		i := m.keywordIndex(keyword)
+		if i == -1 {
+			return extra, false
+		}
+		if letter := byte('a' + i); bytes.IndexByte(letters, letter) == -1 {
+			letters = append(letters, letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters), true
+}
+
+// assignKeywords gives letters to any of the keywords which don't have one,
+// and records them in the folder's keyword list. The mailbox and the UID
+// list must be locked.
+func (m *MaildirMailbox) assignKeywords(keywords []string) error {
+	list, err := readKeywordList(m.path)
+	if err != nil {
+		return err
+	}
+	m.keywords = list
+	changed := false
+	for _, keyword := range keywords {
+		if m.keywordIndex(keyword) != -1 {
+			continue
+		}
+		i := 0
+		for i < len(m.keywords) && m.keywords[i] != "" {
+			i++
+		}
+		if i >= maildirMaxKeywords {
+			return errors.New("Too many keywords in mailbox")
+		}
+		if i == len(m.keywords) {
+			m.keywords = append(m.keywords, "")
+		}
+		m.keywords[i] = keyword
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return writeKeywordList(m.path, m.keywords)
+}
+
+// filePath returns the current path of a message's file, which changes
+// whenever its flags do.
+func (m *MaildirMailbox) filePath(base string) string {
+	m.load()
+	defer m.mu.Unlock()
+	for _, entry := range m.messages {
+		if entry.base == base {
+			return filepath.Join(m.path, "cur", entry.filename())
+		}
+	}
+	return ""
+}
+
+// writeMaildirFile writes a message to a new file with CRLF line endings,
+// and returns its size.
+func writeMaildirFile(path string, content io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	n, err := io.Copy(w, newLineReader(content, "\r\n"))
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// MaildirMessage is a message in a Maildir folder. Its header is read from
+// disk when first needed, and its body is only ever streamed from the file.
+type MaildirMessage struct {
+	mailbox        *MaildirMailbox
+	uid            uint32
+	sequenceNumber uint32
+	base           string
+	flags          types.Flags
+	keywords       []string
+	internalDate   time.Time
+	size           uint32 // 0 until counted if the filename has no size
+
+	changed bool                 // The header or body have been replaced
+	header  textproto.MIMEHeader // nil until the header has been read
+	body    io.Reader            // The new body, if it has been replaced
+}
+
+// open opens the message's file.
+func (m *MaildirMessage) open() (*os.File, error) {
+	path := m.mailbox.filePath(m.base)
+	if m.uid == 0 || path == "" {
+		return nil, errors.New("Message has not been saved")
+	}
+	return os.Open(path)
+}
+
+// Header implements the Header method on the Message interface
+func (m *MaildirMessage) Header() textproto.MIMEHeader {
+	if m.header != nil {
+		return m.header
+	}
+	m.header = make(textproto.MIMEHeader)
+	f, err := m.open()
+	if err != nil {
+		return m.header
+	}
+	defer f.Close()
+	if header, _, err := util.ReadHeader(bufio.NewReader(f)); err == nil {
+		m.header = util.ParseHeader(header)
+	}
+	return m.header
+}
+
+// UID implements the UID method on the Message interface
+func (m *MaildirMessage) UID() uint32 { return m.uid }
+
+// SequenceNumber implements the SequenceNumber method on the Message
+// interface
+func (m *MaildirMessage) SequenceNumber() uint32 { return m.sequenceNumber }
+
+// Size implements the Size method on the Message interface
+func (m *MaildirMessage) Size() uint32 {
+	if m.size != 0 || m.uid == 0 {
+		return m.size
+	}
+	r, err := m.Open()
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+	n, _ := io.Copy(ioutil.Discard, r)
+	m.size = uint32(n)
+	return m.size
+}
+
+// InternalDate implements the InternalDate method on the Message interface
+func (m *MaildirMessage) InternalDate() time.Time { return m.internalDate }
+
+// Open implements the Open method on the Message interface. Messages are
+// often stored with bare LF line endings, which IMAP clients don't expect,
+// so they are converted as the file is read. Changes to the message aren't
+// seen until it has been saved.
+func (m *MaildirMessage) Open() (io.ReadCloser, error) {
+	f, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{newLineReader(f, "\r\n"), f}, nil
+}
+
+// Keywords implements the Keywords method on the Message interface
+func (m *MaildirMessage) Keywords() []string {
+	if m.keywords == nil {
+		return []string{}
+	}
+	return m.keywords
+}
+
+// AddKeywords implements the AddKeywords method on the Message interface
+func (m *MaildirMessage) AddKeywords(keywords ...string) Message {
+	m.keywords = types.AddKeywords(m.keywords, keywords...)
+	return m
+}
+
+// RemoveKeywords implements the RemoveKeywords method on the Message
+// interface
+func (m *MaildirMessage) RemoveKeywords(keywords ...string) Message {
+	m.keywords = types.RemoveKeywords(m.keywords, keywords...)
+	return m
+}
+
+// Flags implements the Flags method on the Message interface
+func (m *MaildirMessage) Flags() types.Flags { return m.flags }
+
+// OverwriteFlags implements the OverwriteFlags method on the Message
+// interface
+func (m *MaildirMessage) OverwriteFlags(newFlags types.Flags) Message {
+	m.flags = newFlags
+	return m
+}
+
+// AddFlags implements the AddFlags method on the Message interface
+func (m *MaildirMessage) AddFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.SetFlags(newFlags)
+	return m
+}
+
+// RemoveFlags implements the RemoveFlags method on the Message interface
+func (m *MaildirMessage) RemoveFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.ResetFlags(newFlags)
+	return m
+}
+
+// SetHeaders implements the SetHeaders method on the Message interface
+func (m *MaildirMessage) SetHeaders(newHeader textproto.MIMEHeader) Message {
+	m.header = newHeader
+	m.changed = true
+	return m
+}
+
+// SetBody implements the SetBody method on the Message interface. The body
+// is read when the message is saved.
+func (m *MaildirMessage) SetBody(newBody io.Reader) Message {
+	m.body = newBody
+	m.changed = true
+	return m
+}
+
+// Save implements the Save method on the Message interface. Maildir message
+// files are never modified, so replacing the header or body of an existing
+// message delivers a new file in its place.
+func (m *MaildirMessage) Save() (Message, error) {
+	if m.uid != 0 && !m.changed {
+		if err := m.mailbox.update(m.base, m.flags, m.keywords); err != nil {
+			return m, err
+		}
+		return m, nil
+	}
+
+	header, body := m.Header(), m.body
+	oldPath := ""
+	if m.uid != 0 {
+		oldPath = m.mailbox.filePath(m.base)
+	}
+	switch {
+	case body == nil && oldPath != "":
+		// Only the header has been replaced, so the body is copied from
+		// the old file
+		f, err := os.Open(oldPath)
+		if err != nil {
+			return m, err
+		}
+		defer f.Close()
+		r := bufio.NewReader(f)
+		if _, _, err := util.ReadHeader(r); err != nil {
+			return m, err
+		}
+		body = r
+	case body == nil:
+		body = strings.NewReader("")
+	}
+
+	uid, err := m.mailbox.deliver(header, body, m.flags, m.keywords, m.internalDate)
+	if err != nil {
+		return m, err
+	}
+	if oldPath != "" {
+		os.Remove(oldPath)
+	}
+
+	saved := m.mailbox.MessageByUID(uid)
+	if saved == nil {
+		return m, errors.New("Message was removed while being saved")
+	}
+	return saved, nil
+}
+
+// uidList is the contents of a dovecot-uidlist file.
+type uidList struct {
+	validity uint32
+	next     uint32
+	uids     map[string]uint32 // UIDs by the unique part of the filename
+}
+
+// readUIDList reads a folder's UID list. A missing list is empty, with a
+// UIDVALIDITY of 0.
+func readUIDList(path string) (*uidList, error) {
+	list := &uidList{next: 1, uids: make(map[string]uint32)}
+	data, err := ioutil.ReadFile(filepath.Join(path, maildirUIDList))
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	header := strings.Fields(lines[0])
+	if len(header) == 0 {
+		return list, nil
+	}
+	version := header[0]
+	switch version {
+	case "1":
+		// 1 <uidvalidity> <nextuid>
+		if len(header) >= 3 {
+			list.validity = parseUint32(header[1])
+			list.next = parseUint32(header[2])
+		}
+	case "3":
+		// 3 V<uidvalidity> N<nextuid> [other fields]
+		for _, field := range header[1:] {
+			switch field[0] {
+			case 'V':
+				list.validity = parseUint32(field[1:])
+			case 'N':
+				list.next = parseUint32(field[1:])
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported %s version %s", maildirUIDList, version)
+	}
+
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		var uidField, filename string
+		if version == "1" {
+			// <uid> <filename>
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			uidField, filename = fields[0], fields[1]
+		} else {
+			// <uid> [extension fields] :<filename>
+			i := strings.Index(line, ":")
+			fields := strings.Fields(line)
+			if i < 0 || len(fields) == 0 {
+				continue
+			}
+			uidField, filename = fields[0], line[i+1:]
+		}
+		uid := parseUint32(uidField)
+		if uid == 0 {
+			continue
+		}
+		base, _, _ := parseMaildirFilename(filename)
+		list.uids[base] = uid
+		if uid >= list.next {
+			list.next = uid + 1
+		}
+	}
+	if list.next == 0 {
+		list.next = 1
+	}
+	return list, nil
+}
+
+// write saves the UID list in version 3 format.
+func (l *uidList) write(path string) error {
+	bases := make([]string, 0, len(l.uids))
+	for base := range l.uids {
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return l.uids[bases[i]] < l.uids[bases[j]] })
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "3 V%d N%d\n", l.validity, l.next)
+	for _, base := range bases {
+		fmt.Fprintf(&buf, "%d :%s\n", l.uids[base], base)
+	}
+	return writeFileAtomic(filepath.Join(path, maildirUIDList), buf.Bytes())
+}
+
+// readKeywordList reads the keyword list of a folder, indexed by letter. A
+// missing list has no keywords.
+func readKeywordList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, maildirKeywordList))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keywords []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(fields[0])
+		if err != nil || i < 0 || i >= maildirMaxKeywords {
+			continue
+		}
+		for len(keywords) <= i {
+			keywords = append(keywords, "")
+		}
+		keywords[i] = fields[1]
+	}
+	return keywords, nil
+}
+
+// writeKeywordList saves the keyword list of a folder.
+func writeKeywordList(path string, keywords []string) error {
+	var buf bytes.Buffer
+	for i, keyword := range keywords {
+		if keyword != "" {
+			fmt.Fprintf(&buf, "%d %s\n", i, keyword)
+		}
+	}
+	return writeFileAtomic(filepath.Join(path, maildirKeywordList), buf.Bytes())
+}
+
+// lockUIDList takes the dovecot-uidlist.lock file which stops other
+// processes changing the UID list. It returns a function to release it.
+func lockUIDList(path string) (func(), error) {
+	return dotLock(filepath.Join(path, maildirUIDList+".lock"))
+}
+
+// createMaildir creates a Maildir with its cur, new and tmp directories, if
+// it doesn't already exist. Maildir++ folders are marked with a
+// maildirfolder file.
+func createMaildir(path string, folder bool) error {
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	if folder {
+		f, err := os.OpenFile(filepath.Join(path, "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
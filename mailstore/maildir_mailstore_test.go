@@ -0,0 +1,322 @@
+package mailstore
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+func newTestDir(t *testing.T) (root string, cleanup func()) {
+	root, err := ioutil.TempDir("", "mailstore")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	return root, func() { os.RemoveAll(root) }
+}
+
+func openMaildirUser(t *testing.T, root string) *MaildirUser {
+	store := NewMaildirMailstore(root, func(username, password string) bool {
+		return password == "password"
+	})
+	user, err := store.Authenticate("username", "password")
+	if err != nil {
+		t.Fatalf("Error getting user: %s", err)
+	}
+	return user.(*MaildirUser)
+}
+
+func openMaildirInbox(t *testing.T, root string) *MaildirMailbox {
+	mailbox, err := openMaildirUser(t, root).MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Error getting INBOX: %s", err)
+	}
+	return mailbox.(*MaildirMailbox)
+}
+
+func deliverTestMessage(t *testing.T, root string, dir string, filename string) {
+	content := "From: sender@example.com\nSubject: " + filename + "\n\nHello\n"
+	path := filepath.Join(root, "username", dir, filename)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Error delivering message: %s", err)
+	}
+}
+
+func TestMaildirAuthenticate(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	store := NewMaildirMailstore(root, func(username, password string) bool {
+		return password == "password"
+	})
+	if _, err := store.Authenticate("username", "wrong"); err == nil {
+		t.Errorf("Expected an incorrect password to be refused")
+	}
+	if _, err := store.Authenticate("../username", "password"); err == nil {
+		t.Errorf("Expected a username containing a path to be refused")
+	}
+	if _, err := store.Authenticate("username", "password"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !isDir(filepath.Join(root, "username", "cur")) {
+		t.Errorf("Expected a Maildir to be created for the user")
+	}
+}
+
+func TestMaildirDelivery(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	inbox := openMaildirInbox(t, root)
+	deliverTestMessage(t, root, "new", "1000.A.host")
+	deliverTestMessage(t, root, "cur", "1001.B.host:2,FS")
+
+	if inbox.Messages() != 2 {
+		t.Fatalf("Expected 2 messages, got %d", inbox.Messages())
+	}
+	if inbox.Recent() != 2 || inbox.Unseen() != 1 {
+		t.Errorf("Expected 2 recent and 1 unseen, got %d and %d", inbox.Recent(), inbox.Unseen())
+	}
+
+	msg := inbox.MessageByUID(1)
+	if msg == nil || msg.Header().Get("Subject") != "1000.A.host" {
+		t.Fatalf("Expected message 1 to be the first delivered")
+	}
+	if body := messageBody(t, msg); body != "Hello\r\n" {
+		t.Errorf("Expected line endings to be converted, got %q", body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", "cur", "1000.A.host:2,")); err != nil {
+		t.Errorf("Expected the message to be moved to cur: %s", err)
+	}
+
+	flags := inbox.MessageByUID(2).Flags()
+	if !flags.HasFlags(types.FlagFlagged | types.FlagSeen) {
+		t.Errorf("Expected flags to be read from the filename, got %s", flags)
+	}
+}
+
+func TestMaildirPersistence(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	inbox := openMaildirInbox(t, root)
+	deliverTestMessage(t, root, "new", "1000.A.host")
+	deliverTestMessage(t, root, "new", "1001.B.host")
+	validity := inbox.UIDValidity()
+
+	msg := inbox.MessageByUID(2).AddFlags(types.FlagAnswered | types.FlagDeleted)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", "cur", "1001.B.host:2,RT")); err != nil {
+		t.Errorf("Expected flags to be written to the filename: %s", err)
+	}
+	if _, err := inbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// A new store must see the same UIDs, and never reuse the deleted one
+	deliverTestMessage(t, root, "new", "1002.C.host")
+	inbox = openMaildirInbox(t, root)
+	if inbox.UIDValidity() != validity {
+		t.Errorf("Expected UIDVALIDITY to be kept")
+	}
+	assertMessageUIDs(t, inbox.MessageSetByUID(types.SequenceSet{{Min: "1", Max: "*"}}),
+		[]uint32{1, 3})
+	if inbox.NextUID() != 4 {
+		t.Errorf("Expected next UID to be 4, got %d", inbox.NextUID())
+	}
+}
+
+func TestMaildirDovecotUIDList(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	openMaildirUser(t, root)
+	deliverTestMessage(t, root, "cur", "1000.A.host:2,S")
+	deliverTestMessage(t, root, "cur", "1001.B.host:2,")
+	list := "3 V1234 N20 G0123456789abcdef\n" +
+		"7 :1000.A.host\n" +
+		"15 W123 :1001.B.host:2,\n"
+	path := filepath.Join(root, "username", maildirUIDList)
+	if err := ioutil.WriteFile(path, []byte(list), 0600); err != nil {
+		t.Fatalf("Error writing UID list: %s", err)
+	}
+
+	inbox := openMaildirInbox(t, root)
+	if inbox.UIDValidity() != 1234 || inbox.NextUID() != 20 {
+		t.Errorf("Expected UIDVALIDITY 1234 and next UID 20, got %d and %d",
+			inbox.UIDValidity(), inbox.NextUID())
+	}
+	assertMessageUIDs(t, inbox.MessageSetBySequenceNumber(types.SequenceSet{{Min: "1", Max: "*"}}),
+		[]uint32{7, 15})
+}
+
+func TestMaildirDovecotKeywords(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	openMaildirUser(t, root)
+	deliverTestMessage(t, root, "cur", "1000.A.host:2,Sb")
+	path := filepath.Join(root, "username", maildirKeywordList)
+	if err := ioutil.WriteFile(path, []byte("0 $Junk\n1 $Label1\n"), 0600); err != nil {
+		t.Fatalf("Error writing keyword list: %s", err)
+	}
+
+	inbox := openMaildirInbox(t, root)
+	msg := inbox.MessageBySequenceNumber(1)
+	if keywords := msg.Keywords(); len(keywords) != 1 || keywords[0] != "$Label1" {
+		t.Fatalf("Expected keyword $Label1, got %v", keywords)
+	}
+
+	// A new keyword is given the next letter
+	if _, err := msg.AddKeywords("$Forwarded").Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	list, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading keyword list: %s", err)
+	}
+	if string(list) != "0 $Junk\n1 $Label1\n2 $Forwarded\n" {
+		t.Errorf("Expected $Forwarded to be added to the keyword list, got %q", list)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", "cur", "1000.A.host:2,Sbc")); err != nil {
+		t.Errorf("Expected the keyword letters in the filename: %s", err)
+	}
+}
+
+func TestMaildirAppend(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	inbox := openMaildirInbox(t, root)
+	watcher := inbox.Watch()
+	defer watcher.Close()
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Subject", "Appended")
+	msg, err := inbox.NewMessage().
+		SetHeaders(hdr).
+		SetBody(strings.NewReader("Hello\r\n")).
+		AddFlags(types.FlagSeen).
+		Save()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.UID() != 1 || msg.SequenceNumber() != 1 {
+		t.Errorf("Expected UID 1 and sequence number 1, got %d and %d",
+			msg.UID(), msg.SequenceNumber())
+	}
+	if !msg.Flags().HasFlags(types.FlagSeen) {
+		t.Errorf("Expected flags to be kept")
+	}
+
+	updates := watcher.Updates()
+	if len(updates) != 1 || updates[0].Type != UpdateExists || updates[0].UID != 1 {
+		t.Errorf("Expected an update for the new message, got %v", updates)
+	}
+
+	reread := openMaildirInbox(t, root).MessageByUID(1)
+	if reread.Header().Get("Subject") != "Appended" || messageBody(t, reread) != "Hello\r\n" {
+		t.Errorf("Expected the message to be stored")
+	}
+	if reread.Size() != msg.Size() {
+		t.Errorf("Expected size %d, got %d", msg.Size(), reread.Size())
+	}
+}
+
+func TestMaildirFolders(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	user := openMaildirUser(t, root)
+	if _, err := user.CreateMailbox("Work/Project.X"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !isDir(filepath.Join(root, "username", ".Work.Project%2EX", "cur")) {
+		t.Errorf("Expected a Maildir++ folder to be created")
+	}
+	if _, err := user.CreateMailbox("Work"); err == nil {
+		t.Errorf("Expected an error creating an existing mailbox")
+	}
+
+	if err := user.RenameMailbox("Work", "Archive/Work"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var names []string
+	for _, mailbox := range user.Mailboxes() {
+		names = append(names, mailbox.Name())
+	}
+	expected := []string{"INBOX", "Archive", "Archive/Work", "Archive/Work/Project.X"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected mailboxes %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected mailboxes %v, got %v", expected, names)
+		}
+	}
+
+	if err := user.DeleteMailbox("INBOX"); err == nil {
+		t.Errorf("Expected an error deleting INBOX")
+	}
+	if err := user.DeleteMailbox("Archive/Work/Project.X"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := user.MailboxByName("Archive/Work/Project.X"); err == nil {
+		t.Errorf("Expected the mailbox to be deleted")
+	}
+}
+
+func TestMaildirSubscriptions(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	user := openMaildirUser(t, root)
+	user.Subscribe("Work")
+	user.Subscribe("Archive")
+	if err := user.Unsubscribe("Work"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := user.Unsubscribe("Work"); err == nil {
+		t.Errorf("Expected an error unsubscribing twice")
+	}
+
+	subscriptions := openMaildirUser(t, root).Subscriptions()
+	if len(subscriptions) != 1 || subscriptions[0] != "Archive" {
+		t.Errorf("Expected subscriptions to be kept, got %v", subscriptions)
+	}
+}
+
+func TestMaildirMove(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	user := openMaildirUser(t, root)
+	archive, err := user.CreateMailbox("Archive")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	deliverTestMessage(t, root, "cur", "1000.A.host:2,F")
+	inbox := openMaildirInbox(t, root)
+
+	moved, err := inbox.MoveMessages(inbox.MessageSetByUID(types.SequenceSet{{Min: "1"}}), archive)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(moved) != 1 || moved[0].UID() != 1 || !moved[0].Flags().HasFlags(types.FlagFlagged) {
+		t.Fatalf("Expected the message to be moved with its flags, got %v", moved)
+	}
+
+	// The file is renamed rather than copied
+	if _, err := os.Stat(filepath.Join(root, "username", ".Archive", "cur", "1000.A.host:2,F")); err != nil {
+		t.Errorf("Expected the file to be moved: %s", err)
+	}
+	if inbox.Messages() != 0 {
+		t.Errorf("Expected the message to be removed from INBOX")
+	}
+}
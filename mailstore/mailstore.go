@@ -1,6 +1,7 @@
 package mailstore
 
 import (
+	"io"
 	"net/textproto"
 	"time"
 
@@ -14,6 +15,25 @@ type Mailstore interface {
 	Authenticate(username string, password string) (User, error)
 }
 
+// MailboxTyper may optionally be implemented by a Mailstore to give a
+// Mailbox of the type its mailboxes have, without opening one. Only its type
+// is used, to find which of the optional interfaces, such as UIDExpunger, the
+// mailboxes implement, so that the server can advertise only the extensions
+// it can serve, even before login. Mailstores which don't implement it are
+// taken to support none of them.
+type MailboxTyper interface {
+	MailboxType() Mailbox
+}
+
+// mailboxType returns a Mailbox of the type of a mailstore's mailboxes, or
+// nil if the mailstore doesn't implement MailboxTyper.
+func mailboxType(m Mailstore) Mailbox {
+	if t, ok := m.(MailboxTyper); ok {
+		return t.MailboxType()
+	}
+	return nil
+}
+
 // User represents a user in the mail storage system
 type User interface {
 	// Return a list of mailboxes belonging to this user
@@ -22,11 +42,72 @@ type User interface {
 	MailboxByName(name string) (Mailbox, error)
 }
 
+// DefaultDelimiter separates the levels of mailbox names, unless the User
+// implements HierarchyDelimiter.
+const DefaultDelimiter = "/"
+
+// HierarchyDelimiter may optionally be implemented by a User whose mailbox
+// names separate the levels of the hierarchy with something other than
+// DefaultDelimiter.
+type HierarchyDelimiter interface {
+	// Delimiter returns the string separating levels of mailbox names, or
+	// "" if the names are flat and mailboxes can't have inferiors.
+	Delimiter() string
+}
+
+// Delimiter returns the hierarchy delimiter of a user's mailbox names.
+func Delimiter(u User) string {
+	if hd, ok := u.(HierarchyDelimiter); ok {
+		return hd.Delimiter()
+	}
+	return DefaultDelimiter
+}
+
+// MailboxManager may optionally be implemented by a User to allow clients to
+// create, delete and rename mailboxes. Mailbox names are hierarchical, with
+// levels separated by the user's Delimiter.
+type MailboxManager interface {
+	// Create a new, empty mailbox along with any missing superior mailboxes
+	// in its hierarchy. A trailing delimiter on the name may be ignored.
+	// INBOX and existing mailboxes cannot be created.
+	CreateMailbox(name string) (Mailbox, error)
+
+	// Permanently delete a mailbox and all of its messages. Inferior
+	// mailboxes are left untouched. INBOX cannot be deleted.
+	DeleteMailbox(name string) error
+
+	// Rename a mailbox and all of its inferior mailboxes. Renaming INBOX is
+	// special: its messages are moved to a new mailbox with the new name,
+	// leaving INBOX empty and its inferiors unchanged.
+	RenameMailbox(oldName string, newName string) error
+}
+
+// SubscriptionManager may optionally be implemented by a User to track the
+// set of mailboxes the user is subscribed to. Without it, every mailbox is
+// treated as subscribed.
+type SubscriptionManager interface {
+	// Add a mailbox to the subscription list. The mailbox does not need to
+	// exist.
+	Subscribe(name string) error
+
+	// Remove a mailbox from the subscription list
+	Unsubscribe(name string) error
+
+	// Return the names of all subscribed mailboxes
+	Subscriptions() []string
+}
+
 // Mailbox represents a mailbox belonging to a user in the mail storage system
 type Mailbox interface {
 	// The name of the mailbox
 	Name() string
 
+	// UIDValidity returns the UIDVALIDITY of the mailbox. It must stay the
+	// same for as long as the mailbox's UIDs do, and change if they are ever
+	// reassigned, eg because the mailbox was deleted and created again with
+	// the same name.
+	UIDValidity() uint32
+
 	// The unique identifier that will LIKELY be assigned
 	// to the next mail that is added to this mailbox
 	NextUID() uint32
@@ -79,19 +160,32 @@ type Message interface {
 	// Return the sequence number of the email
 	SequenceNumber() uint32
 
-	// Return the RFC822 size of the message
+	// Return the RFC822 size of the message, which is the number of bytes
+	// read from Open
 	Size() uint32
 
 	// Return the date the email was received by the server
 	// (This is not the date on the envelope of the email)
 	InternalDate() time.Time
 
-	// Return the body of the email
-	Body() string
+	// Open returns a reader for the whole message as it is sent to clients:
+	// the header, a blank line and then the body, with CRLF line endings.
+	// The message is read as it is needed rather than all at once, so that
+	// large messages don't have to fit in memory. The reader must be closed
+	// when finished with.
+	Open() (io.ReadCloser, error)
 
 	// Return the list of custom keywords/flags for this message
 	Keywords() []string
 
+	// Add custom keywords to this message and return the updated message.
+	// Keywords are compared case insensitively, and any already present are
+	// left as they are.
+	AddKeywords(...string) Message
+
+	// Remove custom keywords from this message and return the updated message
+	RemoveKeywords(...string) Message
+
 	// Get the flags for this message
 	Flags() types.Flags
 
@@ -107,8 +201,9 @@ type Message interface {
 	// Overwrite the message headers
 	SetHeaders(textproto.MIMEHeader) Message
 
-	// Overwrite the message body
-	SetBody(string) Message
+	// Overwrite the message body. The body is read from the reader no later
+	// than when the message is saved.
+	SetBody(io.Reader) Message
 
 	// Save any changes to the message
 	Save() (Message, error)
@@ -0,0 +1,1036 @@
+// Package mailstoretest provides a conformance test suite for implementations
+// of the mailstore interfaces. It checks the behaviour the conn package relies
+// on, so that a new storage backend can be validated with a single test:
+//
+//	func TestConformance(t *testing.T) {
+//		mailstoretest.Run(t, func(t *testing.T) (mailstore.Mailstore, string, string) {
+//			return newTestStore(t), "username", "password"
+//		})
+//	}
+package mailstoretest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordwest/imap-server/mailstore"
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+// Factory creates a new mailstore for a single test and returns it along with
+// the credentials of a user which can log in to it. Every call must return a
+// store which doesn't share any messages with the others. Anything the store
+// needs to clean up afterwards should be registered with t.Cleanup.
+type Factory func(t *testing.T) (store mailstore.Mailstore, username string, password string)
+
+// Run runs the whole suite against the mailstore created by newStore, with
+// each check as a subtest. The optional MailboxManager, SubscriptionManager
+// and Notifier interfaces are only tested if the store implements them.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, newStore Factory)
+	}{
+		{"Authenticate", testAuthenticate},
+		{"Mailboxes", testMailboxes},
+		{"EmptyMailbox", testEmptyMailbox},
+		{"NewMessage", testNewMessage},
+		{"Append", testAppend},
+		{"MessageLookup", testMessageLookup},
+		{"MessageSetByUID", testMessageSetByUID},
+		{"MessageSetBySequenceNumber", testMessageSetBySequenceNumber},
+		{"Flags", testFlags},
+		{"Keywords", testKeywords},
+		{"DeleteFlaggedMessages", testDeleteFlaggedMessages},
+		{"DeleteFlaggedMessagesByUID", testDeleteFlaggedMessagesByUID},
+		{"UIDsNotReused", testUIDsNotReused},
+		{"UIDValidity", testUIDValidity},
+		{"MoveMessages", testMoveMessages},
+		{"SharedBetweenSessions", testSharedBetweenSessions},
+		{"Context", testContext},
+		{"Notifier", testNotifier},
+		{"MailboxManager", testMailboxManager},
+		{"SubscriptionManager", testSubscriptionManager},
+		{"MailboxType", testMailboxType},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newStore)
+		})
+	}
+}
+
+// login creates a new store and logs in to it
+func login(t *testing.T, newStore Factory) (mailstore.Mailstore, mailstore.User) {
+	store, username, password := newStore(t)
+	user, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in: %s", err)
+	}
+	return store, user
+}
+
+// emptyMailbox returns a mailbox with no messages in it. A new mailbox is
+// created if the user supports it, otherwise INBOX is emptied.
+func emptyMailbox(t *testing.T, user mailstore.User) mailstore.Mailbox {
+	if manager, ok := user.(mailstore.MailboxManager); ok {
+		mailbox, err := manager.CreateMailbox("Conformance")
+		if err != nil {
+			t.Fatalf("Error creating mailbox: %s", err)
+		}
+		return mailbox
+	}
+
+	mailbox, err := user.MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Error getting INBOX: %s", err)
+	}
+	for _, msg := range mailbox.MessageSetBySequenceNumber(parseSet(t, "1:*")) {
+		if _, err := msg.AddFlags(types.FlagDeleted).Save(); err != nil {
+			t.Fatalf("Error flagging message: %s", err)
+		}
+	}
+	if _, err := mailbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Error emptying INBOX: %s", err)
+	}
+	if mailbox.Messages() != 0 {
+		t.Fatalf("Expected INBOX to be empty, but it has %d messages", mailbox.Messages())
+	}
+	return mailbox
+}
+
+// appendMessage saves a new message with the given subject and flags
+func appendMessage(t *testing.T, mailbox mailstore.Mailbox, subject string, flags types.Flags) mailstore.Message {
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("From", "me@test.com")
+	hdr.Set("To", "you@test.com")
+	hdr.Set("Subject", subject)
+	hdr.Set("Date", "Tue, 28 Oct 2014 00:09:00 +0700")
+
+	msg, err := mailbox.NewMessage().
+		SetHeaders(hdr).
+		SetBody(strings.NewReader(subject + "\r\n")).
+		OverwriteFlags(flags).
+		Save()
+	if err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	return msg
+}
+
+// appendMessages saves n new messages and returns their UIDs
+func appendMessages(t *testing.T, mailbox mailstore.Mailbox, n int) []uint32 {
+	var uids []uint32
+	for i := 1; i <= n; i++ {
+		msg := appendMessage(t, mailbox, fmt.Sprintf("Message %d", i), 0)
+		uids = append(uids, msg.UID())
+	}
+	return uids
+}
+
+// messageBody reads the body of a message, after its header
+func messageBody(t *testing.T, msg mailstore.Message) string {
+	r, err := msg.Open()
+	if err != nil {
+		t.Fatalf("Error opening message: %s", err)
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	if _, _, err := util.ReadHeader(br); err != nil {
+		t.Fatalf("Error reading header: %s", err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Error reading body: %s", err)
+	}
+	return string(body)
+}
+
+// messageSize counts the bytes read from Open
+func messageSize(t *testing.T, msg mailstore.Message) uint32 {
+	r, err := msg.Open()
+	if err != nil {
+		t.Fatalf("Error opening message: %s", err)
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatalf("Error reading message: %s", err)
+	}
+	return uint32(n)
+}
+
+func parseSet(t *testing.T, s string) types.SequenceSet {
+	set, err := types.InterpretSequenceSet(s)
+	if err != nil {
+		t.Fatalf("Invalid sequence set %q: %s", s, err)
+	}
+	return set
+}
+
+func assertUIDs(t *testing.T, desc string, msgs []mailstore.Message, uids []uint32) {
+	var actual []uint32
+	for _, msg := range msgs {
+		if msg == nil {
+			t.Errorf("%s: expected no nil messages, got %v", desc, msgs)
+			return
+		}
+		actual = append(actual, msg.UID())
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(uids) {
+		t.Errorf("%s: expected UIDs %v, got %v", desc, uids, actual)
+	}
+}
+
+// assertSequenceNumbers checks that the messages in a mailbox are numbered
+// from 1 upwards, in order of their UIDs
+func assertSequenceNumbers(t *testing.T, mailbox mailstore.Mailbox, uids []uint32) {
+	if mailbox.Messages() != uint32(len(uids)) {
+		t.Fatalf("Expected %d messages, got %d", len(uids), mailbox.Messages())
+	}
+	for i, uid := range uids {
+		seqno := uint32(i + 1)
+		msg := mailbox.MessageBySequenceNumber(seqno)
+		if msg == nil || msg.UID() != uid {
+			t.Errorf("Expected message %d to have UID %d, got %v", seqno, uid, msg)
+			continue
+		}
+		if msg.SequenceNumber() != seqno {
+			t.Errorf("Expected message %d to have sequence number %d, got %d",
+				uid, seqno, msg.SequenceNumber())
+		}
+		if byUID := mailbox.MessageByUID(uid); byUID == nil || byUID.SequenceNumber() != seqno {
+			t.Errorf("Expected message %d to have sequence number %d when found by UID", uid, seqno)
+		}
+	}
+}
+
+// countFlagged returns the number of messages in a mailbox with the given flag
+func countFlagged(mailbox mailstore.Mailbox, flag types.Flags) uint32 {
+	var count uint32
+	for seqno := uint32(1); seqno <= mailbox.Messages(); seqno++ {
+		if mailbox.MessageBySequenceNumber(seqno).Flags().HasFlags(flag) {
+			count++
+		}
+	}
+	return count
+}
+
+func testAuthenticate(t *testing.T, newStore Factory) {
+	store, username, password := newStore(t)
+	if _, err := store.Authenticate(username, password+"wrong"); err == nil {
+		t.Errorf("Expected an incorrect password to be refused")
+	}
+	if _, err := store.Authenticate(username+"wrong", password); err == nil {
+		t.Errorf("Expected an unknown user to be refused")
+	}
+	user, err := store.Authenticate(username, password)
+	if err != nil || user == nil {
+		t.Fatalf("Expected the user to be logged in, got %s", err)
+	}
+}
+
+func testMailboxes(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+
+	inbox, err := user.MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Expected every user to have an INBOX, got %s", err)
+	}
+	if inbox.Name() != "INBOX" {
+		t.Errorf("Expected the name INBOX, got %q", inbox.Name())
+	}
+	if _, err := user.MailboxByName("Nonexistent"); err == nil {
+		t.Errorf("Expected an error getting a mailbox which doesn't exist")
+	}
+
+	found := false
+	for _, mailbox := range user.Mailboxes() {
+		if mailbox.Name() == "INBOX" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected INBOX to be listed")
+	}
+}
+
+func testEmptyMailbox(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+
+	if mailbox.Messages() != 0 || mailbox.Recent() != 0 || mailbox.Unseen() != 0 {
+		t.Errorf("Expected no messages, got %d messages, %d recent and %d unseen",
+			mailbox.Messages(), mailbox.Recent(), mailbox.Unseen())
+	}
+	if mailbox.NextUID() == 0 {
+		t.Errorf("Expected the next UID to be at least 1")
+	}
+	if mailbox.LastUID() != mailbox.NextUID() {
+		t.Errorf("Expected the last UID of an empty mailbox to be the next UID %d, got %d",
+			mailbox.NextUID(), mailbox.LastUID())
+	}
+	if msg := mailbox.MessageBySequenceNumber(1); msg != nil {
+		t.Errorf("Expected no message 1, got %v", msg)
+	}
+	if msg := mailbox.MessageByUID(mailbox.NextUID()); msg != nil {
+		t.Errorf("Expected no message with the next UID, got %v", msg)
+	}
+	for _, s := range []string{"1:*", "*", "1"} {
+		assertUIDs(t, "UID "+s, mailbox.MessageSetByUID(parseSet(t, s)), nil)
+		assertUIDs(t, s, mailbox.MessageSetBySequenceNumber(parseSet(t, s)), nil)
+	}
+
+	deleted, err := mailbox.DeleteFlaggedMessages()
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("Expected nothing to be deleted, got %v and %v", deleted, err)
+	}
+}
+
+func testNewMessage(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	next := mailbox.NextUID()
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Subject", "Unsaved")
+	mailbox.NewMessage().SetHeaders(hdr).SetBody(strings.NewReader("Unsaved\r\n")).AddFlags(types.FlagSeen)
+
+	if mailbox.Messages() != 0 || mailbox.NextUID() != next {
+		t.Errorf("Expected the mailbox not to change until the message is saved")
+	}
+}
+
+func testAppend(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	next := mailbox.NextUID()
+
+	var uids []uint32
+	for i, flags := range []types.Flags{0, types.FlagSeen, types.FlagFlagged | types.FlagAnswered} {
+		msg := appendMessage(t, mailbox, fmt.Sprintf("Message %d", i+1), flags)
+		if msg.UID() < next {
+			t.Errorf("Expected UID %d to be at least the next UID %d", msg.UID(), next)
+		}
+		if len(uids) > 0 && msg.UID() <= uids[len(uids)-1] {
+			t.Errorf("Expected UID %d to be greater than the previous %d",
+				msg.UID(), uids[len(uids)-1])
+		}
+		if mailbox.NextUID() <= msg.UID() {
+			t.Errorf("Expected the next UID %d to be greater than %d", mailbox.NextUID(), msg.UID())
+		}
+		if mailbox.LastUID() != msg.UID() {
+			t.Errorf("Expected the last UID to be %d, got %d", msg.UID(), mailbox.LastUID())
+		}
+		if msg.SequenceNumber() != uint32(i+1) {
+			t.Errorf("Expected sequence number %d, got %d", i+1, msg.SequenceNumber())
+		}
+		if !msg.Flags().HasFlags(flags) {
+			t.Errorf("Expected flags %s, got %s", flags, msg.Flags())
+		}
+		uids = append(uids, msg.UID())
+	}
+	assertSequenceNumbers(t, mailbox, uids)
+	if mailbox.Unseen() != 2 {
+		t.Errorf("Expected 2 unseen messages, got %d", mailbox.Unseen())
+	}
+
+	// Read the messages back from a fresh copy of the mailbox
+	mailbox, err := user.MailboxByName(mailbox.Name())
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	msg := mailbox.MessageByUID(uids[2])
+	if msg == nil {
+		t.Fatalf("Expected message %d to be stored", uids[2])
+	}
+	if msg.Header().Get("Subject") != "Message 3" || msg.Header().Get("From") != "me@test.com" {
+		t.Errorf("Expected the headers to be stored, got %v", msg.Header())
+	}
+	if body := messageBody(t, msg); body != "Message 3\r\n" {
+		t.Errorf("Expected the body to be stored, got %q", body)
+	}
+	if !msg.Flags().HasFlags(types.FlagFlagged | types.FlagAnswered) {
+		t.Errorf("Expected the flags to be stored, got %s", msg.Flags())
+	}
+	if size := messageSize(t, msg); msg.Size() != size {
+		t.Errorf("Expected the size to be the %d bytes read from Open, got %d", size, msg.Size())
+	}
+	if msg.InternalDate().IsZero() {
+		t.Errorf("Expected the message to have an internal date")
+	}
+}
+
+func testMessageLookup(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 3)
+
+	assertSequenceNumbers(t, mailbox, uids)
+	if msg := mailbox.MessageBySequenceNumber(0); msg != nil {
+		t.Errorf("Expected no message 0, got %v", msg)
+	}
+	if msg := mailbox.MessageBySequenceNumber(4); msg != nil {
+		t.Errorf("Expected no message past the end, got %v", msg)
+	}
+	if msg := mailbox.MessageByUID(0); msg != nil {
+		t.Errorf("Expected no message with UID 0, got %v", msg)
+	}
+	if msg := mailbox.MessageByUID(mailbox.NextUID()); msg != nil {
+		t.Errorf("Expected no message with the next UID, got %v", msg)
+	}
+	if msg := mailbox.MessageByUID(uids[1]); msg == nil || msg.Header().Get("Subject") != "Message 2" {
+		t.Errorf("Expected to find message 2 by its UID")
+	}
+}
+
+func testMessageSetByUID(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 4)
+	next := mailbox.NextUID()
+
+	tests := []struct {
+		set  string
+		uids []uint32
+	}{
+		{"1:*", uids},
+		{"*", uids[3:]},
+		{fmt.Sprintf("%d:*", uids[2]), uids[2:]},
+		{fmt.Sprintf("%d", uids[1]), uids[1:2]},
+		{fmt.Sprintf("%d:%d", uids[1], uids[2]), uids[1:3]},
+		{fmt.Sprintf("%d,%d", uids[0], uids[3]), []uint32{uids[0], uids[3]}},
+		{fmt.Sprintf("%d", next), nil},
+		// A range starting past the last UID doesn't match the last message
+		{fmt.Sprintf("%d:*", next), nil},
+	}
+	for _, test := range tests {
+		assertUIDs(t, "UID "+test.set, mailbox.MessageSetByUID(parseSet(t, test.set)), test.uids)
+	}
+}
+
+func testMessageSetBySequenceNumber(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 4)
+
+	tests := []struct {
+		set  string
+		uids []uint32
+	}{
+		{"1:*", uids},
+		{"*", uids[3:]},
+		{"3:*", uids[2:]},
+		{"2", uids[1:2]},
+		{"2:3", uids[1:3]},
+		{"1,4", []uint32{uids[0], uids[3]}},
+		{"5", nil},
+		{"3:10", uids[2:]},
+		{"5:*", nil},
+	}
+	for _, test := range tests {
+		assertUIDs(t, test.set, mailbox.MessageSetBySequenceNumber(parseSet(t, test.set)), test.uids)
+	}
+}
+
+func testFlags(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 2)
+
+	msg := mailbox.MessageByUID(uids[0]).AddFlags(types.FlagSeen | types.FlagFlagged)
+	if !msg.Flags().HasFlags(types.FlagSeen | types.FlagFlagged) {
+		t.Errorf("Expected flags to be added, got %s", msg.Flags())
+	}
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	msg = mailbox.MessageByUID(uids[0])
+	if !msg.Flags().HasFlags(types.FlagSeen | types.FlagFlagged) {
+		t.Errorf("Expected added flags to be saved, got %s", msg.Flags())
+	}
+	if mailbox.Unseen() != 1 {
+		t.Errorf("Expected 1 unseen message, got %d", mailbox.Unseen())
+	}
+
+	msg = msg.RemoveFlags(types.FlagFlagged)
+	if msg.Flags().HasFlags(types.FlagFlagged) {
+		t.Errorf("Expected the flag to be removed, got %s", msg.Flags())
+	}
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	if flags := mailbox.MessageByUID(uids[0]).Flags(); flags.HasFlags(types.FlagFlagged) ||
+		!flags.HasFlags(types.FlagSeen) {
+		t.Errorf("Expected removed flags to be saved, got %s", flags)
+	}
+
+	msg = mailbox.MessageByUID(uids[1]).OverwriteFlags(types.FlagDraft)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	if flags := mailbox.MessageByUID(uids[1]).Flags(); flags != types.FlagDraft {
+		t.Errorf("Expected flags to be overwritten, got %s", flags)
+	}
+	if recent := countFlagged(mailbox, types.FlagRecent); mailbox.Recent() != recent {
+		t.Errorf("Expected %d recent messages, got %d", recent, mailbox.Recent())
+	}
+
+	// Changing flags leaves the rest of the message alone
+	msg = mailbox.MessageByUID(uids[1])
+	if msg.SequenceNumber() != 2 || msg.Header().Get("Subject") != "Message 2" ||
+		messageBody(t, msg) != "Message 2\r\n" {
+		t.Errorf("Expected the message to be unchanged apart from its flags")
+	}
+}
+
+func testKeywords(t *testing.T, newStore Factory) {
+	store, username, password := newStore(t)
+	user, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in: %s", err)
+	}
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 2)
+
+	msg := mailbox.MessageByUID(uids[0]).AddKeywords("$Junk", "$Label1")
+	if _, err := msg.AddFlags(types.FlagSeen).Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+
+	// Keywords are kept by the store, not only by the mailbox
+	second, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in again: %s", err)
+	}
+	other, err := second.MailboxByName(mailbox.Name())
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	msg = other.MessageByUID(uids[0])
+	keywords := types.FlagSet{Keywords: msg.Keywords()}
+	if len(keywords.Keywords) != 2 || !keywords.HasKeyword("$Junk") || !keywords.HasKeyword("$Label1") {
+		t.Errorf("Expected keywords $Junk and $Label1 to be saved, got %v", msg.Keywords())
+	}
+	if !msg.Flags().HasFlags(types.FlagSeen) {
+		t.Errorf("Expected flags to be saved with keywords, got %s", msg.Flags())
+	}
+	if len(other.MessageByUID(uids[1]).Keywords()) != 0 {
+		t.Errorf("Expected other messages to have no keywords")
+	}
+
+	if _, err := msg.RemoveKeywords("$JUNK").Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	msg = mailbox.MessageByUID(uids[0])
+	if len(msg.Keywords()) != 1 || msg.Keywords()[0] != "$Label1" {
+		t.Errorf("Expected only $Label1 to be left, got %v", msg.Keywords())
+	}
+
+	// Replacing the header keeps the keywords
+	header := msg.Header()
+	header.Set("Subject", "Renamed")
+	saved, err := msg.SetHeaders(header).Save()
+	if err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	msg = mailbox.MessageByUID(saved.UID())
+	if msg == nil || msg.Header().Get("Subject") != "Renamed" ||
+		len(msg.Keywords()) != 1 || msg.Keywords()[0] != "$Label1" {
+		t.Errorf("Expected keywords to survive a header change")
+	}
+}
+
+func testDeleteFlaggedMessages(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 5)
+	next := mailbox.NextUID()
+
+	for _, uid := range []uint32{uids[1], uids[3]} {
+		if _, err := mailbox.MessageByUID(uid).AddFlags(types.FlagDeleted).Save(); err != nil {
+			t.Fatalf("Error saving message: %s", err)
+		}
+	}
+	deleted, err := mailbox.DeleteFlaggedMessages()
+	if err != nil {
+		t.Fatalf("Error deleting messages: %s", err)
+	}
+	assertUIDs(t, "Deleted", deleted, []uint32{uids[1], uids[3]})
+
+	// The remaining messages are renumbered, but keep their UIDs
+	remaining := []uint32{uids[0], uids[2], uids[4]}
+	assertSequenceNumbers(t, mailbox, remaining)
+	assertUIDs(t, "1:*", mailbox.MessageSetBySequenceNumber(parseSet(t, "1:*")), remaining)
+	assertUIDs(t, "UID 1:*", mailbox.MessageSetByUID(parseSet(t, "1:*")), remaining)
+	if msg := mailbox.MessageByUID(uids[1]); msg != nil {
+		t.Errorf("Expected the deleted message to be gone, got %v", msg)
+	}
+	if mailbox.NextUID() != next {
+		t.Errorf("Expected the next UID to stay %d, got %d", next, mailbox.NextUID())
+	}
+	if msg := mailbox.MessageBySequenceNumber(2); msg.Header().Get("Subject") != "Message 3" {
+		t.Errorf("Expected message 2 to be the third message appended")
+	}
+
+	deleted, err = mailbox.DeleteFlaggedMessages()
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("Expected nothing more to be deleted, got %v and %v", deleted, err)
+	}
+}
+
+// testDeleteFlaggedMessagesByUID checks that only flagged messages in the
+// set are deleted, and that stores which don't implement UIDExpunger are
+// left alone
+func testDeleteFlaggedMessagesByUID(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 5)
+	for _, uid := range []uint32{uids[0], uids[2], uids[4]} {
+		if _, err := mailbox.MessageByUID(uid).AddFlags(types.FlagDeleted).Save(); err != nil {
+			t.Fatalf("Error saving message: %s", err)
+		}
+	}
+
+	// Without the store's own implementation nothing is deleted
+	plain := struct{ mailstore.Mailbox }{mailbox}
+	set := parseSet(t, fmt.Sprintf("%d", uids[4]))
+	deleted, err := mailstore.DeleteFlaggedMessagesByUIDContext(context.Background(), plain, set)
+	if err != mailstore.ErrUIDExpungeNotSupported {
+		t.Errorf("Expected ErrUIDExpungeNotSupported, got %v and %v", deleted, err)
+	}
+	if _, ok := mailbox.(mailstore.UIDExpunger); !ok {
+		t.Skip("Mailbox doesn't implement UIDExpunger")
+	}
+
+	set = parseSet(t, fmt.Sprintf("%d:%d,%d", uids[1], uids[2], uids[4]))
+	deleted, err = mailstore.DeleteFlaggedMessagesByUIDContext(context.Background(), mailbox, set)
+	if err != nil {
+		t.Fatalf("Error deleting messages: %s", err)
+	}
+	assertUIDs(t, "Deleted", deleted, []uint32{uids[2], uids[4]})
+
+	remaining := []uint32{uids[0], uids[1], uids[3]}
+	assertSequenceNumbers(t, mailbox, remaining)
+	if !mailbox.MessageByUID(uids[0]).Flags().HasFlags(types.FlagDeleted) {
+		t.Errorf("Expected the message outside the set to stay flagged")
+	}
+}
+
+// testMoveMessages checks that messages are moved with their content and
+// flags, both by the store and by the fallback for stores which don't
+// implement Mover. A second mailbox is needed, so it is skipped for users
+// which don't implement MailboxManager, and the fallback needs UIDExpunger.
+func testMoveMessages(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	manager, ok := user.(mailstore.MailboxManager)
+	if !ok {
+		t.Skip("User doesn't implement MailboxManager")
+	}
+	mailbox := emptyMailbox(t, user)
+	dest, err := manager.CreateMailbox("Moved")
+	if err != nil {
+		t.Fatalf("Error creating mailbox: %s", err)
+	}
+	appendMessage(t, mailbox, "Message 1", 0)
+	appendMessage(t, mailbox, "Message 2", types.FlagFlagged)
+	appendMessage(t, mailbox, "Message 3", types.FlagDeleted)
+	appendMessage(t, mailbox, "Message 4", types.FlagSeen)
+
+	// Without either interface nothing can be moved
+	plain := struct{ mailstore.Mailbox }{mailbox}
+	msgs := mailbox.MessageSetBySequenceNumber(parseSet(t, "1"))
+	if _, err := mailstore.MoveMessagesContext(context.Background(), plain, msgs, dest); err != mailstore.ErrMoveNotSupported {
+		t.Errorf("Expected ErrMoveNotSupported, got %v", err)
+	}
+	if dest.Messages() != 0 {
+		t.Errorf("Expected nothing to be copied, got %d messages", dest.Messages())
+	}
+
+	// Hiding the store's own implementation tests the fallback
+	expunger, ok := mailbox.(mailstore.UIDExpunger)
+	if !ok {
+		t.Skip("Mailbox doesn't implement UIDExpunger")
+	}
+	fallback := struct {
+		mailstore.Mailbox
+		mailstore.UIDExpunger
+	}{mailbox, expunger}
+	for _, source := range []mailstore.Mailbox{mailbox, fallback} {
+		if _, err := mailbox.MessageBySequenceNumber(2).AddKeywords("$Label1").Save(); err != nil {
+			t.Fatalf("Error saving message: %s", err)
+		}
+		msgs := mailbox.MessageSetBySequenceNumber(parseSet(t, "2"))
+		subject, body, flags := msgs[0].Header().Get("Subject"), messageBody(t, msgs[0]), msgs[0].Flags()
+		moved, err := mailstore.MoveMessagesContext(context.Background(), source, msgs, dest)
+		if err != nil {
+			t.Fatalf("Error moving messages: %s", err)
+		}
+		if len(moved) != 1 {
+			t.Fatalf("Expected 1 message to be moved, got %d", len(moved))
+		}
+		copied := dest.MessageByUID(moved[0].UID())
+		if copied == nil || copied.Header().Get("Subject") != subject || messageBody(t, copied) != body {
+			t.Errorf("Expected the message to be in the destination mailbox")
+		}
+		if !moved[0].Flags().HasFlags(flags.ResetFlags(types.FlagRecent)) {
+			t.Errorf("Expected flags %s to be kept, got %s", flags, moved[0].Flags())
+		}
+		if keywords := moved[0].Keywords(); len(keywords) != 1 || keywords[0] != "$Label1" {
+			t.Errorf("Expected keywords to be kept, got %v", keywords)
+		}
+		if mailbox.MessageByUID(msgs[0].UID()) != nil {
+			t.Errorf("Expected the message to be removed from the source mailbox")
+		}
+	}
+
+	if mailbox.Messages() != 2 || dest.Messages() != 2 {
+		t.Fatalf("Expected 2 messages in each mailbox, got %d and %d",
+			mailbox.Messages(), dest.Messages())
+	}
+	if msg := mailbox.MessageBySequenceNumber(2); msg.Header().Get("Subject") != "Message 4" {
+		t.Errorf("Expected the remaining messages to be renumbered")
+	}
+}
+
+func testUIDsNotReused(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	uids := appendMessages(t, mailbox, 2)
+
+	for _, uid := range uids {
+		if _, err := mailbox.MessageByUID(uid).AddFlags(types.FlagDeleted).Save(); err != nil {
+			t.Fatalf("Error saving message: %s", err)
+		}
+	}
+	if _, err := mailbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Error deleting messages: %s", err)
+	}
+	if mailbox.Messages() != 0 {
+		t.Fatalf("Expected the mailbox to be empty, got %d messages", mailbox.Messages())
+	}
+	if mailbox.NextUID() <= uids[1] {
+		t.Errorf("Expected the next UID to be greater than %d, got %d", uids[1], mailbox.NextUID())
+	}
+	if mailbox.LastUID() != mailbox.NextUID() {
+		t.Errorf("Expected the last UID of an empty mailbox to be the next UID %d, got %d",
+			mailbox.NextUID(), mailbox.LastUID())
+	}
+
+	msg := appendMessage(t, mailbox, "After", 0)
+	if msg.UID() <= uids[1] {
+		t.Errorf("Expected UID %d not to be reused, got %d", uids[1], msg.UID())
+	}
+	if msg.SequenceNumber() != 1 {
+		t.Errorf("Expected sequence number 1, got %d", msg.SequenceNumber())
+	}
+}
+
+// testUIDValidity checks that UIDVALIDITY is kept between sessions, and
+// changes when a mailbox is deleted and created again with the same name
+func testUIDValidity(t *testing.T, newStore Factory) {
+	store, username, password := newStore(t)
+	first, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in: %s", err)
+	}
+	mailbox := emptyMailbox(t, first)
+	appendMessage(t, mailbox, "Message 1", 0)
+	validity := mailbox.UIDValidity()
+	if validity == 0 {
+		t.Errorf("Expected UIDVALIDITY to be non-zero")
+	}
+
+	second, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in again: %s", err)
+	}
+	other, err := second.MailboxByName(mailbox.Name())
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	if other.UIDValidity() != validity {
+		t.Errorf("Expected UIDVALIDITY %d to be kept, got %d", validity, other.UIDValidity())
+	}
+
+	manager, ok := first.(mailstore.MailboxManager)
+	if !ok {
+		return
+	}
+	if err := manager.DeleteMailbox(mailbox.Name()); err != nil {
+		t.Fatalf("Error deleting mailbox: %s", err)
+	}
+	recreated, err := manager.CreateMailbox(mailbox.Name())
+	if err != nil {
+		t.Fatalf("Error creating mailbox: %s", err)
+	}
+	if recreated.UIDValidity() == validity {
+		t.Errorf("Expected UIDVALIDITY to change when the mailbox is recreated")
+	}
+}
+
+func testSharedBetweenSessions(t *testing.T, newStore Factory) {
+	store, username, password := newStore(t)
+	first, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in: %s", err)
+	}
+	mailbox := emptyMailbox(t, first)
+
+	second, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in again: %s", err)
+	}
+	other, err := second.MailboxByName(mailbox.Name())
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+
+	msg := appendMessage(t, mailbox, "Shared", 0)
+	if other.Messages() != 1 || other.MessageByUID(msg.UID()) == nil {
+		t.Errorf("Expected a new message to be seen by other sessions")
+	}
+	if _, err := other.MessageByUID(msg.UID()).AddFlags(types.FlagSeen).Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	if !mailbox.MessageByUID(msg.UID()).Flags().HasFlags(types.FlagSeen) {
+		t.Errorf("Expected flag changes to be seen by other sessions")
+	}
+}
+
+// waitForUpdates collects the updates from a watcher until n have arrived
+func waitForUpdates(t *testing.T, watcher *mailstore.Watcher, n int) []mailstore.Update {
+	var updates []mailstore.Update
+	timeout := time.After(5 * time.Second)
+	for len(updates) < n {
+		select {
+		case <-watcher.Ready():
+			updates = append(updates, watcher.Updates()...)
+		case <-timeout:
+			t.Fatalf("Expected %d updates, got %v", n, updates)
+		}
+	}
+	return updates
+}
+
+// testContext checks that nothing is done once the context is cancelled,
+// whether or not the store implements the context-aware interfaces
+func testContext(t *testing.T, newStore Factory) {
+	store, username, password := newStore(t)
+	user, err := store.Authenticate(username, password)
+	if err != nil {
+		t.Fatalf("Error logging in: %s", err)
+	}
+	mailbox := emptyMailbox(t, user)
+	msg := appendMessage(t, mailbox, "Cancelled", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := mailstore.AuthenticateContext(ctx, store, username, password); err != context.Canceled {
+		t.Errorf("Expected authentication to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.MailboxesContext(ctx, user); err != context.Canceled {
+		t.Errorf("Expected listing mailboxes to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.MailboxByNameContext(ctx, user, mailbox.Name()); err != context.Canceled {
+		t.Errorf("Expected getting a mailbox to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.MessageSetByUIDContext(ctx, mailbox, parseSet(t, "1:*")); err != context.Canceled {
+		t.Errorf("Expected getting messages by UID to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.MessageSetBySequenceNumberContext(ctx, mailbox, parseSet(t, "1:*")); err != context.Canceled {
+		t.Errorf("Expected getting messages by sequence number to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.OpenContext(ctx, msg); err != context.Canceled {
+		t.Errorf("Expected opening a message to be cancelled, got %v", err)
+	}
+
+	if _, err := mailstore.SaveContext(ctx, msg.AddFlags(types.FlagDeleted)); err != context.Canceled {
+		t.Errorf("Expected saving a message to be cancelled, got %v", err)
+	}
+	if _, err := mailstore.DeleteFlaggedMessagesContext(ctx, mailbox); err != context.Canceled {
+		t.Errorf("Expected deleting messages to be cancelled, got %v", err)
+	}
+	if mailbox.Messages() != 1 {
+		t.Errorf("Expected the message to be kept, got %d messages", mailbox.Messages())
+	}
+}
+
+func testNotifier(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	mailbox := emptyMailbox(t, user)
+	notifier, ok := mailbox.(mailstore.Notifier)
+	if !ok {
+		t.Skip("Mailbox doesn't implement Notifier")
+	}
+	watcher := notifier.Watch()
+	defer watcher.Close()
+
+	msg := appendMessage(t, mailbox, "Watched", 0)
+	updates := waitForUpdates(t, watcher, 1)
+	if updates[0].Type != mailstore.UpdateExists || updates[0].UID != msg.UID() {
+		t.Errorf("Expected an update for the new message, got %v", updates)
+	}
+
+	if _, err := msg.AddFlags(types.FlagSeen | types.FlagDeleted).Save(); err != nil {
+		t.Fatalf("Error saving message: %s", err)
+	}
+	updates = waitForUpdates(t, watcher, 1)
+	if updates[0].Type != mailstore.UpdateFlags || updates[0].UID != msg.UID() ||
+		!updates[0].Flags.HasFlags(types.FlagSeen|types.FlagDeleted) {
+		t.Errorf("Expected an update for the new flags, got %v", updates)
+	}
+
+	if _, err := mailbox.DeleteFlaggedMessages(); err != nil {
+		t.Fatalf("Error deleting messages: %s", err)
+	}
+	updates = waitForUpdates(t, watcher, 1)
+	if updates[0].Type != mailstore.UpdateExpunge || updates[0].UID != msg.UID() {
+		t.Errorf("Expected an update for the deleted message, got %v", updates)
+	}
+
+	// Nothing is received once the watcher is closed
+	watcher.Close()
+	appendMessage(t, mailbox, "Unwatched", 0)
+	if updates := watcher.Updates(); len(updates) != 0 {
+		t.Errorf("Expected no updates after closing the watcher, got %v", updates)
+	}
+}
+
+func mailboxNames(user mailstore.User) map[string]bool {
+	names := make(map[string]bool)
+	for _, mailbox := range user.Mailboxes() {
+		names[mailbox.Name()] = true
+	}
+	return names
+}
+
+func testMailboxManager(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	manager, ok := user.(mailstore.MailboxManager)
+	if !ok {
+		t.Skip("User doesn't implement MailboxManager")
+	}
+
+	created, err := manager.CreateMailbox("Work/Project")
+	if err != nil {
+		t.Fatalf("Error creating mailbox: %s", err)
+	}
+	if created.Name() != "Work/Project" || created.Messages() != 0 {
+		t.Errorf("Expected a new, empty mailbox named Work/Project, got %q", created.Name())
+	}
+	if names := mailboxNames(user); !names["Work"] || !names["Work/Project"] {
+		t.Errorf("Expected the mailbox and its superior to be created, got %v", names)
+	}
+	if _, err := manager.CreateMailbox("Work/Project"); err == nil {
+		t.Errorf("Expected an error creating an existing mailbox")
+	}
+	if _, err := manager.CreateMailbox("INBOX"); err == nil {
+		t.Errorf("Expected an error creating INBOX")
+	}
+	appendMessage(t, created, "Plans", 0)
+
+	if err := manager.RenameMailbox("Work", "Archive/Work"); err != nil {
+		t.Fatalf("Error renaming mailbox: %s", err)
+	}
+	names := mailboxNames(user)
+	if names["Work"] || names["Work/Project"] || !names["Archive/Work"] || !names["Archive/Work/Project"] {
+		t.Errorf("Expected the mailbox and its inferiors to be renamed, got %v", names)
+	}
+	project, err := user.MailboxByName("Archive/Work/Project")
+	if err != nil {
+		t.Fatalf("Error getting renamed mailbox: %s", err)
+	}
+	if project.Messages() != 1 {
+		t.Errorf("Expected messages to move with their mailbox")
+	}
+
+	inbox, _ := user.MailboxByName("INBOX")
+	appendMessage(t, inbox, "Old", 0)
+	if err := manager.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatalf("Error renaming INBOX: %s", err)
+	}
+	inbox, err = user.MailboxByName("INBOX")
+	if err != nil || inbox.Messages() != 0 {
+		t.Errorf("Expected INBOX to remain, empty, after renaming it")
+	}
+	if old, err := user.MailboxByName("Old"); err != nil || old.Messages() == 0 {
+		t.Errorf("Expected the messages in INBOX to be moved")
+	}
+
+	if err := manager.DeleteMailbox("INBOX"); err == nil {
+		t.Errorf("Expected an error deleting INBOX")
+	}
+	if err := manager.DeleteMailbox("Nonexistent"); err == nil {
+		t.Errorf("Expected an error deleting a mailbox which doesn't exist")
+	}
+	if err := manager.DeleteMailbox("Archive/Work/Project"); err != nil {
+		t.Fatalf("Error deleting mailbox: %s", err)
+	}
+	if _, err := user.MailboxByName("Archive/Work/Project"); err == nil {
+		t.Errorf("Expected the mailbox to be deleted")
+	}
+	if _, err := user.MailboxByName("Archive/Work"); err != nil {
+		t.Errorf("Expected the superior mailbox to be kept")
+	}
+}
+
+func testSubscriptionManager(t *testing.T, newStore Factory) {
+	_, user := login(t, newStore)
+	manager, ok := user.(mailstore.SubscriptionManager)
+	if !ok {
+		t.Skip("User doesn't implement SubscriptionManager")
+	}
+
+	isSubscribed := func(name string) bool {
+		for _, subscription := range manager.Subscriptions() {
+			if subscription == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Mailboxes don't need to exist to be subscribed to
+	if err := manager.Subscribe("Conformance/Subscribed"); err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	if !isSubscribed("Conformance/Subscribed") {
+		t.Errorf("Expected the subscription to be listed, got %v", manager.Subscriptions())
+	}
+	if err := manager.Unsubscribe("Conformance/Subscribed"); err != nil {
+		t.Errorf("Error unsubscribing: %s", err)
+	}
+	if isSubscribed("Conformance/Subscribed") {
+		t.Errorf("Expected the subscription to be removed, got %v", manager.Subscriptions())
+	}
+	if err := manager.Unsubscribe("Conformance/Subscribed"); err == nil {
+		t.Errorf("Expected an error unsubscribing from a mailbox which isn't subscribed")
+	}
+}
+
+func testMailboxType(t *testing.T, newStore Factory) {
+	store, user := login(t, newStore)
+	typer, ok := store.(mailstore.MailboxTyper)
+	if !ok {
+		t.Skip("Mailstore doesn't implement MailboxTyper")
+	}
+	mailbox, err := user.MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Error getting INBOX: %s", err)
+	}
+	if got, want := reflect.TypeOf(typer.MailboxType()), reflect.TypeOf(mailbox); got != want {
+		t.Errorf("Expected MailboxType to give a %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,1560 @@
+package mailstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+const (
+	// mboxInferiors is the suffix of the directory holding a mailbox's
+	// inferiors, as used by Thunderbird, so that a mailbox can have both
+	// messages and inferior mailboxes
+	mboxInferiors = ".sbd"
+
+	// mboxPseudoSubject is the subject of the message used by UW IMAP to hold
+	// the UIDVALIDITY and next UID of an empty mailbox
+	mboxPseudoSubject = "DON'T DELETE THIS MESSAGE -- FOLDER INTERNAL DATA"
+)
+
+// The Status and X-Status fields are padded to these widths, so that a
+// message's flags can be changed without rewriting the file
+const (
+	mboxStatusField  = "Status: "
+	mboxXStatusField = "X-Status: "
+	mboxStatusWidth  = 2 // R and O
+	mboxXStatusWidth = 4 // One letter for each of mboxXStatusFlags
+)
+
+// mboxStateFields are the header fields which store the state of a message
+// and its mailbox. They aren't part of the message shown to clients.
+var mboxStateFields = map[string]bool{
+	"Status":         true,
+	"X-Status":       true,
+	"X-Keywords":     true,
+	"X-Uid":          true,
+	"X-Imapbase":     true,
+	"X-Imap":         true,
+	"Content-Length": true,
+}
+
+// mboxXStatusFlags maps the letters of the X-Status field to IMAP flags
+var mboxXStatusFlags = []struct {
+	letter byte
+	flag   types.Flags
+}{
+	{'A', types.FlagAnswered},
+	{'F', types.FlagFlagged},
+	{'T', types.FlagDraft},
+	{'D', types.FlagDeleted},
+}
+
+// MboxMailstore is a Mailstore which keeps each mailbox in an mboxrd file.
+// Flags are stored in the Status, X-Status and X-Keywords fields and UIDs in
+// the X-UID and X-IMAPbase fields, which are understood by most other mbox
+// readers. Files are locked with a dot lock while they are changed.
+type MboxMailstore struct {
+	// Root is the directory holding each user's mailboxes, named after the
+	// user. INBOX is the file INBOX in that directory, and the inferiors of a
+	// mailbox are kept in a directory named after it with a .sbd suffix.
+	Root string
+
+	// CheckPassword returns true if the password is correct for the user. If
+	// it is nil, every login is refused.
+	CheckPassword func(username string, password string) bool
+
+	mu    sync.Mutex
+	users map[string]*MboxUser
+}
+
+// NewMboxMailstore creates a Mailstore serving the mbox files in the root
+// directory.
+func NewMboxMailstore(root string, checkPassword func(username string, password string) bool) *MboxMailstore {
+	return &MboxMailstore{
+		Root:          root,
+		CheckPassword: checkPassword,
+		users:         make(map[string]*MboxUser),
+	}
+}
+
+// MailboxType implements the MailboxTyper interface
+func (s *MboxMailstore) MailboxType() Mailbox {
+	return &MboxMailbox{}
+}
+
+// Authenticate implements the Authenticate method on the Mailstore interface
+func (s *MboxMailstore) Authenticate(username string, password string) (User, error) {
+	if s.CheckPassword == nil || !s.CheckPassword(username, password) {
+		return nil, errors.New("Invalid username or password")
+	}
+	if !validUsername(username) {
+		return nil, errors.New("Invalid username")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == nil {
+		s.users = make(map[string]*MboxUser)
+	}
+
+	// Users are shared between connections, so that changes made by one
+	// connection are seen by the others
+	user, ok := s.users[username]
+	if !ok {
+		user = &MboxUser{
+			path:      filepath.Join(s.Root, username),
+			mailboxes: make(map[string]*MboxMailbox),
+		}
+		if err := os.MkdirAll(user.path, 0700); err != nil {
+			return nil, err
+		}
+		if err := createMbox(filepath.Join(user.path, "INBOX")); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		s.users[username] = user
+	}
+	return user, nil
+}
+
+// MboxUser is a directory of mbox files belonging to a user.
+type MboxUser struct {
+	path string
+
+	mu        sync.Mutex
+	mailboxes map[string]*MboxMailbox // By file path
+}
+
+// mboxFile returns the path of the file holding a mailbox, relative to the
+// user's directory.
+func mboxFile(name string) (string, error) {
+	levels := strings.Split(name, "/")
+	if strings.EqualFold(levels[0], "INBOX") {
+		levels[0] = "INBOX"
+	}
+	for i, level := range levels {
+		if level == "" || strings.HasPrefix(level, ".") ||
+			strings.HasSuffix(level, mboxInferiors) || strings.HasSuffix(level, ".lock") ||
+			strings.ContainsAny(level, "\\\x00") {
+			return "", errors.New("Invalid mailbox name")
+		}
+		if i < len(levels)-1 {
+			levels[i] += mboxInferiors
+		}
+	}
+	return filepath.Join(levels...), nil
+}
+
+// mboxMailboxName reverses mboxFile.
+func mboxMailboxName(file string) string {
+	levels := strings.Split(filepath.ToSlash(file), "/")
+	for i := range levels {
+		levels[i] = strings.TrimSuffix(levels[i], mboxInferiors)
+	}
+	return strings.Join(levels, "/")
+}
+
+// mailbox returns the shared mailbox for a file.
+func (u *MboxUser) mailbox(file string) *MboxMailbox {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	path := filepath.Join(u.path, file)
+	mailbox, ok := u.mailboxes[path]
+	if !ok {
+		mailbox = &MboxMailbox{name: mboxMailboxName(file), path: path}
+		u.mailboxes[path] = mailbox
+	}
+	return mailbox
+}
+
+// forget drops shared mailboxes for files which have been deleted or
+// renamed.
+func (u *MboxUser) forget(files ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, file := range files {
+		delete(u.mailboxes, filepath.Join(u.path, file))
+	}
+}
+
+// files returns the paths of all mailbox files in a directory and the
+// inferior directories within it, relative to the user's directory.
+func (u *MboxUser) files(dir string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(u.path, dir))
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		if entry.IsDir() && strings.HasSuffix(name, mboxInferiors) {
+			files = append(files, u.files(filepath.Join(dir, name))...)
+		} else if entry.Mode().IsRegular() {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	return files
+}
+
+// Mailboxes implements the Mailboxes method on the User interface
+func (u *MboxUser) Mailboxes() []Mailbox {
+	files := u.files("")
+	sort.Slice(files, func(i, j int) bool {
+		// INBOX comes first
+		if (files[i] == "INBOX") != (files[j] == "INBOX") {
+			return files[i] == "INBOX"
+		}
+		return mboxMailboxName(files[i]) < mboxMailboxName(files[j])
+	})
+
+	mailboxes := make([]Mailbox, len(files))
+	for i, file := range files {
+		mailboxes[i] = u.mailbox(file)
+	}
+	return mailboxes
+}
+
+// MailboxByName implements the MailboxByName method on the User interface
+func (u *MboxUser) MailboxByName(name string) (Mailbox, error) {
+	file, err := mboxFile(name)
+	if err != nil || !isFile(filepath.Join(u.path, file)) {
+		return nil, errors.New("Invalid mailbox")
+	}
+	return u.mailbox(file), nil
+}
+
+// createSuperiors creates any missing mailboxes above the given name in the
+// hierarchy, and the directory which will hold the named mailbox.
+func (u *MboxUser) createSuperiors(name string) error {
+	levels := strings.Split(name, "/")
+	for i := 1; i < len(levels); i++ {
+		file, err := mboxFile(strings.Join(levels[:i], "/"))
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(u.path, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := createMbox(path); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	// The mailbox itself may be the first in its superior's directory
+	file, err := mboxFile(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Dir(filepath.Join(u.path, file)), 0700)
+}
+
+// CreateMailbox implements the CreateMailbox method on the MailboxManager
+// interface
+func (u *MboxUser) CreateMailbox(name string) (Mailbox, error) {
+	name = strings.TrimSuffix(name, "/")
+	file, err := mboxFile(name)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(u.path, file)
+	if isFile(path) {
+		return nil, errors.New("Mailbox already exists")
+	}
+
+	if err := u.createSuperiors(name); err != nil {
+		return nil, err
+	}
+	if err := createMbox(path); err != nil {
+		if os.IsExist(err) {
+			return nil, errors.New("Mailbox already exists")
+		}
+		return nil, err
+	}
+	return u.mailbox(file), nil
+}
+
+// DeleteMailbox implements the DeleteMailbox method on the MailboxManager
+// interface
+func (u *MboxUser) DeleteMailbox(name string) error {
+	file, err := mboxFile(name)
+	if err != nil {
+		return errors.New("Invalid mailbox")
+	}
+	if file == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	path := filepath.Join(u.path, file)
+	if !isFile(path) {
+		return errors.New("Invalid mailbox")
+	}
+
+	u.forget(file)
+	return os.Remove(path)
+}
+
+// RenameMailbox implements the RenameMailbox method on the MailboxManager
+// interface
+func (u *MboxUser) RenameMailbox(oldName string, newName string) error {
+	oldFile, err := mboxFile(oldName)
+	if err != nil || !isFile(filepath.Join(u.path, oldFile)) {
+		return errors.New("Invalid mailbox")
+	}
+	newFile, err := mboxFile(newName)
+	if err != nil {
+		return errors.New("Invalid mailbox name")
+	}
+	newPath := filepath.Join(u.path, newFile)
+	if newFile == "INBOX" || isFile(newPath) {
+		return errors.New("Mailbox already exists")
+	}
+	if strings.HasPrefix(newFile, oldFile+mboxInferiors+string(filepath.Separator)) {
+		return errors.New("Cannot rename a mailbox to one of its inferiors")
+	}
+	if err := u.createSuperiors(newName); err != nil {
+		return err
+	}
+
+	oldPath := filepath.Join(u.path, oldFile)
+	unlock, err := dotLock(oldPath + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	u.forget(oldFile)
+
+	// INBOX always exists, and its inferiors stay where they are
+	if oldFile == "INBOX" {
+		return createMbox(oldPath)
+	}
+
+	// Move the inferiors along with the mailbox
+	oldInferiors := oldPath + mboxInferiors
+	if !isDir(oldInferiors) {
+		return nil
+	}
+	moved := u.files(oldFile + mboxInferiors)
+	if err := os.Rename(oldInferiors, newPath+mboxInferiors); err != nil {
+		return err
+	}
+	u.forget(moved...)
+	return nil
+}
+
+// Subscribe implements the Subscribe method on the SubscriptionManager
+// interface
+func (u *MboxUser) Subscribe(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return subscribe(filepath.Join(u.path, ".subscriptions"), name)
+}
+
+// Unsubscribe implements the Unsubscribe method on the SubscriptionManager
+// interface
+func (u *MboxUser) Unsubscribe(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return unsubscribe(filepath.Join(u.path, ".subscriptions"), name)
+}
+
+// Subscriptions implements the Subscriptions method on the
+// SubscriptionManager interface
+func (u *MboxUser) Subscriptions() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return readSubscriptions(filepath.Join(u.path, ".subscriptions"))
+}
+
+// MboxMailbox is an mbox file. The position and state of each message is
+// kept in an index, which is rebuilt whenever the file changes.
+//
+// Changing the flags of a message, or expunging messages, rewrites the whole
+// file, so large archives are best served mostly read-only.
+type MboxMailbox struct {
+	name string
+	path string
+
+	mu          sync.Mutex
+	loaded      bool
+	uidValidity uint32
+	nextUID     uint32
+	messages    []*mboxEntry // In file order, which is also UID order
+	size        int64
+	modTime     time.Time
+	updates     Broadcaster
+}
+
+// mboxEntry is the index entry for a message in an mbox file
+type mboxEntry struct {
+	uid          uint32
+	flags        types.Flags
+	keywords     []string
+	internalDate time.Time
+	size         uint32 // The size with CRLF line endings and no state fields
+
+	fromLine    string // The "From " line which starts the message
+	headerStart int64
+	headerEnd   int64 // Before the blank line ending the header
+	bodyStart   int64
+	end         int64 // Before the blank line separating it from the next message
+
+	// The offsets of the values of the Status and X-Status fields, or zero
+	// if they aren't padded to their full width
+	statusAt  int64
+	xStatusAt int64
+
+	// When the file is rewritten, messages whose content has changed are
+	// written from here rather than copied
+	content *mboxContent
+}
+
+// flagSet returns the flags and keywords of the message
+func (e *mboxEntry) flagSet() types.FlagSet {
+	return types.FlagSet{Flags: e.flags, Keywords: e.keywords}
+}
+
+// mboxContent is the header and body of a message as stored in an mbox file,
+// with LF line endings, without state fields and with From lines in the body
+// quoted. A nil header or body is copied from the message being replaced.
+type mboxContent struct {
+	header []byte
+	body   io.Reader
+}
+
+// Watch implements the Watch method on the Notifier interface. The file is
+// indexed first, so that only changes made after watching starts are
+// reported.
+func (m *MboxMailbox) Watch() *Watcher {
+	m.load()
+	defer m.mu.Unlock()
+	return m.updates.Watch()
+}
+
+// lock takes the dot lock used by mail delivery agents and other mbox
+// readers. It returns a function to release it.
+func (m *MboxMailbox) lock() (func(), error) {
+	return dotLock(m.path + ".lock")
+}
+
+// changed returns true if the file has changed since it was last indexed.
+// The mailbox must be locked.
+func (m *MboxMailbox) changed() (bool, error) {
+	if !m.loaded {
+		return true, nil
+	}
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return false, err
+	}
+	return info.Size() != m.size || !info.ModTime().Equal(m.modTime), nil
+}
+
+// sync reindexes the file if it has changed since it was last indexed. The
+// mailbox must be locked.
+func (m *MboxMailbox) sync() error {
+	if changed, err := m.changed(); err != nil || !changed {
+		return err
+	}
+
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.reindex()
+}
+
+// reindex rebuilds the index of the file, assigning UIDs to any messages
+// without them. The mailbox and the file must be locked. Connections
+// watching the mailbox are told about any messages which have been added or
+// removed, and any flags which have changed.
+func (m *MboxMailbox) reindex() error {
+	messages, validity, next, err := m.scan()
+	if err != nil {
+		return err
+	}
+
+	// The UIDVALIDITY of an empty mailbox is only stored once it has
+	// messages
+	changed := false
+	if validity == 0 && m.uidValidity != 0 {
+		validity = m.uidValidity
+	}
+	if next < m.nextUID && validity == m.uidValidity {
+		next = m.nextUID
+	}
+	if validity == 0 {
+		validity = newUIDValidity()
+		changed = true
+	}
+	if next == 0 {
+		next = 1
+	}
+
+	// UIDs must increase through the file. Messages delivered by other
+	// programs have none, and are numbered now.
+	var last uint32
+	for _, entry := range messages {
+		if entry.uid != 0 && entry.uid > last {
+			last = entry.uid
+			if entry.uid >= next {
+				next = entry.uid + 1
+			}
+			continue
+		}
+		if entry.uid != 0 {
+			// A message has been moved, so its UID can't be kept
+			validity = newUIDValidity()
+		}
+		if next <= last {
+			next = last + 1
+		}
+		entry.uid = next
+		last = next
+		next++
+		changed = true
+	}
+
+	if changed && len(messages) > 0 {
+		if err := m.rewrite(messages, validity, next); err == nil {
+			return m.reindex()
+		}
+		// The file may be read-only, in which case the UIDs only last until
+		// the server is restarted
+	}
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	if m.loaded {
+		m.notifyChanges(messages)
+	}
+	m.loaded = true
+	m.uidValidity = validity
+	m.nextUID = next
+	m.messages = messages
+	m.size = info.Size()
+	m.modTime = info.ModTime()
+	return nil
+}
+
+// notifyChanges tells watchers about the differences between the current
+// index and a new one.
+func (m *MboxMailbox) notifyChanges(messages []*mboxEntry) {
+	previous := make(map[uint32]*mboxEntry, len(m.messages))
+	for _, entry := range m.messages {
+		previous[entry.uid] = entry
+	}
+	current := make(map[uint32]bool, len(messages))
+	for _, entry := range messages {
+		current[entry.uid] = true
+	}
+
+	for _, entry := range m.messages {
+		if !current[entry.uid] {
+			m.updates.Notify(Update{Type: UpdateExpunge, UID: entry.uid})
+		}
+	}
+	for _, entry := range messages {
+		old, ok := previous[entry.uid]
+		if !ok {
+			m.updates.Notify(Update{Type: UpdateExists, UID: entry.uid, Flags: entry.flags, Keywords: entry.keywords})
+		} else if !old.flagSet().Equal(entry.flagSet()) {
+			m.updates.Notify(Update{Type: UpdateFlags, UID: entry.uid, Flags: entry.flags, Keywords: entry.keywords})
+		}
+	}
+}
+
+// scan reads the file and indexes its messages. It also returns the
+// UIDVALIDITY and next UID stored in the file, which are zero if there are
+// none.
+func (m *MboxMailbox) scan() (messages []*mboxEntry, validity uint32, next uint32, err error) {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	var entry *mboxEntry
+	var fields textproto.MIMEHeader // The state fields of the current message
+	var field string                // The field being read, for continuation lines
+	var inHeader, prevBlank bool
+	var pos, prevPos int64
+
+	finish := func() {
+		if entry == nil {
+			return
+		}
+		if inHeader {
+			entry.headerEnd, entry.bodyStart, entry.end = pos, pos, pos
+			entry.size += 2
+		} else if prevBlank && entry.end > entry.bodyStart {
+			// The blank line before the next message isn't part of this one
+			entry.end = prevPos
+			entry.size -= 2
+		}
+
+		if fields.Get("X-Imap") != "" && len(messages) == 0 {
+			// The UW IMAP pseudo message isn't shown to clients
+			validity, next = parseMboxBase(fields.Get("X-Imap"))
+			entry = nil
+			return
+		}
+		if fields.Get("X-Imapbase") != "" && len(messages) == 0 {
+			validity, next = parseMboxBase(fields.Get("X-Imapbase"))
+		}
+		entry.uid = parseUint32(strings.TrimSpace(fields.Get("X-Uid")))
+		entry.flags = parseMboxFlags(fields.Get("Status"), fields.Get("X-Status"))
+		entry.keywords = strings.Fields(strings.Replace(fields.Get("X-Keywords"), ",", " ", -1))
+		if entry.internalDate.IsZero() {
+			if date, err := mail.ParseDate(fields.Get("Date")); err == nil {
+				entry.internalDate = date
+			}
+		}
+		messages = append(messages, entry)
+		entry = nil
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		raw, readErr := r.ReadBytes('\n')
+		if len(raw) == 0 && readErr != nil {
+			if readErr != io.EOF {
+				return nil, 0, 0, readErr
+			}
+			break
+		}
+		// Line endings are removed the same way as by lineReader, so that
+		// the size matches what is read from Open
+		line := strings.TrimSuffix(strings.TrimSuffix(string(raw), "\n"), "\r")
+
+		switch {
+		case strings.HasPrefix(line, "From ") && (pos == 0 || prevBlank):
+			finish()
+			entry = &mboxEntry{
+				fromLine:     line,
+				headerStart:  pos + int64(len(raw)),
+				internalDate: parseMboxFromLine(line),
+			}
+			fields = make(textproto.MIMEHeader)
+			field = ""
+			inHeader = true
+			line = "-" // Not blank
+		case entry == nil:
+			// Anything before the first message is ignored
+		case inHeader && line == "":
+			entry.headerEnd = pos
+			entry.bodyStart = pos + int64(len(raw))
+			entry.end = entry.bodyStart
+			entry.size += 2
+			inHeader = false
+		case inHeader && (line[0] == ' ' || line[0] == '\t'):
+			if field != "" {
+				values := fields[field]
+				values[len(values)-1] += " " + strings.TrimSpace(line)
+				if field == "Status" || field == "X-Status" {
+					// A folded field can't be changed in place
+					entry.statusAt, entry.xStatusAt = 0, 0
+				}
+			} else {
+				entry.size += uint32(len(line)) + 2
+			}
+		case inHeader:
+			field = ""
+			if i := strings.IndexByte(line, ':'); i > 0 {
+				name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+				if mboxStateFields[name] || name == "Date" {
+					fields.Add(name, strings.TrimSpace(line[i+1:]))
+				}
+				switch name {
+				case "Status":
+					entry.statusAt = mboxFieldValueAt(line, pos, len(fields[name]),
+						mboxStatusField, mboxStatusWidth)
+				case "X-Status":
+					entry.xStatusAt = mboxFieldValueAt(line, pos, len(fields[name]),
+						mboxXStatusField, mboxXStatusWidth)
+				}
+				if mboxStateFields[name] {
+					field = name
+					break
+				}
+			}
+			entry.size += uint32(len(line)) + 2
+		default:
+			entry.end = pos + int64(len(raw))
+			entry.size += uint32(len(unquoteMboxLine([]byte(line)))) + 2
+		}
+
+		prevBlank = line == ""
+		prevPos = pos
+		pos += int64(len(raw))
+		if readErr != nil {
+			break
+		}
+	}
+	finish()
+	return messages, validity, next, nil
+}
+
+// rewrite replaces the file with the given messages, storing their current
+// state. The mailbox and the file must be locked.
+func (m *MboxMailbox) rewrite(messages []*mboxEntry, validity uint32, next uint32) error {
+	old, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	info, err := old.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The new file is written alongside the old one, then replaces it
+	tmpPath := filepath.Join(filepath.Dir(m.path), "."+filepath.Base(m.path)+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+
+	if len(messages) == 0 && next > 1 {
+		writeMboxPseudoMessage(w, validity, next)
+	}
+	for i, entry := range messages {
+		var content mboxContent
+		if entry.content != nil {
+			content = *entry.content
+		}
+		if content.header == nil {
+			if content.header, err = entry.readHeader(old); err != nil {
+				break
+			}
+		}
+		if content.body == nil {
+			// Bodies are copied as they are, without being read into memory
+			content.body = io.NewSectionReader(old, entry.bodyStart, entry.end-entry.bodyStart)
+		}
+		base := ""
+		if i == 0 {
+			base = fmt.Sprintf("%d %d", validity, next)
+		}
+		if err = writeMboxMessage(w, entry, &content, base); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
+
+// load brings the index up to date and locks the mailbox. Errors are
+// ignored, as the methods of the Mailbox interface have no way to report
+// them; the mailbox is left as it was last seen.
+func (m *MboxMailbox) load() {
+	m.mu.Lock()
+	m.sync()
+}
+
+// Name implements the Name method on the Mailbox interface
+func (m *MboxMailbox) Name() string { return m.name }
+
+// UIDValidity returns the UIDVALIDITY of the mailbox, which changes if its
+// UIDs are ever reassigned.
+func (m *MboxMailbox) UIDValidity() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return m.uidValidity
+}
+
+// NextUID implements the NextUID method on the Mailbox interface
+func (m *MboxMailbox) NextUID() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return m.nextUID
+}
+
+// LastUID implements the LastUID method on the Mailbox interface
+func (m *MboxMailbox) LastUID() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		return m.nextUID
+	}
+	return m.messages[len(m.messages)-1].uid
+}
+
+// Recent implements the Recent method on the Mailbox interface
+func (m *MboxMailbox) Recent() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	var count uint32
+	for _, entry := range m.messages {
+		if entry.flags.HasFlags(types.FlagRecent) {
+			count++
+		}
+	}
+	return count
+}
+
+// Messages implements the Messages method on the Mailbox interface
+func (m *MboxMailbox) Messages() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	return uint32(len(m.messages))
+}
+
+// Unseen implements the Unseen method on the Mailbox interface
+func (m *MboxMailbox) Unseen() uint32 {
+	m.load()
+	defer m.mu.Unlock()
+	var count uint32
+	for _, entry := range m.messages {
+		if !entry.flags.HasFlags(types.FlagSeen) {
+			count++
+		}
+	}
+	return count
+}
+
+// message returns a copy of the message at the given index. The mailbox
+// must be locked.
+func (m *MboxMailbox) message(index int) *MboxMessage {
+	entry := m.messages[index]
+	return &MboxMessage{
+		mailbox:        m,
+		uid:            entry.uid,
+		sequenceNumber: uint32(index) + 1,
+		flags:          entry.flags,
+		keywords:       entry.keywords,
+		internalDate:   entry.internalDate,
+		size:           entry.size,
+	}
+}
+
+// indexOf returns the index of the message with the given UID, or -1. The
+// mailbox must be locked.
+func (m *MboxMailbox) indexOf(uid uint32) int {
+	i := sort.Search(len(m.messages), func(i int) bool { return m.messages[i].uid >= uid })
+	if i < len(m.messages) && m.messages[i].uid == uid {
+		return i
+	}
+	return -1
+}
+
+// MessageBySequenceNumber implements the MessageBySequenceNumber method on
+// the Mailbox interface
+func (m *MboxMailbox) MessageBySequenceNumber(seqno uint32) Message {
+	m.load()
+	defer m.mu.Unlock()
+	if seqno == 0 || seqno > uint32(len(m.messages)) {
+		return nil
+	}
+	return m.message(int(seqno) - 1)
+}
+
+// MessageByUID implements the MessageByUID method on the Mailbox interface
+func (m *MboxMailbox) MessageByUID(uidno uint32) Message {
+	m.load()
+	defer m.mu.Unlock()
+	i := m.indexOf(uidno)
+	if i < 0 {
+		return nil
+	}
+	return m.message(i)
+}
+
+// MessageSetByUID implements the MessageSetByUID method on the Mailbox
+// interface
+func (m *MboxMailbox) MessageSetByUID(set types.SequenceSet) []Message {
+	m.load()
+	defer m.mu.Unlock()
+	msgs := make([]Message, 0)
+	if len(m.messages) == 0 {
+		return msgs
+	}
+	last := m.messages[len(m.messages)-1].uid
+	for i, entry := range m.messages {
+		if inSequenceSet(set, entry.uid, last) {
+			msgs = append(msgs, m.message(i))
+		}
+	}
+	return msgs
+}
+
+// MessageSetBySequenceNumber implements the MessageSetBySequenceNumber
+// method on the Mailbox interface
+func (m *MboxMailbox) MessageSetBySequenceNumber(set types.SequenceSet) []Message {
+	m.load()
+	defer m.mu.Unlock()
+	msgs := make([]Message, 0)
+	last := uint32(len(m.messages))
+	for i := range m.messages {
+		if inSequenceSet(set, uint32(i)+1, last) {
+			msgs = append(msgs, m.message(i))
+		}
+	}
+	return msgs
+}
+
+// NewMessage implements the NewMessage method on the Mailbox interface
+func (m *MboxMailbox) NewMessage() Message {
+	return &MboxMessage{
+		mailbox:      m,
+		header:       make(textproto.MIMEHeader),
+		internalDate: time.Now(),
+	}
+}
+
+// DeleteFlaggedMessages implements the DeleteFlaggedMessages method on the
+// Mailbox interface
+func (m *MboxMailbox) DeleteFlaggedMessages() ([]Message, error) {
+	return m.deleteFlagged(nil)
+}
+
+// DeleteFlaggedMessagesByUID implements the UIDExpunger interface
+func (m *MboxMailbox) DeleteFlaggedMessagesByUID(set types.SequenceSet) ([]Message, error) {
+	return m.deleteFlagged(set)
+}
+
+// deleteFlagged deletes the flagged messages whose UIDs are in set, or all
+// of them if set is nil.
+func (m *MboxMailbox) deleteFlagged(set types.SequenceSet) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := m.reindex(); err != nil {
+		return nil, err
+	}
+
+	var deleted []Message
+	kept := make([]*mboxEntry, 0, len(m.messages))
+	for i, entry := range m.messages {
+		inSet := set == nil || inSequenceSet(set, entry.uid, m.messages[len(m.messages)-1].uid)
+		if inSet && entry.flags.HasFlags(types.FlagDeleted) {
+			deleted = append(deleted, m.message(i))
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+
+	// Reindexing tells watchers the messages have gone
+	if err := m.rewrite(kept, m.uidValidity, m.nextUID); err != nil {
+		return nil, err
+	}
+	return deleted, m.reindex()
+}
+
+// append adds a new message to the end of the file and returns its UID.
+func (m *MboxMailbox) append(content *mboxContent, flags types.Flags, keywords []string, internalDate time.Time) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := m.reindex(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(m.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Messages are separated by a blank line
+	separator := ""
+	if info.Size() > 0 {
+		tail := make([]byte, 2)
+		if info.Size() == 1 {
+			tail = tail[1:]
+		}
+		if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+			return 0, err
+		}
+		switch {
+		case bytes.HasSuffix(tail, []byte("\n\n")):
+		case bytes.HasSuffix(tail, []byte("\n")):
+			separator = "\n"
+		default:
+			separator = "\n\n"
+		}
+	}
+
+	uid := m.nextUID
+	base := ""
+	if len(m.messages) == 0 {
+		base = fmt.Sprintf("%d %d", m.uidValidity, uid+1)
+	}
+	entry := &mboxEntry{
+		uid:          uid,
+		flags:        flags,
+		keywords:     keywords,
+		internalDate: internalDate,
+		fromLine:     formatMboxFromLine(internalDate),
+	}
+
+	// The body may be streamed from a client which goes away, so the file
+	// is cut back to its old size if the message can't be written in full
+	w := bufio.NewWriter(f)
+	w.WriteString(separator)
+	err = writeMboxMessage(w, entry, content, base)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Truncate(info.Size())
+		return 0, err
+	}
+
+	if err := m.reindex(); err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+// update stores new flags, and new content if it isn't nil, for a message.
+// A change to the flags alone is written in place; anything else rewrites
+// the file.
+func (m *MboxMailbox) update(uid uint32, flags types.Flags, keywords []string, content *mboxContent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if changed, err := m.changed(); err != nil {
+		return err
+	} else if changed {
+		if err := m.reindex(); err != nil {
+			return err
+		}
+	}
+
+	i := m.indexOf(uid)
+	if i < 0 {
+		return errors.New("Message has been deleted")
+	}
+	entry := m.messages[i]
+	if entry.flagSet().Equal(types.FlagSet{Flags: flags, Keywords: keywords}) && content == nil {
+		return nil
+	}
+	sameKeywords := types.FlagSet{Keywords: entry.keywords}.Equal(types.FlagSet{Keywords: keywords})
+	if content == nil && sameKeywords && entry.statusAt != 0 && entry.xStatusAt != 0 {
+		return m.writeFlags(i, flags)
+	}
+
+	// The index is left as it is until the file has been rewritten, so that
+	// reindexing can tell watchers what has changed
+	messages := make([]*mboxEntry, len(m.messages))
+	copy(messages, m.messages)
+	updated := *messages[i]
+	updated.flags = flags
+	updated.keywords = keywords
+	updated.content = content
+	messages[i] = &updated
+
+	if err := m.rewrite(messages, m.uidValidity, m.nextUID); err != nil {
+		return err
+	}
+	return m.reindex()
+}
+
+// writeFlags overwrites the padded Status and X-Status fields of the i'th
+// message to store new flags. The mailbox and the file must be locked.
+func (m *MboxMailbox) writeFlags(i int, flags types.Flags) error {
+	f, err := os.OpenFile(m.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	entry := m.messages[i]
+	status, xStatus := formatMboxFlags(flags)
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%-*s", mboxStatusWidth, status)), entry.statusAt)
+	if err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%-*s", mboxXStatusWidth, xStatus)), entry.xStatusAt)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The file hasn't otherwise changed, so the index is updated rather
+	// than rebuilt
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	updated := *entry
+	updated.flags = flags
+	m.messages[i] = &updated
+	m.size = info.Size()
+	m.modTime = info.ModTime()
+	m.updates.Notify(Update{Type: UpdateFlags, UID: updated.uid, Flags: flags, Keywords: updated.keywords})
+	return nil
+}
+
+// open opens the file and returns the index entry of a message. Both are
+// read while the mailbox is locked, so the entry's offsets are correct for
+// the open file even if the file is rewritten later.
+func (m *MboxMailbox) open(uid uint32) (*os.File, mboxEntry, error) {
+	m.load()
+	defer m.mu.Unlock()
+
+	i := m.indexOf(uid)
+	if i < 0 {
+		return nil, mboxEntry{}, errors.New("Message has been deleted")
+	}
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, mboxEntry{}, err
+	}
+	return f, *m.messages[i], nil
+}
+
+// readHeader reads a message's header from the file, without its state
+// fields.
+func (e *mboxEntry) readHeader(f *os.File) ([]byte, error) {
+	r := newLineReader(io.NewSectionReader(f, e.headerStart, e.headerEnd-e.headerStart), "\n")
+	r.edit = withoutStateFields()
+	r.terminate = true
+	return ioutil.ReadAll(r)
+}
+
+// newMboxContent converts a message's header and body to the form stored in
+// an mbox file. Either may be nil to keep those of the message being
+// replaced. The body is converted as it is read.
+func newMboxContent(header textproto.MIMEHeader, body io.Reader) *mboxContent {
+	content := &mboxContent{}
+	if header != nil {
+		r := newLineReader(strings.NewReader(util.MIMEHeaderToString(header)), "\n")
+		r.edit = withoutStateFields()
+		content.header, _ = ioutil.ReadAll(r)
+	}
+	if body != nil {
+		r := newLineReader(body, "\n")
+		r.edit = quoteMboxLine
+		r.terminate = true
+		content.body = r
+	}
+	return content
+}
+
+// withoutStateFields returns an edit function for lineReader which leaves
+// the state fields, and any continuation lines, out of a header.
+func withoutStateFields() func(line []byte) []byte {
+	skipping := false
+	return func(line []byte) []byte {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if skipping {
+				return nil
+			}
+			return line
+		}
+		skipping = false
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			name := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:i])))
+			skipping = mboxStateFields[name]
+		}
+		if skipping {
+			return nil
+		}
+		return line
+	}
+}
+
+// writeMboxMessage writes a message followed by the blank line which
+// separates it from the next. If base isn't empty, it is stored as the
+// mailbox's UIDVALIDITY and next UID.
+func writeMboxMessage(w *bufio.Writer, entry *mboxEntry, content *mboxContent, base string) error {
+	w.WriteString(entry.fromLine + "\n")
+	w.Write(content.header)
+	if len(content.header) > 0 && content.header[len(content.header)-1] != '\n' {
+		w.WriteByte('\n')
+	}
+	if base != "" {
+		fmt.Fprintf(w, "X-IMAPbase: %s\n", base)
+	}
+
+	status, xStatus := formatMboxFlags(entry.flags)
+	fmt.Fprintf(w, "%s%-*s\n", mboxStatusField, mboxStatusWidth, status)
+	fmt.Fprintf(w, "%s%-*s\n", mboxXStatusField, mboxXStatusWidth, xStatus)
+	if len(entry.keywords) > 0 {
+		fmt.Fprintf(w, "X-Keywords: %s\n", strings.Join(entry.keywords, " "))
+	}
+	fmt.Fprintf(w, "X-UID: %d\n\n", entry.uid)
+
+	body := &lastByteWriter{w: w}
+	n, err := io.Copy(body, content.body)
+	if err != nil {
+		return err
+	}
+	if n > 0 && body.last != '\n' {
+		w.WriteByte('\n')
+	}
+	return w.WriteByte('\n')
+}
+
+// lastByteWriter remembers the last byte written through it.
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		l.last = p[len(p)-1]
+	}
+	return l.w.Write(p)
+}
+
+// writeMboxPseudoMessage writes the message UW IMAP uses to store the
+// UIDVALIDITY and next UID of an empty mailbox.
+func writeMboxPseudoMessage(w *bufio.Writer, validity uint32, next uint32) {
+	now := time.Now()
+	fmt.Fprintf(w, "%s\n", formatMboxFromLine(now))
+	fmt.Fprintf(w, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "From: Mail System Internal Data <MAILER-DAEMON@localhost>\n")
+	fmt.Fprintf(w, "Subject: %s\n", mboxPseudoSubject)
+	fmt.Fprintf(w, "X-IMAP: %d %d\n", validity, next)
+	fmt.Fprintf(w, "Status: RO\n\n")
+	fmt.Fprintf(w, "This text is part of the internal format of your mail folder, and is not\n"+
+		"a real message.  It is created automatically by the mail system software.\n"+
+		"If deleted, important folder data will be lost, and it will be re-created\n"+
+		"with the data reset to initial values.\n\n")
+}
+
+// formatMboxFromLine returns the "From " line which starts a message.
+func formatMboxFromLine(date time.Time) string {
+	return "From MAILER-DAEMON " + date.Format(time.ANSIC)
+}
+
+// parseMboxFromLine returns the date from a "From " line, or the zero time
+// if it has none.
+func parseMboxFromLine(line string) time.Time {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range []string{
+		"Mon Jan 2 15:04:05 2006",
+		"Mon Jan 2 15:04:05 2006 -0700",
+		"Mon Jan 2 15:04:05 MST 2006",
+		"Mon Jan 2 15:04 2006",
+	} {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseMboxBase parses the UIDVALIDITY and next UID stored in the X-IMAPbase
+// or X-IMAP field.
+func parseMboxBase(value string) (validity uint32, next uint32) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return 0, 0
+	}
+	return parseUint32(fields[0]), parseUint32(fields[1])
+}
+
+// mboxFieldValueAt returns the offset of the value of a Status or X-Status
+// field starting at pos, or zero if it isn't padded to its full width or the
+// field appears more than once.
+func mboxFieldValueAt(line string, pos int64, count int, prefix string, width int) int64 {
+	if count != 1 || len(line) != len(prefix)+width || !strings.HasPrefix(line, prefix) {
+		return 0
+	}
+	return pos + int64(len(prefix))
+}
+
+// parseMboxFlags returns the flags stored in the Status and X-Status fields.
+// R in Status means seen, and O means the message is old, so it isn't
+// recent.
+func parseMboxFlags(status string, xStatus string) types.Flags {
+	var flags types.Flags
+	if strings.Contains(status, "R") {
+		flags = flags.SetFlags(types.FlagSeen)
+	}
+	if !strings.Contains(status, "O") {
+		flags = flags.SetFlags(types.FlagRecent)
+	}
+	for _, f := range mboxXStatusFlags {
+		if strings.IndexByte(xStatus, f.letter) >= 0 {
+			flags = flags.SetFlags(f.flag)
+		}
+	}
+	return flags
+}
+
+// formatMboxFlags reverses parseMboxFlags.
+func formatMboxFlags(flags types.Flags) (status string, xStatus string) {
+	if flags.HasFlags(types.FlagSeen) {
+		status += "R"
+	}
+	if !flags.HasFlags(types.FlagRecent) {
+		status += "O"
+	}
+	for _, f := range mboxXStatusFlags {
+		if flags.HasFlags(f.flag) {
+			xStatus += string(f.letter)
+		}
+	}
+	return status, xStatus
+}
+
+// quoteMboxLine adds a ">" to a line of a message body which would otherwise
+// be mistaken for the start of a message. In the mboxrd format, lines
+// already starting with ">From " are quoted again, so that unquoteMboxLine
+// can always remove one ">".
+func quoteMboxLine(line []byte) []byte {
+	if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		return append([]byte{'>'}, line...)
+	}
+	return line
+}
+
+// unquoteMboxLine reverses quoteMboxLine.
+func unquoteMboxLine(line []byte) []byte {
+	if bytes.HasPrefix(line, []byte(">")) && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// createMbox creates an empty mbox file, failing if it already exists.
+func createMbox(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// MboxMessage is a message in an mbox file. Its header is read from the file
+// when first needed, and its body is only ever streamed from the file.
+type MboxMessage struct {
+	mailbox        *MboxMailbox
+	uid            uint32
+	sequenceNumber uint32
+	flags          types.Flags
+	keywords       []string
+	internalDate   time.Time
+	size           uint32
+
+	header    textproto.MIMEHeader // nil until the header has been read
+	headerSet bool                 // The header has been replaced
+	body      io.Reader            // The new body, if it has been replaced
+}
+
+// Header implements the Header method on the Message interface
+func (m *MboxMessage) Header() textproto.MIMEHeader {
+	if m.header != nil {
+		return m.header
+	}
+	m.header = make(textproto.MIMEHeader)
+	r, err := m.Open()
+	if err != nil {
+		return m.header
+	}
+	defer r.Close()
+	if header, _, err := util.ReadHeader(bufio.NewReader(r)); err == nil {
+		m.header = util.ParseHeader(header)
+	}
+	return m.header
+}
+
+// UID implements the UID method on the Message interface
+func (m *MboxMessage) UID() uint32 { return m.uid }
+
+// SequenceNumber implements the SequenceNumber method on the Message
+// interface
+func (m *MboxMessage) SequenceNumber() uint32 { return m.sequenceNumber }
+
+// Size implements the Size method on the Message interface
+func (m *MboxMessage) Size() uint32 { return m.size }
+
+// InternalDate implements the InternalDate method on the Message interface
+func (m *MboxMessage) InternalDate() time.Time { return m.internalDate }
+
+// Open implements the Open method on the Message interface. The message is
+// read from the file without its state fields, with CRLF line endings and
+// with From lines in the body unquoted. Changes to the message aren't seen
+// until it has been saved.
+func (m *MboxMessage) Open() (io.ReadCloser, error) {
+	if m.uid == 0 {
+		return nil, errors.New("Message has not been saved")
+	}
+	f, entry, err := m.mailbox.open(m.uid)
+	if err != nil {
+		return nil, err
+	}
+
+	header := newLineReader(io.NewSectionReader(f, entry.headerStart, entry.headerEnd-entry.headerStart), "\r\n")
+	header.edit = withoutStateFields()
+	header.terminate = true
+	body := newLineReader(io.NewSectionReader(f, entry.bodyStart, entry.end-entry.bodyStart), "\r\n")
+	body.edit = unquoteMboxLine
+	body.terminate = true
+	return readCloser{io.MultiReader(header, strings.NewReader("\r\n"), body), f}, nil
+}
+
+// Keywords implements the Keywords method on the Message interface
+func (m *MboxMessage) Keywords() []string {
+	if m.keywords == nil {
+		return []string{}
+	}
+	return m.keywords
+}
+
+// AddKeywords implements the AddKeywords method on the Message interface
+func (m *MboxMessage) AddKeywords(keywords ...string) Message {
+	m.keywords = types.AddKeywords(m.keywords, keywords...)
+	return m
+}
+
+// RemoveKeywords implements the RemoveKeywords method on the Message
+// interface
+func (m *MboxMessage) RemoveKeywords(keywords ...string) Message {
+	m.keywords = types.RemoveKeywords(m.keywords, keywords...)
+	return m
+}
+
+// Flags implements the Flags method on the Message interface
+func (m *MboxMessage) Flags() types.Flags { return m.flags }
+
+// OverwriteFlags implements the OverwriteFlags method on the Message
+// interface
+func (m *MboxMessage) OverwriteFlags(newFlags types.Flags) Message {
+	m.flags = newFlags
+	return m
+}
+
+// AddFlags implements the AddFlags method on the Message interface
+func (m *MboxMessage) AddFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.SetFlags(newFlags)
+	return m
+}
+
+// RemoveFlags implements the RemoveFlags method on the Message interface
+func (m *MboxMessage) RemoveFlags(newFlags types.Flags) Message {
+	m.flags = m.flags.ResetFlags(newFlags)
+	return m
+}
+
+// SetHeaders implements the SetHeaders method on the Message interface
+func (m *MboxMessage) SetHeaders(newHeader textproto.MIMEHeader) Message {
+	m.header = newHeader
+	m.headerSet = true
+	return m
+}
+
+// SetBody implements the SetBody method on the Message interface. The body
+// is read when the message is saved.
+func (m *MboxMessage) SetBody(newBody io.Reader) Message {
+	m.body = newBody
+	return m
+}
+
+// Save implements the Save method on the Message interface. New messages are
+// appended to the file; any other change rewrites it.
+func (m *MboxMessage) Save() (Message, error) {
+	if m.uid != 0 {
+		var content *mboxContent
+		if m.headerSet || m.body != nil {
+			var header textproto.MIMEHeader
+			if m.headerSet {
+				header = m.header
+			}
+			content = newMboxContent(header, m.body)
+		}
+		if err := m.mailbox.update(m.uid, m.flags, m.keywords, content); err != nil {
+			return m, err
+		}
+		m.headerSet, m.body = false, nil
+		if saved := m.mailbox.MessageByUID(m.uid); saved != nil {
+			m.size = saved.(*MboxMessage).size
+		}
+		return m, nil
+	}
+
+	body := m.body
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	content := newMboxContent(m.Header(), body)
+
+	// Messages are recent in the mailbox they are added to
+	flags := m.flags.SetFlags(types.FlagRecent)
+	uid, err := m.mailbox.append(content, flags, m.keywords, m.internalDate)
+	if err != nil {
+		return m, err
+	}
+	saved := m.mailbox.MessageByUID(uid)
+	if saved == nil {
+		return m, errors.New("Message was removed while being saved")
+	}
+	return saved, nil
+}
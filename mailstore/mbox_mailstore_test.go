@@ -0,0 +1,283 @@
+package mailstore
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+const testMbox = "From alice@example.com Mon Jan  2 15:04:05 2006\n" +
+	"From: alice@example.com\n" +
+	"Subject: First\n" +
+	"Status: RO\n" +
+	"X-Status: F\n" +
+	"\n" +
+	">From the start\n" +
+	">>From quoted\n" +
+	"\n" +
+	"From bob@example.com Tue Jan  3 15:04:05 2006\n" +
+	"From: bob@example.com\n" +
+	"Subject: Second\n" +
+	"\n" +
+	"Hello\n"
+
+func openMboxUser(t *testing.T, root string) *MboxUser {
+	store := NewMboxMailstore(root, func(username, password string) bool {
+		return password == "password"
+	})
+	user, err := store.Authenticate("username", "password")
+	if err != nil {
+		t.Fatalf("Error getting user: %s", err)
+	}
+	return user.(*MboxUser)
+}
+
+func openMboxInbox(t *testing.T, root string) *MboxMailbox {
+	mailbox, err := openMboxUser(t, root).MailboxByName("INBOX")
+	if err != nil {
+		t.Fatalf("Error getting INBOX: %s", err)
+	}
+	return mailbox.(*MboxMailbox)
+}
+
+func writeTestMbox(t *testing.T, root string, content string) string {
+	path := filepath.Join(root, "username", "INBOX")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing mbox: %s", err)
+	}
+	return path
+}
+
+func TestMboxRead(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	writeTestMbox(t, root, testMbox)
+
+	inbox := openMboxInbox(t, root)
+	if inbox.Messages() != 2 || inbox.Recent() != 1 || inbox.Unseen() != 1 {
+		t.Fatalf("Expected 2 messages, 1 recent and 1 unseen, got %d, %d and %d",
+			inbox.Messages(), inbox.Recent(), inbox.Unseen())
+	}
+
+	msg := inbox.MessageBySequenceNumber(1)
+	if msg.UID() != 1 || msg.Header().Get("Subject") != "First" {
+		t.Errorf("Expected the first message to have UID 1")
+	}
+	if msg.Header().Get("Status") != "" {
+		t.Errorf("Expected state fields to be hidden")
+	}
+	if !msg.Flags().HasFlags(types.FlagSeen | types.FlagFlagged) {
+		t.Errorf("Expected flags to be read from the header, got %s", msg.Flags())
+	}
+	if body := messageBody(t, msg); body != "From the start\r\n>From quoted\r\n" {
+		t.Errorf("Expected From lines to be unquoted, got %q", body)
+	}
+	expectedSize := len("From: alice@example.com\r\nSubject: First\r\n\r\n" +
+		"From the start\r\n>From quoted\r\n")
+	if msg.Size() != uint32(expectedSize) {
+		t.Errorf("Expected size %d, got %d", expectedSize, msg.Size())
+	}
+	if msg.InternalDate().Day() != 2 {
+		t.Errorf("Expected the date to be read from the From line, got %s", msg.InternalDate())
+	}
+
+	if body := messageBody(t, inbox.MessageByUID(2)); body != "Hello\r\n" {
+		t.Errorf("Expected the last message's body, got %q", body)
+	}
+}
+
+func TestMboxUIDPersistence(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := writeTestMbox(t, root, testMbox)
+
+	validity := openMboxInbox(t, root).UIDValidity()
+	data, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(data), "X-IMAPbase: ") || !strings.Contains(string(data), "X-UID: 2\n") {
+		t.Errorf("Expected UIDs to be written to the file:\n%s", data)
+	}
+	if !strings.Contains(string(data), "\n>From the start\n>>From quoted\n") {
+		t.Errorf("Expected quoted From lines to be kept:\n%s", data)
+	}
+
+	// Messages delivered by other programs are numbered after the others
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	f.WriteString("From carol@example.com Wed Jan  4 15:04:05 2006\nSubject: Third\n\nHi\n")
+	f.Close()
+
+	inbox := openMboxInbox(t, root)
+	if inbox.UIDValidity() != validity {
+		t.Errorf("Expected UIDVALIDITY to be kept")
+	}
+	assertMessageUIDs(t, inbox.MessageSetBySequenceNumber(types.SequenceSet{{Min: "1", Max: "*"}}),
+		[]uint32{1, 2, 3})
+}
+
+func TestMboxFlagsAndExpunge(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	writeTestMbox(t, root, testMbox)
+
+	inbox := openMboxInbox(t, root)
+	watcher := inbox.Watch()
+	defer watcher.Close()
+
+	msg := inbox.MessageByUID(1).AddFlags(types.FlagDeleted)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg = inbox.MessageByUID(2).AddFlags(types.FlagAnswered).RemoveFlags(types.FlagRecent)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	deleted, err := inbox.DeleteFlaggedMessages()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assertMessageUIDs(t, deleted, []uint32{1})
+
+	updates := watcher.Updates()
+	if len(updates) != 3 || updates[2].Type != UpdateExpunge || updates[2].UID != 1 {
+		t.Errorf("Expected two flag updates and an expunge, got %v", updates)
+	}
+
+	inbox = openMboxInbox(t, root)
+	msg = inbox.MessageBySequenceNumber(1)
+	if msg == nil || msg.UID() != 2 {
+		t.Fatalf("Expected only message 2 to remain")
+	}
+	if msg.Flags() != types.FlagAnswered {
+		t.Errorf("Expected flags to be stored, got %s", msg.Flags())
+	}
+	if body := messageBody(t, msg); body != "Hello\r\n" {
+		t.Errorf("Expected the body to be kept, got %q", body)
+	}
+
+	// UIDs aren't reused, even once the mailbox is empty
+	msg.AddFlags(types.FlagDeleted).Save()
+	inbox.DeleteFlaggedMessages()
+	if next := openMboxInbox(t, root).NextUID(); next != 3 {
+		t.Errorf("Expected next UID 3, got %d", next)
+	}
+}
+
+func TestMboxAppend(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	inbox := openMboxInbox(t, root)
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Subject", "Appended")
+	hdr.Set("X-UID", "99")
+	for i := 0; i < 2; i++ {
+		msg, err := inbox.NewMessage().
+			SetHeaders(hdr).
+			SetBody(strings.NewReader("From here\r\n")).
+			AddFlags(types.FlagSeen).
+			Save()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if msg.UID() != uint32(i+1) {
+			t.Errorf("Expected UID %d, got %d", i+1, msg.UID())
+		}
+	}
+
+	msg := openMboxInbox(t, root).MessageByUID(2)
+	if msg == nil || msg.Header().Get("Subject") != "Appended" || messageBody(t, msg) != "From here\r\n" {
+		t.Fatalf("Expected the message to be stored")
+	}
+	if !msg.Flags().HasFlags(types.FlagSeen | types.FlagRecent) {
+		t.Errorf("Expected flags to be stored, got %s", msg.Flags())
+	}
+}
+
+func TestMboxFolders(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+
+	user := openMboxUser(t, root)
+	if _, err := user.CreateMailbox("Work/Project"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !isFile(filepath.Join(root, "username", "Work.sbd", "Project")) {
+		t.Errorf("Expected the mailbox to be created")
+	}
+	if err := user.RenameMailbox("Work", "Archive/Work"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var names []string
+	for _, mailbox := range user.Mailboxes() {
+		names = append(names, mailbox.Name())
+	}
+	expected := "INBOX Archive Archive/Work Archive/Work/Project"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected mailboxes %s, got %s", expected, strings.Join(names, " "))
+	}
+
+	if err := user.DeleteMailbox("Archive/Work/Project"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := user.MailboxByName("Archive/Work/Project"); err == nil {
+		t.Errorf("Expected the mailbox to be deleted")
+	}
+}
+
+func TestMboxFlagsInPlace(t *testing.T) {
+	root, cleanup := newTestDir(t)
+	defer cleanup()
+	path := writeTestMbox(t, root, testMbox)
+
+	// Reading the mailbox numbers the messages, which pads their flags
+	inbox := openMboxInbox(t, root)
+	watcher := inbox.Watch()
+	defer watcher.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	msg := inbox.MessageByUID(2).AddFlags(types.FlagSeen | types.FlagFlagged)
+	if _, err := msg.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !os.SameFile(before, after) || after.Size() != before.Size() {
+		t.Errorf("Expected the flags to be changed without rewriting the file")
+	}
+	if updates := watcher.Updates(); len(updates) != 1 || updates[0].Type != UpdateFlags {
+		t.Errorf("Expected a flag update, got %v", updates)
+	}
+
+	expected := types.FlagSeen | types.FlagFlagged | types.FlagRecent
+	if flags := openMboxInbox(t, root).MessageByUID(2).Flags(); flags != expected {
+		t.Errorf("Expected flags %s to be stored, got %s", expected, flags)
+	}
+	if flags := openMboxInbox(t, root).MessageByUID(1).Flags(); flags != types.FlagSeen|types.FlagFlagged {
+		t.Errorf("Expected the other message's flags to be kept, got %s", flags)
+	}
+
+	// Changing keywords still rewrites the file
+	if _, err := inbox.MessageByUID(2).AddKeywords("$Work").Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keywords := openMboxInbox(t, root).MessageByUID(2).Keywords(); len(keywords) != 1 {
+		t.Errorf("Expected the keyword to be stored, got %v", keywords)
+	}
+}
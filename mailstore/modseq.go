@@ -0,0 +1,96 @@
+package mailstore
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// ModSeqMailbox may optionally be implemented by a Mailbox which keeps a
+// mod-sequence for each message, as CONDSTORE (RFC 7162) requires. A
+// message's mod-sequence is raised whenever its flags or keywords change,
+// and is always higher than that of any earlier change to the mailbox.
+// Mailboxes which don't implement it are reported to clients as NOMODSEQ.
+type ModSeqMailbox interface {
+	// HighestModSeq returns the highest mod-sequence of any change made to
+	// the mailbox, including messages which have since been expunged. It is
+	// always at least 1.
+	HighestModSeq() uint64
+}
+
+// ModSeqMessage is implemented by the messages of a ModSeqMailbox.
+type ModSeqMessage interface {
+	// ModSeq returns the mod-sequence of the last change made to the
+	// message's flags or keywords, or of its delivery.
+	ModSeq() uint64
+}
+
+// ExpungeTracker may optionally be implemented by a ModSeqMailbox which
+// remembers the UIDs of the messages expunged from it, and the mod-sequence
+// of each expunge, as QRESYNC (RFC 7162) requires.
+type ExpungeTracker interface {
+	// ExpungedSince returns the UIDs, in ascending order, of the messages
+	// expunged from the mailbox with a mod-sequence higher than modSeq.
+	ExpungedSince(modSeq uint64) []uint32
+}
+
+// SupportsModSeq reports whether the mailboxes of a mailstore implement
+// ModSeqMailbox.
+func SupportsModSeq(m Mailstore) bool {
+	_, ok := mailboxType(m).(ModSeqMailbox)
+	return ok
+}
+
+// HighestModSeq returns the highest mod-sequence of a mailbox, and false if
+// the mailbox doesn't keep mod-sequences.
+func HighestModSeq(m Mailbox) (uint64, bool) {
+	if mm, ok := m.(ModSeqMailbox); ok {
+		return mm.HighestModSeq(), true
+	}
+	return 0, false
+}
+
+// ModSeq returns the mod-sequence of a message, or 0 if its mailbox doesn't
+// keep mod-sequences.
+func ModSeq(msg Message) uint64 {
+	if mm, ok := msg.(ModSeqMessage); ok {
+		return mm.ModSeq()
+	}
+	return 0
+}
+
+// ExpungedSinceContext returns the UIDs in set of the messages expunged from
+// a mailbox since the mod-sequence modSeq, giving up if ctx is cancelled.
+// "*" in the set stands for the highest UID the mailbox has assigned, so
+// that messages expunged from the end of the mailbox are included. Mailboxes
+// which don't implement ExpungeTracker report every UID in the set that
+// isn't in the mailbox, which RFC 7162 allows but may include UIDs which
+// were never used. They are found from the UIDs of the messages in the
+// mailbox, so the cost doesn't grow with the highest UID.
+func ExpungedSinceContext(ctx context.Context, m Mailbox, modSeq uint64, set types.SequenceSet) (types.SequenceSet, error) {
+	last := m.NextUID() - 1
+	var expunged []uint32
+	if t, ok := m.(ExpungeTracker); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for _, uid := range t.ExpungedSince(modSeq) {
+			if inSequenceSet(set, uid, last) {
+				expunged = append(expunged, uid)
+			}
+		}
+		return types.NewSequenceSet(expunged), nil
+	}
+
+	msgs, err := MessageSetByUIDContext(ctx, m, set)
+	if err != nil {
+		return nil, err
+	}
+	present := make([]uint32, len(msgs))
+	for i, msg := range msgs {
+		present[i] = msg.UID()
+	}
+	sort.Slice(present, func(i, j int) bool { return present[i] < present[j] })
+	return missingFromSet(set, present, last), nil
+}
@@ -0,0 +1,91 @@
+package mailstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+// ErrCannotMove may be returned by a Mover which can't move messages to the
+// mailbox it was given, eg because it belongs to another kind of store. The
+// messages are then copied and expunged instead.
+var ErrCannotMove = errors.New("Messages can't be moved to this mailbox")
+
+// ErrMoveNotSupported is returned by MoveMessagesContext for mailboxes which
+// implement neither Mover nor UIDExpunger.
+var ErrMoveNotSupported = errors.New("MOVE not supported")
+
+// Mover may optionally be implemented by a Mailbox to move messages to
+// another mailbox atomically, as the MOVE command does. Mailboxes that do
+// not implement it have their messages copied, marked with the Deleted flag
+// and expunged with UIDExpunger, which may leave copies behind if it fails
+// part way.
+type Mover interface {
+	// MoveMessages moves messages from this mailbox to dest and returns
+	// them as they are in dest, in the same order. The messages are removed
+	// from this mailbox as DeleteFlaggedMessages would remove them.
+	MoveMessages(msgs []Message, dest Mailbox) ([]Message, error)
+}
+
+// MoveMessagesContext moves messages from m to dest and returns them as they
+// are in dest, in the same order. It gives up if ctx is cancelled.
+func MoveMessagesContext(ctx context.Context, m Mailbox, msgs []Message, dest Mailbox) ([]Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mover, ok := m.(Mover); ok {
+		moved, err := mover.MoveMessages(msgs, dest)
+		if err != ErrCannotMove {
+			return moved, err
+		}
+	}
+	if _, ok := m.(UIDExpunger); !ok {
+		// Only the moved messages may be expunged
+		return nil, ErrMoveNotSupported
+	}
+
+	moved := make([]Message, 0, len(msgs))
+	uids := make([]uint32, 0, len(msgs))
+	for _, msg := range msgs {
+		copied, err := CopyMessageContext(ctx, msg, dest)
+		if err != nil {
+			return nil, err
+		}
+		moved = append(moved, copied)
+		uids = append(uids, msg.UID())
+	}
+	for _, msg := range msgs {
+		if _, err := SaveContext(ctx, msg.AddFlags(types.FlagDeleted)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := DeleteFlaggedMessagesByUIDContext(ctx, m, types.NewSequenceSet(uids)); err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
+
+// CopyMessageContext saves a copy of a message, with its flags and keywords,
+// in another mailbox and returns the copy, which is recent there. The body is streamed from the
+// original. It gives up if ctx is cancelled.
+func CopyMessageContext(ctx context.Context, msg Message, dest Mailbox) (Message, error) {
+	r, err := OpenContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body := bufio.NewReader(r)
+	if _, _, err := util.ReadHeader(body); err != nil {
+		return nil, err
+	}
+
+	copied := dest.NewMessage().
+		SetHeaders(msg.Header()).
+		SetBody(body).
+		OverwriteFlags(msg.Flags().SetFlags(types.FlagRecent)).
+		AddKeywords(msg.Keywords()...)
+	return SaveContext(ctx, copied)
+}
@@ -0,0 +1,126 @@
+package mailstore
+
+import (
+	"sync"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// UpdateType identifies the kind of change made to a mailbox
+type UpdateType int
+
+const (
+	// UpdateExists is sent when a message is added to the mailbox
+	UpdateExists UpdateType = iota
+
+	// UpdateExpunge is sent when a message is permanently removed from the
+	// mailbox
+	UpdateExpunge
+
+	// UpdateFlags is sent when the flags of a message are changed
+	UpdateFlags
+)
+
+// Update describes a single change made to a mailbox
+type Update struct {
+	Type UpdateType
+
+	// UID is the UID of the message that was changed
+	UID uint32
+
+	// Flags are the message's new flags, for UpdateFlags
+	Flags types.Flags
+
+	// Keywords are the message's new keywords, for UpdateFlags
+	Keywords []string
+
+	// ModSeq is the message's new mod-sequence, for UpdateExists and
+	// UpdateFlags, if the mailbox keeps them
+	ModSeq uint64
+}
+
+// Notifier may optionally be implemented by a Mailbox to push changes to
+// connections which have the mailbox selected, for example while they are
+// waiting in IDLE.
+type Notifier interface {
+	// Watch returns a new Watcher which receives every change made to the
+	// mailbox from now on. The Watcher must be closed when no longer needed.
+	Watch() *Watcher
+}
+
+// Watcher queues the changes made to a mailbox until they are collected. It
+// never blocks the code making the changes.
+type Watcher struct {
+	mu      sync.Mutex
+	pending []Update
+	ready   chan struct{}
+	stop    func()
+}
+
+// Ready returns a channel which receives a value when there are updates
+// waiting to be collected.
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Updates returns and clears all updates waiting to be collected.
+func (w *Watcher) Updates() []Update {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	updates := w.pending
+	w.pending = nil
+	return updates
+}
+
+// Close stops the watcher from receiving any further updates.
+func (w *Watcher) Close() {
+	if w.stop != nil {
+		w.stop()
+	}
+}
+
+func (w *Watcher) push(u Update) {
+	w.mu.Lock()
+	w.pending = append(w.pending, u)
+	w.mu.Unlock()
+
+	// Wake up anything waiting, unless it has already been woken
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Broadcaster is a helper for implementing Notifier. It keeps track of
+// watchers and sends updates to all of them.
+type Broadcaster struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]bool
+}
+
+// Watch implements the Watch method on the Notifier interface
+func (b *Broadcaster) Watch() *Watcher {
+	w := &Watcher{ready: make(chan struct{}, 1)}
+	w.stop = func() {
+		b.mu.Lock()
+		delete(b.watchers, w)
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*Watcher]bool)
+	}
+	b.watchers[w] = true
+	b.mu.Unlock()
+	return w
+}
+
+// Notify sends an update to every watcher.
+func (b *Broadcaster) Notify(u Update) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for w := range b.watchers {
+		w.push(u)
+	}
+}
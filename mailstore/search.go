@@ -0,0 +1,196 @@
+package mailstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jordwest/imap-server/types"
+	"github.com/jordwest/imap-server/util"
+)
+
+// Searcher may optionally be implemented by a Mailbox to execute searches
+// natively, eg as a database query. Mailboxes that do not implement it are
+// searched by examining each message in turn.
+type Searcher interface {
+	// Search returns the messages matching the criteria, in sequence number
+	// order
+	Search(criteria *types.SearchCriteria) ([]Message, error)
+}
+
+// ContextSearcher may optionally be implemented by a Mailbox to execute
+// searches natively in a way which can be cancelled.
+type ContextSearcher interface {
+	SearchContext(ctx context.Context, criteria *types.SearchCriteria) ([]Message, error)
+}
+
+// Search returns all messages in the mailbox that match the given criteria.
+func Search(m Mailbox, criteria *types.SearchCriteria) ([]Message, error) {
+	return SearchContext(context.Background(), m, criteria)
+}
+
+// SearchContext is like Search, but gives up if ctx is cancelled.
+func SearchContext(ctx context.Context, m Mailbox, criteria *types.SearchCriteria) ([]Message, error) {
+	if searcher, ok := m.(ContextSearcher); ok {
+		return searcher.SearchContext(ctx, criteria)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if searcher, ok := m.(Searcher); ok {
+		return searcher.Search(criteria)
+	}
+
+	msgs := make([]Message, 0)
+	count := m.Messages()
+	for seqNo := uint32(1); seqNo <= count; seqNo++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		msg := m.MessageBySequenceNumber(seqNo)
+		if msg == nil {
+			continue
+		}
+		if MatchesSearch(m, msg, criteria) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// MatchesSearch returns true if the message matches the search criteria. The
+// mailbox is used to resolve "*" in sequence sets.
+func MatchesSearch(m Mailbox, msg Message, c *types.SearchCriteria) bool {
+	switch c.Key {
+	case types.SearchAll:
+		return true
+	case types.SearchAnd:
+		for _, child := range c.Children {
+			if !MatchesSearch(m, msg, child) {
+				return false
+			}
+		}
+		return true
+	case types.SearchOr:
+		for _, child := range c.Children {
+			if MatchesSearch(m, msg, child) {
+				return true
+			}
+		}
+		return false
+	case types.SearchNot:
+		return !MatchesSearch(m, msg, c.Children[0])
+	case types.SearchSequenceSet:
+		return c.Set.Contains(msg.SequenceNumber(), m.Messages())
+	case types.SearchUID:
+		return c.Set.Contains(msg.UID(), m.LastUID())
+	case types.SearchFlags:
+		return msg.Flags().HasFlags(c.Flags)
+	case types.SearchModSeq:
+		return ModSeq(msg) >= c.ModSeq
+	case types.SearchKeyword:
+		for _, keyword := range msg.Keywords() {
+			if strings.EqualFold(keyword, c.Value) {
+				return true
+			}
+		}
+		return false
+	case types.SearchHeader:
+		values, ok := msg.Header()[textproto.CanonicalMIMEHeaderKey(c.Field)]
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if containsFold(value, c.Value) {
+				return true
+			}
+		}
+		return false
+	case types.SearchBody, types.SearchText:
+		return messageContainsFold(msg, c.Value, c.Key == types.SearchText)
+	case types.SearchBefore:
+		return dateOnly(msg.InternalDate()).Before(dateOnly(c.Date))
+	case types.SearchOn:
+		return dateOnly(msg.InternalDate()).Equal(dateOnly(c.Date))
+	case types.SearchSince:
+		return !dateOnly(msg.InternalDate()).Before(dateOnly(c.Date))
+	case types.SearchSentBefore, types.SearchSentOn, types.SearchSentSince:
+		sent, err := mail.ParseDate(msg.Header().Get("Date"))
+		if err != nil {
+			return false
+		}
+		sent = dateOnly(sent)
+		switch c.Key {
+		case types.SearchSentBefore:
+			return sent.Before(dateOnly(c.Date))
+		case types.SearchSentOn:
+			return sent.Equal(dateOnly(c.Date))
+		}
+		return !sent.Before(dateOnly(c.Date))
+	case types.SearchLarger:
+		return msg.Size() > c.Size
+	case types.SearchSmaller:
+		return msg.Size() < c.Size
+	}
+	return false
+}
+
+// containsFold reports whether substr is within s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// messageContainsFold reports whether substr is within the body of a message,
+// or anywhere in it if withHeader is set, ignoring case. The message is
+// streamed rather than read into memory.
+func messageContainsFold(msg Message, substr string, withHeader bool) bool {
+	r, err := msg.Open()
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	if withHeader {
+		return readerContainsFold(r, substr)
+	}
+	body := bufio.NewReader(r)
+	if _, _, err := util.ReadHeader(body); err != nil {
+		return false
+	}
+	return readerContainsFold(body, substr)
+}
+
+// readerContainsFold reports whether substr is within the content of r,
+// ignoring case. The end of each chunk read is kept for the next, so that
+// matches which cross chunks are found.
+func readerContainsFold(r io.Reader, substr string) bool {
+	lower := bytes.ToLower([]byte(substr))
+	overlap := 2*len(substr) + utf8.UTFMax
+	buf := make([]byte, 0, 32*1024+overlap)
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if bytes.Contains(bytes.ToLower(buf), lower) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		if len(buf) > overlap {
+			buf = buf[:copy(buf, buf[len(buf)-overlap:])]
+		}
+	}
+}
+
+// dateOnly strips the time from a date, keeping the date as it was in the
+// date's own timezone. RFC 3501 requires date searches to disregard time and
+// timezone.
+func dateOnly(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,63 @@
+package mailstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// searchingMailbox records whether the native search hook was used
+type searchingMailbox struct {
+	*DummyMailbox
+	called bool
+}
+
+func (m *searchingMailbox) Search(criteria *types.SearchCriteria) ([]Message, error) {
+	m.called = true
+	return []Message{m.MessageBySequenceNumber(1)}, nil
+}
+
+func TestSearch(t *testing.T) {
+	inbox := getDefaultInbox(t)
+	msgs, err := Search(inbox, &types.SearchCriteria{Key: types.SearchOr,
+		Children: []*types.SearchCriteria{
+			{Key: types.SearchHeader, Field: "subject", Value: "LAST"},
+			{Key: types.SearchUID, Set: types.SequenceSet{{Min: "10", Max: ""}}},
+		}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assertMessageUIDs(t, msgs, []uint32{10, 12})
+}
+
+func TestSearchUsesMailboxSearcher(t *testing.T) {
+	inbox := &searchingMailbox{DummyMailbox: getDefaultInbox(t)}
+	msgs, err := Search(inbox, &types.SearchCriteria{Key: types.SearchAll})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !inbox.called {
+		t.Errorf("Expected the mailbox's Search method to be used")
+	}
+	assertMessageUIDs(t, msgs, []uint32{10})
+}
+
+func TestReaderContainsFold(t *testing.T) {
+	long := strings.Repeat("x", 40*1024)
+	tests := []struct {
+		content, substr string
+		expected        bool
+	}{
+		{"Hello World", "WORLD", true},
+		{"Hello World", "planet", false},
+		{long + "Needle" + long, "nEEDLE", true},
+		{long[:32*1024-3] + "Needle", "needle", true},
+		{long, "y", false},
+	}
+	for _, test := range tests {
+		if readerContainsFold(strings.NewReader(test.content), test.substr) != test.expected {
+			t.Errorf("Expected %t searching for %q", test.expected, test.substr)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package mailstore
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// inSequenceSet returns true if n is within one of the ranges in the set,
+// with "*" standing for last. It matches the way DummyMailbox interprets
+// sequence sets, so that every store included in this package returns the
+// same messages for the same set: a range whose start is past its end
+// matches nothing.
+func inSequenceSet(set types.SequenceSet, n uint32, last uint32) bool {
+	for _, r := range set {
+		if start, end, ok := rangeBounds(r, last); ok && n >= start && n <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeBounds returns the first and last numbers a range matches, as
+// inSequenceSet interprets it, and false if it matches nothing.
+func rangeBounds(r types.SequenceRange, last uint32) (start uint32, end uint32, ok bool) {
+	if r.Min.Last() {
+		return last, last, true
+	}
+
+	start, err := r.Min.Value()
+	if err != nil {
+		return 0, 0, false
+	}
+	if r.Max.Nil() {
+		return start, start, true
+	}
+
+	end = last
+	if !r.Max.Last() {
+		if end, err = r.Max.Value(); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, end, start <= end
+}
+
+// missingFromSet returns the numbers in a set, up to last, which aren't in
+// present, which must be sorted. It works from the ranges of the set rather
+// than trying each number, as a range such as 1:* may cover many more
+// numbers than there are messages.
+func missingFromSet(set types.SequenceSet, present []uint32, last uint32) types.SequenceSet {
+	type span struct{ start, end uint32 }
+	var spans []span
+	for _, r := range set {
+		start, end, ok := rangeBounds(r, last)
+		if end > last {
+			end = last
+		}
+		if ok && start <= end {
+			spans = append(spans, span{start, end})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var missing []span
+	add := func(start, end uint32) {
+		if n := len(missing); n > 0 && missing[n-1].end+1 == start {
+			missing[n-1].end = end
+			return
+		}
+		missing = append(missing, span{start, end})
+	}
+
+	// Numbers below next have already been looked at, as spans may overlap
+	next := uint32(0)
+	for _, s := range spans {
+		if s.start < next {
+			s.start = next
+		}
+		if s.start > s.end {
+			continue
+		}
+		next = s.end + 1
+
+		for s.start <= s.end {
+			for len(present) > 0 && present[0] < s.start {
+				present = present[1:]
+			}
+			if len(present) == 0 || present[0] > s.end {
+				add(s.start, s.end)
+				break
+			}
+			if present[0] > s.start {
+				add(s.start, present[0]-1)
+			}
+			s.start = present[0] + 1
+		}
+	}
+
+	set = make(types.SequenceSet, len(missing))
+	for i, s := range missing {
+		set[i].Min = types.SequenceNumber(strconv.FormatUint(uint64(s.start), 10))
+		if s.end != s.start {
+			set[i].Max = types.SequenceNumber(strconv.FormatUint(uint64(s.end), 10))
+		}
+	}
+	return set
+}
@@ -0,0 +1,249 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jordwest/imap-server/types"
+)
+
+// ArgKind identifies the syntactic type of an argument.
+type ArgKind int
+
+const (
+	// KindAtom is a bare word such as FLAGS, \Seen or 1:5
+	KindAtom ArgKind = iota
+	// KindQuoted is a string enclosed in double quotes
+	KindQuoted
+	// KindLiteral is a string sent as {n} followed by n octets
+	KindLiteral
+	// KindList is a parenthesised list of arguments
+	KindList
+	// KindNil is the special atom NIL
+	KindNil
+)
+
+func (k ArgKind) String() string {
+	switch k {
+	case KindAtom:
+		return "atom"
+	case KindQuoted:
+		return "quoted string"
+	case KindLiteral:
+		return "literal"
+	case KindList:
+		return "list"
+	case KindNil:
+		return "NIL"
+	}
+	return "unknown"
+}
+
+// Arg is a single argument of a client command.
+type Arg struct {
+	Kind ArgKind
+
+	// Value holds the contents of atoms, strings and NIL
+	Value string
+
+	// List holds the members of a parenthesised list
+	List []Arg
+
+	// Literal is set for a literal which the Reader left to be streamed,
+	// in which case Value is empty
+	Literal *Literal
+}
+
+// IsString returns true if the argument is a quoted string or literal.
+func (a Arg) IsString() bool {
+	return a.Kind == KindQuoted || a.Kind == KindLiteral
+}
+
+// String returns the argument formatted roughly as the client sent it.
+// Literals are shown as quoted strings.
+func (a Arg) String() string {
+	switch a.Kind {
+	case KindQuoted, KindLiteral:
+		if a.Literal != nil {
+			return fmt.Sprintf("{%d}", a.Literal.Size)
+		}
+		return strconv.Quote(a.Value)
+	case KindList:
+		items := make([]string, len(a.List))
+		for i, item := range a.List {
+			items[i] = item.String()
+		}
+		return "(" + strings.Join(items, " ") + ")"
+	}
+	return a.Value
+}
+
+// Command is a single parsed client command.
+type Command struct {
+	// Tag is the client-chosen identifier for the command
+	Tag string
+
+	// Name is the upper case command name, eg FETCH
+	Name string
+
+	// UID is set when the command was prefixed with UID, eg UID FETCH
+	UID bool
+
+	Args []Arg
+}
+
+// ArgError describes an argument that is missing or of the wrong type.
+type ArgError struct {
+	// Index is the zero-based position of the argument
+	Index int
+	Arg   *Arg
+	Msg   string
+}
+
+func (e *ArgError) Error() string {
+	if e.Arg == nil {
+		return fmt.Sprintf("%s (argument %d missing)", e.Msg, e.Index+1)
+	}
+	return fmt.Sprintf("%s (argument %d: %s)", e.Msg, e.Index+1, e.Arg.String())
+}
+
+func argError(args []Arg, i int, msg string) *ArgError {
+	if i < len(args) {
+		return &ArgError{Index: i, Arg: &args[i], Msg: msg}
+	}
+	return &ArgError{Index: i, Msg: msg}
+}
+
+// ExpectCount checks that the command has between min and max arguments.
+func (c *Command) ExpectCount(min, max int) error {
+	n := len(c.Args)
+	if n < min {
+		return argError(c.Args, n, "Not enough arguments")
+	}
+	if n > max {
+		return argError(c.Args, max, "Too many arguments")
+	}
+	return nil
+}
+
+// ExpectMin checks that the command has at least min arguments.
+func (c *Command) ExpectMin(min int) error {
+	if len(c.Args) < min {
+		return argError(c.Args, len(c.Args), "Not enough arguments")
+	}
+	return nil
+}
+
+// Has returns true if the argument at index i was given.
+func (c *Command) Has(i int) bool {
+	return i < len(c.Args)
+}
+
+// Atom returns the argument at index i, which must be an atom.
+func (c *Command) Atom(i int) (string, error) {
+	if !c.Has(i) || (c.Args[i].Kind != KindAtom && c.Args[i].Kind != KindNil) {
+		return "", argError(c.Args, i, "Expected atom")
+	}
+	return c.Args[i].Value, nil
+}
+
+// AString returns the argument at index i, which may be an atom or string.
+func (c *Command) AString(i int) (string, error) {
+	if !c.Has(i) || c.Args[i].Kind == KindList {
+		return "", argError(c.Args, i, "Expected string")
+	}
+	return c.Args[i].Value, nil
+}
+
+// String returns the argument at index i, which must be a quoted string or
+// a literal.
+func (c *Command) String(i int) (string, error) {
+	if !c.Has(i) || !c.Args[i].IsString() {
+		return "", argError(c.Args, i, "Expected quoted string or literal")
+	}
+	return c.Args[i].Value, nil
+}
+
+// Literal returns the argument at index i, which must be a quoted string or
+// a literal, as a reader. Streamed literals are read from the connection.
+func (c *Command) Literal(i int) (*Literal, error) {
+	if !c.Has(i) || !c.Args[i].IsString() {
+		return nil, argError(c.Args, i, "Expected quoted string or literal")
+	}
+	if c.Args[i].Literal != nil {
+		return c.Args[i].Literal, nil
+	}
+	value := c.Args[i].Value
+	return &Literal{Size: int64(len(value)), r: strings.NewReader(value)}, nil
+}
+
+// Mailbox returns the argument at index i as a mailbox name. As required by
+// RFC 3501, the name INBOX is case-insensitive and always returned in upper
+// case.
+func (c *Command) Mailbox(i int) (string, error) {
+	name, err := c.AString(i)
+	if err != nil {
+		return "", argError(c.Args, i, "Expected mailbox name")
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX", nil
+	}
+	return name, nil
+}
+
+// Number returns the argument at index i as an unsigned 32-bit integer.
+func (c *Command) Number(i int) (uint32, error) {
+	if !c.Has(i) || c.Args[i].Kind != KindAtom {
+		return 0, argError(c.Args, i, "Expected number")
+	}
+	n, err := strconv.ParseUint(c.Args[i].Value, 10, 32)
+	if err != nil {
+		return 0, argError(c.Args, i, "Expected number")
+	}
+	return uint32(n), nil
+}
+
+// SequenceSet returns the argument at index i as a set of sequence numbers or
+// UIDs.
+func (c *Command) SequenceSet(i int) (types.SequenceSet, error) {
+	if !c.Has(i) || c.Args[i].Kind != KindAtom {
+		return nil, argError(c.Args, i, "Expected sequence set")
+	}
+	set, err := types.InterpretSequenceSet(c.Args[i].Value)
+	if err != nil {
+		return nil, argError(c.Args, i, "Invalid sequence set")
+	}
+	return set, nil
+}
+
+// List returns the members of the parenthesised list at index i.
+func (c *Command) List(i int) ([]Arg, error) {
+	if !c.Has(i) || c.Args[i].Kind != KindList {
+		return nil, argError(c.Args, i, "Expected parenthesised list")
+	}
+	return c.Args[i].List, nil
+}
+
+// Atoms returns the argument at index i as a list of atoms. The argument may
+// either be a parenthesised list of atoms or a single atom.
+func (c *Command) Atoms(i int) ([]string, error) {
+	if !c.Has(i) {
+		return nil, argError(c.Args, i, "Expected atom or list of atoms")
+	}
+	if c.Args[i].Kind != KindList {
+		atom, err := c.Atom(i)
+		if err != nil {
+			return nil, argError(c.Args, i, "Expected atom or list of atoms")
+		}
+		return []string{atom}, nil
+	}
+	atoms := make([]string, len(c.Args[i].List))
+	for j, item := range c.Args[i].List {
+		if item.Kind != KindAtom && item.Kind != KindNil {
+			return nil, argError(c.Args, i, "Expected list of atoms")
+		}
+		atoms[j] = item.Value
+	}
+	return atoms, nil
+}
@@ -0,0 +1,557 @@
+// Package parser tokenizes and parses client commands according to the
+// grammar in RFC 3501 section 9.
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// MaxLiteralSize is the largest literal which is read into memory as part of
+// a command. Larger literals are refused, unless they are streamed.
+const MaxLiteralSize = 64 * 1024
+
+// MaxCommandSize is the most a command may take up in memory, counting the
+// command line and any literals which aren't streamed. Longer commands are
+// refused, so that a client can't make the server buffer without limit.
+const MaxCommandSize = 1024 * 1024
+
+// MaxListDepth is how deeply parenthesised lists may be nested.
+const MaxListDepth = 32
+
+// Reader reads complete client commands from a connection, including any
+// literals embedded in them.
+type Reader struct {
+	r *bufio.Reader
+
+	// Continuation is called when the client sends a synchronising literal
+	// and must be told to go ahead before sending the literal data.
+	Continuation func() error
+
+	// StreamLiteral, if set, is called when a literal is found outside any
+	// list, with the command read so far. If it returns true the literal
+	// isn't read: the command is returned straight away, ending with a
+	// literal argument which reads the data from the connection. Anything
+	// left of the command is skipped before the next command is read.
+	StreamLiteral func(cmd *Command) bool
+
+	// raw holds every byte read for the current command, for transcripts
+	raw bytes.Buffer
+
+	cmd     *Command // The command being read
+	literal *Literal // The streamed literal of the last command, if any
+}
+
+// Literal is a literal argument which is read from the connection by the
+// command handler, so that large literals needn't be held in memory.
+type Literal struct {
+	// Size is the length of the literal in bytes
+	Size int64
+
+	r       io.Reader
+	p       *Reader
+	sync    bool // The client waits to be told to send the data
+	started bool
+}
+
+// Read reads the literal data. The client is told to send a synchronising
+// literal when it is first read, so that a command which fails before then
+// is refused without the data being sent.
+func (l *Literal) Read(b []byte) (int, error) {
+	if !l.started {
+		l.started = true
+		if l.sync && l.p != nil && l.p.Continuation != nil {
+			if err := l.p.Continuation(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return l.r.Read(b)
+}
+
+// Close skips any of the literal which hasn't been read, and the rest of the
+// command line, so that the command can be answered. It needn't be called if
+// the next command is read before responding.
+func (l *Literal) Close() error {
+	if l.p == nil || l.p.literal != l {
+		return nil
+	}
+	return l.p.finish()
+}
+
+// NewReader creates a new command reader on top of the given buffered reader.
+func NewReader(r *bufio.Reader, continuation func() error) *Reader {
+	return &Reader{r: r, Continuation: continuation}
+}
+
+// Raw returns the bytes read for the most recent command, without the final
+// line ending.
+func (p *Reader) Raw() string {
+	return strings.TrimRight(p.raw.String(), "\r\n")
+}
+
+// ReadCommand reads and parses a single command from the client.
+//
+// If the command is malformed a *SyntaxError is returned, along with as much
+// of the command as could be parsed (at least the tag if one was present).
+// The remainder of the offending line is discarded so the next call starts on
+// a fresh command. Any other error is an I/O error from the connection.
+func (p *Reader) ReadCommand() (cmd *Command, err error) {
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	p.raw.Reset()
+	cmd = &Command{}
+	p.cmd = cmd
+
+	// Skip any blank lines sent between commands
+	for {
+		b, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if b != '\r' && b != '\n' {
+			break
+		}
+		p.readByte()
+		p.raw.Reset()
+	}
+
+	cmd.Tag, err = p.readTag()
+	if err != nil {
+		return p.fail(cmd, err)
+	}
+	if err = p.expectSpace(); err != nil {
+		return p.fail(cmd, err)
+	}
+
+	name, err := p.readAtom()
+	if err != nil {
+		return p.fail(cmd, err)
+	}
+	cmd.Name = strings.ToUpper(name)
+
+	if cmd.Name == "UID" {
+		if err = p.expectSpace(); err != nil {
+			return p.fail(cmd, err)
+		}
+		name, err = p.readAtom()
+		if err != nil {
+			return p.fail(cmd, err)
+		}
+		cmd.UID = true
+		cmd.Name = strings.ToUpper(name)
+	}
+
+	cmd.Args, err = p.readArgs(0)
+	if err != nil {
+		return p.fail(cmd, err)
+	}
+	return cmd, nil
+}
+
+// finish skips what is left of a command whose literal was streamed: any of
+// the literal the handler didn't read, and the rest of the line.
+func (p *Reader) finish() error {
+	l := p.literal
+	if l == nil {
+		return nil
+	}
+	p.literal = nil
+	if l.sync && !l.started {
+		// The client was never told to send the literal, so it has
+		// abandoned the command
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, l.r); err != nil {
+		return err
+	}
+	return p.discardLine()
+}
+
+// fail discards the rest of the current line and passes syntax errors back to
+// the caller along with the partially parsed command.
+func (p *Reader) fail(cmd *Command, err error) (*Command, error) {
+	if _, ok := err.(*SyntaxError); !ok {
+		return nil, err
+	}
+	if err := p.discardLine(); err != nil {
+		return nil, err
+	}
+	return cmd, err
+}
+
+// readArgs reads arguments separated by spaces until the end of the line or,
+// when nested inside a list, until the closing parenthesis.
+func (p *Reader) readArgs(depth int) ([]Arg, error) {
+	args := make([]Arg, 0)
+	for {
+		b, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case b == '\r' || b == '\n':
+			if depth > 0 {
+				return nil, p.syntaxError("", "unterminated parenthesised list")
+			}
+			return args, p.readLineEnding()
+		case b == ')':
+			if depth == 0 {
+				return nil, p.syntaxError(")", "unexpected ')'")
+			}
+			p.readByte()
+			return args, nil
+		}
+
+		if len(args) > 0 || depth == 0 {
+			if err = p.expectSpace(); err != nil {
+				return nil, err
+			}
+		}
+
+		if depth == 0 {
+			p.cmd.Args = args
+		}
+		arg, err := p.readArg(depth)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if arg.Literal != nil {
+			// The rest of the command follows the streamed literal
+			return args, nil
+		}
+	}
+}
+
+// readArg reads a single argument of any type.
+func (p *Reader) readArg(depth int) (Arg, error) {
+	b, err := p.peek()
+	if err != nil {
+		return Arg{}, err
+	}
+
+	switch b {
+	case '"':
+		s, err := p.readQuoted()
+		return Arg{Kind: KindQuoted, Value: s}, err
+	case '{':
+		stream := depth == 0 && p.StreamLiteral != nil && p.StreamLiteral(p.cmd)
+		s, literal, err := p.readLiteral(stream)
+		return Arg{Kind: KindLiteral, Value: s, Literal: literal}, err
+	case '(':
+		if depth >= MaxListDepth {
+			return Arg{}, p.syntaxError("(", "lists nested too deeply")
+		}
+		p.readByte()
+		list, err := p.readArgs(depth + 1)
+		return Arg{Kind: KindList, List: list}, err
+	}
+
+	s, err := p.readAtom()
+	if err != nil {
+		return Arg{}, err
+	}
+	if strings.EqualFold(s, "NIL") {
+		return Arg{Kind: KindNil, Value: s}, nil
+	}
+	return Arg{Kind: KindAtom, Value: s}, nil
+}
+
+// readTag reads the command tag. Tags are atoms that may not contain '+'.
+func (p *Reader) readTag() (string, error) {
+	tag, err := p.readAtom()
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(tag, "+[]") {
+		return "", p.syntaxError(tag, "invalid tag")
+	}
+	return tag, nil
+}
+
+// readAtom reads an atom. For convenience in FETCH and other commands, any
+// bracketed section (eg BODY[HEADER.FIELDS (From To)]) is treated as part of
+// the atom, including any spaces, parentheses or quotes inside it.
+func (p *Reader) readAtom() (string, error) {
+	var atom bytes.Buffer
+	brackets := 0
+	for {
+		b, err := p.peek()
+		if err != nil {
+			return "", err
+		}
+
+		if brackets > 0 {
+			if b == '\r' || b == '\n' {
+				return "", p.syntaxError(atom.String(), "unterminated '['")
+			}
+			if b == '"' {
+				s, err := p.readQuoted()
+				if err != nil {
+					return "", err
+				}
+				atom.WriteString(strconv.Quote(s))
+				continue
+			}
+		} else if isAtomSpecial(b) {
+			break
+		}
+
+		switch b {
+		case '[':
+			brackets++
+		case ']':
+			if brackets > 0 {
+				brackets--
+			}
+		}
+		atom.WriteByte(b)
+		p.readByte()
+	}
+
+	if atom.Len() == 0 {
+		b, _ := p.peek()
+		return "", p.syntaxError(string(b), "expected atom")
+	}
+	return atom.String(), nil
+}
+
+// readQuoted reads a quoted string, handling escaped quotes and backslashes.
+func (p *Reader) readQuoted() (string, error) {
+	var s bytes.Buffer
+	p.readByte() // Opening quote
+	for {
+		b, err := p.readByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			b, err = p.readByte()
+			if err != nil {
+				return "", err
+			}
+			if b != '"' && b != '\\' {
+				return "", p.syntaxError("\\"+string(b), "invalid escape in quoted string")
+			}
+		case '\r', '\n':
+			p.unreadByte()
+			return "", p.syntaxError("\""+s.String(), "unterminated quoted string")
+		}
+		s.WriteByte(b)
+	}
+}
+
+// readLiteral reads a literal of the form {n}CRLF followed by n octets. The
+// non-synchronising form {n+} from RFC 7888 is also accepted. If stream is
+// set, the data is left to be read through the returned Literal.
+func (p *Reader) readLiteral(stream bool) (string, *Literal, error) {
+	p.readByte() // Opening brace
+	var spec bytes.Buffer
+	for {
+		b, err := p.readByte()
+		if err != nil {
+			return "", nil, err
+		}
+		if b == '}' {
+			break
+		}
+		if b == '\r' || b == '\n' {
+			p.unreadByte()
+			return "", nil, p.syntaxError("{"+spec.String(), "unterminated literal length")
+		}
+		spec.WriteByte(b)
+	}
+
+	sync := true
+	lengthStr := spec.String()
+	if strings.HasSuffix(lengthStr, "+") {
+		sync = false
+		lengthStr = strings.TrimSuffix(lengthStr, "+")
+	}
+	length, err := strconv.ParseUint(lengthStr, 10, 32)
+	if err != nil {
+		return "", nil, p.syntaxError("{"+spec.String()+"}", "invalid literal length")
+	}
+
+	// The literal length must be the last thing on the line
+	b, err := p.peek()
+	if err != nil {
+		return "", nil, err
+	}
+	if b != '\r' && b != '\n' {
+		return "", nil, p.syntaxError("{"+spec.String()+"}", "literal length must be followed by a line ending")
+	}
+	tooLarge := ""
+	switch {
+	case stream:
+	case length > MaxLiteralSize:
+		tooLarge = "literal too large"
+	case p.raw.Len()+int(length) > MaxCommandSize:
+		tooLarge = "command too long"
+	}
+	if tooLarge != "" {
+		if !sync {
+			// The client sends the data without waiting, so skip it
+			if err = p.readLineEnding(); err != nil {
+				return "", nil, err
+			}
+			if _, err = io.CopyN(ioutil.Discard, p.r, int64(length)); err != nil {
+				return "", nil, err
+			}
+		}
+		return "", nil, p.syntaxError("{"+spec.String()+"}", tooLarge)
+	}
+	if err = p.readLineEnding(); err != nil {
+		return "", nil, err
+	}
+
+	if stream {
+		p.literal = &Literal{
+			Size: int64(length),
+			r:    io.LimitReader(p.r, int64(length)),
+			p:    p,
+			sync: sync,
+		}
+		return "", p.literal, nil
+	}
+
+	if sync && p.Continuation != nil {
+		if err = p.Continuation(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// The buffer grows as the data arrives, rather than trusting the length
+	var data bytes.Buffer
+	if _, err = io.CopyN(&data, p.r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	p.raw.Write(data.Bytes())
+	return data.String(), nil, nil
+}
+
+func (p *Reader) expectSpace() error {
+	b, err := p.peek()
+	if err != nil {
+		return err
+	}
+	if b != ' ' {
+		if b == '\r' || b == '\n' {
+			return p.syntaxError("", "missing argument")
+		}
+		return p.syntaxError(string(b), "expected space")
+	}
+	p.readByte()
+	return nil
+}
+
+// readLineEnding consumes a CRLF, also accepting a bare LF.
+func (p *Reader) readLineEnding() error {
+	b, err := p.readByte()
+	if err != nil {
+		return err
+	}
+	if b == '\r' {
+		b, err = p.readByte()
+		if err != nil {
+			return err
+		}
+	}
+	if b != '\n' {
+		return p.syntaxError(string(b), "expected line ending")
+	}
+	return nil
+}
+
+// discardLine skips everything up to and including the next line feed. Only
+// as much as fits in MaxCommandSize is kept for the transcript.
+func (p *Reader) discardLine() error {
+	for {
+		line, err := p.r.ReadSlice('\n')
+		if room := MaxCommandSize - p.raw.Len(); room > 0 {
+			if len(line) > room {
+				p.raw.Write(line[:room])
+			} else {
+				p.raw.Write(line)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// peek returns the next byte without reading it. Once the command has used
+// up MaxCommandSize nothing more is read.
+func (p *Reader) peek() (byte, error) {
+	if p.raw.Len() >= MaxCommandSize {
+		return 0, p.syntaxError("", "command too long")
+	}
+	b, err := p.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (p *Reader) readByte() (byte, error) {
+	if p.raw.Len() >= MaxCommandSize {
+		return 0, p.syntaxError("", "command too long")
+	}
+	b, err := p.r.ReadByte()
+	if err == nil {
+		p.raw.WriteByte(b)
+	}
+	return b, err
+}
+
+func (p *Reader) unreadByte() {
+	p.r.UnreadByte()
+	p.raw.Truncate(p.raw.Len() - 1)
+}
+
+func (p *Reader) syntaxError(token string, msg string) *SyntaxError {
+	return &SyntaxError{Offset: p.raw.Len(), Token: token, Msg: msg}
+}
+
+// isAtomSpecial returns true for characters that terminate an atom. This is
+// slightly more lenient than the RFC 3501 atom-specials so that list
+// wildcards, flags and sequence sets can all be read as atoms.
+func isAtomSpecial(b byte) bool {
+	switch b {
+	case '(', ')', '{', ' ', '"':
+		return true
+	}
+	return b < 0x20 || b == 0x7f
+}
+
+// SyntaxError is returned when a command does not match the IMAP grammar.
+type SyntaxError struct {
+	// Offset is the zero-based byte offset into the command where the error
+	// occurred
+	Offset int
+	// Token is the text that could not be parsed, if any
+	Token string
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("Syntax error at column %d: %s", e.Offset+1, e.Msg)
+	}
+	return fmt.Sprintf("Syntax error at column %d near %q: %s", e.Offset+1, e.Token, e.Msg)
+}
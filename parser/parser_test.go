@@ -0,0 +1,265 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readCommand(input string) (*Command, error) {
+	r := NewReader(bufio.NewReader(strings.NewReader(input)), nil)
+	return r.ReadCommand()
+}
+
+func TestReadCommand(t *testing.T) {
+	cmd, err := readCommand("a001 UID fetch 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (From To)])\r\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cmd.Tag != "a001" || cmd.Name != "FETCH" || !cmd.UID {
+		t.Fatalf("Unexpected command %+v", cmd)
+	}
+	if len(cmd.Args) != 2 {
+		t.Fatalf("Expected 2 arguments, got %d", len(cmd.Args))
+	}
+	if _, err = cmd.SequenceSet(0); err != nil {
+		t.Errorf("Expected a sequence set: %s", err)
+	}
+	atoms, err := cmd.Atoms(1)
+	if err != nil {
+		t.Fatalf("Expected a list of atoms: %s", err)
+	}
+	expected := []string{"FLAGS", "BODY.PEEK[HEADER.FIELDS (From To)]"}
+	for i, atom := range expected {
+		if atoms[i] != atom {
+			t.Errorf("Expected %q, got %q", atom, atoms[i])
+		}
+	}
+}
+
+func TestReadQuotedAndLiteral(t *testing.T) {
+	continuations := 0
+	r := NewReader(bufio.NewReader(strings.NewReader(
+		"a002 LOGIN {4}\r\nuser \"pass \\\"word\\\"\"\r\n")), func() error {
+		continuations++
+		return nil
+	})
+	cmd, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if continuations != 1 {
+		t.Errorf("Expected 1 continuation request, got %d", continuations)
+	}
+	if cmd.Args[0].Kind != KindLiteral || cmd.Args[0].Value != "user" {
+		t.Errorf("Unexpected first argument %+v", cmd.Args[0])
+	}
+	if cmd.Args[1].Kind != KindQuoted || cmd.Args[1].Value != "pass \"word\"" {
+		t.Errorf("Unexpected second argument %+v", cmd.Args[1])
+	}
+}
+
+func TestReadMailboxNames(t *testing.T) {
+	cmd, err := readCommand("a003 RENAME \"Sent Items\" Archive/2024\r\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i, expected := range []string{"Sent Items", "Archive/2024"} {
+		name, err := cmd.Mailbox(i)
+		if err != nil || name != expected {
+			t.Errorf("Expected mailbox %q, got %q (%v)", expected, name, err)
+		}
+	}
+}
+
+func TestReadNilAndNestedLists(t *testing.T) {
+	cmd, err := readCommand("a004 X nil (a (b c) \"d\") ()\r\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cmd.Args[0].Kind != KindNil {
+		t.Errorf("Expected NIL, got %s", cmd.Args[0].Kind)
+	}
+	if s := cmd.Args[1].String(); s != "(a (b c) \"d\")" {
+		t.Errorf("Unexpected list %s", s)
+	}
+	if cmd.Args[2].Kind != KindList || len(cmd.Args[2].List) != 0 {
+		t.Errorf("Expected empty list, got %s", cmd.Args[2])
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	inputs := []string{
+		"a005 SELECT \"INBOX\r\n",
+		"a006 FETCH 1 (FLAGS\r\n",
+		"a007 FETCH 1 FLAGS)\r\n",
+		"a008 APPEND INBOX {abc}\r\n",
+		"a009  NOOP\r\n",
+	}
+	for _, input := range inputs {
+		cmd, err := readCommand(input)
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected a syntax error for %q, got %v", input, err)
+			continue
+		}
+		if cmd.Tag != input[:4] {
+			t.Errorf("Expected tag %q to be parsed, got %q", input[:4], cmd.Tag)
+		}
+	}
+}
+
+func TestResyncAfterSyntaxError(t *testing.T) {
+	r := NewReader(bufio.NewReader(strings.NewReader(
+		"a010 SELECT \"INBOX\r\na011 NOOP\r\n")), nil)
+	if _, err := r.ReadCommand(); err == nil {
+		t.Fatalf("Expected a syntax error")
+	}
+	cmd, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cmd.Tag != "a011" || cmd.Name != "NOOP" {
+		t.Errorf("Unexpected command %+v", cmd)
+	}
+}
+
+func TestLiteralTooLarge(t *testing.T) {
+	// The client waits to be told to send a synchronising literal, so only
+	// the line is discarded
+	continued := false
+	r := NewReader(bufio.NewReader(strings.NewReader(
+		"a020 LOGIN {4294967295}\r\na021 NOOP\r\n")), func() error {
+		continued = true
+		return nil
+	})
+	if _, err := r.ReadCommand(); err == nil || !strings.Contains(err.Error(), "literal too large") {
+		t.Fatalf("Expected the literal to be refused, got %v", err)
+	}
+	if continued {
+		t.Errorf("Expected the client not to be told to send the literal")
+	}
+	if cmd, err := r.ReadCommand(); err != nil || cmd.Tag != "a021" {
+		t.Errorf("Expected the next command to be read, got %+v and %v", cmd, err)
+	}
+
+	// A non-synchronising literal is sent anyway, so it is skipped
+	big := strings.Repeat("x", MaxLiteralSize+1)
+	r = NewReader(bufio.NewReader(strings.NewReader(fmt.Sprintf(
+		"a022 LOGIN {%d+}\r\n%s pass\r\na023 NOOP\r\n", len(big), big))), nil)
+	if _, err := r.ReadCommand(); err == nil {
+		t.Fatalf("Expected the literal to be refused")
+	}
+	if cmd, err := r.ReadCommand(); err != nil || cmd.Tag != "a023" {
+		t.Errorf("Expected the next command to be read, got %+v and %v", cmd, err)
+	}
+}
+
+func TestCommandTooLong(t *testing.T) {
+	atom := strings.Repeat("x", MaxCommandSize)
+	literal := fmt.Sprintf("{%d+}\r\n%s", MaxLiteralSize, strings.Repeat("x", MaxLiteralSize))
+	inputs := []string{
+		"a030 SELECT " + atom + "\r\n",
+		"a030 SELECT \"" + atom + "\"\r\n",
+		"a030 SEARCH" + strings.Repeat(" TEXT "+literal, MaxCommandSize/MaxLiteralSize) + "\r\n",
+	}
+	for _, input := range inputs {
+		r := NewReader(bufio.NewReader(strings.NewReader(input+"a031 NOOP\r\n")), nil)
+		_, err := r.ReadCommand()
+		if _, ok := err.(*SyntaxError); !ok || !strings.Contains(err.Error(), "command too long") {
+			t.Errorf("Expected the command to be refused, got %v", err)
+		}
+		if len(r.Raw()) > MaxCommandSize {
+			t.Errorf("Expected at most %d bytes to be kept, got %d", MaxCommandSize, len(r.Raw()))
+		}
+		if cmd, err := r.ReadCommand(); err != nil || cmd.Tag != "a031" {
+			t.Errorf("Expected the next command to be read, got %+v and %v", cmd, err)
+		}
+	}
+}
+
+func TestListsNestedTooDeeply(t *testing.T) {
+	nested := strings.Repeat("(", MaxListDepth) + strings.Repeat(")", MaxListDepth)
+	if _, err := readCommand("a032 SEARCH " + nested + "\r\n"); err != nil {
+		t.Errorf("Unexpected error for %d nested lists: %s", MaxListDepth, err)
+	}
+
+	r := NewReader(bufio.NewReader(strings.NewReader(
+		"a033 SEARCH "+strings.Repeat("(", 100000)+"\r\na034 NOOP\r\n")), nil)
+	_, err := r.ReadCommand()
+	if _, ok := err.(*SyntaxError); !ok || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("Expected the lists to be refused, got %v", err)
+	}
+	if cmd, err := r.ReadCommand(); err != nil || cmd.Tag != "a034" {
+		t.Errorf("Expected the next command to be read, got %+v and %v", cmd, err)
+	}
+}
+
+func TestArgErrors(t *testing.T) {
+	cmd, err := readCommand("a012 COPY 1:x (Trash)\r\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err = cmd.SequenceSet(0); err == nil ||
+		err.Error() != "Invalid sequence set (argument 1: 1:x)" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err = cmd.Mailbox(1); err == nil {
+		t.Errorf("Expected an error for a list as a mailbox name")
+	}
+	if err = cmd.ExpectCount(3, 3); err == nil {
+		t.Errorf("Expected an error for a missing argument")
+	}
+}
+
+func TestStreamLiteral(t *testing.T) {
+	continuations := 0
+	r := NewReader(bufio.NewReader(strings.NewReader(
+		"a003 APPEND INBOX {11}\r\nHello world\r\n"+
+			"a004 APPEND INBOX {5}\r\n"+
+			"a005 APPEND INBOX {5+}\r\nHello\r\n"+
+			"a006 NOOP\r\n")), func() error {
+		continuations++
+		return nil
+	})
+	r.StreamLiteral = func(cmd *Command) bool {
+		return cmd.Name == "APPEND" && len(cmd.Args) > 0
+	}
+
+	// The literal is read by the caller, once the client has been told to
+	// send it
+	cmd, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	literal, err := cmd.Literal(1)
+	if err != nil || literal.Size != 11 {
+		t.Fatalf("Expected a literal of 11 bytes, got %v and %v", literal, err)
+	}
+	if continuations != 0 {
+		t.Errorf("Expected no continuation until the literal is read")
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(literal, data); err != nil || string(data) != "Hello" {
+		t.Errorf("Expected to read the literal, got %q and %v", data, err)
+	}
+	if continuations != 1 {
+		t.Errorf("Expected a continuation request, got %d", continuations)
+	}
+	if err := literal.Close(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	// The rest of the literal is skipped. A synchronising literal which
+	// was never started hasn't been sent, but a non-synchronising one has.
+	for _, tag := range []string{"a004", "a005", "a006"} {
+		cmd, err := r.ReadCommand()
+		if err != nil || cmd.Tag != tag {
+			t.Fatalf("Expected command %s, got %+v and %v", tag, cmd, err)
+		}
+	}
+	if continuations != 1 {
+		t.Errorf("Expected no more continuation requests, got %d", continuations)
+	}
+}
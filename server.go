@@ -1,11 +1,16 @@
 package imap
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/textproto"
+	"sync"
+	"time"
 
 	"github.com/jordwest/imap-server/conn"
 	"github.com/jordwest/imap-server/mailstore"
@@ -15,14 +20,56 @@ const (
 	// defaultAddress is the default address that the IMAP server should listen
 	// on.
 	defaultAddress = ":143"
+
+	// defaultTLSAddress is the default address for implicit TLS (IMAPS)
+	// connections.
+	defaultTLSAddress = ":993"
 )
 
+// shutdownPollInterval is how often Shutdown checks whether every connection
+// has closed.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ErrServerClosed is returned by Serve and ServeTLS after Shutdown or Close
+// has been called.
+var ErrServerClosed = errors.New("imap: Server closed")
+
 // Server represents an IMAP server instance.
 type Server struct {
 	Addr       string
-	listeners  []net.Listener
 	Transcript io.Writer
 	mailstore  mailstore.Mailstore
+
+	// TLSConfig is used for implicit TLS connections and for the STARTTLS
+	// command. If it is set, clients connecting without TLS must use
+	// STARTTLS before they can log in.
+	TLSConfig *tls.Config
+
+	// Registry holds the commands and FETCH items understood by the
+	// server's connections. Applications may add their own commands or
+	// change the built in ones before the server starts.
+	Registry *conn.Registry
+
+	// AppendLimit is the largest message in bytes which clients may APPEND,
+	// or 0 for no limit.
+	AppendLimit uint32
+
+	// Timeouts for each connection, which default to those in the conn
+	// package. A client which is silent for longer than AutologoutTimeout,
+	// or PreAuthTimeout before logging in, is disconnected. LiteralTimeout
+	// limits waiting for more of a literal, and WriteTimeout limits each
+	// write. Zero disables a timeout.
+	AutologoutTimeout time.Duration
+	PreAuthTimeout    time.Duration
+	LiteralTimeout    time.Duration
+	WriteTimeout      time.Duration
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]bool
+	conns      map[*conn.Conn]bool
+	inShutdown bool
+	ctx        context.Context // Parent of every connection's context
+	cancel     context.CancelFunc
 }
 
 // NewServer initialises a new Server. Note that this does not start the server.
@@ -32,6 +79,12 @@ func NewServer(store mailstore.Mailstore) *Server {
 		Addr:       defaultAddress,
 		mailstore:  store,
 		Transcript: ioutil.Discard,
+		Registry:   conn.NewRegistry(),
+
+		AutologoutTimeout: conn.DefaultAutologoutTimeout,
+		PreAuthTimeout:    conn.DefaultPreAuthTimeout,
+		LiteralTimeout:    conn.DefaultLiteralTimeout,
+		WriteTimeout:      conn.DefaultWriteTimeout,
 	}
 	return s
 }
@@ -48,29 +101,232 @@ func (s *Server) ListenAndServe() (err error) {
 	return s.Serve(ln)
 }
 
+// ListenAndServeTLS listens for implicit TLS (IMAPS) connections on Addr, or
+// port 993 if Addr has not been changed from the default. If certFile and
+// keyFile are given, the certificate is loaded from them, otherwise the
+// certificates in TLSConfig are used.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) (err error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Error loading certificate: %s\n", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	s.TLSConfig = config
+
+	addr := s.Addr
+	if addr == defaultAddress {
+		addr = defaultTLSAddress
+	}
+
+	fmt.Fprintf(s.Transcript, "Listening on %s\n", addr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Error listening: %s\n", err)
+	}
+
+	return s.ServeTLS(ln)
+}
+
+// ServeTLS is like Serve, except that every connection is encrypted with TLS
+// from the start using the server's TLSConfig.
+func (s *Server) ServeTLS(l net.Listener) error {
+	if s.TLSConfig == nil {
+		return fmt.Errorf("Error serving TLS: no TLSConfig set\n")
+	}
+	return s.Serve(tls.NewListener(l, s.TLSConfig))
+}
+
 // Serve starts the server and spawns new goroutines to handle each client
-// connection as they come in. This function blocks.
+// connection as they come in. This function blocks until the listener fails,
+// or until Shutdown or Close is called, when it returns ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
 	fmt.Fprintf(s.Transcript, "Serving on %s\n", l.Addr().String())
 	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var delay time.Duration // How long to wait after a temporary error
 	for {
-		conn, err := l.Accept()
+		netConn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Eg the process has run out of file descriptors, so
+				// wait for some connections to close
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				fmt.Fprintf(s.Transcript, "Error accepting connection: %s; retrying in %s\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
 			return fmt.Errorf("Error accepting connection: %s\n", err)
 		}
+		delay = 0
 
 		fmt.Fprintf(s.Transcript, "Connection accepted\n")
-		c, err := s.newConn(conn)
+		c, err := s.newConn(netConn)
 		if err != nil {
 			return err
 		}
+		if !s.trackConn(c, true) {
+			netConn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.trackConn(c, false)
+			c.StartContext(s.context())
+		}()
+	}
+}
+
+// Shutdown stops the server gracefully. It stops listening, and tells each
+// client that the server is shutting down, waiting for any command in
+// progress to finish first. It then waits for every connection to close. If
+// ctx is cancelled first, Shutdown returns the context's error, leaving the
+// remaining connections open; Close can then be used to close them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	// Connections are told without the lock held, as they may be slow
+	for _, c := range s.Conns() {
+		c.Shutdown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if len(s.Conns()) == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server immediately, closing every listener and
+// connection. Commands in progress are interrupted, and their contexts are
+// cancelled.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// Conns returns the connections which are currently open.
+func (s *Server) Conns() []*conn.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*conn.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
 
-		go c.Start()
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// context returns the parent context of every connection, which is
+// cancelled by Close.
+func (s *Server) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// trackListener adds or removes a listener from those closed by Shutdown and
+// Close. It returns false if a listener can't be added because the server is
+// shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[l] = true
+	return true
+}
+
+// trackConn adds or removes a connection from those returned by Conns. It
+// returns false if a connection can't be added because the server is
+// shutting down.
+func (s *Server) trackConn(c *conn.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn.Conn]bool)
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
+	return err
 }
 
 func (s *Server) newConn(netConn net.Conn) (c *conn.Conn, err error) {
 	c = conn.NewConn(s.mailstore, netConn, s.Transcript)
+	c.TLSConfig = s.TLSConfig
+	c.Registry = s.Registry
+	c.AppendLimit = s.AppendLimit
+	c.AutologoutTimeout = s.AutologoutTimeout
+	c.PreAuthTimeout = s.PreAuthTimeout
+	c.LiteralTimeout = s.LiteralTimeout
+	c.WriteTimeout = s.WriteTimeout
 	c.SetState(conn.StateNew)
 	return c, nil
 }
@@ -1,6 +1,16 @@
 package imap
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
 	"net"
 	"testing"
 	"time"
@@ -22,3 +32,230 @@ func TestDataRace(t *testing.T) {
 	time.Sleep(time.Millisecond)
 	l.Close()
 }
+
+// testTLSConfig creates a server TLS configuration with a self-signed
+// certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+}
+
+func TestServeTLS(t *testing.T) {
+	s := NewServer(mailstore.NewDummyMailstore())
+	s.TLSConfig = testTLSConfig(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go s.ServeTLS(l)
+
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if greeting != "* OK IMAP4rev1 Service Ready\r\n" {
+		t.Errorf("Unexpected greeting %q", greeting)
+	}
+
+	// Implicit TLS connections don't need STARTTLS before logging in
+	c.Write([]byte("a1 CAPABILITY\r\n"))
+	capability, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capability != "* CAPABILITY IMAP4rev1 AUTH=PLAIN IDLE UIDPLUS MOVE CONDSTORE ENABLE QRESYNC STATUS=SIZE\r\n" {
+		t.Errorf("Unexpected capabilities %q", capability)
+	}
+}
+
+// dialTestServer connects to a server and reads the greeting
+func dialTestServer(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	return c, r
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewServer(mailstore.NewDummyMailstore())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	// One client is waiting to send a command, and the other is idling
+	waiting, waitingReader := dialTestServer(t, l.Addr().String())
+	defer waiting.Close()
+	idling, idlingReader := dialTestServer(t, l.Addr().String())
+	defer idling.Close()
+	idling.Write([]byte("a1 LOGIN username password\r\na2 IDLE\r\n"))
+	for _, expected := range []string{"a1 OK Authenticated\r\n", "+ idling\r\n"} {
+		if line, err := idlingReader.ReadString('\n'); line != expected {
+			t.Fatalf("Expected %q, got %q and %v", expected, line, err)
+		}
+	}
+	if n := len(s.Conns()); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, r := range []*bufio.Reader{waitingReader, idlingReader} {
+		if line, _ := r.ReadString('\n'); line != "* BYE Server shutting down\r\n" {
+			t.Errorf("Expected clients to be told about the shutdown, got %q", line)
+		}
+	}
+	if n := len(s.Conns()); n != 0 {
+		t.Errorf("Expected no connections, got %d", n)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Errorf("Expected a shut down server not to serve, got %v", err)
+	}
+}
+
+func TestAutologout(t *testing.T) {
+	s := NewServer(mailstore.NewDummyMailstore())
+	s.PreAuthTimeout = 50 * time.Millisecond
+	s.AutologoutTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	// A client which never logs in gets the shorter timeout, and one which
+	// has logged in is also disconnected once it has been silent for long
+	// enough
+	silent, silentReader := dialTestServer(t, l.Addr().String())
+	defer silent.Close()
+	idling, idlingReader := dialTestServer(t, l.Addr().String())
+	defer idling.Close()
+	idling.Write([]byte("a1 LOGIN username password\r\na2 IDLE\r\n"))
+	idlingReader.ReadString('\n')
+	idlingReader.ReadString('\n')
+
+	start := time.Now()
+	line, _ := silentReader.ReadString('\n')
+	if line != "* BYE Autologout; idle for too long\r\n" {
+		t.Errorf("Expected a silent client to be logged out, got %q", line)
+	}
+	if _, err := silentReader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	line, _ = idlingReader.ReadString('\n')
+	if line != "* BYE Autologout; idle for too long\r\n" {
+		t.Errorf("Expected an idling client to be logged out, got %q", line)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected clients to be logged out promptly, took %s", elapsed)
+	}
+}
+
+// blockingMailstore authenticates nobody, waiting until the login is
+// cancelled.
+type blockingMailstore struct {
+	*mailstore.DummyMailstore
+	cancelled chan struct{}
+}
+
+func (s blockingMailstore) AuthenticateContext(ctx context.Context, username string, password string) (mailstore.User, error) {
+	<-ctx.Done()
+	close(s.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestDisconnectDuringCommand(t *testing.T) {
+	store := blockingMailstore{mailstore.NewDummyMailstore(), make(chan struct{})}
+	s := NewServer(store)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	// The client goes away while its login is being checked
+	client, _ := dialTestServer(t, l.Addr().String())
+	client.Write([]byte("a1 LOGIN username password\r\n"))
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	select {
+	case <-store.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the command to be cancelled when the client disconnected")
+	}
+}
+
+func TestLiteralTimeout(t *testing.T) {
+	s := NewServer(mailstore.NewDummyMailstore())
+	s.AutologoutTimeout = time.Minute
+	s.PreAuthTimeout = time.Minute
+	s.LiteralTimeout = 50 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	// A client which stops part way through a command's literal gets the
+	// shorter timeout
+	client, r := dialTestServer(t, l.Addr().String())
+	defer client.Close()
+	client.Write([]byte("a1 LOGIN {8}\r\n"))
+	if line, _ := r.ReadString('\n'); len(line) == 0 || line[0] != '+' {
+		t.Fatalf("Expected a continuation request, got %q", line)
+	}
+
+	start := time.Now()
+	line, _ := r.ReadString('\n')
+	if line != "* BYE Autologout; idle for too long\r\n" {
+		t.Errorf("Expected the client to be logged out, got %q", line)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the literal to time out promptly, took %s", elapsed)
+	}
+}
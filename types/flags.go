@@ -1,6 +1,9 @@
 package types
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // Flags provide information on flags that are attached to a message
 type Flags int32
@@ -25,6 +28,7 @@ func CombineFlags(flags ...Flags) Flags {
 }
 
 // FlagsFromString returns the flags based on the input IMAP format string.
+// Keywords and unknown flags are ignored; use ParseFlagSet to keep them.
 func FlagsFromString(imapFlagString string) Flags {
 	var f Flags
 
@@ -93,3 +97,122 @@ func (f Flags) Strings() []string {
 func (f Flags) String() string {
 	return strings.Join(f.Strings(), " ")
 }
+
+// systemFlags maps the upper case names of the system flags to their values
+var systemFlags = map[string]Flags{
+	"\\SEEN":     FlagSeen,
+	"\\ANSWERED": FlagAnswered,
+	"\\FLAGGED":  FlagFlagged,
+	"\\DELETED":  FlagDeleted,
+	"\\DRAFT":    FlagDraft,
+	"\\RECENT":   FlagRecent,
+}
+
+// FlagSet holds all the flags of a message: the system flags defined by
+// IMAP, and keywords, which are any other flags, such as $Junk, $Forwarded
+// or $Label1.
+type FlagSet struct {
+	Flags    Flags
+	Keywords []string
+}
+
+// ParseFlagSet creates a FlagSet from flags given by a client, eg in a
+// STORE or APPEND command. System flags are matched case insensitively, and
+// an error is returned for unknown system flags or keywords which aren't
+// valid atoms.
+func ParseFlagSet(flags []string) (FlagSet, error) {
+	var set FlagSet
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "\\") {
+			f, ok := systemFlags[strings.ToUpper(flag)]
+			if !ok {
+				return FlagSet{}, fmt.Errorf("Unknown flag %s", flag)
+			}
+			set.Flags = set.Flags.SetFlags(f)
+			continue
+		}
+		if !ValidKeyword(flag) {
+			return FlagSet{}, fmt.Errorf("Invalid keyword %q", flag)
+		}
+		set.Keywords = AddKeywords(set.Keywords, flag)
+	}
+	return set, nil
+}
+
+// ValidKeyword returns true if a keyword can be sent to clients as an atom.
+func ValidKeyword(keyword string) bool {
+	if keyword == "" {
+		return false
+	}
+	for _, c := range []byte(keyword) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("(){%*\"\\]", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HasKeyword returns true if the set contains a keyword, compared case
+// insensitively.
+func (s FlagSet) HasKeyword(keyword string) bool {
+	return HasKeyword(s.Keywords, keyword)
+}
+
+// Equal returns true if both sets contain the same flags and keywords, in
+// any order.
+func (s FlagSet) Equal(other FlagSet) bool {
+	if s.Flags != other.Flags || len(s.Keywords) != len(other.Keywords) {
+		return false
+	}
+	for _, keyword := range other.Keywords {
+		if !s.HasKeyword(keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// Strings converts the set to a list of IMAP format flags, with the system
+// flags first.
+func (s FlagSet) Strings() []string {
+	return append(s.Flags.Strings(), s.Keywords...)
+}
+
+// String converts the set to an IMAP flag list string.
+func (s FlagSet) String() string {
+	return strings.Join(s.Strings(), " ")
+}
+
+// HasKeyword returns true if a list of keywords contains the given one.
+// Keywords are compared case insensitively.
+func HasKeyword(keywords []string, keyword string) bool {
+	for _, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddKeywords returns a new list of keywords with the given ones added,
+// leaving out any which are already present.
+func AddKeywords(keywords []string, add ...string) []string {
+	result := append([]string(nil), keywords...)
+	for _, keyword := range add {
+		if !HasKeyword(result, keyword) {
+			result = append(result, keyword)
+		}
+	}
+	return result
+}
+
+// RemoveKeywords returns a new list of keywords without the given ones.
+func RemoveKeywords(keywords []string, remove ...string) []string {
+	result := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		if !HasKeyword(remove, keyword) {
+			result = append(result, keyword)
+		}
+	}
+	return result
+}
@@ -53,3 +53,43 @@ func TestFlagsFromString(t *testing.T) {
 		t.Errorf("Expected %d, Actual %d", expected, c1)
 	}
 }
+
+func TestParseFlagSet(t *testing.T) {
+	set, err := ParseFlagSet([]string{"\\seen", "$Junk", "\\Flagged", "$junk", "NonJunk"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if set.Flags != FlagSeen|FlagFlagged {
+		t.Errorf("Expected \\Seen and \\Flagged, got %s", set.Flags)
+	}
+	if set.String() != "\\Seen \\Flagged $Junk NonJunk" {
+		t.Errorf("Expected keywords to be kept once each, got %q", set.String())
+	}
+
+	for _, invalid := range []string{"\\Unknown", "a]b", "a\"b", ""} {
+		if _, err := ParseFlagSet([]string{invalid}); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	keywords := AddKeywords([]string{"$Junk"}, "$junk", "$Label1")
+	if len(keywords) != 2 || keywords[1] != "$Label1" {
+		t.Errorf("Expected $Label1 to be added once, got %v", keywords)
+	}
+	keywords = RemoveKeywords(keywords, "$JUNK")
+	if len(keywords) != 1 || keywords[0] != "$Label1" {
+		t.Errorf("Expected $Junk to be removed, got %v", keywords)
+	}
+
+	a := FlagSet{Flags: FlagSeen, Keywords: []string{"$Junk", "$Label1"}}
+	b := FlagSet{Flags: FlagSeen, Keywords: []string{"$label1", "$junk"}}
+	if !a.Equal(b) {
+		t.Errorf("Expected %s to equal %s", a, b)
+	}
+	b.Keywords = b.Keywords[:1]
+	if a.Equal(b) {
+		t.Errorf("Expected %s not to equal %s", a, b)
+	}
+}
@@ -0,0 +1,81 @@
+package types
+
+import "time"
+
+// SearchKey identifies the type of a single search criterion.
+type SearchKey int
+
+// Search keys, see RFC 3501 section 6.4.4. Keys which are shorthand for
+// others, such as FROM (HEADER FROM) or NEW (RECENT UNSEEN), are reduced to
+// these when the search is parsed.
+const (
+	// SearchAll matches every message
+	SearchAll SearchKey = iota
+	// SearchAnd matches messages matching all of Children
+	SearchAnd
+	// SearchOr matches messages matching either of the two Children
+	SearchOr
+	// SearchNot matches messages that do not match the single child
+	SearchNot
+	// SearchSequenceSet matches messages with sequence numbers in Set
+	SearchSequenceSet
+	// SearchUID matches messages with UIDs in Set
+	SearchUID
+	// SearchFlags matches messages with all of Flags set
+	SearchFlags
+	// SearchKeyword matches messages with the keyword in Value
+	SearchKeyword
+	// SearchHeader matches messages whose Field header contains Value
+	SearchHeader
+	// SearchBody matches messages whose body contains Value
+	SearchBody
+	// SearchText matches messages whose header or body contains Value
+	SearchText
+	// SearchBefore matches messages with an internal date before Date
+	SearchBefore
+	// SearchOn matches messages with an internal date on Date
+	SearchOn
+	// SearchSince matches messages with an internal date on or after Date
+	SearchSince
+	// SearchSentBefore matches messages with a Date header before Date
+	SearchSentBefore
+	// SearchSentOn matches messages with a Date header on Date
+	SearchSentOn
+	// SearchSentSince matches messages with a Date header on or after Date
+	SearchSentSince
+	// SearchLarger matches messages with an RFC822 size larger than Size
+	SearchLarger
+	// SearchSmaller matches messages with an RFC822 size smaller than Size
+	SearchSmaller
+	// SearchModSeq matches messages with a mod-sequence of at least ModSeq
+	// (RFC 7162)
+	SearchModSeq
+)
+
+// SearchCriteria is a tree of search keys describing which messages should
+// be returned by a SEARCH command. Only the fields relevant to the Key are
+// set.
+type SearchCriteria struct {
+	Key SearchKey
+
+	// Children are the nested criteria of AND, OR and NOT
+	Children []*SearchCriteria
+
+	// Set is the set of sequence numbers or UIDs
+	Set SequenceSet
+
+	Flags Flags
+
+	// Field is the header field name for SearchHeader
+	Field string
+
+	// Value is the string to search for, or the keyword
+	Value string
+
+	// Date is the date to compare against. Only the date portion is used.
+	Date time.Time
+
+	Size uint32
+
+	ModSeq uint64
+}
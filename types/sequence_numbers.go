@@ -143,3 +143,82 @@ func InterpretSequenceSet(imapSequenceSet string) (seqSet SequenceSet, err error
 
 	return seqSet, nil
 }
+
+// Bounds returns the lowest and highest sequence numbers or UIDs in the
+// range, which are the same for a single number. The value of "*" must be
+// given as last, which is the highest sequence number or UID in the mailbox.
+func (r SequenceRange) Bounds(last uint32) (min uint32, max uint32) {
+	min = last
+	if !r.Min.Last() {
+		min, _ = r.Min.Value()
+	}
+	if r.Max.Nil() {
+		return min, min
+	}
+
+	max = last
+	if !r.Max.Last() {
+		max, _ = r.Max.Value()
+	}
+	// "*" may be smaller than the other end of the range, eg 15:* when the
+	// last message is 12
+	if min > max {
+		min, max = max, min
+	}
+	return min, max
+}
+
+// Contains returns true if the given sequence number or UID falls within the
+// range. See SequenceRange.Bounds.
+func (r SequenceRange) Contains(n uint32, last uint32) bool {
+	min, max := r.Bounds(last)
+	return n >= min && n <= max
+}
+
+// Contains returns true if the given sequence number or UID falls within any
+// range in the set. See SequenceRange.Contains.
+func (s SequenceSet) Contains(n uint32, last uint32) bool {
+	for _, r := range s {
+		if r.Contains(n, last) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSequenceSet creates a SequenceSet containing the given sequence numbers
+// or UIDs in the same order, joining runs of consecutive numbers into
+// ranges.
+func NewSequenceSet(ns []uint32) SequenceSet {
+	var set SequenceSet
+	for i := 0; i < len(ns); {
+		j := i
+		for j+1 < len(ns) && ns[j+1] == ns[j]+1 {
+			j++
+		}
+		r := SequenceRange{Min: SequenceNumber(strconv.FormatUint(uint64(ns[i]), 10))}
+		if j > i {
+			r.Max = SequenceNumber(strconv.FormatUint(uint64(ns[j]), 10))
+		}
+		set = append(set, r)
+		i = j + 1
+	}
+	return set
+}
+
+// String returns the range in the IMAP format, eg 5:9
+func (r SequenceRange) String() string {
+	if r.Max.Nil() {
+		return string(r.Min)
+	}
+	return string(r.Min) + ":" + string(r.Max)
+}
+
+// String returns the set in the IMAP format, eg 1,3,5:9,18:*
+func (s SequenceSet) String() string {
+	ranges := make([]string, len(s))
+	for i, r := range s {
+		ranges[i] = r.String()
+	}
+	return strings.Join(ranges, ",")
+}
@@ -104,6 +104,38 @@ var _ = Describe("Sequence Numbers", func() {
 		testSet("1,3,:8:14,18:*", nil, errInvalidSequenceSetString("1,3,:8:14,18:*"))
 	})
 
+	Context("SequenceSet.Contains", func() {
+		set, _ := InterpretSequenceSet("2,4:6,15:*")
+		It("should contain single values and ranges", func() {
+			Expect(set.Contains(2, 20)).To(BeTrue())
+			Expect(set.Contains(5, 20)).To(BeTrue())
+			Expect(set.Contains(3, 20)).To(BeFalse())
+			Expect(set.Contains(7, 20)).To(BeFalse())
+		})
+		It("should resolve * to the last value", func() {
+			Expect(set.Contains(20, 20)).To(BeTrue())
+			Expect(set.Contains(21, 20)).To(BeFalse())
+		})
+		It("should treat a range ending in * as a range to the last value when * is smaller", func() {
+			Expect(set.Contains(12, 12)).To(BeTrue())
+			Expect(set.Contains(11, 12)).To(BeFalse())
+		})
+	})
+
+	Context("NewSequenceSet", func() {
+		It("should join consecutive numbers into ranges", func() {
+			set := NewSequenceSet([]uint32{1, 2, 3, 5, 8, 9})
+			Expect(set.String()).To(Equal("1:3,5,8:9"))
+		})
+		It("should keep the order of the numbers", func() {
+			Expect(NewSequenceSet([]uint32{7, 3, 4}).String()).To(Equal("7,3:4"))
+		})
+		It("should format an interpreted set as it was given", func() {
+			set, _ := InterpretSequenceSet("1,3,8:14,18:*")
+			Expect(set.String()).To(Equal("1,3,8:14,18:*"))
+		})
+	})
+
 	Context("SequenceNumber", func() {
 		const (
 			IsNil    = true
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 )
@@ -41,10 +42,17 @@ func SplitParams(params string) []string {
 
 // WriteMIMEHeader writes the MIME header out in the standard format. This
 // should eventually be superseded by textproto.MIMEHeader.Write(w) once
-// it is implemented in the go standard library.
+// it is implemented in the go standard library. Fields are written in order
+// of their names, so that a header is always written the same way.
 func WriteMIMEHeader(writer io.Writer, header textproto.MIMEHeader) (n int, err error) {
-	for k, vv := range header {
-		for _, v := range vv {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
 			bytes, err := fmt.Fprintf(writer, "%s: %s\r\n", k, v)
 			if err != nil {
 				return n, err
@@ -65,3 +73,25 @@ func MIMEHeaderToString(header textproto.MIMEHeader) string {
 	}
 	return buf.String()
 }
+
+// FormatString formats a string for an IMAP response. It is quoted if
+// possible, otherwise it is sent as a literal.
+func FormatString(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' || s[i] == 0 || s[i] > 0x7f {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// FormatNString formats a string for an IMAP response, using NIL for an
+// empty string.
+func FormatNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return FormatString(s)
+}
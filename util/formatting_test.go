@@ -24,3 +24,21 @@ func TestSplitParams(t *testing.T) {
 			len(originalList), len(result), result)
 	}
 }
+
+func TestFormatString(t *testing.T) {
+	tests := map[string]string{
+		"plain":        "\"plain\"",
+		"say \"hi\"":   "\"say \\\"hi\\\"\"",
+		"back\\slash":  "\"back\\\\slash\"",
+		"two\r\nlines": "{10}\r\ntwo\r\nlines",
+		"café":         "{5}\r\ncafé",
+	}
+	for input, expected := range tests {
+		if result := FormatString(input); result != expected {
+			t.Errorf("Expected %q to be formatted as %q, got %q", input, expected, result)
+		}
+	}
+	if FormatNString("") != "NIL" {
+		t.Errorf("Expected empty string to be formatted as NIL")
+	}
+}
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// MIMEPart is a single part of a MIME message. The message itself is the
+// outermost part.
+type MIMEPart struct {
+	// Header holds the part's MIME header. For the outermost part this is
+	// the message header.
+	Header textproto.MIMEHeader
+
+	// RawHeader is the header as it appeared in the message, without the
+	// blank line which ends it
+	RawHeader string
+
+	// Body is the raw content of the part, still in its transfer encoding
+	Body string
+
+	// Type and Subtype are the lower case media type of the part, eg "text"
+	// and "plain"
+	Type    string
+	Subtype string
+
+	// Params holds the Content-Type parameters, with lower case names
+	Params map[string]string
+
+	// Parts holds the children of a multipart part
+	Parts []*MIMEPart
+
+	// Message holds the encapsulated message of a message/rfc822 part
+	Message *MIMEPart
+}
+
+// ParseMIMEMessage parses a complete message, header and body.
+func ParseMIMEMessage(raw string) *MIMEPart {
+	header, body := splitHeader(raw)
+	p := ParseMIMEPart(ParseHeader(header), body, "text/plain")
+	p.RawHeader = header
+	return p
+}
+
+// ParseMIMEPart parses the body of a part with the given header. The default
+// type is used if the header has no Content-Type, which RFC 2046 says is
+// text/plain except within multipart/digest.
+func ParseMIMEPart(header textproto.MIMEHeader, body string, defaultType string) *MIMEPart {
+	p := &MIMEPart{
+		Header: header,
+		Body:   body,
+	}
+
+	mediaType := defaultType
+	params := map[string]string{}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		mediaType, params, _ = mime.ParseMediaType(contentType)
+		if mediaType == "" {
+			// Fall back to the default for an unparseable type
+			mediaType = defaultType
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+	}
+	if mediaType == "text/plain" && header.Get("Content-Type") == "" {
+		params["charset"] = "us-ascii"
+	}
+	p.Params = params
+
+	p.Type, p.Subtype = mediaType, ""
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		p.Type, p.Subtype = mediaType[:i], mediaType[i+1:]
+	}
+
+	switch {
+	case p.Type == "multipart":
+		childType := "text/plain"
+		if p.Subtype == "digest" {
+			childType = "message/rfc822"
+		}
+		for _, raw := range splitMultipart(body, params["boundary"]) {
+			childHeader, childBody := splitHeader(raw)
+			child := ParseMIMEPart(ParseHeader(childHeader), childBody, childType)
+			child.RawHeader = childHeader
+			p.Parts = append(p.Parts, child)
+		}
+	case p.Type == "message" && p.Subtype == "rfc822":
+		p.Message = ParseMIMEMessage(body)
+	}
+	return p
+}
+
+// Part returns the nth child of the part, numbered from 1 as in an IMAP
+// section specification, or nil if there is no such part. The children of
+// a message/rfc822 part are those of the encapsulated message, and a part
+// which isn't multipart has only itself as part 1.
+func (p *MIMEPart) Part(n int) *MIMEPart {
+	if p.Message != nil {
+		p = p.Message
+	}
+	if p.Type == "multipart" {
+		if n < 1 || n > len(p.Parts) {
+			return nil
+		}
+		return p.Parts[n-1]
+	}
+	if n == 1 {
+		return p
+	}
+	return nil
+}
+
+// Lines returns the number of lines in the part's body.
+func (p *MIMEPart) Lines() int {
+	if p.Body == "" {
+		return 0
+	}
+	lines := strings.Count(p.Body, "\n")
+	if !strings.HasSuffix(p.Body, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// splitHeader splits a message or part into its header and body, which are
+// separated by the first blank line. The header keeps its final line ending.
+func splitHeader(raw string) (header string, body string) {
+	pos := 0
+	for pos < len(raw) {
+		end := strings.IndexByte(raw[pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := raw[pos : pos+end+1]
+		if line == "\n" || line == "\r\n" {
+			return raw[:pos], raw[pos+len(line):]
+		}
+		pos += end + 1
+	}
+	// There is no body
+	return raw, ""
+}
+
+// ReadHeader reads a message header from r, up to and including the blank
+// line which ends it, leaving the body to be read. It returns the header as
+// it appeared, without the blank line, and the number of bytes read. If
+// there is no blank line the whole of r is the header.
+func ReadHeader(r *bufio.Reader) (header string, n int64, err error) {
+	var buf strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if line == "\n" || line == "\r\n" {
+			return buf.String(), n, nil
+		}
+		buf.WriteString(line)
+		if err == io.EOF {
+			return buf.String(), n, nil
+		}
+		if err != nil {
+			return buf.String(), n, err
+		}
+	}
+}
+
+// ParseHeader parses a MIME header, ignoring any malformed lines.
+func ParseHeader(header string) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(header + "\r\n")))
+	hdr, _ := r.ReadMIMEHeader()
+	if hdr == nil {
+		return make(textproto.MIMEHeader)
+	}
+	return hdr
+}
+
+// splitMultipart returns the raw body parts of a multipart body. The line
+// ending before each boundary delimiter belongs to the delimiter.
+func splitMultipart(body string, boundary string) []string {
+	if boundary == "" {
+		return nil
+	}
+	delimiter := "--" + boundary
+
+	var parts []string
+	start := -1
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		if end := strings.IndexByte(body[pos:], '\n'); end >= 0 {
+			next = pos + end + 1
+		}
+		line := strings.TrimRight(body[pos:next], " \t\r\n")
+
+		if strings.HasPrefix(line, delimiter) {
+			rest := line[len(delimiter):]
+			if rest == "" || rest == "--" {
+				if start >= 0 {
+					parts = append(parts, trimLineEnding(body[start:pos]))
+				}
+				if rest == "--" {
+					return parts
+				}
+				start = next
+			}
+		}
+		pos = next
+	}
+
+	// The closing delimiter is missing, so the last part runs to the end
+	if start >= 0 {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// trimLineEnding removes a single trailing line ending.
+func trimLineEnding(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
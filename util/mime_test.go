@@ -0,0 +1,132 @@
+package util
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const testMultipartMessage = "From: me@test.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"This is the preamble\r\n" +
+	"--outer\r\n" +
+	"\r\n" +
+	"Plain text without a header\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Hello</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Attached\r\n" +
+	"\r\n" +
+	"Attached body\r\n" +
+	"--outer--\r\n" +
+	"This is the epilogue\r\n"
+
+func TestParseMIMEMessage(t *testing.T) {
+	msg := ParseMIMEMessage(testMultipartMessage)
+	if msg.Type != "multipart" || msg.Subtype != "mixed" {
+		t.Fatalf("Expected multipart/mixed, got %s/%s", msg.Type, msg.Subtype)
+	}
+	if len(msg.Parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(msg.Parts))
+	}
+
+	plain := msg.Parts[0]
+	if plain.Type != "text" || plain.Subtype != "plain" || plain.Params["charset"] != "us-ascii" {
+		t.Errorf("Expected default text/plain part, got %s/%s %v",
+			plain.Type, plain.Subtype, plain.Params)
+	}
+	if plain.Body != "Plain text without a header" {
+		t.Errorf("Unexpected body %q", plain.Body)
+	}
+
+	alternative := msg.Parts[1]
+	if len(alternative.Parts) != 2 {
+		t.Fatalf("Expected 2 alternative parts, got %d", len(alternative.Parts))
+	}
+	if alternative.Parts[0].Params["charset"] != "utf-8" {
+		t.Errorf("Expected charset utf-8, got %v", alternative.Parts[0].Params)
+	}
+	if html := alternative.Parts[1]; html.Subtype != "html" || html.Body != "<p>Hello</p>" {
+		t.Errorf("Unexpected HTML part %s %q", html.Subtype, html.Body)
+	}
+
+	attached := msg.Parts[2]
+	if attached.Message == nil {
+		t.Fatalf("Expected an encapsulated message")
+	}
+	if attached.Message.Header.Get("Subject") != "Attached" {
+		t.Errorf("Unexpected encapsulated header %v", attached.Message.Header)
+	}
+	if attached.Message.Body != "Attached body" {
+		t.Errorf("Unexpected encapsulated body %q", attached.Message.Body)
+	}
+	if attached.RawHeader != "Content-Type: message/rfc822\r\n" {
+		t.Errorf("Unexpected raw header %q", attached.RawHeader)
+	}
+}
+
+func TestMIMEPartNumbers(t *testing.T) {
+	msg := ParseMIMEMessage(testMultipartMessage)
+	if msg.Part(2).Part(2) != msg.Parts[1].Parts[1] {
+		t.Errorf("Expected part 2.2 to be the HTML part")
+	}
+	if msg.Part(3).Part(1) != msg.Parts[2].Message {
+		t.Errorf("Expected part 3.1 to be the body of the encapsulated message")
+	}
+	if msg.Part(1).Part(1) != msg.Parts[0] {
+		t.Errorf("Expected part 1.1 to be part 1, which isn't multipart")
+	}
+	if msg.Part(4) != nil || msg.Part(0) != nil || msg.Part(1).Part(2) != nil {
+		t.Errorf("Expected parts which don't exist to be nil")
+	}
+}
+
+func TestMIMEPartLines(t *testing.T) {
+	tests := map[string]int{
+		"":                 0,
+		"one line":         1,
+		"one line\r\n":     1,
+		"two\r\nlines":     2,
+		"two\r\nlines\r\n": 2,
+	}
+	for body, expected := range tests {
+		p := &MIMEPart{Body: body}
+		if p.Lines() != expected {
+			t.Errorf("Expected %d lines in %q, got %d", expected, body, p.Lines())
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(testMultipartMessage))
+	header, n, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "From: me@test.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n"
+	if header != expected || n != int64(len(expected))+2 {
+		t.Errorf("Expected header %q of %d bytes, got %q of %d", expected, len(expected)+2, header, n)
+	}
+	if line, _ := r.ReadString('\n'); line != "This is the preamble\r\n" {
+		t.Errorf("Expected the body to be left to read, got %q", line)
+	}
+
+	header, n, err = ReadHeader(bufio.NewReader(strings.NewReader("Subject: No body")))
+	if err != nil || header != "Subject: No body" || n != 16 {
+		t.Errorf("Expected the whole message to be the header, got %q, %d and %v", header, n, err)
+	}
+}